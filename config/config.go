@@ -27,6 +27,9 @@ type (
 		DBType     DbTypeT
 
 		Port string
+
+		// SessionCookies sets the session tokens as HttpOnly cookies instead of returning them
+		SessionCookies bool
 	}
 )
 
@@ -42,6 +45,8 @@ func DefaultConfig() *Config {
 		DBUser:     os.Getenv("DB_USER"),
 		DBPassword: os.Getenv("DB_PASSWORD"),
 		DBName:     os.Getenv("DB_NAME"),
+
+		SessionCookies: os.Getenv("SESSION_COOKIES") == "true",
 	}
 }
 
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gsarmaonline/goiter/core/models"
@@ -17,7 +18,10 @@ type (
 	AccountUpdateRequest struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
-		PlanID      uint   `json:"plan_id"`
+		// Subdomain is only changed when it's sent, an empty one clears it
+		Subdomain *string `json:"subdomain"`
+		// RequireMFA is only changed when it's sent
+		RequireMFA *bool `json:"require_mfa"`
 	}
 )
 
@@ -25,45 +29,104 @@ func NewAccountHandler(handler *Handler) *AccountHandler {
 	return &AccountHandler{handler: handler, db: handler.Db}
 }
 
-// GetAccount retrieves the account for the current user
+// GetAccount retrieves the current account of the user
 func (h *AccountHandler) GetAccount(c *gin.Context) {
 
-	var account models.Account
-	if err := h.handler.UserScopedDB(c).Preload("Plan").First(&account).Error; err != nil {
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
 		return
 	}
+	if err = h.db.Preload("Plan").First(account, account.ID).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to load the plan of the account")
+		return
+	}
 
 	h.handler.WriteSuccess(c, account)
 }
 
-// UpdateAccount updates the account for the current user
+// UpdateAccount updates the current account of the user. Only owners and admins can update it,
+// including requiring two factor authentication from all the members. The plan is changed
+// with the subscriptions of the billing, so that it's paid for.
 func (h *AccountHandler) UpdateAccount(c *gin.Context) {
 
-	var (
-		account    models.Account
-		updateData AccountUpdateRequest
-	)
+	var updateData AccountUpdateRequest
 
-	if err := h.handler.UserScopedDB(c).First(&account).Error; err != nil {
+	account, role, err := h.handler.GetAccountRoleFromContext(c)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
 		return
 	}
+	if !role.CanManageAccount() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to update the account"})
+		return
+	}
 
 	if err := c.ShouldBindJSON(&updateData); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
+	clearSubdomain := false
+	if updateData.Subdomain != nil {
+		subdomain := strings.ToLower(*updateData.Subdomain)
+		if subdomain == "" {
+			clearSubdomain = true
+		} else if err := models.ValidateSubdomain(subdomain); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subdomain: " + err.Error()})
+			return
+		} else if h.isSubdomainTaken(subdomain, account.ID) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subdomain is already taken"})
+			return
+		}
+		updateData.Subdomain = &subdomain
+	}
+
+	// Admins would otherwise lock themselves out of the account
+	if updateData.RequireMFA != nil && *updateData.RequireMFA && !h.handler.GetUserFromContext(c).IsTOTPEnabled() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Enable two factor authentication before requiring it"})
+		return
+	}
+
 	// Update the account fields with the new data
 	account.Name = updateData.Name
 	account.Description = updateData.Description
-	account.PlanID = updateData.PlanID
+	if updateData.Subdomain != nil && !clearSubdomain {
+		account.Subdomain = updateData.Subdomain
+	}
 
-	if err := h.handler.UpdateWithUser(c, &account, &account); err != nil {
+	if err := h.db.Model(account).Updates(account).Error; err != nil {
+		// The unique index rejects the subdomains taken since they were checked
+		if account.Subdomain != nil && h.isSubdomainTaken(*account.Subdomain, account.ID) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subdomain is already taken"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account"})
 		return
 	}
+	// Updates skips the nil values, so that clearing it has to be written on its own
+	if clearSubdomain {
+		account.Subdomain = nil
+		if err := h.db.Model(account).Update("subdomain", nil).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account"})
+			return
+		}
+	}
+	// Updates skips the zero values, so that turning it off has to be written on its own
+	if updateData.RequireMFA != nil {
+		account.RequireMFA = *updateData.RequireMFA
+		if err := h.db.Model(account).Update("require_mfa", account.RequireMFA).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account"})
+			return
+		}
+	}
 
 	h.handler.WriteSuccess(c, account)
 }
+
+// isSubdomainTaken checks if another account has the subdomain
+func (h *AccountHandler) isSubdomainTaken(subdomain string, accountID uint) bool {
+	var count int64
+	h.db.Model(&models.Account{}).Where("subdomain = ? AND id != ?", subdomain, accountID).Count(&count)
+	return count > 0
+}
@@ -86,16 +86,10 @@ func TestAccountHandler(t *testing.T) {
 			err := db.Where("user_id = ?", user.ID).First(&account).Error
 			require.NoError(t, err)
 
-			// Get a plan for testing plan_id update
-			var plan models.Plan
-			err = db.First(&plan).Error
-			require.NoError(t, err)
-
 			// Prepare update data
 			updateData := map[string]interface{}{
 				"name":        "Updated Account Name",
 				"description": "Updated account description",
-				"plan_id":     plan.ID,
 			}
 
 			// Make request
@@ -111,7 +105,6 @@ func TestAccountHandler(t *testing.T) {
 
 			assert.Equal(t, "Updated Account Name", updatedAccount.Name)
 			assert.Equal(t, "Updated account description", updatedAccount.Description)
-			assert.Equal(t, plan.ID, updatedAccount.PlanID)
 
 			// Ensure the account ID hasn't changed
 			assert.Equal(t, account.ID, updatedAccount.ID)
@@ -319,7 +312,7 @@ func TestAccountHandler_PlanIntegration(t *testing.T) {
 		assert.Equal(t, "Free", account.Plan.Name)
 	})
 
-	t.Run("Update account with different plan", func(t *testing.T) {
+	t.Run("Update account doesn't change the plan", func(t *testing.T) {
 		// Create another plan for testing - use Price: 0 to avoid Stripe integration
 		premiumPlan := &models.Plan{
 			Name:          "Premium",
@@ -333,7 +326,9 @@ func TestAccountHandler_PlanIntegration(t *testing.T) {
 		// Create a user
 		user, token := createTestUser(t, db, "updateplan@example.com")
 
-		// Update account with premium plan
+		// The plan is only changed through the billing subscriptions
+		var account models.Account
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&account).Error)
 		updateData := map[string]interface{}{
 			"name":    "Premium Account",
 			"plan_id": premiumPlan.ID,
@@ -342,11 +337,51 @@ func TestAccountHandler_PlanIntegration(t *testing.T) {
 		w := makeAuthenticatedRequest(t, handler, "PUT", "/account", updateData, token)
 		assert.Equal(t, 200, w.Code)
 
-		// Verify the account was updated with the new plan
 		var updatedAccount models.Account
-		err = db.Preload("Plan").Where("user_id = ?", user.ID).First(&updatedAccount).Error
+		err = db.Where("user_id = ?", user.ID).First(&updatedAccount).Error
 		require.NoError(t, err)
-		assert.Equal(t, premiumPlan.ID, updatedAccount.PlanID)
-		assert.Equal(t, "Premium", updatedAccount.Plan.Name)
+		assert.Equal(t, "Premium Account", updatedAccount.Name)
+		assert.Equal(t, account.PlanID, updatedAccount.PlanID)
+		assert.NotEqual(t, premiumPlan.ID, updatedAccount.PlanID)
+	})
+	t.Run("Entitlements of the plan", func(t *testing.T) {
+		user, token := createTestUser(t, db, "entitlements@example.com")
+		plan := &models.Plan{Name: "Team", BillingPeriod: "monthly"}
+		require.NoError(t, db.Create(plan).Error)
+		for _, feature := range []*models.Feature{
+			{Name: models.ProjectsFeature, Limit: 3},
+			{Name: models.SAMLFeature, Limit: 0},
+		} {
+			require.NoError(t, db.Create(feature).Error)
+			require.NoError(t, db.Create(&models.PlanFeature{PlanID: plan.ID, FeatureID: feature.ID}).Error)
+		}
+		require.NoError(t, db.Model(&models.Account{}).Where("user_id = ?", user.ID).Update("plan_id", plan.ID).Error)
+		createTestProject(t, handler, token, "first")
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/account/entitlements", nil, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string][]map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.Len(t, response["data"], 2)
+		assert.Equal(t, map[string]interface{}{
+			"feature":   models.ProjectsFeature,
+			"limit":     float64(3),
+			"counted":   true,
+			"used":      float64(1),
+			"remaining": float64(2),
+			"allowed":   true,
+		}, response["data"][0])
+		assert.Equal(t, models.SAMLFeature, response["data"][1]["feature"])
+		assert.Equal(t, false, response["data"][1]["allowed"])
+
+		// Counted features are unlimited on plans without them
+		_, otherToken := createTestUser(t, db, "unlimited@example.com")
+		w = makeAuthenticatedRequest(t, handler, "GET", "/account/entitlements", nil, otherToken)
+		require.Equal(t, 200, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.Len(t, response["data"], 1)
+		assert.Equal(t, float64(-1), response["data"][0]["limit"])
+		assert.Equal(t, float64(-1), response["data"][0]["remaining"])
+		assert.Equal(t, true, response["data"][0]["allowed"])
 	})
 }
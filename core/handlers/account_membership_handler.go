@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/mailer"
+	"gorm.io/gorm"
+)
+
+type (
+	AccountMembershipHandler struct {
+		db      *gorm.DB
+		handler *Handler
+	}
+
+	// AccountSummary is an account the user belongs to along with the role of the user in it
+	AccountSummary struct {
+		Account *models.Account     `json:"account"`
+		Role    models.AccountRoleT `json:"role"`
+		Current bool                `json:"current"`
+	}
+
+	SwitchAccountRequest struct {
+		AccountID uint `json:"account_id" binding:"required"`
+	}
+
+	InvitationRequest struct {
+		Email string              `json:"email" binding:"required,email"`
+		Role  models.AccountRoleT `json:"role"`
+	}
+
+	AcceptInvitationRequest struct {
+		Token string `json:"token" binding:"required"`
+	}
+)
+
+func NewAccountMembershipHandler(handler *Handler) *AccountMembershipHandler {
+	return &AccountMembershipHandler{handler: handler, db: handler.Db}
+}
+
+// getManagedAccount returns the current account after checking the user can manage its members
+func (h *AccountMembershipHandler) getManagedAccount(c *gin.Context) (account *models.Account, role models.AccountRoleT, ok bool) {
+	var err error
+	if account, role, err = h.handler.GetAccountRoleFromContext(c); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	if !role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage members of the account"})
+		return
+	}
+	ok = true
+	return
+}
+
+// ListAccounts lists the accounts the user belongs to
+func (h *AccountMembershipHandler) ListAccounts(c *gin.Context) {
+	user := h.handler.GetUserFromContext(c)
+	accounts, err := user.GetAccounts(h.db)
+	if err != nil {
+		h.handler.WriteError(c, err, "Failed to list accounts")
+		return
+	}
+	current, err := user.GetCurrentAccount(h.db)
+	if err != nil {
+		h.handler.WriteError(c, err, "Failed to load the current account")
+		return
+	}
+
+	summaries := []AccountSummary{}
+	for _, account := range accounts {
+		role, err := account.GetRole(h.db, user.ID)
+		if err != nil {
+			h.handler.WriteError(c, err, "Failed to load the role in the account")
+			return
+		}
+		summaries = append(summaries, AccountSummary{
+			Account: account,
+			Role:    role,
+			Current: account.ID == current.ID,
+		})
+	}
+	h.handler.WriteSuccess(c, summaries)
+}
+
+// SwitchAccount makes another account the user belongs to the current one
+func (h *AccountMembershipHandler) SwitchAccount(c *gin.Context) {
+	var req SwitchAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	account, err := h.handler.GetUserFromContext(c).SwitchAccount(h.db, req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	h.handler.WriteSuccess(c, account)
+}
+
+// ListMembers lists the members of the current account
+func (h *AccountMembershipHandler) ListMembers(c *gin.Context) {
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	memberships := []models.AccountMembership{}
+	if err = h.db.Preload("Member").Where("account_id = ?", account.ID).Find(&memberships).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list account members")
+		return
+	}
+	h.handler.WriteSuccess(c, memberships)
+}
+
+// RemoveMember removes a member from the current account. Members can also remove
+// themselves to leave the account, except for the user who created it.
+func (h *AccountMembershipHandler) RemoveMember(c *gin.Context) {
+	account, role, err := h.handler.GetAccountRoleFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	membership := &models.AccountMembership{}
+	if err = h.db.Where("account_id = ? AND id = ?", account.ID, c.Param(DefaultUrlKeyName)).First(membership).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account member not found"})
+		return
+	}
+
+	isSelf := membership.MemberID == h.handler.GetUserFromContext(c).ID
+	if !isSelf && !role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage members of the account"})
+		return
+	}
+	if membership.MemberID == account.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The creator of the account can't be removed"})
+		return
+	}
+	if !isSelf && membership.Role == models.AccountOwnerRole && role != models.AccountOwnerRole {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners can remove other owners"})
+		return
+	}
+
+	if err = h.db.Delete(membership).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to remove account member")
+		return
+	}
+	h.handler.WriteSuccess(c, gin.H{"message": "Account member removed successfully"})
+}
+
+// ListInvitations lists the invitations of the current account
+func (h *AccountMembershipHandler) ListInvitations(c *gin.Context) {
+	account, _, ok := h.getManagedAccount(c)
+	if !ok {
+		return
+	}
+	invitations := []models.AccountInvitation{}
+	if err := h.db.Where("account_id = ?", account.ID).Order("id DESC").Find(&invitations).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list invitations")
+		return
+	}
+	h.handler.WriteSuccess(c, invitations)
+}
+
+// CreateInvitation invites an email to join the current account and emails the invitation token
+func (h *AccountMembershipHandler) CreateInvitation(c *gin.Context) {
+	var (
+		req   InvitationRequest
+		count int64
+	)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.AccountMemberRole
+	}
+	if !req.Role.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+	account, role, ok := h.getManagedAccount(c)
+	if !ok {
+		return
+	}
+	if req.Role == models.AccountOwnerRole && role != models.AccountOwnerRole {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners can invite other owners"})
+		return
+	}
+
+	h.db.Model(&models.AccountMembership{}).
+		Joins("JOIN users ON users.id = account_memberships.member_id").
+		Where("account_memberships.account_id = ? AND LOWER(users.email) = LOWER(?)", account.ID, req.Email).
+		Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a member of the account"})
+		return
+	}
+	pending := []models.AccountInvitation{}
+	h.db.Where("account_id = ? AND LOWER(email) = LOWER(?)", account.ID, req.Email).Find(&pending)
+	for _, invitation := range pending {
+		if invitation.Status == models.InvitationPending {
+			c.JSON(http.StatusConflict, gin.H{"error": "A pending invitation already exists for the email"})
+			return
+		}
+	}
+
+	user := h.handler.GetUserFromContext(c)
+	invitation, token, err := models.NewAccountInvitation(h.db, account, user.ID, req.Email, req.Role)
+	if err != nil {
+		h.handler.WriteError(c, err, "Failed to create invitation")
+		return
+	}
+
+	acceptURL := fmt.Sprintf("%s/invitations/accept?token=%s", os.Getenv("FRONTEND_URL"), token)
+	if err = h.handler.mailer.Send(&mailer.MailerRequest{
+		To:          []string{invitation.Email},
+		Subject:     fmt.Sprintf("%s invited you to %s", user.Name, account.Name),
+		PlainText:   fmt.Sprintf("Accept the invitation to join %s: %s", account.Name, acceptURL),
+		HtmlContent: fmt.Sprintf("<p>Accept the invitation to join %s: <a href=\"%s\">%s</a></p>", account.Name, acceptURL, acceptURL),
+	}); err != nil {
+		log.Println("Failed to send the invitation email", invitation.ID, err)
+	}
+	h.handler.WriteSuccess(c, invitation)
+}
+
+// RevokeInvitation revokes a pending invitation of the current account
+func (h *AccountMembershipHandler) RevokeInvitation(c *gin.Context) {
+	account, _, ok := h.getManagedAccount(c)
+	if !ok {
+		return
+	}
+	invitation := &models.AccountInvitation{}
+	if err := h.db.Where("account_id = ? AND id = ?", account.ID, c.Param(DefaultUrlKeyName)).First(invitation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+	if err := invitation.Revoke(h.db); err != nil {
+		if errors.Is(err, models.ErrInvitationNotPending) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Invitation is no longer pending"})
+			return
+		}
+		h.handler.WriteError(c, err, "Failed to revoke invitation")
+		return
+	}
+	h.handler.WriteSuccess(c, invitation)
+}
+
+// AcceptInvitation adds the user to the account of the invitation and switches to it
+func (h *AccountMembershipHandler) AcceptInvitation(c *gin.Context) {
+	var req AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	invitation, err := models.GetInvitationByToken(h.db, req.Token)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+	switch invitation.Status {
+	case models.InvitationExpired:
+		c.JSON(http.StatusGone, gin.H{"error": "Invitation has expired"})
+		return
+	case models.InvitationAccepted, models.InvitationRevoked:
+		c.JSON(http.StatusConflict, gin.H{"error": "Invitation is no longer pending"})
+		return
+	}
+
+	user := h.handler.GetUserFromContext(c)
+	membership, err := invitation.Accept(h.db, user)
+	if err != nil {
+		if errors.Is(err, models.ErrInvitationEmail) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invitation was sent to another email"})
+			return
+		}
+		h.handler.WriteError(c, err, "Failed to accept invitation")
+		return
+	}
+	if _, err = user.SwitchAccount(h.db, invitation.AccountID); err != nil {
+		h.handler.WriteError(c, err, "Failed to switch to the account")
+		return
+	}
+	h.handler.WriteSuccess(c, membership)
+}
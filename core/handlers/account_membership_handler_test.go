@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/middleware"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/mailer"
+)
+
+// recordingMailer records the emails instead of sending them
+type recordingMailer struct {
+	requests []*mailer.MailerRequest
+}
+
+func (m *recordingMailer) Send(req *mailer.MailerRequest) error {
+	m.requests = append(m.requests, req)
+	return nil
+}
+
+// lastToken returns the token of the last email sent
+func (m *recordingMailer) lastToken(t *testing.T) string {
+	require.NotEmpty(t, m.requests)
+	body := m.requests[len(m.requests)-1].PlainText
+	index := strings.Index(body, "token=")
+	require.NotEqual(t, -1, index, body)
+	return body[index+len("token="):]
+}
+
+func inviteTestUser(t *testing.T, handler *Handler, m *recordingMailer, token, email string, role models.AccountRoleT) (invitationID uint, invitationToken string) {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/account/invitations", map[string]interface{}{
+		"email": email,
+		"role":  role,
+	}, token)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	return parseDataID(t, w), m.lastToken(t)
+}
+
+func TestAccountMembershipHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	m := &recordingMailer{}
+	handler.SetMailer(m)
+
+	owner, ownerToken := createTestUser(t, db, "teamowner@example.com")
+	_, memberToken := createTestUser(t, db, "teammember@example.com")
+	_, otherToken := createTestUser(t, db, "teamother@example.com")
+
+	var account models.Account
+	require.NoError(t, db.Where("user_id = ?", owner.ID).First(&account).Error)
+
+	t.Run("Creator is the owner", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "GET", "/account/members", nil, ownerToken)
+		require.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		members := response["data"].([]interface{})
+		require.Len(t, members, 1)
+		assert.Equal(t, string(models.AccountOwnerRole), members[0].(map[string]interface{})["role"])
+	})
+
+	t.Run("Invite and accept", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/account/invitations", map[string]interface{}{
+			"email": "teammember@example.com",
+			"role":  "superuser",
+		}, ownerToken)
+		assertErrorResponse(t, w, 400, "Invalid role")
+
+		_, invitationToken := inviteTestUser(t, handler, m, ownerToken, "TeamMember@example.com", models.AccountBillingRole)
+		assert.Equal(t, []string{"teammember@example.com"}, m.requests[len(m.requests)-1].To)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/account/invitations", map[string]interface{}{
+			"email": "teammember@example.com",
+		}, ownerToken)
+		assertErrorResponse(t, w, 409, "A pending invitation already exists for the email")
+
+		// The invitation can only be accepted by the invited email
+		w = makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": invitationToken}, otherToken)
+		assertErrorResponse(t, w, 403, "Invitation was sent to another email")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": "unknown"}, memberToken)
+		assertErrorResponse(t, w, 404, "Invitation not found")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": invitationToken}, memberToken)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		w = makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": invitationToken}, memberToken)
+		assertErrorResponse(t, w, 409, "Invitation is no longer pending")
+
+		// Accepting switches to the account
+		w = makeAuthenticatedRequest(t, handler, "GET", "/account", nil, memberToken)
+		require.Equal(t, 200, w.Code)
+		assert.Equal(t, account.ID, parseDataID(t, w))
+
+		w = makeAuthenticatedRequest(t, handler, "GET", "/accounts", nil, memberToken)
+		require.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		summaries := response["data"].([]interface{})
+		require.Len(t, summaries, 2)
+		for _, summary := range summaries {
+			summary := summary.(map[string]interface{})
+			accountData := summary["account"].(map[string]interface{})
+			isShared := uint(accountData["id"].(float64)) == account.ID
+			assert.Equal(t, isShared, summary["current"])
+			if isShared {
+				assert.Equal(t, string(models.AccountBillingRole), summary["role"])
+			}
+		}
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/account/invitations", map[string]interface{}{
+			"email": "teammember@example.com",
+		}, ownerToken)
+		assertErrorResponse(t, w, 409, "User is already a member of the account")
+	})
+
+	t.Run("Roles", func(t *testing.T) {
+		// Billing members can't update the account or manage its members
+		w := makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"name": "Renamed"}, memberToken)
+		assertErrorResponse(t, w, 403, "Not allowed to update the account")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/account/invitations", map[string]interface{}{
+			"email": "someone@example.com",
+		}, memberToken)
+		assertErrorResponse(t, w, 403, "Not allowed to manage members of the account")
+
+		// Billing endpoints act on the current account
+		w = makeAuthenticatedRequest(t, handler, "GET", "/billing/subscriptions", nil, memberToken)
+		require.Equal(t, 200, w.Code)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/account/invitations", map[string]interface{}{
+			"email": "teamother@example.com",
+			"role":  models.AccountMemberRole,
+		}, ownerToken)
+		require.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": m.lastToken(t)}, otherToken)
+		require.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "DELETE", "/billing/subscriptions", nil, otherToken)
+		assertErrorResponse(t, w, 403, "Not allowed to manage billing of the account")
+	})
+
+	t.Run("Switch account", func(t *testing.T) {
+		_, strangerToken := createTestUser(t, db, "teamstranger@example.com")
+		w := makeAuthenticatedRequest(t, handler, "POST", "/accounts/switch", map[string]interface{}{"account_id": account.ID}, strangerToken)
+		assertErrorResponse(t, w, 404, "Account not found")
+
+		var memberAccount models.Account
+		require.NoError(t, db.Joins("JOIN users ON users.id = accounts.user_id").
+			Where("users.email = ?", "teammember@example.com").First(&memberAccount).Error)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/accounts/switch", map[string]interface{}{"account_id": memberAccount.ID}, memberToken)
+		require.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "GET", "/account", nil, memberToken)
+		assert.Equal(t, memberAccount.ID, parseDataID(t, w))
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/accounts/switch", map[string]interface{}{"account_id": account.ID}, memberToken)
+		require.Equal(t, 200, w.Code)
+	})
+
+	t.Run("Revoke and expire", func(t *testing.T) {
+		_, inviteeToken := createTestUser(t, db, "teaminvitee@example.com")
+
+		invitationID, invitationToken := inviteTestUser(t, handler, m, ownerToken, "teaminvitee@example.com", models.AccountMemberRole)
+		w := makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/account/invitations/%d", invitationID), nil, ownerToken)
+		require.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/account/invitations/%d", invitationID), nil, ownerToken)
+		assertErrorResponse(t, w, 409, "Invitation is no longer pending")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": invitationToken}, inviteeToken)
+		assertErrorResponse(t, w, 409, "Invitation is no longer pending")
+
+		invitationID, invitationToken = inviteTestUser(t, handler, m, ownerToken, "teaminvitee@example.com", models.AccountMemberRole)
+		require.NoError(t, db.Model(&models.AccountInvitation{}).Where("id = ?", invitationID).
+			Update("expires_at", time.Now().Add(-time.Hour)).Error)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": invitationToken}, inviteeToken)
+		assertErrorResponse(t, w, 410, "Invitation has expired")
+
+		w = makeAuthenticatedRequest(t, handler, "GET", "/account/invitations", nil, ownerToken)
+		require.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		statuses := []string{}
+		for _, invitation := range response["data"].([]interface{}) {
+			statuses = append(statuses, invitation.(map[string]interface{})["status"].(string))
+		}
+		assert.Equal(t, []string{"expired", "revoked", "accepted", "accepted"}, statuses)
+	})
+
+	t.Run("Remove members", func(t *testing.T) {
+		memberships := []models.AccountMembership{}
+		require.NoError(t, db.Preload("Member").Where("account_id = ?", account.ID).Order("id").Find(&memberships).Error)
+		require.Len(t, memberships, 3)
+		ownerMembership, billingMembership, otherMembership := memberships[0], memberships[1], memberships[2]
+
+		w := makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/account/members/%d", ownerMembership.ID), nil, ownerToken)
+		assertErrorResponse(t, w, 400, "The creator of the account can't be removed")
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/account/members/%d", otherMembership.ID), nil, memberToken)
+		assertErrorResponse(t, w, 403, "Not allowed to manage members of the account")
+
+		// Members can leave the account
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/account/members/%d", billingMembership.ID), nil, memberToken)
+		require.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/account/members/%d", otherMembership.ID), nil, ownerToken)
+		require.Equal(t, 200, w.Code)
+
+		// Removed members fall back to their own account
+		w = makeAuthenticatedRequest(t, handler, "GET", "/account", nil, otherToken)
+		require.Equal(t, 200, w.Code)
+		assert.NotEqual(t, account.ID, parseDataID(t, w))
+	})
+
+	t.Run("Admins manage the projects and groups of the account", func(t *testing.T) {
+		_, adminToken := createTestUser(t, db, "teamadmin@example.com")
+		_, invitationToken := inviteTestUser(t, handler, m, ownerToken, "teamadmin@example.com", models.AccountAdminRole)
+		w := makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": invitationToken}, adminToken)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		projectID := createTestProject(t, handler, ownerToken, "shared")
+		w = makeAuthenticatedRequest(t, handler, "PUT", fmt.Sprintf("/projects/%d", projectID), map[string]interface{}{"name": "renamed"}, adminToken)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		createTestProject(t, handler, adminToken, "created by an admin")
+
+		groupID := createTestGroup(t, handler, adminToken, "admins", "")
+		var group models.Group
+		require.NoError(t, db.First(&group, groupID).Error)
+		assert.Equal(t, account.ID, group.OwnerID)
+	})
+}
+
+func TestAccountMiddleware(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	m := &recordingMailer{}
+	handler.SetMailer(m)
+
+	owner, ownerToken := createTestUser(t, db, "tenantowner@example.com")
+	member, memberToken := createTestUser(t, db, "tenantmember@example.com")
+	_, strangerToken := createTestUser(t, db, "tenantstranger@example.com")
+
+	var account, memberAccount models.Account
+	require.NoError(t, db.Where("user_id = ?", owner.ID).First(&account).Error)
+	require.NoError(t, db.Where("user_id = ?", member.ID).First(&memberAccount).Error)
+	require.NoError(t, db.Model(&account).Update("subdomain", "acme").Error)
+
+	_, invitationToken := inviteTestUser(t, handler, m, ownerToken, member.Email, models.AccountAdminRole)
+	w := makeAuthenticatedRequest(t, handler, "POST", "/invitations/accept", map[string]interface{}{"token": invitationToken}, memberToken)
+	require.Equal(t, 200, w.Code)
+	w = makeAuthenticatedRequest(t, handler, "POST", "/accounts/switch", map[string]interface{}{"account_id": memberAccount.ID}, memberToken)
+	require.Equal(t, 200, w.Code)
+
+	os.Setenv("TENANT_DOMAIN", "example.test")
+	defer os.Unsetenv("TENANT_DOMAIN")
+
+	// claimToken signs a token for the user which selects the account
+	claimToken := func(user *models.User, accountID uint) string {
+		return signTestToken(t, user, jwt.MapClaims{
+			"exp":                   time.Now().Add(time.Hour).Unix(),
+			middleware.AccountClaim: accountID,
+		})
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		header         string
+		host           string
+		expectedStatus int
+		expectedError  string
+		expectedID     uint
+	}{
+		{name: "Current account", token: memberToken, expectedStatus: 200, expectedID: memberAccount.ID},
+		{name: "Header", token: memberToken, header: fmt.Sprintf("%d", account.ID), expectedStatus: 200, expectedID: account.ID},
+		{name: "Header of another tenant", token: strangerToken, header: fmt.Sprintf("%d", account.ID), expectedStatus: 403, expectedError: "Not a member of the account"},
+		{name: "Invalid header", token: memberToken, header: "acme", expectedStatus: 400, expectedError: "Invalid account ID"},
+		{name: "Claim", token: claimToken(member, account.ID), expectedStatus: 200, expectedID: account.ID},
+		{name: "Claim of another tenant", token: claimToken(owner, memberAccount.ID), expectedStatus: 403, expectedError: "Not a member of the account"},
+		{name: "Header before claim", token: claimToken(member, account.ID), header: fmt.Sprintf("%d", memberAccount.ID), expectedStatus: 200, expectedID: memberAccount.ID},
+		{name: "Subdomain", token: memberToken, host: "acme.example.test:8080", expectedStatus: 200, expectedID: account.ID},
+		{name: "Subdomain of another tenant", token: strangerToken, host: "acme.example.test", expectedStatus: 403, expectedError: "Not a member of the account"},
+		{name: "Other domain", token: memberToken, host: "acme.other.test", expectedStatus: 200, expectedID: memberAccount.ID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/account", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			if tt.header != "" {
+				req.Header.Set(middleware.AccountHeader, tt.header)
+			}
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			w := httptest.NewRecorder()
+			handler.router.ServeHTTP(w, req)
+
+			if tt.expectedError != "" {
+				assertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+				return
+			}
+			require.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.Equal(t, tt.expectedID, parseDataID(t, w))
+		})
+	}
+
+	t.Run("Account scoped queries", func(t *testing.T) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Set(middleware.UserKey, member)
+		c.Set(middleware.AccountKey, &account)
+
+		group := &models.Group{Name: "tenant"}
+		require.NoError(t, handler.CreateInAccount(c, group))
+		assert.Equal(t, member.ID, group.UserID)
+		assert.Equal(t, models.AccountScopeType, group.OwnerType)
+		assert.Equal(t, account.ID, group.OwnerID)
+
+		groups := []models.Group{}
+		require.NoError(t, handler.AccountScopedDB(c).Find(&groups).Error)
+		assert.Len(t, groups, 1)
+
+		// The groups of the account aren't visible from the other accounts of the user
+		c.Set(middleware.AccountKey, &memberAccount)
+		groups = []models.Group{}
+		require.NoError(t, handler.AccountScopedDB(c).Find(&groups).Error)
+		assert.Empty(t, groups)
+	})
+
+	t.Run("Subdomains are unique", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"subdomain": "ACME"}, memberToken)
+		assertErrorResponse(t, w, 409, "Subdomain is already taken")
+		w = makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"subdomain": "Globex"}, memberToken)
+		require.Equal(t, 200, w.Code)
+		require.NoError(t, db.First(&memberAccount, memberAccount.ID).Error)
+		require.NotNil(t, memberAccount.Subdomain)
+		assert.Equal(t, "globex", *memberAccount.Subdomain)
+
+		// The unique index rejects the duplicates the check missed
+		err := db.Model(&models.Account{}).Where("id = ?", account.ID).Update("subdomain", "globex").Error
+		assert.Error(t, err)
+	})
+
+	t.Run("Subdomains are DNS labels", func(t *testing.T) {
+		for _, subdomain := range []string{"a.b", "-acme", "acme_corp", strings.Repeat("a", 64)} {
+			w := makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"subdomain": subdomain}, memberToken)
+			assertErrorResponse(t, w, 400, "Invalid subdomain")
+		}
+		w := makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"subdomain": "WWW"}, memberToken)
+		assertErrorResponse(t, w, 400, "subdomain is reserved")
+	})
+
+	t.Run("Subdomains can be cleared", func(t *testing.T) {
+		// Omitting the subdomain keeps it
+		w := makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"name": "Globex"}, memberToken)
+		require.Equal(t, 200, w.Code)
+		require.NoError(t, db.First(&memberAccount, memberAccount.ID).Error)
+		require.NotNil(t, memberAccount.Subdomain)
+
+		w = makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"name": "Globex", "subdomain": ""}, memberToken)
+		require.Equal(t, 200, w.Code)
+		require.NoError(t, db.First(&memberAccount, memberAccount.ID).Error)
+		assert.Nil(t, memberAccount.Subdomain)
+
+		// Many accounts don't have a subdomain
+		var count int64
+		db.Model(&models.Account{}).Where("subdomain IS NULL").Count(&count)
+		assert.Greater(t, count, int64(1))
+	})
+}
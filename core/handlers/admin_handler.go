@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gsarmaonline/goiter/core/middleware"
+	"github.com/gsarmaonline/goiter/core/models"
+	"gorm.io/gorm"
+)
+
+type (
+	// AdminHandler serves the routes of the superusers
+	AdminHandler struct {
+		db      *gorm.DB
+		handler *Handler
+	}
+
+	ImpersonateRequest struct {
+		UserID uint `json:"user_id" binding:"required"`
+	}
+)
+
+func NewAdminHandler(handler *Handler) *AdminHandler {
+	return &AdminHandler{handler: handler, db: handler.Db}
+}
+
+// Impersonate issues a token acting as the user on behalf of the superuser. The token carries
+// both users, isn't bound to a session and can't be refreshed.
+func (h *AdminHandler) Impersonate(c *gin.Context) {
+	var req ImpersonateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	admin := h.handler.GetUserFromContext(c)
+	user := &models.User{}
+	if err := h.db.First(user, req.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "User not found"})
+			return
+		}
+		h.handler.WriteError(c, err, "Failed to find user")
+		return
+	}
+	if !admin.CanImpersonate(user) {
+		c.JSON(403, gin.H{"error": "User can't be impersonated"})
+		return
+	}
+
+	token, err := h.handler.signJWT(jwt.MapClaims{
+		"sub":                 subject(user),
+		"exp":                 time.Now().Add(models.ImpersonationTTL).Unix(),
+		middleware.ActorClaim: map[string]interface{}{"sub": subject(admin)},
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create token"})
+		return
+	}
+	if err = models.RecordImpersonation(h.db, admin.ID, user.ID, c.Request.Method, c.Request.URL.Path, 200, c.ClientIP()); err != nil {
+		h.handler.WriteError(c, err, "Failed to record the impersonation")
+		return
+	}
+	h.handler.WriteSuccess(c, gin.H{
+		"token":      token,
+		"expires_in": int(models.ImpersonationTTL.Seconds()),
+		"user":       user,
+	})
+}
+
+// ListImpersonationLogs lists the latest impersonated requests, optionally of a user or an impersonator
+func (h *AdminHandler) ListImpersonationLogs(c *gin.Context) {
+	query := h.db.Order("id DESC").Limit(100)
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if impersonatorID := c.Query("impersonator_id"); impersonatorID != "" {
+		query = query.Where("impersonator_id = ?", impersonatorID)
+	}
+	logs := []models.ImpersonationLog{}
+	if err := query.Find(&logs).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list the impersonation logs")
+		return
+	}
+	h.handler.WriteSuccess(c, logs)
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+func TestAdminHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	admin, adminToken := createTestUser(t, db, "admin@example.com")
+	require.NoError(t, db.Model(admin).Update("is_superuser", true).Error)
+	otherAdmin, _ := createTestUser(t, db, "otheradmin@example.com")
+	require.NoError(t, db.Model(otherAdmin).Update("is_superuser", true).Error)
+	customer, customerToken := createTestUser(t, db, "customer@example.com")
+
+	// impersonate returns the token of the superuser acting as the customer
+	impersonate := func(t *testing.T) string {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/admin/impersonate", map[string]interface{}{"user_id": customer.ID}, adminToken)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response["data"]["token"].(string)
+	}
+
+	t.Run("Only superusers can impersonate", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/admin/impersonate", map[string]interface{}{"user_id": admin.ID}, customerToken)
+		assertErrorResponse(t, w, 403, "Superuser access required")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/admin/impersonate", map[string]interface{}{"user_id": otherAdmin.ID}, adminToken)
+		assertErrorResponse(t, w, 403, "User can't be impersonated")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/admin/impersonate", map[string]interface{}{"user_id": 999999}, adminToken)
+		assertErrorResponse(t, w, 404, "User not found")
+	})
+
+	t.Run("Impersonated requests act as the user", func(t *testing.T) {
+		token := impersonate(t)
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, customer.Email, response["data"]["email"])
+		assert.Equal(t, admin.Email, response["data"]["impersonator"].(map[string]interface{})["email"])
+
+		// The impersonated user isn't a superuser
+		w = makeAuthenticatedRequest(t, handler, "GET", "/admin/impersonation_logs", nil, token)
+		assertErrorResponse(t, w, 403, "Superuser access required")
+	})
+
+	t.Run("Sensitive routes are blocked while impersonating", func(t *testing.T) {
+		token := impersonate(t)
+
+		w := makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions", map[string]interface{}{"plan_id": 1}, token)
+		assertErrorResponse(t, w, 403, "Not allowed while impersonating")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/api_keys", map[string]interface{}{"name": "Key", "scopes": []string{"read"}}, token)
+		assertErrorResponse(t, w, 403, "Not allowed while impersonating")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/enroll", nil, token)
+		assertErrorResponse(t, w, 403, "Not allowed while impersonating")
+
+		// Changes which would outlive the impersonation
+		for _, route := range []struct{ method, path string }{
+			{"PUT", "/account"},
+			{"POST", "/account/invitations"},
+			{"DELETE", "/account/invitations/1"},
+			{"DELETE", "/account/members/1"},
+			{"POST", "/invitations/accept"},
+			{"POST", "/role_accesses"},
+			{"DELETE", "/role_accesses/1"},
+		} {
+			w = makeAuthenticatedRequest(t, handler, route.method, route.path, map[string]interface{}{}, token)
+			assertErrorResponse(t, w, 403, "Not allowed while impersonating")
+		}
+	})
+
+	t.Run("Every impersonated request is recorded", func(t *testing.T) {
+		require.NoError(t, db.Where("1 = 1").Delete(&models.ImpersonationLog{}).Error)
+		token := impersonate(t)
+		makeAuthenticatedRequest(t, handler, "GET", "/me", nil, token)
+		makeAuthenticatedRequest(t, handler, "DELETE", "/billing/subscriptions", nil, token)
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/admin/impersonation_logs?user_id="+subject(customer), nil, adminToken)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string][]models.ImpersonationLog
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		logs := response["data"]
+		require.Len(t, logs, 3)
+		assert.Equal(t, "/billing/subscriptions", logs[0].Path)
+		assert.Equal(t, 403, logs[0].StatusCode)
+		assert.Equal(t, "/me", logs[1].Path)
+		assert.Equal(t, 200, logs[1].StatusCode)
+		assert.Equal(t, "/admin/impersonate", logs[2].Path)
+		for _, log := range logs {
+			assert.Equal(t, admin.ID, log.ImpersonatorID)
+			assert.Equal(t, customer.ID, log.UserID)
+		}
+	})
+
+	t.Run("Impersonation stops once the impersonator isn't a superuser", func(t *testing.T) {
+		token := impersonate(t)
+		require.NoError(t, db.Model(admin).Update("is_superuser", false).Error)
+		defer db.Model(admin).Update("is_superuser", true)
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, token)
+		assertErrorResponse(t, w, 401, "Impersonation isn't allowed")
+	})
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"gorm.io/gorm"
+)
+
+type (
+	APIKeyHandler struct {
+		db      *gorm.DB
+		handler *Handler
+	}
+
+	APIKeyRequest struct {
+		Name      string           `json:"name" binding:"required"`
+		Scopes    []models.ActionT `json:"scopes" binding:"required"`
+		ExpiresAt *time.Time       `json:"expires_at"`
+		// Account creates a key owned by the active account instead of the user
+		Account bool `json:"account"`
+	}
+
+	// APIKeyResponse is a newly created key along with its secret, which isn't shown again
+	APIKeyResponse struct {
+		*models.APIKey
+		Key string `json:"key"`
+	}
+)
+
+func NewAPIKeyHandler(handler *Handler) *APIKeyHandler {
+	return &APIKeyHandler{handler: handler, db: handler.Db}
+}
+
+// visibleKeys scopes the query to the keys of the user and, for the users
+// who can manage it, the keys of the active account
+func (h *APIKeyHandler) visibleKeys(c *gin.Context) (query *gorm.DB) {
+	user := h.handler.GetUserFromContext(c)
+	owned := h.db.Where("owner_type = ? AND user_id = ?", models.UserScopeType, user.ID)
+	if account, role, err := h.handler.GetAccountRoleFromContext(c); err == nil && role.CanManageAccount() {
+		owned = owned.Or("owner_type = ? AND owner_id = ?", models.AccountScopeType, account.ID)
+	}
+	query = h.db.Where(owned)
+	return
+}
+
+// ListAPIKeys lists the keys which weren't revoked
+func (h *APIKeyHandler) ListAPIKeys(c *gin.Context) {
+	if !h.handler.rejectAPIKey(c, "API keys can't manage API keys") {
+		return
+	}
+	apiKeys := []models.APIKey{}
+	if err := h.visibleKeys(c).Where("revoked_at IS NULL").Order("created_at DESC").Find(&apiKeys).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list API keys")
+		return
+	}
+	h.handler.WriteSuccess(c, apiKeys)
+}
+
+// CreateAPIKey creates a key of the user, or of the active account for its owners and admins
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	if !h.handler.rejectAPIKey(c, "API keys can't manage API keys") {
+		return
+	}
+	var req APIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+
+	user := h.handler.GetUserFromContext(c)
+	ownerType, ownerID := models.UserScopeType, user.ID
+	if req.Account {
+		account, role, err := h.handler.GetAccountRoleFromContext(c)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+			return
+		}
+		if !role.CanManageAccount() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage API keys of the account"})
+			return
+		}
+		ownerType, ownerID = models.AccountScopeType, account.ID
+	}
+
+	apiKey, key, err := models.NewAPIKey(h.db, user, ownerType, ownerID, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidScopes) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scopes"})
+			return
+		}
+		h.handler.WriteError(c, err, "Failed to create API key")
+		return
+	}
+	h.handler.WriteSuccess(c, APIKeyResponse{APIKey: apiKey, Key: key})
+}
+
+// RevokeAPIKey revokes a key, rejecting the requests authenticated with it
+func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	if !h.handler.rejectAPIKey(c, "API keys can't manage API keys") {
+		return
+	}
+	apiKey := &models.APIKey{}
+	if err := h.visibleKeys(c).Where("id = ?", c.Param(DefaultUrlKeyName)).First(apiKey).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err := apiKey.Revoke(h.db); err != nil {
+		h.handler.WriteError(c, err, "Failed to revoke API key")
+		return
+	}
+	h.handler.WriteSuccess(c, apiKey)
+}
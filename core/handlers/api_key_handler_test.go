@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/middleware"
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+// createTestAPIKey creates a key with the token and returns its ID and secret
+func createTestAPIKey(t *testing.T, handler *Handler, token string, body map[string]interface{}) (id uint, key string) {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/api_keys", body, token)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var response map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return uint(response["data"]["id"].(float64)), response["data"]["key"].(string)
+}
+
+func TestAPIKeyHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	user, token := createTestUser(t, db, "apikeys@example.com")
+	_, otherToken := createTestUser(t, db, "otherapikeys@example.com")
+
+	t.Run("Key authenticates as its user", func(t *testing.T) {
+		id, key := createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":   "CI",
+			"scopes": []string{"read"},
+		})
+		assert.True(t, strings.HasPrefix(key, models.APIKeyPrefix))
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, key)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), user.Email)
+
+		var apiKey models.APIKey
+		require.NoError(t, db.First(&apiKey, id).Error)
+		assert.NotEqual(t, key, apiKey.TokenHash)
+		assert.Equal(t, key[:len(apiKey.Prefix)], apiKey.Prefix)
+		assert.NotNil(t, apiKey.LastUsedAt)
+
+		// The secret is only shown when the key is created
+		w = makeAuthenticatedRequest(t, handler, "GET", "/api_keys", nil, token)
+		require.Equal(t, 200, w.Code)
+		assert.NotContains(t, w.Body.String(), key)
+		assert.Contains(t, w.Body.String(), apiKey.Prefix)
+	})
+
+	t.Run("Scopes limit the actions", func(t *testing.T) {
+		_, key := createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":   "Read only",
+			"scopes": []string{"read"},
+		})
+		w := makeAuthenticatedRequest(t, handler, "POST", "/projects", map[string]string{"name": "Denied"}, key)
+		assertErrorResponse(t, w, 403, "API key isn't allowed to create")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/api_keys", map[string]interface{}{
+			"name":   "Invalid",
+			"scopes": []string{"admin"},
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid scopes")
+	})
+
+	t.Run("Keys can't manage keys", func(t *testing.T) {
+		_, key := createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":   "Full",
+			"scopes": []string{"read", "create", "update", "delete"},
+		})
+		w := makeAuthenticatedRequest(t, handler, "GET", "/api_keys", nil, key)
+		assertErrorResponse(t, w, 403, "API keys can't manage API keys")
+	})
+
+	t.Run("Revoked and expired keys are rejected", func(t *testing.T) {
+		id, key := createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":   "Revoked",
+			"scopes": []string{"read"},
+		})
+		// Other users can't see the key
+		w := makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/api_keys/%d", id), nil, otherToken)
+		assertErrorResponse(t, w, 404, "API key not found")
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/api_keys/%d", id), nil, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, key)
+		assertErrorResponse(t, w, 401, "Invalid API key")
+
+		expiresAt := time.Now().Add(time.Hour)
+		id, key = createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":       "Expiring",
+			"scopes":     []string{"read"},
+			"expires_at": expiresAt,
+		})
+		require.NoError(t, db.Model(&models.APIKey{}).Where("id = ?", id).Update("expires_at", time.Now().Add(-time.Minute)).Error)
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, key)
+		assertErrorResponse(t, w, 401, "Invalid API key")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/api_keys", map[string]interface{}{
+			"name":       "Expired",
+			"scopes":     []string{"read"},
+			"expires_at": time.Now().Add(-time.Hour),
+		}, token)
+		assertErrorResponse(t, w, 400, "Expiry must be in the future")
+	})
+
+	t.Run("Account keys act on their account", func(t *testing.T) {
+		var account models.Account
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&account).Error)
+		id, key := createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":    "Account",
+			"scopes":  []string{"read"},
+			"account": true,
+		})
+		var apiKey models.APIKey
+		require.NoError(t, db.First(&apiKey, id).Error)
+		assert.Equal(t, models.AccountScopeType, apiKey.OwnerType)
+		assert.Equal(t, account.ID, apiKey.OwnerID)
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/account", nil, key)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		req := httptest.NewRequest("GET", "/account", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set(middleware.AccountHeader, fmt.Sprint(account.ID+1000))
+		w = httptest.NewRecorder()
+		handler.router.ServeHTTP(w, req)
+		assertErrorResponse(t, w, 403, "API key belongs to another account")
+	})
+}
@@ -1,30 +1,33 @@
 package handlers
 
 import (
-	"encoding/json"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
-	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gsarmaonline/goiter/config"
+	"github.com/gsarmaonline/goiter/core/middleware"
 	"github.com/gsarmaonline/goiter/core/models"
 )
 
 type (
-	TokenResponse struct {
-		AccessToken  string `json:"access_token"`
-		IDToken      string `json:"id_token"`
-		ExpiresIn    int    `json:"expires_in"`
+	// SessionTokens are the tokens issued when the user signs in or refreshes a session
+	SessionTokens struct {
+		AccessToken  string `json:"token"`
 		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
 		TokenType    string `json:"token_type"`
-		Scope        string `json:"scope"`
+	}
+
+	RefreshRequest struct {
+		RefreshToken string `json:"refresh_token"`
 	}
 )
 
@@ -50,13 +53,11 @@ func (h *Handler) handleShortCircuitLogin(c *gin.Context) {
 	// Try to find existing user by email
 	if result := h.Db.Where(models.User{Email: req.Email}).First(&modUser); result.Error != nil {
 		// User doesn't exist, create new one
-		someRandomNumber := strconv.Itoa(rand.Int())
 		user := models.User{
-			GoogleID:    someRandomNumber,
 			Email:       req.Email,
 			Name:        fmt.Sprintf("User %s", req.Email),
 			UserStatus:  models.ActiveUser,
-			CreatedFrom: "login",
+			CreatedFrom: models.ShortCircuitCreatedFrom,
 		}
 
 		if err := h.Db.Create(&user).Error; err != nil {
@@ -73,192 +74,195 @@ func (h *Handler) handleShortCircuitLogin(c *gin.Context) {
 		}
 	}
 
-	// Create JWT
-	token, err := h.createJWT(modUser.Email)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create token"})
-		return
-	}
-
-	c.JSON(200, gin.H{
-		"message": "Short circuit login successful",
-		"token":   token,
-	})
-
+	h.completeLogin(c, "Short circuit login successful", modUser)
 }
 
-func (h *Handler) handleGoogleLogin(c *gin.Context) {
-	googleClientID := os.Getenv("GOOGLE_CLIENT_ID")
-	if googleClientID == "" {
-		c.JSON(500, gin.H{"error": "Google client ID not configured"})
-		return
-	}
+func (h *Handler) handleGetUser(c *gin.Context) {
+	user := h.GetUserFromContext(c)
 
-	callbackURL := os.Getenv("GOOGLE_CALLBACK_URL")
-	if callbackURL == "" {
-		c.JSON(500, gin.H{"error": "Google callback URL not configured"})
-		return
+	userData := gin.H{
+		"id":      user.ID,
+		"email":   user.Email,
+		"name":    user.Name,
+		"picture": user.Picture,
+		"profile": user.Profile,
+	}
+	// Lets the frontend show who is acting as the user
+	if impersonator := h.GetImpersonatorFromContext(c); impersonator != nil {
+		userData["impersonator"] = gin.H{
+			"id":    impersonator.ID,
+			"email": impersonator.Email,
+			"name":  impersonator.Name,
+		}
 	}
 
-	redirectURL := fmt.Sprintf(
-		"https://accounts.google.com/o/oauth2/v2/auth?client_id=%s&redirect_uri=%s&response_type=code&scope=email profile&access_type=offline",
-		googleClientID,
-		callbackURL,
-	)
-
-	c.Redirect(http.StatusTemporaryRedirect, redirectURL)
+	h.WriteSuccess(c, userData)
 }
 
-func (h *Handler) handleGoogleCallback(c *gin.Context) {
-	code := c.Query("code")
-	if code == "" {
-		c.JSON(400, gin.H{"error": "No code provided"})
-		return
+// handleLogout revokes the session of the token the request is authenticated with
+func (h *Handler) handleLogout(c *gin.Context) {
+	if session := h.GetSessionFromContext(c); session != nil {
+		if err := session.Revoke(h.Db, models.LogoutRevokeReason); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to revoke session"})
+			return
+		}
 	}
+	h.clearSessionCookies(c)
+	c.JSON(200, gin.H{"message": "Logged out successfully"})
+}
 
-	// Exchange code for tokens
-	token, err := h.exchangeCodeForToken(code)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to exchange code for token"})
+// handleRefresh rotates the refresh token of a session and issues a new access token.
+// Reusing a rotated refresh token revokes the session.
+func (h *Handler) handleRefresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(400, gin.H{"error": "Invalid request"})
 		return
 	}
-
-	// Get user info from Google
-	userInfo, err := h.getGoogleUserInfo(token.AccessToken)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to get user info"})
-		return
+	// In the session cookie mode the refresh token is only sent as a cookie
+	if req.RefreshToken == "" {
+		req.RefreshToken, _ = c.Cookie(middleware.RefreshTokenCookie)
 	}
-
-	// Create or update user in database
-	user := models.User{
-		GoogleID:    userInfo.ID,
-		Email:       userInfo.Email,
-		Name:        userInfo.Name,
-		Picture:     userInfo.Picture,
-		AccessToken: token.AccessToken,
-		UserStatus:  models.ActiveUser,
+	if req.RefreshToken == "" {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
 	}
-	modUser := &models.User{}
-
-	if result := h.Db.Where(models.User{Email: userInfo.Email}).FirstOrCreate(&modUser); result.Error != nil {
-		c.JSON(500, gin.H{"error": "Failed to save user"})
+	session, refreshToken, err := models.RefreshSession(h.Db, req.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRefreshTokenReused):
+			c.JSON(401, gin.H{"error": "Refresh token was already used, the session has been revoked"})
+		case errors.Is(err, models.ErrSessionInactive):
+			c.JSON(401, gin.H{"error": "Session was revoked or has expired"})
+		case errors.Is(err, models.ErrInvalidRefreshToken):
+			c.JSON(401, gin.H{"error": "Invalid refresh token"})
+		default:
+			c.JSON(500, gin.H{"error": "Failed to refresh session"})
+		}
 		return
 	}
-	user.ID = modUser.ID
-
-	if err := h.Db.Save(&user).Error; err != nil {
-		c.JSON(500, gin.H{"error": "Failed to update user status"})
+	user := &models.User{}
+	if err = h.Db.Where("id = ?", session.UserID).First(user).Error; err != nil {
+		c.JSON(401, gin.H{"error": "User not found"})
 		return
 	}
-
-	// Create JWT
-	jwtToken, err := h.createJWT(user.Email)
+	accessToken, err := h.createSessionJWT(user, session)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to create token"})
 		return
 	}
-
-	// Redirect to frontend with success parameter
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		c.JSON(500, gin.H{"error": "Frontend URL not configured"})
-		return
+	tokens := &SessionTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(models.AccessTokenTTL.Seconds()),
+		TokenType:    "Bearer",
 	}
-	c.Redirect(http.StatusTemporaryRedirect, frontendURL+"?token="+jwtToken)
-}
-
-func (h *Handler) handleGetUser(c *gin.Context) {
-	user := h.GetUserFromContext(c)
-
-	userData := gin.H{
-		"id":      user.ID,
-		"email":   user.Email,
-		"name":    user.Name,
-		"picture": user.Picture,
-		"profile": user.Profile,
+	if h.cfg.SessionCookies {
+		if err = h.setSessionCookies(c, tokens); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create token"})
+			return
+		}
+		h.WriteSuccess(c, gin.H{"expires_in": tokens.ExpiresIn})
+		return
 	}
-
-	h.WriteSuccess(c, userData)
-}
-
-func (h *Handler) handleLogout(c *gin.Context) {
-	c.JSON(200, gin.H{"message": "Logged out successfully"})
+	h.WriteSuccess(c, tokens)
 }
 
-func (h *Handler) exchangeCodeForToken(code string) (*TokenResponse, error) {
-	clientID := os.Getenv("GOOGLE_CLIENT_ID")
-	clientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
-	callbackURL := os.Getenv("GOOGLE_CALLBACK_URL")
-
-	if callbackURL == "" {
-		return nil, fmt.Errorf("Google callback URL not configured")
-	}
-
-	url := "https://oauth2.googleapis.com/token"
-	data := fmt.Sprintf(
-		"client_id=%s&client_secret=%s&code=%s&grant_type=authorization_code&redirect_uri=%s",
-		clientID,
-		clientSecret,
-		code,
-		callbackURL,
-	)
-
-	resp, err := http.Post(url, "application/x-www-form-urlencoded", strings.NewReader(data))
+// startSession signs the user in on the device of the request
+func (h *Handler) startSession(c *gin.Context, user *models.User) (tokens *SessionTokens, err error) {
+	session, refreshToken, err := models.NewSession(h.Db, user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
-		return nil, err
+		return
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	accessToken, err := h.createSessionJWT(user, session)
 	if err != nil {
-		return nil, err
+		return
 	}
-
-	var token TokenResponse
-	if err := json.Unmarshal(body, &token); err != nil {
-		return nil, err
+	tokens = &SessionTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(models.AccessTokenTTL.Seconds()),
+		TokenType:    "Bearer",
 	}
-
-	return &token, nil
+	return
 }
 
-func (h *Handler) getGoogleUserInfo(accessToken string) (*models.GoogleUserInfo, error) {
-	resp, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + accessToken)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// writeSessionTokens answers a sign in with the tokens of the new session. In the session
+// cookie mode the tokens are set as HttpOnly cookies instead of being returned.
+func (h *Handler) writeSessionTokens(c *gin.Context, message string, tokens *SessionTokens) {
+	if h.cfg.SessionCookies {
+		if err := h.setSessionCookies(c, tokens); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create token"})
+			return
+		}
+		c.JSON(200, gin.H{
+			"message":    message,
+			"expires_in": tokens.ExpiresIn,
+		})
+		return
 	}
+	c.JSON(200, gin.H{
+		"message":       message,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"token_type":    tokens.TokenType,
+	})
+}
 
-	var userInfo models.GoogleUserInfo
-	if err := json.Unmarshal(body, &userInfo); err != nil {
-		return nil, err
+// setSessionCookies sets the tokens as HttpOnly cookies along with a fresh CSRF token.
+// The refresh token is only sent to the refresh endpoint.
+func (h *Handler) setSessionCookies(c *gin.Context, tokens *SessionTokens) (err error) {
+	csrfToken := make([]byte, 32)
+	if _, err = cryptorand.Read(csrfToken); err != nil {
+		return
 	}
+	secure := h.secureCookies(c)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(middleware.AccessTokenCookie, tokens.AccessToken, tokens.ExpiresIn, "/", "", secure, true)
+	c.SetCookie(middleware.CSRFCookie, hex.EncodeToString(csrfToken), int(models.RefreshTokenTTL.Seconds()), "/", "", secure, false)
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(middleware.RefreshTokenCookie, tokens.RefreshToken, int(models.RefreshTokenTTL.Seconds()), "/auth/refresh", "", secure, true)
+	return
+}
 
-	return &userInfo, nil
+// clearSessionCookies removes the cookies of the session cookie mode
+func (h *Handler) clearSessionCookies(c *gin.Context) {
+	secure := h.secureCookies(c)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(middleware.AccessTokenCookie, "", -1, "/", "", secure, true)
+	c.SetCookie(middleware.CSRFCookie, "", -1, "/", "", secure, false)
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(middleware.RefreshTokenCookie, "", -1, "/auth/refresh", "", secure, true)
 }
 
-func (h *Handler) createJWT(email string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"email": email,
-			"exp":   time.Now().Add(time.Hour * 24).Unix(),
-		})
+// createJWT creates an access token of the user which isn't bound to a session
+func (h *Handler) createJWT(user *models.User) (string, error) {
+	return h.signJWT(jwt.MapClaims{
+		"sub": subject(user),
+		"exp": time.Now().Add(models.AccessTokenTTL).Unix(),
+	})
+}
 
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		return "", fmt.Errorf("JWT secret not configured")
-	}
+// createSessionJWT creates an access token of the session, which is rejected once the session is revoked
+func (h *Handler) createSessionJWT(user *models.User, session *models.Session) (string, error) {
+	return h.signJWT(jwt.MapClaims{
+		"sub":                   subject(user),
+		"exp":                   time.Now().Add(models.AccessTokenTTL).Unix(),
+		middleware.SessionClaim: session.ID,
+	})
+}
 
-	tokenString, err := token.SignedString([]byte(secret))
+// signJWT signs the claims with the current signing key, adding the iss, aud, iat and jti claims
+func (h *Handler) signJWT(claims jwt.MapClaims) (tokenString string, err error) {
+	keySet, err := h.keys.KeySet()
 	if err != nil {
-		return "", err
+		return
 	}
+	return keySet.Sign(claims)
+}
 
-	return tokenString, nil
+// subject returns the sub claim of the tokens of the user
+func subject(user *models.User) string {
+	return strconv.FormatUint(uint64(user.ID), 10)
 }
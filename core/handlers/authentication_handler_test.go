@@ -2,17 +2,21 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/gsarmaonline/goiter/config"
 	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/signing"
 )
 
 // Test helper functions (add to the top of the file after imports)
@@ -74,7 +78,6 @@ func TestAuthenticationHandler(t *testing.T) {
 			existingUser := &models.User{
 				Email:       "existing@example.com",
 				Name:        "Existing User",
-				GoogleID:    "existing-google-id",
 				UserStatus:  models.InactiveUser, // Start as inactive
 				CreatedFrom: "test",
 			}
@@ -158,7 +161,7 @@ func TestAuthenticationHandler(t *testing.T) {
 			location := w.Header().Get("Location")
 			assert.Contains(t, location, "accounts.google.com/o/oauth2/v2/auth")
 			assert.Contains(t, location, "client_id=test-client-id")
-			assert.Contains(t, location, "redirect_uri=http://localhost:8080/auth/google/callback")
+			assert.Contains(t, location, "redirect_uri="+url.QueryEscape("http://localhost:8080/auth/google/callback"))
 		})
 
 		t.Run("Missing Google Client ID", func(t *testing.T) {
@@ -220,14 +223,9 @@ func TestAuthenticationHandler(t *testing.T) {
 			// Create an expired token
 			user, _ := createTestUser(t, db, "expiredtoken@example.com")
 
-			expiredToken := jwt.NewWithClaims(jwt.SigningMethodHS256,
-				jwt.MapClaims{
-					"email": user.Email,
-					"exp":   time.Now().Add(-time.Hour).Unix(), // Expired 1 hour ago
-				})
-
-			expiredTokenString, err := expiredToken.SignedString([]byte("test-secret-key"))
-			require.NoError(t, err)
+			expiredTokenString := signTestToken(t, user, jwt.MapClaims{
+				"exp": time.Now().Add(-time.Hour).Unix(), // Expired 1 hour ago
+			})
 
 			w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, expiredTokenString)
 			assertErrorResponse(t, w, 401, "Invalid token")
@@ -235,14 +233,11 @@ func TestAuthenticationHandler(t *testing.T) {
 
 		t.Run("User Not Found", func(t *testing.T) {
 			// Create a JWT for a user that doesn't exist in the database
-			nonexistentToken := jwt.NewWithClaims(jwt.SigningMethodHS256,
-				jwt.MapClaims{
-					"email": "nonexistent@example.com",
-					"exp":   time.Now().Add(time.Hour * 24).Unix(),
-				})
-
-			tokenString, err := nonexistentToken.SignedString([]byte("test-secret-key"))
-			require.NoError(t, err)
+			nonexistent := &models.User{}
+			nonexistent.ID = 999999
+			tokenString := signTestToken(t, nonexistent, jwt.MapClaims{
+				"exp": time.Now().Add(time.Hour * 24).Unix(),
+			})
 
 			w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, tokenString)
 			assertErrorResponse(t, w, 401, "User not found")
@@ -272,14 +267,14 @@ func TestAuthenticationHandler(t *testing.T) {
 }
 
 func TestJWTCreation(t *testing.T) {
-	handler, _ := setupTestHandler(t)
+	handler, db := setupTestHandler(t)
 
 	t.Run("Valid JWT Creation", func(t *testing.T) {
-		email := "test@example.com"
+		user, _ := createTestUser(t, db, "test@example.com")
 
 		// Use reflection to access the private createJWT method
 		// Note: In a real scenario, you might want to expose this as a testable function
-		token, err := handler.createJWT(email)
+		token, err := handler.createJWT(user)
 		require.NoError(t, err)
 		require.NotEmpty(t, token)
 
@@ -292,7 +287,11 @@ func TestJWTCreation(t *testing.T) {
 
 		claims, ok := parsedToken.Claims.(jwt.MapClaims)
 		require.True(t, ok)
-		assert.Equal(t, email, claims["email"])
+		assert.Equal(t, fmt.Sprint(user.ID), claims["sub"])
+		assert.Equal(t, signing.DefaultIssuer, claims["iss"])
+		assert.Equal(t, signing.DefaultIssuer, claims["aud"])
+		assert.NotEmpty(t, claims["jti"])
+		assert.Empty(t, parsedToken.Header["kid"])
 
 		// Check expiration is in the future
 		exp := claims["exp"].(float64)
@@ -305,7 +304,9 @@ func TestJWTCreation(t *testing.T) {
 		os.Unsetenv("JWT_SECRET")
 		defer func() { os.Setenv("JWT_SECRET", originalSecret) }()
 
-		_, err := handler.createJWT("test@example.com")
+		// The keys are loaded by the first token the handler signs
+		handler := NewHandler(gin.New(), db, &config.Config{Mode: config.ModeDev})
+		_, err := handler.createJWT(&models.User{Email: "test@example.com"})
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "JWT secret not configured")
 	})
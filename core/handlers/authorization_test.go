@@ -3,6 +3,8 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -11,8 +13,10 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gsarmaonline/goiter/config"
+	"github.com/gsarmaonline/goiter/core/helpers/authorisation"
 	"github.com/gsarmaonline/goiter/core/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -26,7 +30,7 @@ func setupAuthorizationTest() (*gorm.DB, *gin.Engine, *Handler) {
 		panic("Failed to connect to test database")
 	}
 
-	db.AutoMigrate(&models.User{}, &models.Account{}, &models.Plan{}, &models.Profile{}, &models.Group{})
+	db.AutoMigrate(&models.User{}, &models.Account{}, &models.AccountMembership{}, &models.Plan{}, &models.Profile{}, &models.Group{}, &models.OutboxEvent{})
 
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
@@ -39,8 +43,7 @@ func setupAuthorizationTest() (*gorm.DB, *gin.Engine, *Handler) {
 
 func createAuthTestUser(db *gorm.DB, email string) (*models.User, string) {
 	user := &models.User{
-		Email:    email,
-		GoogleID: "google_" + email,
+		Email: email,
 	}
 	db.Create(user)
 
@@ -438,3 +441,567 @@ func TestAuthorization_DatabaseIntegration(t *testing.T) {
 		assert.NotEqual(t, user1Profiles[0].CompanyName, user2Profiles[0].CompanyName)
 	})
 }
+
+func TestAuthorization_RoleAccess(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	handler.SetAuthorisationState(true)
+	defer handler.SetAuthorisationState(false)
+
+	owner, _ := createTestUser(t, db, "roleaccess-owner@example.com")
+	accessor, accessorToken := createTestUser(t, db, "roleaccess-accessor@example.com")
+
+	var account models.Account
+	err := db.Where("user_id = ?", owner.ID).First(&account).Error
+	require.NoError(t, err)
+
+	handler.ProtectedRouteGroup.GET("/test_accounts/:id", func(c *gin.Context) {
+		var account models.Account
+		if err := handler.Db.First(&account, c.Param(DefaultUrlKeyName)).Error; err != nil {
+			handler.WriteError(c, err, "Account not found")
+			return
+		}
+		if err := handler.Authorise(c, &account, models.ReadAction); err != nil {
+			handler.WriteError(c, err, "Not allowed to read account")
+			return
+		}
+		handler.WriteSuccess(c, account)
+	})
+	accountPath := fmt.Sprintf("/test_accounts/%d", account.ID)
+
+	newContext := func(user *models.User) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/test", nil)
+		c.Set("user", user)
+		return c
+	}
+	cleanup := func() {
+		db.Where("1 = 1").Delete(&models.RoleAccess{})
+		db.Where("1 = 1").Delete(&models.GroupMember{})
+		db.Where("1 = 1").Delete(&models.Group{})
+	}
+
+	t.Run("Owner has implicit access", func(t *testing.T) {
+		assert.True(t, handler.authorisation.CanPerformAction(newContext(owner), &account, models.DeleteAction))
+	})
+
+	t.Run("Owner access can be disabled", func(t *testing.T) {
+		handler.authorisation.AllowImplicitOwnerAccess = false
+		defer func() { handler.authorisation.AllowImplicitOwnerAccess = true }()
+		assert.False(t, handler.authorisation.CanPerformAction(newContext(owner), &account, models.ReadAction))
+	})
+
+	t.Run("Denied without a rule", func(t *testing.T) {
+		assert.False(t, handler.authorisation.CanPerformAction(newContext(accessor), &account, models.ReadAction))
+
+		w := makeAuthenticatedRequest(t, handler, "GET", accountPath, nil, accessorToken)
+		assertErrorResponse(t, w, 403, "Not allowed to read account")
+	})
+
+	t.Run("Direct rule", func(t *testing.T) {
+		defer cleanup()
+		require.NoError(t, db.Create(&models.RoleAccess{
+			AccessorType: models.UserElement,
+			AccessorID:   accessor.ID,
+			ResourceType: "Account",
+			ResourceID:   account.ID,
+			Action:       models.ReadAction,
+		}).Error)
+
+		assert.True(t, handler.authorisation.CanPerformAction(newContext(accessor), &account, models.ReadAction))
+		assert.False(t, handler.authorisation.CanPerformAction(newContext(accessor), &account, models.UpdateAction))
+
+		w := makeAuthenticatedRequest(t, handler, "GET", accountPath, nil, accessorToken)
+		assert.Equal(t, 200, w.Code)
+	})
+
+	t.Run("Rule on all resources of a type", func(t *testing.T) {
+		defer cleanup()
+		require.NoError(t, db.Create(&models.RoleAccess{
+			AccessorType: models.UserElement,
+			AccessorID:   accessor.ID,
+			ResourceType: "Account",
+			Action:       models.UpdateAction,
+		}).Error)
+
+		assert.True(t, handler.authorisation.CanPerformAction(newContext(accessor), &account, models.UpdateAction))
+	})
+
+	t.Run("Rule inherited via nested accessor groups", func(t *testing.T) {
+		defer cleanup()
+		finance := &models.Group{Name: "finance"}
+		financeExecs := &models.Group{Name: "finance_execs"}
+		require.NoError(t, db.Create(finance).Error)
+		require.NoError(t, db.Create(financeExecs).Error)
+		require.NoError(t, db.Create(&models.GroupMember{GroupID: finance.ID, MemberType: models.GroupMemberType, MemberID: financeExecs.ID}).Error)
+		require.NoError(t, db.Create(&models.GroupMember{GroupID: financeExecs.ID, MemberType: "User", MemberID: accessor.ID}).Error)
+		require.NoError(t, db.Create(&models.RoleAccess{
+			AccessorType: models.GroupElement,
+			AccessorID:   finance.ID,
+			ResourceType: "Account",
+			ResourceID:   account.ID,
+			Action:       models.ReadAction,
+		}).Error)
+
+		assert.True(t, handler.authorisation.CanPerformAction(newContext(accessor), &account, models.ReadAction))
+	})
+
+	t.Run("Rule inherited via resource groups", func(t *testing.T) {
+		defer cleanup()
+		billing := &models.Group{Name: "billing"}
+		require.NoError(t, db.Create(billing).Error)
+		require.NoError(t, db.Create(&models.GroupMember{GroupID: billing.ID, MemberType: "Account", MemberID: account.ID}).Error)
+		require.NoError(t, db.Create(&models.RoleAccess{
+			AccessorType: models.UserElement,
+			AccessorID:   accessor.ID,
+			ResourceType: models.GroupElement,
+			ResourceID:   billing.ID,
+			Action:       models.ReadAction,
+		}).Error)
+
+		assert.True(t, handler.authorisation.CanPerformAction(newContext(accessor), &account, models.ReadAction))
+	})
+
+	t.Run("Scoped rule only applies within its scope", func(t *testing.T) {
+		defer cleanup()
+		scopedAccount := account
+		scopedAccount.OwnerType = models.AccountScopeType
+		scopedAccount.OwnerID = account.ID
+		require.NoError(t, db.Create(&models.RoleAccess{
+			AccessorType: models.UserElement,
+			AccessorID:   accessor.ID,
+			ResourceType: "Account",
+			ResourceID:   account.ID,
+			Scope:        models.Scope{ScopeType: models.AccountScopeType, ScopeID: account.ID + 1},
+			Action:       models.ReadAction,
+		}).Error)
+
+		assert.False(t, handler.authorisation.CanPerformAction(newContext(accessor), &scopedAccount, models.ReadAction))
+	})
+}
+
+func TestAuthorization_PermittedListQuery(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	handler.SetAuthorisationState(true)
+	defer handler.SetAuthorisationState(false)
+
+	owner, _ := createTestUser(t, db, "listquery-owner@example.com")
+	accessor, _ := createTestUser(t, db, "listquery-accessor@example.com")
+
+	var ownerAccount, accessorAccount models.Account
+	require.NoError(t, db.Where("user_id = ?", owner.ID).First(&ownerAccount).Error)
+	require.NoError(t, db.Where("user_id = ?", accessor.ID).First(&accessorAccount).Error)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/test", nil)
+	c.Set("user", accessor)
+
+	listAccountIDs := func() (accountIDs []uint) {
+		var accounts []models.Account
+		require.NoError(t, handler.FindWithUser(c, &accounts))
+		for _, account := range accounts {
+			accountIDs = append(accountIDs, account.ID)
+		}
+		return
+	}
+	createRule := func(rule *models.RoleAccess) {
+		require.NoError(t, db.Create(rule).Error)
+	}
+	createGroup := func(name string) *models.Group {
+		group := &models.Group{Name: name}
+		require.NoError(t, db.Create(group).Error)
+		return group
+	}
+	addMember := func(group *models.Group, memberType models.ElementTypeT, memberID uint) {
+		require.NoError(t, db.Create(&models.GroupMember{GroupID: group.ID, MemberType: memberType, MemberID: memberID}).Error)
+	}
+	cleanup := func() {
+		db.Where("1 = 1").Delete(&models.RoleAccess{})
+		db.Where("1 = 1").Delete(&models.GroupMember{})
+		db.Where("1 = 1").Delete(&models.Group{})
+	}
+
+	t.Run("Only owned resources without a rule", func(t *testing.T) {
+		assert.ElementsMatch(t, []uint{accessorAccount.ID}, listAccountIDs())
+	})
+
+	t.Run("Direct rule", func(t *testing.T) {
+		defer cleanup()
+		createRule(&models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: "Account", ResourceID: ownerAccount.ID, Action: models.ReadAction})
+		assert.ElementsMatch(t, []uint{accessorAccount.ID, ownerAccount.ID}, listAccountIDs())
+	})
+
+	t.Run("Rules for other actions are ignored", func(t *testing.T) {
+		defer cleanup()
+		createRule(&models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: "Account", ResourceID: ownerAccount.ID, Action: models.UpdateAction})
+		assert.ElementsMatch(t, []uint{accessorAccount.ID}, listAccountIDs())
+	})
+
+	t.Run("Rule on all resources of a type", func(t *testing.T) {
+		defer cleanup()
+		createRule(&models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: "Account", Action: models.ReadAction})
+		assert.ElementsMatch(t, []uint{accessorAccount.ID, ownerAccount.ID}, listAccountIDs())
+	})
+
+	t.Run("Rule inherited via nested accessor groups", func(t *testing.T) {
+		defer cleanup()
+		finance := createGroup("finance")
+		financeExecs := createGroup("finance_execs")
+		addMember(finance, models.GroupMemberType, financeExecs.ID)
+		addMember(financeExecs, models.UserMemberType, accessor.ID)
+		createRule(&models.RoleAccess{AccessorType: models.GroupElement, AccessorID: finance.ID,
+			ResourceType: "Account", ResourceID: ownerAccount.ID, Action: models.ReadAction})
+		assert.ElementsMatch(t, []uint{accessorAccount.ID, ownerAccount.ID}, listAccountIDs())
+	})
+
+	t.Run("Rule inherited via nested resource groups", func(t *testing.T) {
+		defer cleanup()
+		billing := createGroup("billing")
+		invoices := createGroup("invoices")
+		addMember(billing, models.GroupMemberType, invoices.ID)
+		addMember(invoices, "Account", ownerAccount.ID)
+		createRule(&models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: models.GroupElement, ResourceID: billing.ID, Action: models.ReadAction})
+		assert.ElementsMatch(t, []uint{accessorAccount.ID, ownerAccount.ID}, listAccountIDs())
+	})
+
+	t.Run("Scoped rule only applies within its scope", func(t *testing.T) {
+		defer cleanup()
+		createRule(&models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: "Account", Action: models.ReadAction,
+			Scope: models.Scope{ScopeType: models.AccountScopeType, ScopeID: ownerAccount.ID}})
+		assert.ElementsMatch(t, []uint{accessorAccount.ID}, listAccountIDs())
+	})
+
+	t.Run("Only owned resources when disabled", func(t *testing.T) {
+		defer cleanup()
+		handler.SetAuthorisationState(false)
+		defer handler.SetAuthorisationState(true)
+		createRule(&models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: "Account", ResourceID: ownerAccount.ID, Action: models.ReadAction})
+		assert.ElementsMatch(t, []uint{accessorAccount.ID}, listAccountIDs())
+	})
+}
+
+func TestAuthorization_DenyRules(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	handler.SetAuthorisationState(true)
+	defer handler.SetAuthorisationState(false)
+
+	owner, _ := createTestUser(t, db, "deny-owner@example.com")
+	intern, _ := createTestUser(t, db, "deny-intern@example.com")
+
+	var account models.Account
+	require.NoError(t, db.Where("user_id = ?", owner.ID).First(&account).Error)
+
+	// finance_interns is nested inside finance
+	finance := &models.Group{Name: "finance"}
+	financeInterns := &models.Group{Name: "finance_interns"}
+	require.NoError(t, db.Create(finance).Error)
+	require.NoError(t, db.Create(financeInterns).Error)
+	require.NoError(t, db.Create(&models.GroupMember{GroupID: finance.ID, MemberType: models.GroupMemberType, MemberID: financeInterns.ID}).Error)
+	require.NoError(t, db.Create(&models.GroupMember{GroupID: financeInterns.ID, MemberType: models.UserMemberType, MemberID: intern.ID}).Error)
+
+	newRule := func(accessorType models.ElementT, accessorID uint, effect models.EffectT, priority int) *models.RoleAccess {
+		rule := &models.RoleAccess{
+			AccessorType: accessorType,
+			AccessorID:   accessorID,
+			ResourceType: "Account",
+			ResourceID:   account.ID,
+			Action:       models.ReadAction,
+			Effect:       effect,
+			Priority:     priority,
+		}
+		require.NoError(t, db.Create(rule).Error)
+		return rule
+	}
+	explain := func() *authorisation.Decision {
+		decision, err := handler.ExplainAccess(intern, &account, models.ReadAction)
+		require.NoError(t, err)
+		return decision
+	}
+	listAccountIDs := func() (accountIDs []uint) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/test", nil)
+		c.Set("user", intern)
+		var accounts []models.Account
+		require.NoError(t, handler.FindWithUser(c, &accounts))
+		for _, listed := range accounts {
+			accountIDs = append(accountIDs, listed.ID)
+		}
+		return
+	}
+	cleanup := func() {
+		db.Where("1 = 1").Delete(&models.RoleAccess{})
+	}
+
+	tests := []struct {
+		name     string
+		rules    func() (decisive *models.RoleAccess)
+		allowed  bool
+		pathSize int
+	}{
+		{
+			name: "Allow inherited from the parent group",
+			rules: func() *models.RoleAccess {
+				return newRule(models.GroupElement, finance.ID, "", 0)
+			},
+			allowed:  true,
+			pathSize: 2,
+		},
+		{
+			name: "Deny on the nested group beats allow on the parent group",
+			rules: func() *models.RoleAccess {
+				newRule(models.GroupElement, finance.ID, models.AllowEffect, 0)
+				return newRule(models.GroupElement, financeInterns.ID, models.DenyEffect, 0)
+			},
+			allowed:  false,
+			pathSize: 1,
+		},
+		{
+			name: "Deny beats allow at the same level",
+			rules: func() *models.RoleAccess {
+				newRule(models.GroupElement, financeInterns.ID, models.AllowEffect, 0)
+				return newRule(models.GroupElement, financeInterns.ID, models.DenyEffect, 0)
+			},
+			allowed:  false,
+			pathSize: 1,
+		},
+		{
+			name: "Allow on the user beats deny inherited via groups",
+			rules: func() *models.RoleAccess {
+				newRule(models.GroupElement, financeInterns.ID, models.DenyEffect, 0)
+				return newRule(models.UserElement, intern.ID, models.AllowEffect, 0)
+			},
+			allowed:  true,
+			pathSize: 0,
+		},
+		{
+			name: "Higher priority beats specificity",
+			rules: func() *models.RoleAccess {
+				newRule(models.UserElement, intern.ID, models.AllowEffect, 0)
+				return newRule(models.GroupElement, finance.ID, models.DenyEffect, 10)
+			},
+			allowed:  false,
+			pathSize: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer cleanup()
+			decisive := tt.rules()
+
+			decision := explain()
+			assert.Equal(t, tt.allowed, decision.Allowed)
+			assert.Equal(t, authorisation.RuleReason, decision.Reason)
+			require.NotNil(t, decision.Match)
+			assert.Equal(t, decisive.ID, decision.Match.Rule.ID)
+			assert.Len(t, decision.Match.AccessorPath, tt.pathSize)
+
+			// List queries follow the same precedence
+			if tt.allowed {
+				assert.Contains(t, listAccountIDs(), account.ID)
+			} else {
+				assert.NotContains(t, listAccountIDs(), account.ID)
+			}
+		})
+	}
+
+	t.Run("Explain the accessor path", func(t *testing.T) {
+		defer cleanup()
+		newRule(models.GroupElement, finance.ID, models.AllowEffect, 0)
+
+		decision := explain()
+		require.NotNil(t, decision.Match)
+		assert.Equal(t, 2, decision.Match.AccessorDepth)
+		assert.Equal(t, "finance_interns", decision.Match.AccessorPath[0].Name)
+		assert.Equal(t, "finance", decision.Match.AccessorPath[1].Name)
+	})
+
+	t.Run("No matching rule", func(t *testing.T) {
+		decision := explain()
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, authorisation.NoRuleReason, decision.Reason)
+		assert.Nil(t, decision.Match)
+	})
+
+	t.Run("Owner access isn't affected by deny rules", func(t *testing.T) {
+		defer cleanup()
+		newRule(models.UserElement, owner.ID, models.DenyEffect, 0)
+
+		decision, err := handler.ExplainAccess(owner, &account, models.ReadAction)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, authorisation.OwnerReason, decision.Reason)
+	})
+}
+
+// failingCacheBackend fails all its operations, like an unreachable Redis
+type failingCacheBackend struct{}
+
+func (failingCacheBackend) Get(key string) ([]byte, bool, error) {
+	return nil, false, errors.New("cache unavailable")
+}
+
+func (failingCacheBackend) Set(key string, value []byte) error {
+	return errors.New("cache unavailable")
+}
+
+func (failingCacheBackend) Invalidate() error {
+	return errors.New("cache unavailable")
+}
+
+func TestAuthorization_Cache(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	handler.SetAuthorisationState(true)
+	defer handler.SetAuthorisationState(false)
+	handler.SetAuthorisationCache(authorisation.NewLRUCacheBackend(100))
+	defer handler.authorisation.SetCache(nil)
+	cache := handler.authorisation.GetCache()
+
+	owner, _ := createTestUser(t, db, "cache-owner@example.com")
+	accessor, accessorToken := createTestUser(t, db, "cache-accessor@example.com")
+
+	var account models.Account
+	require.NoError(t, db.Where("user_id = ?", owner.ID).First(&account).Error)
+
+	canRead := func() bool {
+		decision, err := handler.ExplainAccess(accessor, &account, models.ReadAction)
+		require.NoError(t, err)
+		return decision.Allowed
+	}
+
+	t.Run("Decisions are cached", func(t *testing.T) {
+		before := cache.Stats()
+		assert.False(t, canRead())
+		afterMiss := cache.Stats()
+		// The decision and both the ancestries miss
+		assert.Equal(t, before.Misses+3, afterMiss.Misses)
+
+		assert.False(t, canRead())
+		assert.Equal(t, afterMiss.Hits+1, cache.Stats().Hits)
+		assert.Equal(t, afterMiss.Misses, cache.Stats().Misses)
+	})
+
+	t.Run("Rule changes invalidate the cache", func(t *testing.T) {
+		rule := &models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: "Account", ResourceID: account.ID, Action: models.ReadAction}
+		require.NoError(t, db.Create(rule).Error)
+		assert.True(t, canRead())
+
+		require.NoError(t, db.Model(rule).Update("effect", models.DenyEffect).Error)
+		assert.False(t, canRead())
+
+		require.NoError(t, db.Delete(rule).Error)
+		assert.False(t, canRead())
+	})
+
+	t.Run("Group changes invalidate the cache", func(t *testing.T) {
+		defer db.Where("1 = 1").Delete(&models.RoleAccess{})
+		finance := &models.Group{Name: "finance"}
+		require.NoError(t, db.Create(finance).Error)
+		require.NoError(t, db.Create(&models.RoleAccess{AccessorType: models.GroupElement, AccessorID: finance.ID,
+			ResourceType: "Account", ResourceID: account.ID, Action: models.ReadAction}).Error)
+		assert.False(t, canRead())
+
+		require.NoError(t, db.Create(&models.GroupMember{GroupID: finance.ID, MemberType: models.UserMemberType, MemberID: accessor.ID}).Error)
+		assert.True(t, canRead())
+
+		require.NoError(t, db.Where("group_id = ?", finance.ID).Delete(&models.GroupMember{}).Error)
+		assert.False(t, canRead())
+
+		require.NoError(t, finance.DeleteWithMembers(db))
+	})
+
+	t.Run("Cache failures don't fail the writes", func(t *testing.T) {
+		handler.SetAuthorisationCache(failingCacheBackend{})
+		defer handler.authorisation.SetCache(cache)
+
+		group := &models.Group{Name: "failing"}
+		require.NoError(t, db.Create(group).Error)
+		require.NoError(t, db.Model(group).Update("name", "still failing").Error)
+		require.NoError(t, group.DeleteWithMembers(db))
+	})
+
+	t.Run("Stats endpoint", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "GET", "/role_accesses/cache_stats", nil, accessorToken)
+		require.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		data := response["data"].(map[string]interface{})
+		assert.Equal(t, float64(cache.Stats().Hits), data["hits"])
+		assert.Equal(t, float64(cache.Stats().Misses), data["misses"])
+	})
+
+	t.Run("LRU evicts the least recently used entries", func(t *testing.T) {
+		lru := authorisation.NewLRUCacheBackend(2)
+		require.NoError(t, lru.Set("a", []byte("1")))
+		require.NoError(t, lru.Set("b", []byte("2")))
+		_, found, _ := lru.Get("a")
+		assert.True(t, found)
+		require.NoError(t, lru.Set("c", []byte("3")))
+
+		_, found, _ = lru.Get("b")
+		assert.False(t, found)
+		value, found, _ := lru.Get("a")
+		assert.True(t, found)
+		assert.Equal(t, []byte("1"), value)
+		assert.Equal(t, 2, lru.Len())
+
+		require.NoError(t, lru.Invalidate())
+		assert.Equal(t, 0, lru.Len())
+	})
+}
+
+func TestAuthorization_Require(t *testing.T) {
+	handler := setupGroupTestHandler(t)
+	db := handler.Db
+	handler.SetAuthorisationState(true)
+	defer handler.SetAuthorisationState(false)
+
+	owner, ownerToken := createTestUser(t, db, "require-owner@example.com")
+	accessor, accessorToken := createTestUser(t, db, "require-accessor@example.com")
+
+	var account models.Account
+	require.NoError(t, db.Where("user_id = ?", owner.ID).First(&account).Error)
+
+	handler.ProtectedRouteGroup.PUT("/required_accounts/:id", handler.Require(models.UpdateAction, "Account"), func(c *gin.Context) {
+		handler.WriteSuccess(c, handler.GetResourceFromContext(c))
+	})
+	accountPath := fmt.Sprintf("/required_accounts/%d", account.ID)
+
+	t.Run("Owner", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "PUT", accountPath, nil, ownerToken)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, account.ID, parseDataID(t, w))
+	})
+
+	t.Run("Forbidden without a rule", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "PUT", accountPath, nil, accessorToken)
+		assertErrorResponse(t, w, 403, "Not allowed to update Account")
+	})
+
+	t.Run("Allowed by a rule for the action", func(t *testing.T) {
+		defer db.Where("1 = 1").Delete(&models.RoleAccess{})
+		require.NoError(t, db.Create(&models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: "Account", ResourceID: account.ID, Action: models.ReadAction}).Error)
+		w := makeAuthenticatedRequest(t, handler, "PUT", accountPath, nil, accessorToken)
+		assertErrorResponse(t, w, 403, "Not allowed to update Account")
+
+		require.NoError(t, db.Create(&models.RoleAccess{AccessorType: models.UserElement, AccessorID: accessor.ID,
+			ResourceType: "Account", ResourceID: account.ID, Action: models.UpdateAction}).Error)
+		w = makeAuthenticatedRequest(t, handler, "PUT", accountPath, nil, accessorToken)
+		assert.Equal(t, 200, w.Code)
+	})
+
+	t.Run("Unknown resource", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "PUT", "/required_accounts/99999", nil, ownerToken)
+		assertErrorResponse(t, w, 404, "Account not found")
+
+		w = makeAuthenticatedRequest(t, handler, "PUT", "/required_accounts/abc", nil, ownerToken)
+		assertErrorResponse(t, w, 404, "Account not found")
+	})
+}
@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"errors"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gsarmaonline/goiter/core/models"
 	"github.com/gsarmaonline/goiter/core/services"
+	"github.com/gsarmaonline/goiter/core/services/payments"
 	"gorm.io/gorm"
 )
 
@@ -24,13 +27,28 @@ func NewBillingHandler(handler *Handler) *BillingHandler {
 	}
 }
 
+// getBillingAccount returns the current account after checking the user can manage its billing
+func (h *BillingHandler) getBillingAccount(c *gin.Context) (account *models.Account, ok bool) {
+	account, role, err := h.handler.GetAccountRoleFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	if !role.CanManageBilling() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage billing of the account"})
+		return
+	}
+	ok = true
+	return
+}
+
 // CreateSubscriptionRequest represents the request body for creating a subscription
 type CreateSubscriptionRequest struct {
 	PlanID          uint   `json:"plan_id" binding:"required"`
 	PaymentMethodID string `json:"payment_method_id" binding:"required"`
 }
 
-// CreateSubscription creates a new subscription for the current user's account
+// CreateSubscription creates a new subscription for the current account of the user
 func (h *BillingHandler) CreateSubscription(c *gin.Context) {
 	var req CreateSubscriptionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -38,10 +56,9 @@ func (h *BillingHandler) CreateSubscription(c *gin.Context) {
 		return
 	}
 
-	// Get the account for the current user
-	var account models.Account
-	if err := h.handler.UserScopedDB(c).First(&account).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+	// Get the current account of the user
+	account, ok := h.getBillingAccount(c)
+	if !ok {
 		return
 	}
 
@@ -66,12 +83,123 @@ func (h *BillingHandler) CreateSubscription(c *gin.Context) {
 	})
 }
 
-// CancelSubscription cancels the current user's subscription
+// ChangeSubscriptionRequest represents the request body for changing the plan of a subscription.
+// ProrationBehavior defaults to the PRORATION_BEHAVIOR of the config, else create_prorations,
+// and ProrationDate is the one of the preview the change was confirmed from, if any.
+type ChangeSubscriptionRequest struct {
+	PlanID            uint                        `json:"plan_id" binding:"required"`
+	ProrationBehavior payments.ProrationBehaviorT `json:"proration_behavior"`
+	ProrationDate     *time.Time                  `json:"proration_date"`
+}
+
+// SubscriptionChangePreview is the upcoming invoice of the account if it changed its plan
+type SubscriptionChangePreview struct {
+	PlanID            uint                        `json:"plan_id"`
+	ProrationBehavior payments.ProrationBehaviorT `json:"proration_behavior"`
+	*payments.ProrationPreview
+}
+
+// bindPlanChange returns the account, the plan and the proration of the plan change of the request
+func (h *BillingHandler) bindPlanChange(c *gin.Context) (account *models.Account, plan *models.Plan, req *ChangeSubscriptionRequest, ok bool) {
+	req = &ChangeSubscriptionRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ProrationBehavior == "" {
+		req.ProrationBehavior = payments.ProrationBehaviorT(h.handler.cfg.GetKey("PRORATION_BEHAVIOR"))
+	}
+	if req.ProrationBehavior == "" {
+		req.ProrationBehavior = payments.CreateProrations
+	}
+	if !req.ProrationBehavior.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid proration behavior"})
+		return
+	}
+
+	if account, ok = h.getBillingAccount(c); !ok {
+		return
+	}
+
+	plan = &models.Plan{}
+	if err := h.db.Where("id = ?", req.PlanID).First(plan).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plan ID"})
+		return nil, nil, nil, false
+	}
+	return
+}
+
+// writePlanChangeError answers with the error of a plan change
+func (h *BillingHandler) writePlanChangeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrNoSubscription):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Account has no subscription to change, create one first"})
+	case errors.Is(err, models.ErrAlreadyOnPlan):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Account is already on the plan"})
+	case errors.Is(err, models.ErrPlanNotBillable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan can't be subscribed to, cancel the subscription to move to the free plan"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// ChangeSubscription moves the subscription of the current account of the user to another plan,
+// prorating the change instead of canceling the subscription and creating a new one
+func (h *BillingHandler) ChangeSubscription(c *gin.Context) {
+	account, plan, req, ok := h.bindPlanChange(c)
+	if !ok {
+		return
+	}
+
+	var prorationDate time.Time
+	if req.ProrationDate != nil {
+		prorationDate = *req.ProrationDate
+	}
+	subscription, err := account.ChangeStripeSubscriptionPlan(h.db, plan, req.ProrationBehavior, prorationDate)
+	if err != nil {
+		h.writePlanChangeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"subscription_id":    subscription.ID,
+		"status":             subscription.Status,
+		"plan_id":            plan.ID,
+		"proration_behavior": req.ProrationBehavior,
+		"message":            "Subscription changed successfully",
+	})
+}
+
+// PreviewSubscriptionChange returns the proration and the upcoming invoice of the current
+// account if its subscription moved to another plan, without changing it
+func (h *BillingHandler) PreviewSubscriptionChange(c *gin.Context) {
+	account, plan, req, ok := h.bindPlanChange(c)
+	if !ok {
+		return
+	}
+
+	var prorationDate time.Time
+	if req.ProrationDate != nil {
+		prorationDate = *req.ProrationDate
+	}
+	preview, err := account.PreviewStripeSubscriptionPlan(h.db, plan, req.ProrationBehavior, prorationDate)
+	if err != nil {
+		h.writePlanChangeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &SubscriptionChangePreview{
+		PlanID:            plan.ID,
+		ProrationBehavior: req.ProrationBehavior,
+		ProrationPreview:  preview,
+	})
+}
+
+// CancelSubscription cancels the subscription of the current account of the user
 func (h *BillingHandler) CancelSubscription(c *gin.Context) {
-	// Get the account for the current user
-	var account models.Account
-	if err := h.handler.UserScopedDB(c).First(&account).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+	// Get the current account of the user
+	account, ok := h.getBillingAccount(c)
+	if !ok {
 		return
 	}
 
@@ -88,12 +216,13 @@ func (h *BillingHandler) CancelSubscription(c *gin.Context) {
 
 // GetSubscriptionStatus returns the current subscription status
 func (h *BillingHandler) GetSubscriptionStatus(c *gin.Context) {
-	// Get the account for the current user
-	var account models.Account
-	if err := h.handler.UserScopedDB(c).Preload("Plan").First(&account).Error; err != nil {
+	// Get the current account of the user
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
 		return
 	}
+	h.db.Preload("Plan").First(account, account.ID)
 
 	c.JSON(http.StatusOK, gin.H{
 		"subscription_id": account.StripeSubscriptionID,
@@ -3,18 +3,21 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gsarmaonline/goiter/config"
 	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/payments"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -45,7 +48,7 @@ func setupBillingTest() (*gorm.DB, *gin.Engine, *BillingHandler) {
 	}
 
 	// Migrate schema
-	db.AutoMigrate(&models.User{}, &models.Account{}, &models.Plan{}, &models.Profile{}, &models.Group{})
+	db.AutoMigrate(&models.User{}, &models.Account{}, &models.AccountMembership{}, &models.Plan{}, &models.Profile{}, &models.Group{}, &models.OutboxEvent{})
 
 	// Setup router
 	gin.SetMode(gin.TestMode)
@@ -63,8 +66,7 @@ func setupBillingTest() (*gorm.DB, *gin.Engine, *BillingHandler) {
 
 func createBillingTestUser(db *gorm.DB, email string) *BillingTestUser {
 	user := &models.User{
-		Email:    email,
-		GoogleID: "google_" + strings.ReplaceAll(email, "@", "_"),
+		Email: email,
 	}
 	db.Create(user)
 
@@ -481,3 +483,393 @@ func TestBillingHandler_StripeServiceMocking(t *testing.T) {
 		assert.Equal(t, "past_due", updatedAccount.SubscriptionStatus)
 	})
 }
+
+// sendTestWebhook posts the event signed by the fake gateway to the webhook
+func sendTestWebhook(t *testing.T, handler *Handler, gateway *payments.FakeGateway, event *payments.Event) *httptest.ResponseRecorder {
+	payload, signature := gateway.NewEvent(event)
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signature)
+	w := httptest.NewRecorder()
+	handler.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestBillingHandler_PaymentGateway(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	gateway := payments.NewFakeGateway()
+	handler.SetPaymentGateway(gateway)
+
+	plan := &models.Plan{Name: "Pro", Price: 10, BillingPeriod: "yearly"}
+	require.NoError(t, db.Create(plan).Error)
+	processed, err := handler.BillingOutbox().Process()
+	require.NoError(t, err)
+	assert.Equal(t, 1, processed)
+	require.NoError(t, db.First(plan, plan.ID).Error)
+	require.Contains(t, gateway.Prices, plan.StripePriceID)
+	assert.Equal(t, int64(1000), gateway.Prices[plan.StripePriceID].UnitAmount)
+	assert.Equal(t, payments.YearInterval, gateway.Prices[plan.StripePriceID].Interval)
+	assert.Equal(t, plan.Name, gateway.Products[plan.StripeProductID].Name)
+
+	user, token := createTestUser(t, db, "gateway@example.com")
+	subscribe := map[string]interface{}{"plan_id": plan.ID, "payment_method_id": "pm_card_visa"}
+
+	t.Run("Subscriptions are created with the gateway", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions", subscribe, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		subscription := gateway.Subscriptions[response["subscription_id"].(string)]
+		require.NotNil(t, subscription)
+		assert.Equal(t, payments.ActiveSubscription, subscription.Status)
+		assert.Equal(t, plan.StripePriceID, subscription.Items[0].PriceID)
+
+		account := &models.Account{}
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(account).Error)
+		assert.Equal(t, plan.ID, account.PlanID)
+		assert.Equal(t, subscription.ID, account.StripeSubscriptionID)
+		assert.Equal(t, subscription.CustomerID, account.StripeCustomerID)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions", subscribe, token)
+		assertErrorResponse(t, w, 500, "account already has an active subscription")
+	})
+
+	t.Run("Declined cards are rejected", func(t *testing.T) {
+		_, otherToken := createTestUser(t, db, "declined@example.com")
+		w := makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions", map[string]interface{}{
+			"plan_id":           plan.ID,
+			"payment_method_id": payments.FakeDeclinedPaymentMethod,
+		}, otherToken)
+		assertErrorResponse(t, w, 500, payments.ErrCardDeclined.Error())
+	})
+
+	t.Run("Webhooks update the subscription of the account", func(t *testing.T) {
+		account := &models.Account{}
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(account).Error)
+		periodStart := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		subscription := gateway.Subscriptions[account.StripeSubscriptionID]
+		subscription.Status = payments.PastDueSubscription
+		subscription.CurrentPeriodStart = periodStart
+		subscription.CurrentPeriodEnd = periodStart.AddDate(1, 0, 0)
+
+		w := sendTestWebhook(t, handler, gateway, &payments.Event{
+			Type:         payments.SubscriptionUpdatedEvent,
+			Subscription: &payments.Subscription{ID: account.StripeSubscriptionID, Status: payments.ActiveSubscription},
+		})
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, db.First(account, account.ID).Error)
+		// The subscription is read from the gateway, since the events may be outdated
+		assert.Equal(t, payments.PastDueSubscription, account.SubscriptionStatus)
+		require.NotNil(t, account.CurrentPeriodStart)
+		assert.True(t, periodStart.Equal(*account.CurrentPeriodStart))
+
+		w = sendTestWebhook(t, handler, gateway, &payments.Event{
+			Type:    payments.InvoicePaymentSucceededEvent,
+			Invoice: &payments.Invoice{ID: "in_paid", SubscriptionID: account.StripeSubscriptionID},
+		})
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, payments.ActiveSubscription, account.SubscriptionStatus)
+
+		// Unsigned events are rejected
+		payload, _ := gateway.NewEvent(&payments.Event{Type: payments.SubscriptionDeletedEvent})
+		req := httptest.NewRequest("POST", "/webhook", bytes.NewBuffer(payload))
+		req.Header.Set("Stripe-Signature", "forged")
+		w = httptest.NewRecorder()
+		handler.router.ServeHTTP(w, req)
+		assertErrorResponse(t, w, 400, "signature")
+	})
+
+	t.Run("Subscriptions are canceled at the end of the period", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "DELETE", "/billing/subscriptions", nil, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		account := &models.Account{}
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(account).Error)
+		assert.Equal(t, "canceling", account.SubscriptionStatus)
+		assert.True(t, gateway.Subscriptions[account.StripeSubscriptionID].CancelAtPeriodEnd)
+	})
+
+	t.Run("Deleted subscriptions reset the account to the free plan", func(t *testing.T) {
+		account := &models.Account{}
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(account).Error)
+		freePlan, err := models.GetDefaultPlan(db)
+		require.NoError(t, err)
+
+		w := sendTestWebhook(t, handler, gateway, &payments.Event{
+			Type:         payments.SubscriptionDeletedEvent,
+			Subscription: &payments.Subscription{ID: account.StripeSubscriptionID, Status: payments.CanceledSubscription},
+		})
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, freePlan.ID, account.PlanID)
+		assert.Empty(t, account.StripeSubscriptionID)
+		assert.Equal(t, payments.CanceledSubscription, account.SubscriptionStatus)
+	})
+}
+
+func TestBillingHandler_Outbox(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	gateway := payments.NewFakeGateway()
+	handler.SetPaymentGateway(gateway)
+	outbox := handler.BillingOutbox()
+
+	t.Run("Rolled back plans leave no Stripe objects", func(t *testing.T) {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			require.NoError(t, tx.Create(&models.Plan{Name: "Rolled back", Price: 5}).Error)
+			return errors.New("rollback")
+		})
+		require.Error(t, err)
+
+		processed, err := outbox.Process()
+		require.NoError(t, err)
+		assert.Equal(t, 0, processed)
+		assert.Empty(t, gateway.Products)
+		assert.Empty(t, gateway.Prices)
+	})
+
+	t.Run("Failed side effects are retried without duplicates", func(t *testing.T) {
+		// The product is created, the price fails
+		gateway.FailNext(nil)
+		gateway.FailNext(errors.New("stripe is down"))
+		plan := &models.Plan{Name: "Retried", Price: 20}
+		require.NoError(t, db.Create(plan).Error)
+
+		processed, err := outbox.Process()
+		assert.ErrorContains(t, err, "stripe is down")
+		assert.Equal(t, 0, processed)
+		event := &models.OutboxEvent{}
+		require.NoError(t, db.Where("subject_id = ? AND kind = ?", plan.ID, models.CreatePlanPriceOutboxKind).First(event).Error)
+		assert.Equal(t, models.PendingOutboxEvent, event.Status)
+		assert.Equal(t, 1, event.Attempts)
+		assert.Contains(t, event.LastError, "stripe is down")
+		assert.True(t, event.RunAt.After(time.Now()))
+
+		// The retry waits for its backoff
+		processed, err = outbox.Process()
+		require.NoError(t, err)
+		assert.Equal(t, 0, processed)
+
+		require.NoError(t, db.Model(event).Update("run_at", time.Now().Add(-time.Second)).Error)
+		processed, err = outbox.Process()
+		require.NoError(t, err)
+		assert.Equal(t, 1, processed)
+
+		require.NoError(t, db.First(plan, plan.ID).Error)
+		require.NoError(t, db.First(event, event.ID).Error)
+		assert.Equal(t, models.DoneOutboxEvent, event.Status)
+		assert.NotNil(t, event.ProcessedAt)
+		assert.Len(t, gateway.Products, 1)
+		assert.Len(t, gateway.Prices, 1)
+		assert.Contains(t, gateway.Products, plan.StripeProductID)
+		assert.Contains(t, gateway.Prices, plan.StripePriceID)
+
+		processed, err = outbox.Process()
+		require.NoError(t, err)
+		assert.Equal(t, 0, processed)
+	})
+
+	t.Run("Moving to the free plan cancels the subscription once committed", func(t *testing.T) {
+		plan := &models.Plan{Name: "Canceled", Price: 15}
+		require.NoError(t, db.Create(plan).Error)
+		_, err := outbox.Process()
+		require.NoError(t, err)
+		require.NoError(t, db.First(plan, plan.ID).Error)
+		freePlan, err := models.GetDefaultPlan(db)
+		require.NoError(t, err)
+
+		user, token := createTestUser(t, db, "outbox@example.com")
+		w := makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions", map[string]interface{}{
+			"plan_id":           plan.ID,
+			"payment_method_id": "pm_card_visa",
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		account := &models.Account{}
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(account).Error)
+
+		// Updates leaving the plan as is don't touch the subscription
+		require.NoError(t, db.Model(account).Update("subdomain", "outbox").Error)
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, payments.ActiveSubscription, account.SubscriptionStatus)
+
+		for i := 0; i < 2; i++ {
+			require.NoError(t, db.Model(account).Update("plan_id", freePlan.ID).Error)
+		}
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, "canceling", account.SubscriptionStatus)
+		assert.False(t, gateway.Subscriptions[account.StripeSubscriptionID].CancelAtPeriodEnd)
+
+		processed, err := outbox.Process()
+		require.NoError(t, err)
+		assert.Equal(t, 1, processed)
+		assert.True(t, gateway.Subscriptions[account.StripeSubscriptionID].CancelAtPeriodEnd)
+
+		// Later updates on the free plan leave the status of the subscription as is
+		require.NoError(t, db.Model(account).Update("subscription_status", payments.CanceledSubscription).Error)
+		require.NoError(t, db.Model(account).Update("subdomain", "outbox-free").Error)
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, payments.CanceledSubscription, account.SubscriptionStatus)
+	})
+
+	t.Run("Events are given up after the last attempt", func(t *testing.T) {
+		plan := &models.Plan{Name: "Given up", Price: 30}
+		require.NoError(t, db.Create(plan).Error)
+		event := &models.OutboxEvent{}
+		require.NoError(t, db.Where("subject_id = ? AND kind = ?", plan.ID, models.CreatePlanPriceOutboxKind).First(event).Error)
+		require.NoError(t, db.Model(event).Update("attempts", models.MaxOutboxAttempts-1).Error)
+
+		gateway.FailNext(errors.New("stripe is down"))
+		_, err := outbox.Process()
+		assert.Error(t, err)
+		require.NoError(t, db.First(event, event.ID).Error)
+		assert.Equal(t, models.FailedOutboxEvent, event.Status)
+		assert.Equal(t, models.MaxOutboxAttempts, event.Attempts)
+	})
+}
+
+func TestBillingHandler_ChangeSubscription(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	gateway := payments.NewFakeGateway()
+	handler.SetPaymentGateway(gateway)
+
+	pro := &models.Plan{Name: "Pro", Price: 10}
+	enterprise := &models.Plan{Name: "Enterprise", Price: 30}
+	require.NoError(t, db.Create(pro).Error)
+	require.NoError(t, db.Create(enterprise).Error)
+	_, err := handler.BillingOutbox().Process()
+	require.NoError(t, err)
+	require.NoError(t, db.First(pro, pro.ID).Error)
+	require.NoError(t, db.First(enterprise, enterprise.ID).Error)
+	freePlan, err := models.GetDefaultPlan(db)
+	require.NoError(t, err)
+
+	// The subscription runs from January 1st to February 1st, and changes 16 days before its end
+	periodStart := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	changedAt := time.Date(2030, 1, 16, 0, 0, 0, 0, time.UTC)
+	gateway.SetNow(periodStart)
+	user, token := createTestUser(t, db, "change@example.com")
+	w := makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions", map[string]interface{}{
+		"plan_id":           pro.ID,
+		"payment_method_id": "pm_card_visa",
+	}, token)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	account := &models.Account{}
+	require.NoError(t, db.Where("user_id = ?", user.ID).First(account).Error)
+	subscriptionID := account.StripeSubscriptionID
+	gateway.SetNow(changedAt)
+
+	var preview map[string]interface{}
+	t.Run("Previews return the proration without changing the subscription", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions/preview", map[string]interface{}{
+			"plan_id": enterprise.ID,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preview))
+		assert.Equal(t, float64(enterprise.ID), preview["plan_id"])
+		assert.Equal(t, string(payments.CreateProrations), preview["proration_behavior"])
+		// 16/31 of the period: -516 unused on Pro, 1548 remaining on Enterprise
+		assert.Equal(t, float64(1032), preview["proration_amount"])
+		assert.Equal(t, float64(4032), preview["amount_due"])
+		assert.Len(t, preview["lines"], 3)
+
+		assert.Equal(t, pro.StripePriceID, gateway.Subscriptions[subscriptionID].Items[0].PriceID)
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, pro.ID, account.PlanID)
+	})
+
+	t.Run("Proration behavior is configurable", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions/preview", map[string]interface{}{
+			"plan_id":            enterprise.ID,
+			"proration_behavior": payments.NoProrations,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, float64(0), response["proration_amount"])
+		assert.Equal(t, float64(3000), response["amount_due"])
+
+		os.Setenv("PRORATION_BEHAVIOR", string(payments.AlwaysInvoiceProrations))
+		defer os.Unsetenv("PRORATION_BEHAVIOR")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions/preview", map[string]interface{}{
+			"plan_id": enterprise.ID,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, string(payments.AlwaysInvoiceProrations), response["proration_behavior"])
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/billing/subscriptions/preview", map[string]interface{}{
+			"plan_id":            enterprise.ID,
+			"proration_behavior": "sometimes",
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid proration behavior")
+	})
+
+	t.Run("Invalid plan changes are rejected", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "PUT", "/billing/subscriptions", map[string]interface{}{"plan_id": pro.ID}, token)
+		assertErrorResponse(t, w, 400, "already on the plan")
+		w = makeAuthenticatedRequest(t, handler, "PUT", "/billing/subscriptions", map[string]interface{}{"plan_id": freePlan.ID}, token)
+		assertErrorResponse(t, w, 400, "cancel the subscription")
+		w = makeAuthenticatedRequest(t, handler, "PUT", "/billing/subscriptions", map[string]interface{}{"plan_id": 99999}, token)
+		assertErrorResponse(t, w, 400, "Invalid plan ID")
+
+		_, otherToken := createTestUser(t, db, "nochange@example.com")
+		w = makeAuthenticatedRequest(t, handler, "PUT", "/billing/subscriptions", map[string]interface{}{"plan_id": enterprise.ID}, otherToken)
+		assertErrorResponse(t, w, 400, "no subscription")
+	})
+
+	t.Run("Changes prorate the existing subscription like their preview", func(t *testing.T) {
+		// Confirming later with the date of the preview keeps its amounts
+		gateway.SetNow(changedAt.Add(time.Hour))
+		w := makeAuthenticatedRequest(t, handler, "PUT", "/billing/subscriptions", map[string]interface{}{
+			"plan_id":        enterprise.ID,
+			"proration_date": preview["proration_date"],
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, subscriptionID, response["subscription_id"])
+
+		assert.Len(t, gateway.Subscriptions, 1)
+		subscription := gateway.Subscriptions[subscriptionID]
+		assert.Equal(t, payments.ActiveSubscription, subscription.Status)
+		require.Len(t, subscription.Items, 1)
+		assert.Equal(t, enterprise.StripePriceID, subscription.Items[0].PriceID)
+		var prorated int64
+		for _, line := range gateway.Prorations[subscriptionID] {
+			prorated += line.Amount
+		}
+		assert.Equal(t, int64(1032), prorated)
+
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, enterprise.ID, account.PlanID)
+		assert.Equal(t, subscriptionID, account.StripeSubscriptionID)
+	})
+
+	t.Run("Webhooks reconcile the plan of the account", func(t *testing.T) {
+		// A downgrade made outside of the app, like in the Stripe dashboard
+		subscription := gateway.Subscriptions[subscriptionID]
+		subscription.Status = payments.ActiveSubscription
+		subscription.Items = []*payments.SubscriptionItem{
+			{ID: "si_metered", PriceID: "price_metered"},
+			{ID: "si_plan", PriceID: pro.StripePriceID},
+		}
+		w := sendTestWebhook(t, handler, gateway, &payments.Event{
+			Type:         payments.SubscriptionUpdatedEvent,
+			Subscription: subscription,
+		})
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, pro.ID, account.PlanID)
+
+		// Subscriptions without the price of a plan leave the plan as is
+		subscription.Status = payments.PastDueSubscription
+		subscription.Items = subscription.Items[:1]
+		w = sendTestWebhook(t, handler, gateway, &payments.Event{
+			Type:         payments.SubscriptionUpdatedEvent,
+			Subscription: subscription,
+		})
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, db.First(account, account.ID).Error)
+		assert.Equal(t, pro.ID, account.PlanID)
+		assert.Equal(t, payments.PastDueSubscription, account.SubscriptionStatus)
+	})
+}
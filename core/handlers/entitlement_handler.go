@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/entitlements"
+	"gorm.io/gorm"
+)
+
+const (
+	// Codes of the errors of the requests exceeding the plan of the account
+	LimitReachedCode       = "limit_reached"
+	FeatureNotIncludedCode = "feature_not_included"
+)
+
+// RegisterLimit limits the number of rows of the model an account can own by the limit of the
+// feature in its plan, enforced with CheckEntitlementLocked in the transaction creating the rows
+// or, as a soft limit, with CheckEntitlement or RequireEntitlement
+//
+//	h.RegisterLimit(models.ProjectsFeature, &models.Project{})
+func (h *Handler) RegisterLimit(feature string, model models.UserOwnedModel) {
+	h.entitlements.RegisterCounter(feature, entitlements.CountModel(model))
+}
+
+// CheckEntitlement checks the plan of the account allows one more use of the feature.
+// Otherwise it answers with a 402 when the plan doesn't include the feature at all and
+// with a 403 when its limit is reached, along with the entitlement. Concurrent requests may
+// both pass the check, CheckEntitlementLocked enforces the limits which can't be exceeded.
+func (h *Handler) CheckEntitlement(c *gin.Context, account *models.Account, feature string) (ok bool) {
+	_, err := h.entitlements.Check(account, feature)
+	if err == nil {
+		ok = true
+		return
+	}
+	h.writeEntitlementError(c, feature, err)
+	return
+}
+
+// CheckEntitlementLocked checks the plan of the account allows one more use of the feature within
+// the transaction using it, with the row of the account locked until the transaction ends. The
+// error rolls the transaction back and is answered with WriteEntitlementError.
+func (h *Handler) CheckEntitlementLocked(tx *gorm.DB, account *models.Account, feature string) (err error) {
+	_, err = h.entitlements.CheckLocked(tx, account, feature)
+	return
+}
+
+// WriteEntitlementError answers the request with the error of a transaction which checked the
+// feature with CheckEntitlementLocked, like CheckEntitlement does. It returns false for the
+// other errors, which are left to the caller.
+func (h *Handler) WriteEntitlementError(c *gin.Context, feature string, err error) (ok bool) {
+	var limitErr *entitlements.LimitError
+	if !errors.As(err, &limitErr) {
+		return
+	}
+	h.writeEntitlementError(c, feature, err)
+	ok = true
+	return
+}
+
+func (h *Handler) writeEntitlementError(c *gin.Context, feature string, err error) {
+	var limitErr *entitlements.LimitError
+	if !errors.As(err, &limitErr) {
+		h.WriteError(c, err, "Failed to check the limits of the plan")
+		return
+	}
+	if errors.Is(err, entitlements.ErrFeatureNotIncluded) {
+		c.JSON(http.StatusPaymentRequired, gin.H{
+			"error":       feature + " isn't included in the plan",
+			"code":        FeatureNotIncludedCode,
+			"entitlement": limitErr.Entitlement,
+		})
+		return
+	}
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":       feature + " limit of the plan reached",
+		"code":        LimitReachedCode,
+		"entitlement": limitErr.Entitlement,
+	})
+	return
+}
+
+// RequireEntitlement returns a middleware which checks the plan of the account of the
+// request allows one more use of the feature before the handler runs, as a soft limit
+//
+//	routes.POST("/widgets", h.RequireEntitlement("Widgets"), handler)
+func (h *Handler) RequireEntitlement(feature string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		account, err := h.GetAccountFromContext(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+			return
+		}
+		if !h.CheckEntitlement(c, account, feature) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetEntitlements returns the features of the plan of the current account with their remaining quota
+func (h *AccountHandler) GetEntitlements(c *gin.Context) {
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	accountEntitlements, err := h.handler.entitlements.ForAccount(account)
+	if err != nil {
+		h.handler.WriteError(c, err, "Failed to load the entitlements of the account")
+		return
+	}
+	h.handler.WriteSuccess(c, accountEntitlements)
+}
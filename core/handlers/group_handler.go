@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"gorm.io/gorm"
+)
+
+type (
+	GroupHandler struct {
+		db      *gorm.DB
+		handler *Handler
+	}
+
+	GroupRequest struct {
+		Name                 string              `json:"name" binding:"required"`
+		Description          string              `json:"description"`
+		RestrictToMemberType models.ElementTypeT `json:"restrict_to_member_type"`
+	}
+
+	GroupMemberRequest struct {
+		MemberType models.ElementTypeT `json:"member_type" binding:"required"`
+		MemberID   uint                `json:"member_id" binding:"required"`
+	}
+)
+
+func NewGroupHandler(handler *Handler) *GroupHandler {
+	return &GroupHandler{handler: handler, db: handler.Db}
+}
+
+// authoriseAccount checks that the user can perform the action on the active account of the request
+func (h *GroupHandler) authoriseAccount(c *gin.Context, action models.ActionT) (ok bool) {
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	if err = h.handler.AuthoriseAccount(c, account, action); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage groups of the account"})
+		return
+	}
+	ok = true
+	return
+}
+
+func (h *GroupHandler) getGroup(c *gin.Context) (group *models.Group, ok bool) {
+	group = &models.Group{}
+	if err := h.handler.AccountScopedDB(c).Where("id = ?", c.Param(DefaultUrlKeyName)).First(group).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+	ok = true
+	return
+}
+
+// ListGroups lists the groups of the account
+func (h *GroupHandler) ListGroups(c *gin.Context) {
+	ok := h.authoriseAccount(c, models.ReadAction)
+	if !ok {
+		return
+	}
+	groups := []models.Group{}
+	if err := h.handler.AccountScopedDB(c).Find(&groups).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list groups")
+		return
+	}
+	h.handler.WriteSuccess(c, groups)
+}
+
+// CreateGroup creates a group in the account
+func (h *GroupHandler) CreateGroup(c *gin.Context) {
+	var req GroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !isValidRestriction(req.RestrictToMemberType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member type restriction"})
+		return
+	}
+	ok := h.authoriseAccount(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+
+	group := &models.Group{
+		Name:                 req.Name,
+		Description:          req.Description,
+		RestrictToMemberType: req.RestrictToMemberType,
+	}
+	if err := h.handler.CreateInAccount(c, group); err != nil {
+		h.handler.WriteError(c, err, "Failed to create group")
+		return
+	}
+	h.handler.WriteSuccess(c, group)
+}
+
+// GetGroup returns a group of the account
+func (h *GroupHandler) GetGroup(c *gin.Context) {
+	ok := h.authoriseAccount(c, models.ReadAction)
+	if !ok {
+		return
+	}
+	group, ok := h.getGroup(c)
+	if !ok {
+		return
+	}
+	h.handler.WriteSuccess(c, group)
+}
+
+// UpdateGroup updates a group of the account
+func (h *GroupHandler) UpdateGroup(c *gin.Context) {
+	var req GroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !isValidRestriction(req.RestrictToMemberType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member type restriction"})
+		return
+	}
+	ok := h.authoriseAccount(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	group, ok := h.getGroup(c)
+	if !ok {
+		return
+	}
+
+	group.Name = req.Name
+	group.Description = req.Description
+	group.RestrictToMemberType = req.RestrictToMemberType
+	if err := h.db.Model(group).Select("name", "description", "restrict_to_member_type").Updates(group).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to update group")
+		return
+	}
+	h.handler.WriteSuccess(c, group)
+}
+
+// DeleteGroup deletes a group of the account along with its memberships and rules
+func (h *GroupHandler) DeleteGroup(c *gin.Context) {
+	ok := h.authoriseAccount(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	group, ok := h.getGroup(c)
+	if !ok {
+		return
+	}
+	if err := group.DeleteWithMembers(h.db); err != nil {
+		h.handler.WriteError(c, err, "Failed to delete group")
+		return
+	}
+	h.handler.authorisation.InvalidateCache()
+	h.handler.WriteSuccess(c, gin.H{"message": "Group deleted successfully"})
+}
+
+// ListGroupMembers lists the direct members of a group
+func (h *GroupHandler) ListGroupMembers(c *gin.Context) {
+	ok := h.authoriseAccount(c, models.ReadAction)
+	if !ok {
+		return
+	}
+	group, ok := h.getGroup(c)
+	if !ok {
+		return
+	}
+	members := []models.GroupMember{}
+	if err := h.db.Where("group_id = ?", group.ID).Find(&members).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list group members")
+		return
+	}
+	h.handler.WriteSuccess(c, members)
+}
+
+// AddGroupMember adds an user, a resource or another group of the account to the group
+func (h *GroupHandler) AddGroupMember(c *gin.Context) {
+	var (
+		req   GroupMemberRequest
+		count int64
+	)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	ok := h.authoriseAccount(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	group, ok := h.getGroup(c)
+	if !ok {
+		return
+	}
+
+	member := &models.GroupMember{
+		GroupID:    group.ID,
+		MemberType: req.MemberType,
+		MemberID:   req.MemberID,
+	}
+
+	if !h.memberExists(c, member) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Member not found"})
+		return
+	}
+	if err := group.ValidateMember(h.db, member); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND member_type = ? AND member_id = ?", group.ID, member.MemberType, member.MemberID).
+		Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Member already exists in the group"})
+		return
+	}
+
+	if err := h.handler.CreateInAccount(c, member); err != nil {
+		h.handler.WriteError(c, err, "Failed to add group member")
+		return
+	}
+	h.handler.WriteSuccess(c, member)
+}
+
+// RemoveGroupMember removes a member from the group
+func (h *GroupHandler) RemoveGroupMember(c *gin.Context) {
+	ok := h.authoriseAccount(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	group, ok := h.getGroup(c)
+	if !ok {
+		return
+	}
+	member := &models.GroupMember{}
+	if err := h.db.Where("group_id = ? AND id = ?", group.ID, c.Param("member_id")).First(member).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group member not found"})
+		return
+	}
+	if err := h.db.Delete(member).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to remove group member")
+		return
+	}
+	h.handler.WriteSuccess(c, gin.H{"message": "Group member removed successfully"})
+}
+
+// memberExists checks that the member refers to an existing element.
+// Nested groups have to belong to the same account and resources are
+// resolved through the model registry.
+func (h *GroupHandler) memberExists(c *gin.Context, member *models.GroupMember) bool {
+	var count int64
+	switch member.GetElementType() {
+	case models.GroupMemberType:
+		h.handler.AccountScopedDB(c).Model(&models.Group{}).Where("id = ?", member.MemberID).Count(&count)
+	case models.UserElementType:
+		h.db.Model(&models.User{}).Where("id = ?", member.MemberID).Count(&count)
+	default:
+		// Only resources which the user can update can be grouped
+		_, err := h.handler.FindResourceWithAction(c, string(member.MemberType), member.MemberID, models.UpdateAction)
+		return err == nil
+	}
+	return count > 0
+}
+
+func isValidRestriction(memberType models.ElementTypeT) bool {
+	switch memberType {
+	case "", models.UserElementType, models.ResourceElementType:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+// testModelRegistry resolves models by name for the handler tests
+type testModelRegistry map[string]func() models.UserOwnedModel
+
+func (r testModelRegistry) NewModelByType(modelName string) (models.UserOwnedModel, error) {
+	newModel, ok := r[modelName]
+	if !ok {
+		return nil, fmt.Errorf("no model found by the name %s", modelName)
+	}
+	return newModel(), nil
+}
+
+func setupGroupTestHandler(t *testing.T) *Handler {
+	handler, _ := setupTestHandler(t)
+	handler.SetModelRegistry(testModelRegistry{
+		"Account": func() models.UserOwnedModel { return &models.Account{} },
+		"Profile": func() models.UserOwnedModel { return &models.Profile{} },
+	})
+	return handler
+}
+
+func parseDataID(t *testing.T, w *httptest.ResponseRecorder) uint {
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	data := response["data"].(map[string]interface{})
+	return uint(data["id"].(float64))
+}
+
+func createTestGroup(t *testing.T, handler *Handler, token, name string, restrictTo models.ElementTypeT) uint {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/groups", map[string]interface{}{
+		"name":                    name,
+		"restrict_to_member_type": restrictTo,
+	}, token)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	return parseDataID(t, w)
+}
+
+func TestGroupHandler(t *testing.T) {
+	handler := setupGroupTestHandler(t)
+	db := handler.Db
+
+	user, token := createTestUser(t, db, "groups@example.com")
+	member, _ := createTestUser(t, db, "groupmember@example.com")
+	_, otherToken := createTestUser(t, db, "othergroups@example.com")
+
+	var account models.Account
+	require.NoError(t, db.Where("user_id = ?", user.ID).First(&account).Error)
+
+	t.Run("CRUD", func(t *testing.T) {
+		groupID := createTestGroup(t, handler, token, "finance", "")
+
+		var group models.Group
+		require.NoError(t, db.First(&group, groupID).Error)
+		assert.Equal(t, user.ID, group.UserID)
+		assert.Equal(t, models.AccountScopeType, group.OwnerType)
+		assert.Equal(t, account.ID, group.OwnerID)
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/groups", nil, token)
+		assert.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response["data"], 1)
+
+		w = makeAuthenticatedRequest(t, handler, "PUT", fmt.Sprintf("/groups/%d", groupID), map[string]interface{}{
+			"name":        "finance_team",
+			"description": "The finance team",
+		}, token)
+		assert.Equal(t, 200, w.Code)
+		require.NoError(t, db.First(&group, groupID).Error)
+		assert.Equal(t, "finance_team", group.Name)
+		assert.Equal(t, "The finance team", group.Description)
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/groups/%d", groupID), nil, token)
+		assert.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "GET", fmt.Sprintf("/groups/%d", groupID), nil, token)
+		assertErrorResponse(t, w, 404, "Group not found")
+	})
+
+	t.Run("Groups are scoped to the account", func(t *testing.T) {
+		groupID := createTestGroup(t, handler, token, "private", "")
+
+		w := makeAuthenticatedRequest(t, handler, "GET", fmt.Sprintf("/groups/%d", groupID), nil, otherToken)
+		assertErrorResponse(t, w, 404, "Group not found")
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/groups/%d", groupID), nil, otherToken)
+		assertErrorResponse(t, w, 404, "Group not found")
+	})
+
+	t.Run("Invalid restriction", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/groups", map[string]interface{}{
+			"name":                    "invalid",
+			"restrict_to_member_type": "unknown",
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid member type restriction")
+	})
+
+	t.Run("Members", func(t *testing.T) {
+		groupID := createTestGroup(t, handler, token, "members", "")
+		membersPath := fmt.Sprintf("/groups/%d/members", groupID)
+
+		w := makeAuthenticatedRequest(t, handler, "POST", membersPath, map[string]interface{}{
+			"member_type": "User",
+			"member_id":   member.ID,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		userMemberID := parseDataID(t, w)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", membersPath, map[string]interface{}{
+			"member_type": "User",
+			"member_id":   member.ID,
+		}, token)
+		assertErrorResponse(t, w, 409, "Member already exists")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", membersPath, map[string]interface{}{
+			"member_type": "Account",
+			"member_id":   account.ID,
+		}, token)
+		assert.Equal(t, 200, w.Code, w.Body.String())
+
+		w = makeAuthenticatedRequest(t, handler, "POST", membersPath, map[string]interface{}{
+			"member_type": "User",
+			"member_id":   99999,
+		}, token)
+		assertErrorResponse(t, w, 400, "Member not found")
+
+		w = makeAuthenticatedRequest(t, handler, "GET", membersPath, nil, token)
+		assert.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response["data"], 2)
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("%s/%d", membersPath, userMemberID), nil, token)
+		assert.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("%s/%d", membersPath, userMemberID), nil, token)
+		assertErrorResponse(t, w, 404, "Group member not found")
+	})
+
+	t.Run("Resources of other users can't be added", func(t *testing.T) {
+		groupID := createTestGroup(t, handler, token, "foreign", "")
+
+		var otherAccount models.Account
+		require.NoError(t, db.Where("user_id = ?", member.ID).First(&otherAccount).Error)
+
+		w := makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", groupID), map[string]interface{}{
+			"member_type": "Account",
+			"member_id":   otherAccount.ID,
+		}, token)
+		assertErrorResponse(t, w, 400, "Member not found")
+	})
+
+	t.Run("RestrictToMemberType", func(t *testing.T) {
+		groupID := createTestGroup(t, handler, token, "users_only", models.UserElementType)
+		resourceGroupID := createTestGroup(t, handler, token, "resources_only", models.ResourceElementType)
+
+		w := makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", groupID), map[string]interface{}{
+			"member_type": "Account",
+			"member_id":   account.ID,
+		}, token)
+		assertErrorResponse(t, w, 400, "only allows members of type user_element")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", groupID), map[string]interface{}{
+			"member_type": "Group",
+			"member_id":   resourceGroupID,
+		}, token)
+		assertErrorResponse(t, w, 400, "only allows members of type user_element")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", groupID), map[string]interface{}{
+			"member_type": "User",
+			"member_id":   member.ID,
+		}, token)
+		assert.Equal(t, 200, w.Code, w.Body.String())
+	})
+
+	t.Run("Cycle detection", func(t *testing.T) {
+		parentID := createTestGroup(t, handler, token, "parent", "")
+		childID := createTestGroup(t, handler, token, "child", "")
+		grandChildID := createTestGroup(t, handler, token, "grandchild", "")
+
+		w := makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", parentID), map[string]interface{}{
+			"member_type": "Group",
+			"member_id":   childID,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		w = makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", childID), map[string]interface{}{
+			"member_type": "Group",
+			"member_id":   grandChildID,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		w = makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", grandChildID), map[string]interface{}{
+			"member_type": "Group",
+			"member_id":   parentID,
+		}, token)
+		assertErrorResponse(t, w, 400, "can't be nested inside its own descendant")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", parentID), map[string]interface{}{
+			"member_type": "Group",
+			"member_id":   parentID,
+		}, token)
+		assertErrorResponse(t, w, 400, "can't be nested inside its own descendant")
+	})
+
+	t.Run("Deleting a group removes its memberships", func(t *testing.T) {
+		parentID := createTestGroup(t, handler, token, "outer", "")
+		childID := createTestGroup(t, handler, token, "inner", "")
+		w := makeAuthenticatedRequest(t, handler, "POST", fmt.Sprintf("/groups/%d/members", parentID), map[string]interface{}{
+			"member_type": "Group",
+			"member_id":   childID,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/groups/%d", childID), nil, token)
+		assert.Equal(t, 200, w.Code)
+
+		var count int64
+		db.Model(&models.GroupMember{}).Where("member_type = ? AND member_id = ?", models.GroupMemberType, childID).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+}
@@ -1,20 +1,33 @@
 package handlers
 
 import (
-	"fmt"
+	"errors"
 	"log"
+	"net"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gsarmaonline/goiter/config"
 	"github.com/gsarmaonline/goiter/core/helpers/authorisation"
 	"github.com/gsarmaonline/goiter/core/middleware"
 	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/entitlements"
+	"github.com/gsarmaonline/goiter/core/services/mailer"
+	"github.com/gsarmaonline/goiter/core/services/oauth"
+	"github.com/gsarmaonline/goiter/core/services/outbox"
+	"github.com/gsarmaonline/goiter/core/services/payments"
+	"github.com/gsarmaonline/goiter/core/services/signing"
+	"github.com/gsarmaonline/goiter/core/services/sms"
+	"github.com/gsarmaonline/goiter/core/services/usage"
 	"gorm.io/gorm"
 )
 
 const (
 	DefaultUrlKeyName = "id"
 
+	// ResourceKey is the context key under which Require stores the resource of the route
+	ResourceKey = "resource"
+
 	// For FindWithUser query types
 	NilQuery = ""
 )
@@ -26,27 +39,58 @@ type (
 		middleware    *middleware.Middleware
 		cfg           *config.Config
 		authorisation *authorisation.Authorisation
+		modelRegistry ModelRegistry
+		mailer        mailer.Mailer
+		smsSender     sms.Sender
+		// keys sign the tokens issued by the handlers and verify the ones of the requests
+		keys *signing.KeyManager
+		// entitlements enforce the limits of the plans of the accounts
+		entitlements *entitlements.Service
+		// usage meters the usage of the metered features and reports it to the payment gateway
+		usage *usage.Meter
+		// outbox performs the billing side effects of the models once their transaction committed
+		outbox *outbox.Processor
+		// oauthProviders are the providers registered with SetOAuthProvider
+		oauthProviders map[string]oauth.Provider
+		// lookupTXT resolves the DNS TXT records proving the accounts own their SAML domains
+		lookupTXT func(name string) ([]string, error)
 
 		OpenRouteGroup      *gin.RouterGroup
 		ProtectedRouteGroup *gin.RouterGroup
 	}
+
+	// ModelRegistry resolves the registered models by their name
+	ModelRegistry interface {
+		NewModelByType(modelName string) (models.UserOwnedModel, error)
+	}
 )
 
 func NewHandler(router *gin.Engine, db *gorm.DB, cfg *config.Config) (handler *Handler) {
-	middleware := middleware.NewMiddleware(router, db)
+	keys := signing.NewKeyManager(cfg.GetKey)
+	middleware := middleware.NewMiddleware(router, db, keys)
 	handler = &Handler{
 		router:     router,
 		Db:         db,
 		middleware: middleware,
 		cfg:        cfg,
+		mailer:     mailer.NewSendgridMailer(),
+		smsSender:  sms.NewTwilioSender(),
+		keys:       keys,
+
+		entitlements:   entitlements.NewService(db),
+		usage:          usage.NewMeter(db, models.GetPaymentGateway()),
+		outbox:         outbox.NewProcessor(db),
+		oauthProviders: map[string]oauth.Provider{},
+		lookupTXT:      net.LookupTXT,
 
 		OpenRouteGroup:      router.Group("/"),
 		ProtectedRouteGroup: router.Group(""),
 	}
+	handler.RegisterLimit(models.ProjectsFeature, &models.Project{})
 	// Setup routes
 	handler.SetupRoutes()
 	// Setup authorisation
-	handler.authorisation = authorisation.NewAuthorisation(handler)
+	handler.authorisation = authorisation.NewAuthorisation(handler, db)
 	return
 }
 
@@ -55,8 +99,69 @@ func (h *Handler) SetAuthorisationState(status bool) {
 	return
 }
 
+// SetAuthorisationCache caches the authorisation decisions and group ancestries in the backend
+func (h *Handler) SetAuthorisationCache(backend authorisation.CacheBackend) {
+	h.authorisation.SetCache(authorisation.NewDecisionCache(backend))
+	return
+}
+
+// SetMailer replaces the mailer which delivers the emails sent by the handlers
+func (h *Handler) SetMailer(m mailer.Mailer) {
+	h.mailer = m
+	return
+}
+
+// SetSmsSender replaces the sender which delivers the SMS sent by the handlers
+func (h *Handler) SetSmsSender(sender sms.Sender) {
+	h.smsSender = sender
+	return
+}
+
+// SetTXTResolver replaces the DNS lookup of the TXT records verifying the SAML domains
+func (h *Handler) SetTXTResolver(lookupTXT func(name string) ([]string, error)) {
+	h.lookupTXT = lookupTXT
+	return
+}
+
+// SetPaymentGateway replaces the gateway the plans and the accounts are billed with,
+// like the payments.FakeGateway in the tests
+func (h *Handler) SetPaymentGateway(gateway payments.PaymentGateway) {
+	models.SetPaymentGateway(gateway)
+	h.usage.SetReporter(gateway)
+	return
+}
+
+// BillingOutbox returns the processor performing the billing side effects recorded in the
+// outbox, which has to be run for the plans and the subscriptions to reach the payment gateway
+//
+//	go h.BillingOutbox().Run(outbox.DefaultPollInterval)
+func (h *Handler) BillingOutbox() *outbox.Processor {
+	return h.outbox
+}
+
+// LoadSigningKeys loads the keys signing and verifying the tokens from the config
+func (h *Handler) LoadSigningKeys() (err error) {
+	_, err = h.keys.KeySet()
+	return
+}
+
+// GetAuthorisationCacheStats returns the hit and miss counters of the authorisation cache
+func (h *Handler) GetAuthorisationCacheStats(c *gin.Context) {
+	stats := authorisation.CacheStats{}
+	if cache := h.authorisation.GetCache(); cache != nil {
+		stats = cache.Stats()
+	}
+	h.WriteSuccess(c, stats)
+}
+
+func (h *Handler) SetModelRegistry(modelRegistry ModelRegistry) {
+	h.modelRegistry = modelRegistry
+	return
+}
+
 func (h *Handler) SetupRoutes() {
 	h.router.GET("/ping", h.handlePing)
+	h.router.GET("/.well-known/jwks.json", h.handleJWKS)
 	h.setupAuthRoutes()
 }
 
@@ -65,36 +170,152 @@ func (h *Handler) setupAuthRoutes() {
 	{
 		// Public routes (no auth required)
 		authOpenRoutes.POST("/shortcircuitlogin", h.handleShortCircuitLogin)
-		authOpenRoutes.GET("/google", h.handleGoogleLogin)
-		authOpenRoutes.GET("/google/callback", h.handleGoogleCallback)
+		authOpenRoutes.POST("/magic-link", h.handleRequestMagicLink)
+		authOpenRoutes.POST("/magic-link/verify", h.handleMagicLinkLogin)
+		authOpenRoutes.POST("/sms-otp", h.handleRequestSMSCode)
+		authOpenRoutes.POST("/sms-otp/verify", h.handleSMSLogin)
+		authOpenRoutes.POST("/refresh", h.handleRefresh)
+		authOpenRoutes.POST("/register", h.handleRegister)
+		authOpenRoutes.POST("/login", h.handleLogin)
+		authOpenRoutes.POST("/verify-email", h.handleVerifyEmail)
+		authOpenRoutes.POST("/resend-verification", h.handleResendVerification)
+		authOpenRoutes.POST("/forgot-password", h.handleForgotPassword)
+		authOpenRoutes.POST("/reset-password", h.handleResetPassword)
+		authOpenRoutes.POST("/exchange", h.handleExchange)
+		authOpenRoutes.POST("/2fa/verify", h.handleVerifyMFA)
+		authOpenRoutes.POST("/saml/discover", h.handleSAMLDiscover)
+		authOpenRoutes.GET("/saml/:account_id/metadata", h.handleSAMLMetadata)
+		authOpenRoutes.GET("/saml/:account_id/login", h.handleSAMLLogin)
+		authOpenRoutes.POST("/saml/:account_id/acs", h.handleSAMLACS)
+		authOpenRoutes.GET("/:provider", h.handleOAuthLogin)
+		authOpenRoutes.GET("/:provider/callback", h.handleOAuthCallback)
+	}
+
+	// Two factor authentication of the signed in user, which the accounts
+	// requiring it have to let their members enable
+	mfaRoutes := h.router.Group("/auth/2fa")
+	mfaRoutes.Use(h.middleware.AuthenticationMiddleware())
+	mfaRoutes.Use(h.middleware.BlockImpersonation())
+	{
+		mfaRoutes.POST("/enroll", h.handleEnrollTOTP)
+		mfaRoutes.POST("/enable", h.handleEnableTOTP)
+		mfaRoutes.POST("/disable", h.handleDisableTOTP)
+		mfaRoutes.POST("/recovery-codes", h.handleRegenerateRecoveryCodes)
+	}
+
+	// Superuser routes, which aren't scoped to an account
+	adminHandler := NewAdminHandler(h)
+	adminRoutes := h.router.Group("/admin")
+	adminRoutes.Use(h.middleware.AuthenticationMiddleware())
+	adminRoutes.Use(h.middleware.SuperuserMiddleware())
+	{
+		adminRoutes.POST("/impersonate", adminHandler.Impersonate)
+		adminRoutes.GET("/impersonation_logs", adminHandler.ListImpersonationLogs)
 	}
 
 	// Protected routes (auth required)
 	h.ProtectedRouteGroup.Use(h.middleware.AuthenticationMiddleware())
+	h.ProtectedRouteGroup.Use(h.middleware.AccountMiddleware())
 	h.ProtectedRouteGroup.Use(h.middleware.AuthorisationMiddleware())
+	h.ProtectedRouteGroup.Use(h.middleware.ProjectMiddleware())
+	h.ProtectedRouteGroup.Use(h.meterAPICalls())
 	{
 		h.ProtectedRouteGroup.GET("/me", h.handleGetUser)
 		h.ProtectedRouteGroup.POST("/logout", h.handleLogout)
+		h.ProtectedRouteGroup.GET("/sessions", h.handleListSessions)
+		h.ProtectedRouteGroup.DELETE("/sessions", h.middleware.BlockImpersonation(), h.handleRevokeOtherSessions)
+		h.ProtectedRouteGroup.DELETE("/sessions/:id", h.middleware.BlockImpersonation(), h.handleRevokeSession)
 		h.ProtectedRouteGroup.GET("/profile", h.handleGetProfile)
 		h.ProtectedRouteGroup.PUT("/profile", h.handleUpdateProfile)
+		h.ProtectedRouteGroup.POST("/profile/phone", h.middleware.BlockImpersonation(), h.handleRequestPhoneVerification)
+		h.ProtectedRouteGroup.POST("/profile/phone/verify", h.middleware.BlockImpersonation(), h.handleVerifyPhone)
 
 		// Initialize handlers
 		accountHandler := NewAccountHandler(h)
 		billingHandler := NewBillingHandler(h)
+		groupHandler := NewGroupHandler(h)
+		roleAccessHandler := NewRoleAccessHandler(h)
+		projectHandler := NewProjectHandler(h)
+		accountMembershipHandler := NewAccountMembershipHandler(h)
+		samlHandler := NewSAMLHandler(h)
+		apiKeyHandler := NewAPIKeyHandler(h)
 
 		// Account routes
+		// The settings and the members of the account are only changed by the users themselves,
+		// so that an impersonator can't keep access past the impersonation
 		accountRoutes := h.ProtectedRouteGroup.Group("/account")
 		{
 			accountRoutes.GET("", accountHandler.GetAccount)
-			accountRoutes.PUT("", accountHandler.UpdateAccount)
+			accountRoutes.PUT("", h.middleware.BlockImpersonation(), accountHandler.UpdateAccount)
+			accountRoutes.GET("/entitlements", accountHandler.GetEntitlements)
+			accountRoutes.GET("/members", accountMembershipHandler.ListMembers)
+			accountRoutes.DELETE("/members/:id", h.middleware.BlockImpersonation(), accountMembershipHandler.RemoveMember)
+			accountRoutes.GET("/invitations", accountMembershipHandler.ListInvitations)
+			accountRoutes.POST("/invitations", h.middleware.BlockImpersonation(), accountMembershipHandler.CreateInvitation)
+			accountRoutes.DELETE("/invitations/:id", h.middleware.BlockImpersonation(), accountMembershipHandler.RevokeInvitation)
+			accountRoutes.GET("/saml", samlHandler.GetSAMLConfig)
+			accountRoutes.PUT("/saml", h.middleware.BlockImpersonation(), samlHandler.UpdateSAMLConfig)
+			accountRoutes.DELETE("/saml", h.middleware.BlockImpersonation(), samlHandler.DeleteSAMLConfig)
+			accountRoutes.POST("/saml/verify_domains", h.middleware.BlockImpersonation(), samlHandler.VerifySAMLDomains)
 		}
+		h.ProtectedRouteGroup.GET("/accounts", accountMembershipHandler.ListAccounts)
+		h.ProtectedRouteGroup.POST("/accounts/switch", accountMembershipHandler.SwitchAccount)
+		h.ProtectedRouteGroup.POST("/invitations/accept", h.middleware.BlockImpersonation(), accountMembershipHandler.AcceptInvitation)
 
 		// Billing routes
 		billingRoutes := h.ProtectedRouteGroup.Group("/billing")
 		{
-			billingRoutes.POST("/subscriptions", billingHandler.CreateSubscription)
-			billingRoutes.DELETE("/subscriptions", billingHandler.CancelSubscription)
+			// Billing changes are only made by the users themselves, not while impersonating them
+			billingRoutes.POST("/subscriptions", h.middleware.BlockImpersonation(), billingHandler.CreateSubscription)
+			billingRoutes.PUT("/subscriptions", h.middleware.BlockImpersonation(), billingHandler.ChangeSubscription)
+			billingRoutes.DELETE("/subscriptions", h.middleware.BlockImpersonation(), billingHandler.CancelSubscription)
+			billingRoutes.POST("/subscriptions/preview", billingHandler.PreviewSubscriptionChange)
 			billingRoutes.GET("/subscriptions", billingHandler.GetSubscriptionStatus)
+			billingRoutes.GET("/usage", billingHandler.GetUsage)
+		}
+
+		// Group routes
+		groupRoutes := h.ProtectedRouteGroup.Group("/groups")
+		{
+			groupRoutes.GET("", groupHandler.ListGroups)
+			groupRoutes.POST("", groupHandler.CreateGroup)
+			groupRoutes.GET("/:id", groupHandler.GetGroup)
+			groupRoutes.PUT("/:id", groupHandler.UpdateGroup)
+			groupRoutes.DELETE("/:id", groupHandler.DeleteGroup)
+			groupRoutes.GET("/:id/members", groupHandler.ListGroupMembers)
+			groupRoutes.POST("/:id/members", groupHandler.AddGroupMember)
+			groupRoutes.DELETE("/:id/members/:member_id", groupHandler.RemoveGroupMember)
+		}
+
+		// Role access routes
+		roleAccessRoutes := h.ProtectedRouteGroup.Group("/role_accesses")
+		{
+			roleAccessRoutes.GET("", roleAccessHandler.ListRoleAccesses)
+			roleAccessRoutes.POST("", h.middleware.BlockImpersonation(), roleAccessHandler.GrantRoleAccess)
+			roleAccessRoutes.GET("/explain", roleAccessHandler.ExplainRoleAccess)
+			roleAccessRoutes.GET("/cache_stats", h.GetAuthorisationCacheStats)
+			roleAccessRoutes.DELETE("/:id", h.middleware.BlockImpersonation(), roleAccessHandler.RevokeRoleAccess)
+		}
+
+		// Project routes
+		projectRoutes := h.ProtectedRouteGroup.Group("/projects")
+		{
+			projectRoutes.GET("", projectHandler.ListProjects)
+			projectRoutes.POST("", projectHandler.CreateProject)
+			projectRoutes.GET("/:id", projectHandler.GetProject)
+			projectRoutes.PUT("/:id", projectHandler.UpdateProject)
+			projectRoutes.DELETE("/:id", projectHandler.DeleteProject)
+			projectRoutes.GET("/:id/members", projectHandler.ListProjectMembers)
+			projectRoutes.POST("/:id/members", projectHandler.AddProjectMember)
+			projectRoutes.DELETE("/:id/members/:member_id", projectHandler.RemoveProjectMember)
+		}
+
+		// API key routes
+		apiKeyRoutes := h.ProtectedRouteGroup.Group("/api_keys")
+		{
+			apiKeyRoutes.GET("", apiKeyHandler.ListAPIKeys)
+			apiKeyRoutes.POST("", h.middleware.BlockImpersonation(), apiKeyHandler.CreateAPIKey)
+			apiKeyRoutes.DELETE("/:id", h.middleware.BlockImpersonation(), apiKeyHandler.RevokeAPIKey)
 		}
 
 		h.OpenRouteGroup.GET("/plans", h.GetPlans)
@@ -132,11 +353,51 @@ func (handler *Handler) GetUserFromContext(c *gin.Context) (user *models.User) {
 	return
 }
 
+// GetAccountFromContext returns the active account of the request resolved by the
+// AccountMiddleware, falling back to the current account of the user
+func (h *Handler) GetAccountFromContext(c *gin.Context) (account *models.Account, err error) {
+	if cObj, exists := c.Get(middleware.AccountKey); exists {
+		account = cObj.(*models.Account)
+		return
+	}
+	account, err = h.GetUserFromContext(c).GetCurrentAccount(h.Db)
+	return
+}
+
+// GetAccountRoleFromContext returns the account the user is acting on along with the role of the user in it
+func (h *Handler) GetAccountRoleFromContext(c *gin.Context) (account *models.Account, role models.AccountRoleT, err error) {
+	if account, err = h.GetAccountFromContext(c); err != nil {
+		return
+	}
+	role, err = account.GetRole(h.Db, h.GetUserFromContext(c).ID)
+	return
+}
+
+// UserScopedDB scopes the query to the resources the user can read, either
+// owned by the user or shared with them
 func (h *Handler) UserScopedDB(c *gin.Context) (db *gorm.DB) {
 	db = h.authorisation.UserScopedDB(c, h.Db)
 	return
 }
 
+// AccountScopedDB scopes the query to the resources of the active account of the request
+func (h *Handler) AccountScopedDB(c *gin.Context) (db *gorm.DB) {
+	account, err := h.GetAccountFromContext(c)
+	if err != nil {
+		db = h.Db.Session(&gorm.Session{})
+		db.AddError(err)
+		return
+	}
+	db = h.Db.Where("owner_type = ? AND owner_id = ?", models.AccountScopeType, account.ID)
+	return
+}
+
+// OwnerScopedDB scopes the query to the resources owned by the user
+func (h *Handler) OwnerScopedDB(c *gin.Context) (db *gorm.DB) {
+	db = h.Db.Where("user_id = ?", h.GetUserFromContext(c).ID)
+	return
+}
+
 func (h *Handler) FirstWithUser(c *gin.Context, userOwnedModel models.UserOwnedModel) (err error) {
 	if err = h.UserScopedDB(c).First(userOwnedModel).Error; err != nil {
 		return
@@ -144,36 +405,204 @@ func (h *Handler) FirstWithUser(c *gin.Context, userOwnedModel models.UserOwnedM
 	return
 }
 
-func (h *Handler) FindWithUser(c *gin.Context) (userOwnedModels []models.UserOwnedModel, err error) {
-	if err = h.UserScopedDB(c).Find(&userOwnedModels).Error; err != nil {
+// FindWithUser loads the resources the user can read into dest, which
+// has to be a pointer to a slice of a registered model
+func (h *Handler) FindWithUser(c *gin.Context, dest interface{}) (err error) {
+	if err = h.UserScopedDB(c).Find(dest).Error; err != nil {
 		return
 	}
 	return
 }
 
+// GetSessionFromContext returns the session of the token the request is authenticated with, if any
+func (h *Handler) GetSessionFromContext(c *gin.Context) (session *models.Session) {
+	if cObj, exists := c.Get(middleware.SessionKey); exists {
+		session = cObj.(*models.Session)
+	}
+	return
+}
+
+// GetImpersonatorFromContext returns the superuser impersonating the user of the request,
+// if any. GetUserFromContext returns the impersonated user.
+func (h *Handler) GetImpersonatorFromContext(c *gin.Context) (impersonator *models.User) {
+	impersonator = middleware.GetImpersonator(c)
+	return
+}
+
+// rejectAPIKey rejects the requests authenticated with an API key from
+// the routes which only a signed in user can use
+func (h *Handler) rejectAPIKey(c *gin.Context, message string) (ok bool) {
+	if middleware.GetAPIKey(c) != nil {
+		c.JSON(403, gin.H{"error": message})
+		return
+	}
+	ok = true
+	return
+}
+
+// GetProjectFromContext returns the current project of the request, if any
+func (h *Handler) GetProjectFromContext(c *gin.Context) (project *models.Project) {
+	if cObj, exists := c.Get(middleware.ProjectKey); exists {
+		project = cObj.(*models.Project)
+	}
+	return
+}
+
+// CreateWithUser creates the model owned by the user. Models registered with
+// ProjectScopeType are created inside the current project of the request.
 func (h *Handler) CreateWithUser(c *gin.Context, model models.UserOwnedModel) (err error) {
 	h.authorisation.UpdateWithUser(c, model)
+	if project := h.GetProjectFromContext(c); project != nil && model.GetConfig().ScopeType == models.ProjectScopeType {
+		if scopedModel, ok := model.(models.ScopedModel); ok && scopedModel.GetOwnerID() == 0 {
+			scopedModel.SetOwner(models.ProjectScopeType, project.ID)
+		}
+	}
 	if err = h.Db.Create(model).Error; err != nil {
 		return
 	}
 	return
 }
 
-func (h *Handler) UpdateWithUser(c *gin.Context, model models.UserOwnedModel, toUpdateWith interface{}) (err error) {
+// CreateInAccount creates the model inside the active account of the request.
+// The user who creates it is recorded as its creator.
+func (h *Handler) CreateInAccount(c *gin.Context, model models.UserOwnedModel) (err error) {
+	var account *models.Account
+	scopedModel, ok := model.(models.ScopedModel)
+	if !ok {
+		err = errors.New("model can't be owned by an account")
+		return
+	}
+	if account, err = h.GetAccountFromContext(c); err != nil {
+		return
+	}
 	h.authorisation.UpdateWithUser(c, model)
+	scopedModel.SetOwner(models.AccountScopeType, account.ID)
+	err = h.Db.Create(model).Error
+	return
+}
+
+func (h *Handler) UpdateWithUser(c *gin.Context, model models.UserOwnedModel, toUpdateWith interface{}) (err error) {
+	// The owner of the model doesn't change when it's updated by another user
+	if model.GetUserID() == 0 {
+		h.authorisation.UpdateWithUser(c, model)
+	}
+	if err = h.Authorise(c, model, models.UpdateAction); err != nil {
+		return
+	}
 	err = h.Db.Model(model).Updates(toUpdateWith).Error
 	return
 }
 
 func (h *Handler) DeleteWithUser(c *gin.Context, model models.UserOwnedModel) (err error) {
-	if h.authorisation.CanAccessResource(c, model) == false {
-		err = fmt.Errorf("unauthorised to delete resource")
+	if err = h.Authorise(c, model, models.DeleteAction); err != nil {
 		return
 	}
 	err = h.Db.Delete(model).Error
 	return
 }
 
+// FindResource loads the registered model by its name and ID
+func (h *Handler) FindResource(modelName string, id uint) (model models.UserOwnedModel, err error) {
+	if h.modelRegistry == nil {
+		err = errors.New("model registry is not configured")
+		return
+	}
+	if model, err = h.modelRegistry.NewModelByType(modelName); err != nil {
+		return
+	}
+	err = h.Db.Where("id = ?", id).First(model).Error
+	return
+}
+
+// FindResourceWithAction loads the registered model by its name and ID and checks
+// that the user can perform the action on it
+func (h *Handler) FindResourceWithAction(c *gin.Context, modelName string, id uint, action models.ActionT) (model models.UserOwnedModel, err error) {
+	if model, err = h.FindResource(modelName, id); err != nil {
+		return
+	}
+	err = h.Authorise(c, model, action)
+	return
+}
+
+// Require returns a middleware which loads the registered model identified by the
+// DefaultUrlKeyName URL param and checks that the user can perform the action on it
+// before the handler runs. The resource is stored in the context, see GetResourceFromContext.
+//
+//	routes.PUT("/accounts/:id", h.Require(models.UpdateAction, "Account"), handler)
+func (h *Handler) Require(action models.ActionT, modelName string) gin.HandlerFunc {
+	return h.RequireParam(action, modelName, DefaultUrlKeyName)
+}
+
+// RequireParam is Require with the resource identified by the given URL param
+func (h *Handler) RequireParam(action models.ActionT, modelName string, urlKeyName string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param(urlKeyName), 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(404, gin.H{"error": modelName + " not found"})
+			return
+		}
+		model, err := h.FindResourceWithAction(c, modelName, uint(id), action)
+		if err != nil {
+			if errors.Is(err, authorisation.ErrForbidden) {
+				c.AbortWithStatusJSON(403, gin.H{"error": "Not allowed to " + string(action) + " " + modelName})
+				return
+			}
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.AbortWithStatusJSON(404, gin.H{"error": modelName + " not found"})
+				return
+			}
+			log.Println(err, "Failed to load the required resource")
+			c.AbortWithStatusJSON(500, gin.H{"error": "Failed to load " + modelName})
+			return
+		}
+		c.Set(authorisation.ActionKey, action)
+		c.Set(ResourceKey, model)
+		c.Next()
+	}
+}
+
+// GetResourceFromContext returns the resource loaded by Require
+func (h *Handler) GetResourceFromContext(c *gin.Context) (model models.UserOwnedModel) {
+	if resource, exists := c.Get(ResourceKey); exists {
+		model = resource.(models.UserOwnedModel)
+	}
+	return
+}
+
+// Authorise checks if the user can perform the action on the model.
+// It returns authorisation.ErrForbidden if the user isn't allowed to, or if
+// the request is authenticated with an API key which lacks the action.
+func (h *Handler) Authorise(c *gin.Context, model models.UserOwnedModel, action models.ActionT) (err error) {
+	if apiKey := middleware.GetAPIKey(c); apiKey != nil && !apiKey.Allows(action) {
+		err = authorisation.ErrForbidden
+		return
+	}
+	err = h.authorisation.Authorise(c, model, action)
+	return
+}
+
+// AuthoriseAccount checks if the user can perform the action on the account. The members of the
+// account can read it and its owners and admins can manage it, other users need a RoleAccess rule.
+func (h *Handler) AuthoriseAccount(c *gin.Context, account *models.Account, action models.ActionT) (err error) {
+	if apiKey := middleware.GetAPIKey(c); apiKey != nil && !apiKey.Allows(action) {
+		err = authorisation.ErrForbidden
+		return
+	}
+	if role, roleErr := account.GetRole(h.Db, h.GetUserFromContext(c).ID); roleErr == nil {
+		if action == models.ReadAction || role.CanManageAccount() {
+			return
+		}
+	}
+	err = h.authorisation.Authorise(c, account, action)
+	return
+}
+
+// ExplainAccess returns which rule, if any, decides whether the user can perform the action on the model
+func (h *Handler) ExplainAccess(user *models.User, model models.UserOwnedModel, action models.ActionT) (decision *authorisation.Decision, err error) {
+	decision, err = h.authorisation.ExplainForUser(user, model, action)
+	return
+}
+
 func (h *Handler) WriteSuccess(c *gin.Context, data interface{}) {
 	h.WriteJSON(c, 200, data)
 	return
@@ -183,6 +612,12 @@ func (h *Handler) WriteError(c *gin.Context, err error, message string) {
 	if err != nil {
 		log.Println(err, message)
 	}
+	if errors.Is(err, authorisation.ErrForbidden) {
+		c.JSON(403, gin.H{
+			"error": message,
+		})
+		return
+	}
 	c.JSON(500, gin.H{
 		"error": message,
 	})
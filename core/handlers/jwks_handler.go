@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleJWKS publishes the public keys verifying the tokens, so that other services can
+// verify them without sharing a secret. The response isn't wrapped in data as the format
+// is set by RFC 7517. It's empty when the tokens are signed with JWT_SECRET.
+func (h *Handler) handleJWKS(c *gin.Context) {
+	keySet, err := h.keys.KeySet()
+	if err != nil {
+		log.Println("Failed to load the JWT keys", err)
+		c.JSON(500, gin.H{"error": "Failed to load the keys"})
+		return
+	}
+	// The verification keys are kept for longer than the cache so rotations are picked up
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, keySet.JWKS())
+}
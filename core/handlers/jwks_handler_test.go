@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/signing"
+)
+
+// rsaTestToken signs a token of the user with the RSA key and kid, the claims overriding the standard ones
+func rsaTestToken(t *testing.T, key *rsa.PrivateKey, kid string, user *models.User, claims jwt.MapClaims) string {
+	standard := jwt.MapClaims{
+		"sub": fmt.Sprint(user.ID),
+		"iss": signing.DefaultIssuer,
+		"aud": signing.DefaultIssuer,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"jti": fmt.Sprintf("rsa-%d", time.Now().UnixNano()),
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(standard, name)
+			continue
+		}
+		standard[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, standard)
+	token.Header["kid"] = kid
+	tokenString, err := token.SignedString(key)
+	require.NoError(t, err)
+	return tokenString
+}
+
+func TestJWKSHandler(t *testing.T) {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signingDER, err := x509.MarshalPKCS8PrivateKey(signingKey)
+	require.NoError(t, err)
+	// The previous signing key, whose tokens are still accepted
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	oldDER, err := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+	require.NoError(t, err)
+
+	t.Setenv("JWT_SIGNING_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: signingDER})))
+	t.Setenv("JWT_VERIFICATION_KEYS", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: oldDER})))
+
+	handler, db := setupTestHandler(t)
+	user, hmacToken := createTestUser(t, db, "jwks@example.com")
+
+	w := makeAuthenticatedRequest(t, handler, "GET", "/.well-known/jwks.json", nil, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var jwks signing.JWKS
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 2)
+	kids := map[string]string{}
+	for _, key := range jwks.Keys {
+		kids[key.Alg] = key.Kid
+		assert.Equal(t, "sig", key.Use)
+	}
+	require.NotEmpty(t, kids["EdDSA"])
+	require.NotEmpty(t, kids["RS256"])
+
+	t.Run("Tokens are signed with the signing key", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/shortcircuitlogin", map[string]string{"email": user.Email}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		token := response["token"].(string)
+
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		require.NoError(t, err)
+		assert.Equal(t, "EdDSA", parsed.Method.Alg())
+		assert.Equal(t, kids["EdDSA"], parsed.Header["kid"])
+		claims := parsed.Claims.(jwt.MapClaims)
+		assert.Equal(t, fmt.Sprint(user.ID), claims["sub"])
+		assert.Nil(t, claims["email"])
+
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, token)
+		assert.Equal(t, 200, w.Code)
+	})
+
+	t.Run("Tokens of the previous key are still accepted", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, rsaTestToken(t, oldKey, kids["RS256"], user, nil))
+		assert.Equal(t, 200, w.Code, w.Body.String())
+	})
+
+	t.Run("Invalid claims are rejected", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			kid    string
+			claims jwt.MapClaims
+		}{
+			{"Unknown kid", "unknown", nil},
+			{"Wrong audience", kids["RS256"], jwt.MapClaims{"aud": "another-service"}},
+			{"Wrong issuer", kids["RS256"], jwt.MapClaims{"iss": "another-issuer"}},
+			{"Issued in the future", kids["RS256"], jwt.MapClaims{"iat": time.Now().Add(time.Hour).Unix()}},
+			{"Missing jti", kids["RS256"], jwt.MapClaims{"jti": nil}},
+			{"Missing sub", kids["RS256"], jwt.MapClaims{"sub": nil}},
+			{"Missing exp", kids["RS256"], jwt.MapClaims{"exp": nil}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, rsaTestToken(t, oldKey, tt.kid, user, tt.claims))
+				assertErrorResponse(t, w, 401, "Invalid token")
+			})
+		}
+	})
+
+	t.Run("Tokens of the secret aren't accepted once keys are configured", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, hmacToken)
+		assertErrorResponse(t, w, 401, "Invalid token")
+	})
+}
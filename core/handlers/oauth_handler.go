@@ -0,0 +1,365 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/config"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/oauth"
+	"gorm.io/gorm"
+)
+
+const (
+	// OAuthStateCookie holds the state, nonce and PKCE verifier of a sign in until its callback
+	OAuthStateCookie = "oauth_state"
+	OAuthStateTTL    = 10 * time.Minute
+)
+
+var (
+	errUnverifiedProviderEmail = errors.New("email of the provider account isn't verified")
+)
+
+type (
+	oauthState struct {
+		Provider  string `json:"provider"`
+		ExpiresAt int64  `json:"expires_at"`
+		oauth.AuthRequest
+	}
+
+	ExchangeRequest struct {
+		Code string `json:"code" binding:"required"`
+	}
+)
+
+// SetOAuthProvider registers the provider under its name, replacing the one built from the config
+func (h *Handler) SetOAuthProvider(provider oauth.Provider) {
+	h.oauthProviders[provider.Name()] = provider
+	return
+}
+
+// getOAuthProvider returns the registered provider of the name, or builds it from the config
+func (h *Handler) getOAuthProvider(name string) (provider oauth.Provider, err error) {
+	if provider, ok := h.oauthProviders[name]; ok {
+		return provider, nil
+	}
+	return oauth.NewProviderFromConfig(name, h.cfg.GetKey)
+}
+
+// handleOAuthLogin redirects the user to the provider to sign in
+func (h *Handler) handleOAuthLogin(c *gin.Context) {
+	provider, err := h.getOAuthProvider(c.Param("provider"))
+	if err != nil {
+		if errors.Is(err, oauth.ErrUnknownProvider) {
+			c.JSON(404, gin.H{"error": "Unknown provider"})
+			return
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	req, err := oauth.NewAuthRequest()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start sign in"})
+		return
+	}
+	authURL, err := provider.AuthCodeURL(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to reach the provider"})
+		return
+	}
+	state := &oauthState{
+		Provider:    provider.Name(),
+		ExpiresAt:   time.Now().Add(OAuthStateTTL).Unix(),
+		AuthRequest: *req,
+	}
+	if err = h.setOAuthState(c, state); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start sign in"})
+		return
+	}
+	c.Redirect(http.StatusTemporaryRedirect, authURL)
+}
+
+// handleOAuthCallback signs the user in once the provider redirects back with a code.
+// The state has to match the one of the browser which started the sign in. The frontend
+// is handed a one time code to exchange for the tokens, which keeps them out of the URL.
+func (h *Handler) handleOAuthCallback(c *gin.Context) {
+	provider, err := h.getOAuthProvider(c.Param("provider"))
+	if err != nil {
+		if errors.Is(err, oauth.ErrUnknownProvider) {
+			c.JSON(404, gin.H{"error": "Unknown provider"})
+			return
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	state := h.popOAuthState(c)
+	if state == nil || state.Provider != provider.Name() ||
+		subtle.ConstantTimeCompare([]byte(state.State), []byte(c.Query("state"))) != 1 {
+		c.JSON(400, gin.H{"error": "Invalid OAuth state"})
+		return
+	}
+	if c.Query("error") != "" {
+		c.JSON(400, gin.H{"error": "Sign in was denied by the provider"})
+		return
+	}
+	code := c.Query("code")
+	if code == "" {
+		c.JSON(400, gin.H{"error": "No code provided"})
+		return
+	}
+
+	userInfo, err := provider.Authenticate(c.Request.Context(), code, &state.AuthRequest)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrInvalidIDToken):
+			c.JSON(401, gin.H{"error": "Invalid ID token"})
+		case errors.Is(err, oauth.ErrNoEmail):
+			c.JSON(400, gin.H{"error": "The provider didn't share an email"})
+		default:
+			c.JSON(500, gin.H{"error": "Failed to authenticate with the provider"})
+		}
+		return
+	}
+
+	user, err := h.findOrCreateOAuthUser(provider.Name(), userInfo)
+	if err != nil {
+		if errors.Is(err, errUnverifiedProviderEmail) {
+			c.JSON(403, gin.H{"error": "Email of the provider account isn't verified"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to save user"})
+		return
+	}
+	h.redirectWithLoginCode(c, user)
+}
+
+// redirectWithLoginCode sends the user signed in with a provider back to the frontend with a
+// short lived code, which the frontend exchanges for a token
+func (h *Handler) redirectWithLoginCode(c *gin.Context, user *models.User) {
+	frontendURL := os.Getenv("FRONTEND_URL")
+	if frontendURL == "" {
+		c.JSON(500, gin.H{"error": "Frontend URL not configured"})
+		return
+	}
+	_, loginCode, err := models.NewUserToken(h.Db, user, models.LoginCodePurpose, models.LoginCodeTTL)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create token"})
+		return
+	}
+	c.Redirect(http.StatusTemporaryRedirect, frontendURL+"?code="+url.QueryEscape(loginCode))
+}
+
+// handleExchange starts a session in exchange for the one time code of an OAuth sign in
+func (h *Handler) handleExchange(c *gin.Context) {
+	var req ExchangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	userToken, err := models.ConsumeUserToken(h.Db, models.LoginCodePurpose, req.Code)
+	if err != nil {
+		h.writeUserTokenError(c, err)
+		return
+	}
+	user := &models.User{}
+	if err = h.Db.Where("id = ?", userToken.UserID).First(user).Error; err != nil {
+		c.JSON(400, gin.H{"error": "User not found"})
+		return
+	}
+	h.completeLogin(c, "Login successful", user)
+}
+
+// findOrCreateOAuthUser returns the user linked to the provider account. The first sign in
+// links it to the user with the same email, which requires the provider to have verified
+// the email, or creates a new user. Linking an user whose email wasn't verified yet drops the
+// credentials they set up, see models.User.ClaimEmail.
+func (h *Handler) findOrCreateOAuthUser(providerName string, userInfo *oauth.UserInfo) (user *models.User, err error) {
+	user = &models.User{}
+	err = h.Db.Transaction(func(tx *gorm.DB) (err error) {
+		identity := &models.UserIdentity{}
+		err = tx.Where("provider = ? AND subject = ?", providerName, userInfo.Subject).First(identity).Error
+		switch {
+		case err == nil:
+			if err = tx.Where("id = ?", identity.UserID).First(user).Error; err != nil {
+				return
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if user, err = h.linkOAuthUser(tx, providerName, userInfo); err != nil {
+				return
+			}
+		default:
+			return
+		}
+
+		if providerName == oauth.GoogleProviderName {
+			user.GoogleID = &userInfo.Subject
+		}
+		if userInfo.Name != "" {
+			user.Name = userInfo.Name
+		}
+		if userInfo.Picture != "" {
+			user.Picture = userInfo.Picture
+		}
+		user.UserStatus = models.ActiveUser
+		if err = tx.Save(user).Error; err != nil {
+			return
+		}
+		if userInfo.EmailVerified && strings.EqualFold(user.Email, userInfo.Email) {
+			err = user.ClaimEmail(tx)
+		}
+		return
+	})
+	return
+}
+
+// linkOAuthUser links the provider account to the user with its email, creating the user if needed
+func (h *Handler) linkOAuthUser(tx *gorm.DB, providerName string, userInfo *oauth.UserInfo) (user *models.User, err error) {
+	email := normaliseEmail(userInfo.Email)
+	user = &models.User{}
+	err = tx.Where("LOWER(email) = ?", email).First(user).Error
+	switch {
+	case err == nil:
+		// Otherwise anyone could take over an user by claiming their email at a provider
+		if !userInfo.EmailVerified {
+			err = errUnverifiedProviderEmail
+			return
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		name := userInfo.Name
+		if name == "" {
+			name = strings.Split(email, "@")[0]
+		}
+		user = &models.User{
+			Email:       email,
+			Name:        name,
+			UserStatus:  models.ActiveUser,
+			CreatedFrom: providerName,
+		}
+		if err = tx.Create(user).Error; err != nil {
+			return
+		}
+	default:
+		return
+	}
+
+	identity := &models.UserIdentity{
+		Provider: providerName,
+		Subject:  userInfo.Subject,
+		Email:    email,
+	}
+	identity.UserID = user.ID
+	err = tx.Create(identity).Error
+	return
+}
+
+// setOAuthState stores the state of the sign in in a short lived signed cookie
+func (h *Handler) setOAuthState(c *gin.Context, state *oauthState) (err error) {
+	return h.setStateCookie(c, OAuthStateCookie, "/auth", http.SameSiteLaxMode, OAuthStateTTL, state)
+}
+
+// popOAuthState reads the state of the sign in and clears its cookie so that it can't be replayed.
+// States which weren't signed by the server or have expired are ignored.
+func (h *Handler) popOAuthState(c *gin.Context) (state *oauthState) {
+	state = &oauthState{}
+	if !h.popStateCookie(c, OAuthStateCookie, "/auth", http.SameSiteLaxMode, state) ||
+		state.State == "" || time.Now().Unix() > state.ExpiresAt {
+		return nil
+	}
+	return
+}
+
+// setStateCookie stores the JSON of the value in a signed cookie expiring after the TTL
+func (h *Handler) setStateCookie(c *gin.Context, name, path string, sameSite http.SameSite, ttl time.Duration, value interface{}) (err error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	signed, err := h.signCookieValue(base64.RawURLEncoding.EncodeToString(content))
+	if err != nil {
+		return
+	}
+	c.SetSameSite(sameSite)
+	c.SetCookie(name, signed, int(ttl.Seconds()), path, "", h.secureCookies(c), true)
+	return
+}
+
+// popStateCookie reads the value of a cookie set with setStateCookie and clears the cookie.
+// It returns false if the cookie is missing or wasn't signed by the server.
+func (h *Handler) popStateCookie(c *gin.Context, name, path string, sameSite http.SameSite, value interface{}) (ok bool) {
+	cookie, err := c.Cookie(name)
+	if err != nil {
+		return
+	}
+	c.SetSameSite(sameSite)
+	c.SetCookie(name, "", -1, path, "", h.secureCookies(c), true)
+
+	encoded, ok := h.verifyCookieValue(cookie)
+	if !ok {
+		return
+	}
+	content, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	ok = json.Unmarshal(content, value) == nil
+	return
+}
+
+// cookieSecret returns the key signing the cookies, COOKIE_SECRET or else JWT_SECRET
+func (h *Handler) cookieSecret() (secret []byte, err error) {
+	value := h.cfg.GetKey("COOKIE_SECRET")
+	if value == "" {
+		value = h.cfg.GetKey("JWT_SECRET")
+	}
+	if value == "" {
+		err = errors.New("cookie secret not configured")
+		return
+	}
+	secret = []byte(value)
+	return
+}
+
+// signCookieValue appends the HMAC of the value so that the browser can't alter it
+func (h *Handler) signCookieValue(value string) (signed string, err error) {
+	secret, err := h.cookieSecret()
+	if err != nil {
+		return
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	signed = value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return
+}
+
+// verifyCookieValue returns the value of a cookie signed with signCookieValue
+func (h *Handler) verifyCookieValue(signed string) (value string, ok bool) {
+	index := strings.LastIndex(signed, ".")
+	if index == -1 {
+		return
+	}
+	expected, err := h.signCookieValue(signed[:index])
+	if err != nil {
+		return
+	}
+	if !hmac.Equal([]byte(expected), []byte(signed)) {
+		return
+	}
+	return signed[:index], true
+}
+
+// secureCookies checks if the cookies should only be sent over HTTPS
+func (h *Handler) secureCookies(c *gin.Context) bool {
+	return c.Request.TLS != nil || h.cfg.Mode == config.ModeProd
+}
@@ -0,0 +1,318 @@
+package handlers_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/handlers"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/oauth"
+	"github.com/gsarmaonline/goiter/testutils"
+)
+
+// startOAuthLogin starts a sign in with the provider and returns the auth code URL and the state cookie
+func startOAuthLogin(t *testing.T, env *testutils.TestEnvironment, provider string) (authCodeURL string, stateCookie *http.Cookie) {
+	w := env.NewTestClient().MakeRequest(t, "GET", "/auth/"+provider, nil, nil)
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code, w.Body.String())
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == handlers.OAuthStateCookie {
+			stateCookie = cookie
+		}
+	}
+	require.NotNil(t, stateCookie)
+	return w.Header().Get("Location"), stateCookie
+}
+
+// oauthCallback calls the callback URL the provider redirected to with the state cookie
+func oauthCallback(t *testing.T, env *testutils.TestEnvironment, callbackURL string, stateCookie *http.Cookie) *httptest.ResponseRecorder {
+	parsedURL, err := url.Parse(callbackURL)
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", parsedURL.RequestURI(), nil)
+	if stateCookie != nil {
+		req.AddCookie(stateCookie)
+	}
+	w := httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	return w
+}
+
+// editOAuthState rewrites the content of the state cookie, keeping its signature
+func editOAuthState(t *testing.T, stateCookie *http.Cookie, key, value string) *http.Cookie {
+	parts := strings.SplitN(stateCookie.Value, ".", 2)
+	require.Len(t, parts, 2)
+	content, err := base64.RawURLEncoding.DecodeString(parts[0])
+	require.NoError(t, err)
+	state := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(content, &state))
+	require.Contains(t, state, key)
+	state[key] = value
+	content, err = json.Marshal(state)
+	require.NoError(t, err)
+	return &http.Cookie{Name: stateCookie.Name, Value: base64.RawURLEncoding.EncodeToString(content) + "." + parts[1]}
+}
+
+// exchangeLoginCode exchanges the one time code of the redirect to the frontend for an access token
+func exchangeLoginCode(t *testing.T, env *testutils.TestEnvironment, w *httptest.ResponseRecorder) string {
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code, w.Body.String())
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Empty(t, location.Query().Get("token"))
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	w = env.NewTestClient().MakeRequest(t, "POST", "/auth/exchange", map[string]string{"code": code}, nil)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response["token"].(string)
+}
+
+// editAuthCodeURL rewrites a parameter of the auth code URL before it reaches the provider
+func editAuthCodeURL(t *testing.T, authCodeURL, key, value string) string {
+	parsedURL, err := url.Parse(authCodeURL)
+	require.NoError(t, err)
+	query := parsedURL.Query()
+	query.Set(key, value)
+	parsedURL.RawQuery = query.Encode()
+	return parsedURL.String()
+}
+
+// meRequest gets the user of the access token
+func meRequest(t *testing.T, env *testutils.TestEnvironment, token string) *httptest.ResponseRecorder {
+	return env.NewTestClient().MakeRequest(t, "GET", "/me", nil, &testutils.TestUser{Token: token})
+}
+
+func TestOAuthHandler(t *testing.T) {
+	env := testutils.SetupTestEnvironment(t)
+	defer env.Cleanup()
+	client := env.NewTestClient()
+	db := env.DB
+
+	mock := testutils.NewMockGoogleServer(t)
+	defer mock.Close()
+	env.Handler.SetOAuthProvider(oauth.NewOIDCProvider(&oauth.ProviderConfig{
+		Name:        oauth.GoogleProviderName,
+		ClientID:    mock.ClientID,
+		RedirectURL: "http://localhost:8080/auth/google/callback",
+		IssuerURL:   mock.URL(),
+	}))
+
+	t.Run("Sign in with an OIDC provider", func(t *testing.T) {
+		authCodeURL, stateCookie := startOAuthLogin(t, env, "google")
+		assert.True(t, stateCookie.HttpOnly)
+		query, err := url.Parse(authCodeURL)
+		require.NoError(t, err)
+		assert.Equal(t, mock.URL()+"/authorize", query.Scheme+"://"+query.Host+query.Path)
+		assert.Equal(t, "S256", query.Query().Get("code_challenge_method"))
+		assert.NotEmpty(t, query.Query().Get("code_challenge"))
+		assert.NotEmpty(t, query.Query().Get("nonce"))
+		assert.NotEmpty(t, query.Query().Get("state"))
+
+		w := oauthCallback(t, env, mock.Authorize(t, authCodeURL), stateCookie)
+		token := exchangeLoginCode(t, env, w)
+		w = meRequest(t, env, token)
+		assert.Equal(t, 200, w.Code)
+
+		// The state cookie is cleared by the callback
+		w = oauthCallback(t, env, mock.Authorize(t, authCodeURL), stateCookie)
+		clearedCookie := false
+		for _, cookie := range w.Result().Cookies() {
+			clearedCookie = clearedCookie || (cookie.Name == handlers.OAuthStateCookie && cookie.MaxAge < 0)
+		}
+		assert.True(t, clearedCookie)
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", mock.User.Email).First(&user).Error)
+		assert.Equal(t, "google", user.CreatedFrom)
+		require.NotNil(t, user.GoogleID)
+		assert.Equal(t, mock.User.Subject, *user.GoogleID)
+		assert.True(t, user.IsEmailVerified())
+		var identity models.UserIdentity
+		require.NoError(t, db.Where("provider = ? AND subject = ?", "google", mock.User.Subject).First(&identity).Error)
+		assert.Equal(t, user.ID, identity.UserID)
+
+		// The same provider account signs in to the same user even if its email changed
+		mock.User.Email = "renamed@gmail.com"
+		defer func() { mock.User.Email = "mockuser@gmail.com" }()
+		authCodeURL, stateCookie = startOAuthLogin(t, env, "google")
+		w = oauthCallback(t, env, mock.Authorize(t, authCodeURL), stateCookie)
+		w = meRequest(t, env, exchangeLoginCode(t, env, w))
+		assert.Contains(t, w.Body.String(), "mockuser@gmail.com")
+	})
+
+	t.Run("State has to match", func(t *testing.T) {
+		authCodeURL, stateCookie := startOAuthLogin(t, env, "google")
+		callbackURL := mock.Authorize(t, authCodeURL)
+
+		w := oauthCallback(t, env, callbackURL, nil)
+		client.AssertErrorResponse(t, w, 400, "Invalid OAuth state")
+
+		// Callbacks can't be completed with the state cookie of another sign in, nor with a forged one
+		_, otherCookie := startOAuthLogin(t, env, "google")
+		w = oauthCallback(t, env, callbackURL, otherCookie)
+		client.AssertErrorResponse(t, w, 400, "Invalid OAuth state")
+
+		otherProvider := editOAuthState(t, stateCookie, "provider", "github")
+		w = oauthCallback(t, env, callbackURL, otherProvider)
+		client.AssertErrorResponse(t, w, 400, "Invalid OAuth state")
+
+		w = oauthCallback(t, env, callbackURL, stateCookie)
+		exchangeLoginCode(t, env, w)
+	})
+
+	t.Run("PKCE verifier and nonce have to match", func(t *testing.T) {
+		authCodeURL, stateCookie := startOAuthLogin(t, env, "google")
+		otherChallenge := editAuthCodeURL(t, authCodeURL, "code_challenge", "forged")
+		w := oauthCallback(t, env, mock.Authorize(t, otherChallenge), stateCookie)
+		client.AssertErrorResponse(t, w, 500, "Failed to authenticate with the provider")
+
+		authCodeURL, stateCookie = startOAuthLogin(t, env, "google")
+		otherNonce := editAuthCodeURL(t, authCodeURL, "nonce", "forged")
+		w = oauthCallback(t, env, mock.Authorize(t, otherNonce), stateCookie)
+		client.AssertErrorResponse(t, w, 401, "Invalid ID token")
+
+		// The state cookie is signed so its verifier and nonce can't be swapped either
+		authCodeURL, stateCookie = startOAuthLogin(t, env, "google")
+		otherVerifier := editOAuthState(t, stateCookie, "code_verifier", "forged")
+		w = oauthCallback(t, env, mock.Authorize(t, authCodeURL), otherVerifier)
+		client.AssertErrorResponse(t, w, 400, "Invalid OAuth state")
+	})
+
+	t.Run("Login codes are single use", func(t *testing.T) {
+		authCodeURL, stateCookie := startOAuthLogin(t, env, "google")
+		w := oauthCallback(t, env, mock.Authorize(t, authCodeURL), stateCookie)
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		code := location.Query().Get("code")
+
+		w = client.MakeRequest(t, "POST", "/auth/exchange", map[string]string{"code": code}, nil)
+		require.Equal(t, 200, w.Code)
+		w = client.MakeRequest(t, "POST", "/auth/exchange", map[string]string{"code": code}, nil)
+		client.AssertErrorResponse(t, w, 400, "Invalid or already used token")
+		w = client.MakeRequest(t, "POST", "/auth/exchange", map[string]string{"code": "forged"}, nil)
+		client.AssertErrorResponse(t, w, 400, "Invalid or already used token")
+	})
+
+	t.Run("Existing users are linked by verified email only", func(t *testing.T) {
+		existing := env.CreateTestUser(t, "linked@example.com").User
+		mock.User = testutils.MockGoogleUser{Subject: "linked-subject", Email: "linked@example.com", EmailVerified: false, Name: "Linked"}
+
+		authCodeURL, stateCookie := startOAuthLogin(t, env, "google")
+		w := oauthCallback(t, env, mock.Authorize(t, authCodeURL), stateCookie)
+		client.AssertErrorResponse(t, w, 403, "Email of the provider account isn't verified")
+
+		mock.User.EmailVerified = true
+		authCodeURL, stateCookie = startOAuthLogin(t, env, "google")
+		w = oauthCallback(t, env, mock.Authorize(t, authCodeURL), stateCookie)
+		exchangeLoginCode(t, env, w)
+
+		var identity models.UserIdentity
+		require.NoError(t, db.Where("provider = ? AND subject = ?", "google", "linked-subject").First(&identity).Error)
+		assert.Equal(t, existing.ID, identity.UserID)
+		var user models.User
+		require.NoError(t, db.Where("id = ?", existing.ID).First(&user).Error)
+		assert.NotEqual(t, "google", user.CreatedFrom)
+	})
+
+	t.Run("Linking an unverified user drops its credentials", func(t *testing.T) {
+		// Someone registered the email before its owner signed in with the provider
+		squatter := &models.User{Email: "prehijacked@example.com", Name: "Squatter", CreatedFrom: models.PasswordCreatedFrom}
+		require.NoError(t, squatter.SetPassword("squatter-password"))
+		require.NoError(t, db.Create(squatter).Error)
+		session, _, err := models.NewSession(db, squatter, "test", "127.0.0.1")
+		require.NoError(t, err)
+		apiKey, _, err := models.NewAPIKey(db, squatter, models.UserScopeType, squatter.ID, "squatter", []models.ActionT{models.ReadAction}, nil)
+		require.NoError(t, err)
+		_, _, err = squatter.EnrollTOTP(db, "goiter")
+		require.NoError(t, err)
+
+		mock.User = testutils.MockGoogleUser{Subject: "prehijacked-subject", Email: "prehijacked@example.com", EmailVerified: true, Name: "Owner"}
+		authCodeURL, stateCookie := startOAuthLogin(t, env, "google")
+		w := oauthCallback(t, env, mock.Authorize(t, authCodeURL), stateCookie)
+		exchangeLoginCode(t, env, w)
+
+		var user models.User
+		require.NoError(t, db.Where("id = ?", squatter.ID).First(&user).Error)
+		assert.True(t, user.IsEmailVerified())
+		assert.Empty(t, user.PasswordHash)
+		assert.Empty(t, user.TOTPSecret)
+		require.NoError(t, db.First(session, session.ID).Error)
+		assert.Equal(t, models.EmailClaimedRevokeReason, session.RevokedReason)
+		require.NoError(t, db.First(apiKey, apiKey.ID).Error)
+		assert.NotNil(t, apiKey.RevokedAt)
+
+		w = client.MakeRequest(t, "POST", "/auth/login", map[string]string{
+			"email":    "prehijacked@example.com",
+			"password": "squatter-password",
+		}, nil)
+		assert.Equal(t, 401, w.Code, w.Body.String())
+	})
+
+	t.Run("Sign in with GitHub", func(t *testing.T) {
+		gitHub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/login/oauth/access_token":
+				r.ParseForm()
+				if r.Form.Get("code") != "github_code" || r.Form.Get("code_verifier") == "" {
+					json.NewEncoder(w).Encode(map[string]string{"error": "bad_verification_code"})
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]string{"access_token": "github_token", "token_type": "bearer"})
+			case "/user":
+				json.NewEncoder(w).Encode(map[string]interface{}{"id": 4242, "login": "octocat", "avatar_url": "https://example.com/octocat.png"})
+			case "/user/emails":
+				json.NewEncoder(w).Encode([]map[string]interface{}{
+					{"email": "octocat@users.noreply.github.com", "primary": false, "verified": true},
+					{"email": "octocat@example.com", "primary": true, "verified": true},
+				})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer gitHub.Close()
+		env.Handler.SetOAuthProvider(oauth.NewGitHubProvider(&oauth.ProviderConfig{
+			Name:        oauth.GitHubProviderName,
+			ClientID:    "github-client-id",
+			RedirectURL: "http://localhost:8080/auth/github/callback",
+			AuthURL:     gitHub.URL + "/login/oauth/authorize",
+			TokenURL:    gitHub.URL + "/login/oauth/access_token",
+			UserInfoURL: gitHub.URL,
+		}))
+
+		authCodeURL, stateCookie := startOAuthLogin(t, env, "github")
+		parsedURL, err := url.Parse(authCodeURL)
+		require.NoError(t, err)
+		state := parsedURL.Query().Get("state")
+
+		w := oauthCallback(t, env, "/auth/github/callback?code=wrong_code&state="+state, stateCookie)
+		client.AssertErrorResponse(t, w, 500, "Failed to authenticate with the provider")
+
+		authCodeURL, stateCookie = startOAuthLogin(t, env, "github")
+		parsedURL, err = url.Parse(authCodeURL)
+		require.NoError(t, err)
+		state = parsedURL.Query().Get("state")
+		w = oauthCallback(t, env, "/auth/github/callback?code=github_code&state="+state, stateCookie)
+		exchangeLoginCode(t, env, w)
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "octocat@example.com").First(&user).Error)
+		assert.Equal(t, "github", user.CreatedFrom)
+		assert.Equal(t, "octocat", user.Name)
+	})
+
+	t.Run("Unknown provider", func(t *testing.T) {
+		w := client.MakeRequest(t, "GET", "/auth/unknown", nil, nil)
+		client.AssertErrorResponse(t, w, 404, "Unknown provider")
+		w = client.MakeRequest(t, "GET", "/auth/unknown/callback?code=code&state=state", nil, nil)
+		client.AssertErrorResponse(t, w, 404, "Unknown provider")
+	})
+}
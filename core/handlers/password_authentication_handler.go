@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/mailer"
+	"gorm.io/gorm"
+)
+
+type (
+	RegisterRequest struct {
+		Email    string `json:"email" binding:"required,email"`
+		Password string `json:"password" binding:"required"`
+		Name     string `json:"name"`
+	}
+
+	LoginRequest struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	EmailRequest struct {
+		Email string `json:"email" binding:"required"`
+	}
+
+	TokenRequest struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	ResetPasswordRequest struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+)
+
+// normaliseEmail makes the emails comparable regardless of their case and spacing
+func normaliseEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// sendUserTokenEmail emails the user a link to the frontend path carrying the token, after the text
+func (h *Handler) sendUserTokenEmail(user *models.User, purpose models.UserTokenPurposeT, subject, text, path string) (err error) {
+	ttl := models.EmailVerificationTTL
+	if purpose == models.PasswordResetPurpose {
+		ttl = models.PasswordResetTTL
+	}
+	_, secret, err := models.NewUserToken(h.Db, user, purpose, ttl)
+	if err != nil {
+		return
+	}
+	link := fmt.Sprintf("%s%s?token=%s", os.Getenv("FRONTEND_URL"), path, secret)
+	err = h.mailer.Send(&mailer.MailerRequest{
+		To:          []string{user.Email},
+		Subject:     subject,
+		PlainText:   fmt.Sprintf("%s: %s", text, link),
+		HtmlContent: fmt.Sprintf("<p>%s: <a href=\"%s\">%s</a></p>", text, link, link),
+	})
+	return
+}
+
+// handleRegister signs an user up with an email and a password.
+// The user has to verify the email before logging in. It answers the same way whether
+// or not the email is registered so that it can't be used to discover users, the owner
+// of a registered email is sent a password reset link instead.
+func (h *Handler) handleRegister(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if len(req.Password) < models.MinPasswordLength || len(req.Password) > models.MaxPasswordLength {
+		c.JSON(400, gin.H{"error": "Password must be between 8 and 72 characters"})
+		return
+	}
+	email := normaliseEmail(req.Email)
+	message := gin.H{"message": "Registration successful, check your email to verify it"}
+	existing := &models.User{}
+	if err := h.Db.Where("LOWER(email) = ?", email).First(existing).Error; err == nil {
+		if err = h.sendUserTokenEmail(existing, models.PasswordResetPurpose, "Your email is already registered",
+			"Someone tried to sign up with your email, which is already registered. Reset your password to sign in", "/reset-password"); err != nil {
+			log.Println("Failed to send the password reset email", existing.ID, err)
+		}
+		c.JSON(200, message)
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = strings.Split(email, "@")[0]
+	}
+	user := &models.User{
+		Email:       email,
+		Name:        name,
+		UserStatus:  models.ActiveUser,
+		CreatedFrom: models.PasswordCreatedFrom,
+	}
+	if err := user.SetPassword(req.Password); err != nil {
+		c.JSON(400, gin.H{"error": "Password must be between 8 and 72 characters"})
+		return
+	}
+	if err := h.Db.Create(user).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	if err := h.sendUserTokenEmail(user, models.EmailVerificationPurpose, "Verify your email", "Verify your email", "/verify-email"); err != nil {
+		log.Println("Failed to send the verification email", user.ID, err)
+	}
+	c.JSON(200, message)
+}
+
+// handleVerifyEmail verifies the email of the user with the emailed token
+func (h *Handler) handleVerifyEmail(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	userToken, err := models.ConsumeUserToken(h.Db, models.EmailVerificationPurpose, req.Token)
+	if err != nil {
+		h.writeUserTokenError(c, err)
+		return
+	}
+	user := &models.User{}
+	if err = h.Db.Where("id = ?", userToken.UserID).First(user).Error; err != nil {
+		c.JSON(400, gin.H{"error": "User not found"})
+		return
+	}
+	if err = user.VerifyEmail(h.Db); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Email verified successfully"})
+}
+
+// handleResendVerification emails a new verification token. It answers the same way
+// whether or not the email is registered so that it can't be used to discover users.
+func (h *Handler) handleResendVerification(c *gin.Context) {
+	var req EmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := &models.User{}
+	if err := h.Db.Where("LOWER(email) = ?", normaliseEmail(req.Email)).First(user).Error; err == nil && !user.IsEmailVerified() {
+		if err = h.sendUserTokenEmail(user, models.EmailVerificationPurpose, "Verify your email", "Verify your email", "/verify-email"); err != nil {
+			log.Println("Failed to send the verification email", user.ID, err)
+		}
+	}
+	c.JSON(200, gin.H{"message": "If the email is registered and not verified, a verification email has been sent"})
+}
+
+// handleLogin logs an user in with the email and the password.
+// Users are locked out after too many failed attempts in a row.
+// Users with two factor authentication then have to verify their second factor.
+func (h *Handler) handleLogin(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := &models.User{}
+	if err := h.Db.Where("LOWER(email) = ?", normaliseEmail(req.Email)).First(user).Error; err != nil {
+		c.JSON(401, gin.H{"error": "Invalid email or password"})
+		return
+	}
+	if user.IsLocked() {
+		c.JSON(423, gin.H{"error": "Too many failed logins, try again later"})
+		return
+	}
+	if !user.CheckPassword(req.Password) {
+		if err := user.RegisterFailedLogin(h.Db); err != nil {
+			log.Println("Failed to record the failed login", user.ID, err)
+		}
+		c.JSON(401, gin.H{"error": "Invalid email or password"})
+		return
+	}
+	if !user.IsEmailVerified() {
+		c.JSON(403, gin.H{"error": "Email not verified"})
+		return
+	}
+	h.completeLogin(c, "Login successful", user)
+}
+
+// handleForgotPassword emails a password reset token. It answers the same way
+// whether or not the email is registered so that it can't be used to discover users.
+func (h *Handler) handleForgotPassword(c *gin.Context) {
+	var req EmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := &models.User{}
+	if err := h.Db.Where("LOWER(email) = ?", normaliseEmail(req.Email)).First(user).Error; err == nil {
+		if err = h.sendUserTokenEmail(user, models.PasswordResetPurpose, "Reset your password", "Reset your password", "/reset-password"); err != nil {
+			log.Println("Failed to send the password reset email", user.ID, err)
+		}
+	}
+	c.JSON(200, gin.H{"message": "If the email is registered, a password reset email has been sent"})
+}
+
+// handleResetPassword sets a new password with the emailed token. Since the token
+// proves the user owns the email, the email is verified and the lockout is cleared.
+// All the sessions of the user are revoked.
+func (h *Handler) handleResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	// The password is checked before the token is consumed so that a typo doesn't burn it
+	if len(req.Password) < models.MinPasswordLength || len(req.Password) > models.MaxPasswordLength {
+		c.JSON(400, gin.H{"error": "Password must be between 8 and 72 characters"})
+		return
+	}
+	userToken, err := models.ConsumeUserToken(h.Db, models.PasswordResetPurpose, req.Token)
+	if err != nil {
+		h.writeUserTokenError(c, err)
+		return
+	}
+
+	user := &models.User{}
+	if err = h.Db.Where("id = ?", userToken.UserID).First(user).Error; err != nil {
+		c.JSON(400, gin.H{"error": "User not found"})
+		return
+	}
+	if err = user.SetPassword(req.Password); err != nil {
+		c.JSON(400, gin.H{"error": "Password must be between 8 and 72 characters"})
+		return
+	}
+	if err = h.Db.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Model(user).Update("password_hash", user.PasswordHash).Error; err != nil {
+			return
+		}
+		if err = user.VerifyEmail(tx); err != nil {
+			return
+		}
+		if err = user.ResetFailedLogins(tx); err != nil {
+			return
+		}
+		err = models.RevokeUserSessions(tx, user.ID, 0, models.PasswordResetRevokeReason)
+		return
+	}); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Password reset successfully"})
+}
+
+func (h *Handler) writeUserTokenError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrUserTokenExpired):
+		c.JSON(410, gin.H{"error": "Token has expired"})
+	case errors.Is(err, models.ErrInvalidUserToken):
+		c.JSON(400, gin.H{"error": "Invalid or already used token"})
+	default:
+		c.JSON(500, gin.H{"error": "Failed to check token"})
+	}
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+// registerTestUser signs the user up with a password and verifies the email
+func registerTestUser(t *testing.T, handler *Handler, m *recordingMailer, email, password string) {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/auth/register", map[string]string{
+		"email":    email,
+		"password": password,
+	}, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	w = makeAuthenticatedRequest(t, handler, "POST", "/auth/verify-email", map[string]string{"token": m.lastToken(t)}, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+}
+
+func passwordLogin(t *testing.T, handler *Handler, email, password string) (code int, accessToken string) {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/auth/login", map[string]string{
+		"email":    email,
+		"password": password,
+	}, "")
+	if w.Code == 200 {
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		accessToken = response["token"].(string)
+	}
+	return w.Code, accessToken
+}
+
+func TestPasswordAuthenticationHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	m := &recordingMailer{}
+	handler.SetMailer(m)
+
+	t.Run("Register requires email verification", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/register", map[string]string{
+			"email":    "Signup@Example.com",
+			"password": "correct-horse",
+		}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.Len(t, m.requests, 1)
+		assert.Equal(t, []string{"signup@example.com"}, m.requests[0].To)
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "signup@example.com").First(&user).Error)
+		assert.Equal(t, models.PasswordCreatedFrom, user.CreatedFrom)
+		assert.NotEqual(t, "correct-horse", user.PasswordHash)
+		assert.Nil(t, user.EmailVerifiedAt)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/login", map[string]string{
+			"email":    "signup@example.com",
+			"password": "correct-horse",
+		}, "")
+		assertErrorResponse(t, w, 403, "Email not verified")
+
+		token := m.lastToken(t)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/verify-email", map[string]string{"token": token}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/verify-email", map[string]string{"token": token}, "")
+		assertErrorResponse(t, w, 400, "Invalid or already used token")
+
+		code, accessToken := passwordLogin(t, handler, "SIGNUP@example.com", "correct-horse")
+		require.Equal(t, 200, code)
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, accessToken)
+		assert.Equal(t, 200, w.Code)
+	})
+
+	t.Run("Register doesn't reveal the registered emails", func(t *testing.T) {
+		sent := len(m.requests)
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/register", map[string]string{
+			"email":    "SIGNUP@example.com",
+			"password": "another-password",
+		}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.JSONEq(t, `{"message": "Registration successful, check your email to verify it"}`, w.Body.String())
+		require.Len(t, m.requests, sent+1)
+		assert.Equal(t, []string{"signup@example.com"}, m.requests[sent].To)
+		assert.Equal(t, "Your email is already registered", m.requests[sent].Subject)
+
+		// The password isn't changed until the emailed link is used
+		code, _ := passwordLogin(t, handler, "signup@example.com", "another-password")
+		assert.Equal(t, 401, code)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/reset-password", map[string]string{
+			"token":    m.lastToken(t),
+			"password": "another-password",
+		}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		code, _ = passwordLogin(t, handler, "signup@example.com", "another-password")
+		assert.Equal(t, 200, code)
+
+		var count int64
+		db.Model(&models.User{}).Where("LOWER(email) = ?", "signup@example.com").Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Register validation", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/register", map[string]string{
+			"email":    "short@example.com",
+			"password": "short",
+		}, "")
+		assertErrorResponse(t, w, 400, "Password must be between 8 and 72 characters")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/register", map[string]string{
+			"email":    "not-an-email",
+			"password": "correct-horse",
+		}, "")
+		assertErrorResponse(t, w, 400, "Invalid request")
+	})
+
+	t.Run("Expired verification token", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/register", map[string]string{
+			"email":    "expired@example.com",
+			"password": "correct-horse",
+		}, "")
+		require.Equal(t, 200, w.Code)
+		token := m.lastToken(t)
+		require.NoError(t, db.Model(&models.UserToken{}).Where("used_at IS NULL").
+			Update("expires_at", time.Now().Add(-time.Minute)).Error)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/verify-email", map[string]string{"token": token}, "")
+		assertErrorResponse(t, w, 410, "Token has expired")
+
+		// The users who didn't sign in with Google don't have a GoogleID
+		var count int64
+		db.Model(&models.User{}).Where("email IN ? AND google_id IS NULL", []string{"signup@example.com", "expired@example.com"}).Count(&count)
+		assert.Equal(t, int64(2), count)
+
+		// A new token replaces the expired one
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/resend-verification", map[string]string{"email": "expired@example.com"}, "")
+		require.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/verify-email", map[string]string{"token": m.lastToken(t)}, "")
+		assert.Equal(t, 200, w.Code)
+	})
+
+	t.Run("Lockout after repeated failures", func(t *testing.T) {
+		registerTestUser(t, handler, m, "lockout@example.com", "correct-horse")
+
+		for i := 0; i < models.MaxFailedLogins; i++ {
+			code, _ := passwordLogin(t, handler, "lockout@example.com", "wrong-password")
+			assert.Equal(t, 401, code)
+		}
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/login", map[string]string{
+			"email":    "lockout@example.com",
+			"password": "correct-horse",
+		}, "")
+		assertErrorResponse(t, w, 423, "Too many failed logins")
+
+		// The lockout is lifted once it's over
+		require.NoError(t, db.Model(&models.User{}).Where("email = ?", "lockout@example.com").
+			Update("locked_until", time.Now().Add(-time.Minute)).Error)
+		code, _ := passwordLogin(t, handler, "lockout@example.com", "correct-horse")
+		assert.Equal(t, 200, code)
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "lockout@example.com").First(&user).Error)
+		assert.Equal(t, 0, user.FailedLogins)
+		assert.Nil(t, user.LockedUntil)
+	})
+
+	t.Run("Unknown email and users without a password", func(t *testing.T) {
+		code, _ := passwordLogin(t, handler, "nobody@example.com", "correct-horse")
+		assert.Equal(t, 401, code)
+
+		loginTestUser(t, handler, "shortcircuit@example.com")
+		code, _ = passwordLogin(t, handler, "shortcircuit@example.com", "")
+		assert.Equal(t, 400, code)
+		code, _ = passwordLogin(t, handler, "shortcircuit@example.com", "correct-horse")
+		assert.Equal(t, 401, code)
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "shortcircuit@example.com").First(&user).Error)
+		assert.Equal(t, models.ShortCircuitCreatedFrom, user.CreatedFrom)
+	})
+
+	t.Run("Forgot and reset password", func(t *testing.T) {
+		registerTestUser(t, handler, m, "forgot@example.com", "correct-horse")
+		_, accessToken := passwordLogin(t, handler, "forgot@example.com", "correct-horse")
+
+		sent := len(m.requests)
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/forgot-password", map[string]string{"email": "nobody@example.com"}, "")
+		require.Equal(t, 200, w.Code)
+		assert.Len(t, m.requests, sent)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/forgot-password", map[string]string{"email": "forgot@example.com"}, "")
+		require.Equal(t, 200, w.Code)
+		require.Len(t, m.requests, sent+1)
+		token := m.lastToken(t)
+
+		// A rejected password doesn't burn the token
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/reset-password", map[string]string{"token": token, "password": "short"}, "")
+		assertErrorResponse(t, w, 400, "Password must be between 8 and 72 characters")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/reset-password", map[string]string{"token": token, "password": "battery-staple"}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/reset-password", map[string]string{"token": token, "password": "another-password"}, "")
+		assertErrorResponse(t, w, 400, "Invalid or already used token")
+
+		// The existing sessions are revoked
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, accessToken)
+		assertErrorResponse(t, w, 401, "Session revoked")
+
+		code, _ := passwordLogin(t, handler, "forgot@example.com", "correct-horse")
+		assert.Equal(t, 401, code)
+		code, _ = passwordLogin(t, handler, "forgot@example.com", "battery-staple")
+		assert.Equal(t, 200, code)
+	})
+
+	t.Run("Only the latest reset token is valid", func(t *testing.T) {
+		registerTestUser(t, handler, m, "twice@example.com", "correct-horse")
+		makeAuthenticatedRequest(t, handler, "POST", "/auth/forgot-password", map[string]string{"email": "twice@example.com"}, "")
+		firstToken := m.lastToken(t)
+		makeAuthenticatedRequest(t, handler, "POST", "/auth/forgot-password", map[string]string{"email": "twice@example.com"}, "")
+		secondToken := m.lastToken(t)
+
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/reset-password", map[string]string{"token": firstToken, "password": "battery-staple"}, "")
+		assertErrorResponse(t, w, 400, "Invalid or already used token")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/reset-password", map[string]string{"token": secondToken, "password": "battery-staple"}, "")
+		assert.Equal(t, 200, w.Code)
+	})
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/mailer"
+	"github.com/gsarmaonline/goiter/core/services/sms"
+	"gorm.io/gorm"
+)
+
+var (
+	// phoneNumberPattern matches the E.164 phone numbers, e.g. +14155550100
+	phoneNumberPattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+)
+
+type (
+	PhoneRequest struct {
+		Phone string `json:"phone" binding:"required"`
+	}
+
+	PhoneCodeRequest struct {
+		Phone string `json:"phone" binding:"required"`
+		Code  string `json:"code" binding:"required"`
+	}
+)
+
+// normalisePhone strips the separators of a phone number and checks it's in E.164 format
+func normalisePhone(phone string) (normalised string, ok bool) {
+	normalised = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(phone)
+	ok = phoneNumberPattern.MatchString(normalised)
+	return
+}
+
+// writeOneTimeCodeError answers the request of a code which couldn't be issued
+func (h *Handler) writeOneTimeCodeError(c *gin.Context, err error) {
+	if errors.Is(err, models.ErrCodeRateLimited) {
+		c.JSON(429, gin.H{"error": "Too many codes requested, try again later"})
+		return
+	}
+	c.JSON(500, gin.H{"error": "Failed to send the code"})
+}
+
+// sendSmsCode texts the code to the phone number
+func (h *Handler) sendSmsCode(phone, message string) (err error) {
+	smsReq := sms.NewSMS(os.Getenv("SMS_FROM_PHONE_NUMBER"))
+	smsReq.ToPhoneNumber = phone
+	smsReq.Message = message
+	err = h.smsSender.Send(smsReq)
+	return
+}
+
+// handleRequestMagicLink emails a link signing the user in. Emails which aren't
+// registered yet get one as well, the user is created once the link is used.
+func (h *Handler) handleRequestMagicLink(c *gin.Context) {
+	var req EmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	email := normaliseEmail(req.Email)
+	if !strings.Contains(email, "@") {
+		c.JSON(400, gin.H{"error": "Invalid email"})
+		return
+	}
+	_, secret, err := models.NewOneTimeCode(h.Db, models.MagicLinkPurpose, email, 0)
+	if err != nil {
+		h.writeOneTimeCodeError(c, err)
+		return
+	}
+	link := fmt.Sprintf("%s/magic-link?token=%s", os.Getenv("FRONTEND_URL"), secret)
+	if err = h.mailer.Send(&mailer.MailerRequest{
+		To:          []string{email},
+		Subject:     "Sign in link",
+		PlainText:   fmt.Sprintf("Open the link to sign in, it expires in %d minutes: %s", int(models.MagicLinkTTL.Minutes()), link),
+		HtmlContent: fmt.Sprintf(`<p>Open the link to sign in, it expires in %d minutes: <a href="%s">Sign in</a></p>`, int(models.MagicLinkTTL.Minutes()), link),
+	}); err != nil {
+		log.Println("Failed to send the magic link", err)
+		c.JSON(500, gin.H{"error": "Failed to send the code"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "A sign in link has been sent"})
+}
+
+// handleMagicLinkLogin signs the user in with the token of a magic link, creating the user if needed.
+// Opening the link proves the user owns the email, which drops the credentials set up while it
+// wasn't verified, see models.User.ClaimEmail.
+func (h *Handler) handleMagicLinkLogin(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	oneTimeCode, err := models.ConsumeMagicLink(h.Db, req.Token)
+	if err != nil {
+		h.writeUserTokenError(c, err)
+		return
+	}
+
+	user := &models.User{}
+	err = h.Db.Transaction(func(tx *gorm.DB) (err error) {
+		err = tx.Where("LOWER(email) = ?", oneTimeCode.Identifier).First(user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			user = &models.User{
+				Email:       oneTimeCode.Identifier,
+				Name:        strings.Split(oneTimeCode.Identifier, "@")[0],
+				UserStatus:  models.ActiveUser,
+				CreatedFrom: models.MagicLinkCreatedFrom,
+			}
+			err = tx.Create(user).Error
+		}
+		if err != nil {
+			return
+		}
+		err = user.ClaimEmail(tx)
+		return
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save user"})
+		return
+	}
+	h.completeLogin(c, "Login successful", user)
+}
+
+// handleRequestSMSCode texts a sign in code to a verified phone number. It answers the same
+// way whether or not the number belongs to an user so that it can't be used to discover users.
+func (h *Handler) handleRequestSMSCode(c *gin.Context) {
+	var req PhoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	phone, ok := normalisePhone(req.Phone)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid phone number"})
+		return
+	}
+	message := gin.H{"message": "If the phone number can sign in, a code has been sent"}
+	user := &models.User{}
+	if err := h.Db.Where("phone = ? AND phone_verified_at IS NOT NULL", phone).First(user).Error; err != nil {
+		c.JSON(200, message)
+		return
+	}
+	_, code, err := models.NewOneTimeCode(h.Db, models.SMSLoginPurpose, phone, 0)
+	if err != nil {
+		h.writeOneTimeCodeError(c, err)
+		return
+	}
+	if err = h.sendSmsCode(phone, fmt.Sprintf("Your sign in code is %s", code)); err != nil {
+		log.Println("Failed to send the sign in code", user.ID, err)
+		c.JSON(500, gin.H{"error": "Failed to send the code"})
+		return
+	}
+	c.JSON(200, message)
+}
+
+// handleSMSLogin signs the user in with the code texted to their phone number
+func (h *Handler) handleSMSLogin(c *gin.Context) {
+	var req PhoneCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	phone, ok := normalisePhone(req.Phone)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid phone number"})
+		return
+	}
+	if _, err := models.ConsumeOneTimeCode(h.Db, models.SMSLoginPurpose, phone, req.Code); err != nil {
+		h.writeUserTokenError(c, err)
+		return
+	}
+	user := &models.User{}
+	if err := h.Db.Where("phone = ? AND phone_verified_at IS NOT NULL", phone).First(user).Error; err != nil {
+		c.JSON(400, gin.H{"error": "User not found"})
+		return
+	}
+	h.completeLogin(c, "Login successful", user)
+}
+
+// handleRequestPhoneVerification texts a code proving the signed in user owns the phone number
+func (h *Handler) handleRequestPhoneVerification(c *gin.Context) {
+	if !h.rejectAPIKey(c, "API keys can't change the phone number") {
+		return
+	}
+	var req PhoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	phone, ok := normalisePhone(req.Phone)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid phone number"})
+		return
+	}
+	user := h.GetUserFromContext(c)
+	var count int64
+	if err := h.Db.Model(&models.User{}).Where("phone = ? AND id != ?", phone, user.ID).Count(&count).Error; err != nil {
+		h.WriteError(c, err, "Failed to send the code")
+		return
+	}
+	if count > 0 {
+		c.JSON(409, gin.H{"error": "Phone number is already used"})
+		return
+	}
+	_, code, err := models.NewOneTimeCode(h.Db, models.PhoneVerificationPurpose, phone, user.ID)
+	if err != nil {
+		h.writeOneTimeCodeError(c, err)
+		return
+	}
+	if err = h.sendSmsCode(phone, fmt.Sprintf("Your verification code is %s", code)); err != nil {
+		log.Println("Failed to send the verification code", user.ID, err)
+		c.JSON(500, gin.H{"error": "Failed to send the code"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "A verification code has been sent"})
+}
+
+// handleVerifyPhone sets the phone number of the user once the texted code is verified
+func (h *Handler) handleVerifyPhone(c *gin.Context) {
+	if !h.rejectAPIKey(c, "API keys can't change the phone number") {
+		return
+	}
+	var req PhoneCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	phone, ok := normalisePhone(req.Phone)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid phone number"})
+		return
+	}
+	user := h.GetUserFromContext(c)
+	oneTimeCode, err := models.ConsumeOneTimeCode(h.Db, models.PhoneVerificationPurpose, phone, req.Code)
+	if err == nil && oneTimeCode.UserID != user.ID {
+		err = models.ErrInvalidUserToken
+	}
+	if err != nil {
+		h.writeUserTokenError(c, err)
+		return
+	}
+
+	now := time.Now()
+	if err = h.Db.Model(user).Updates(map[string]interface{}{
+		"phone":             phone,
+		"phone_verified_at": now,
+	}).Error; err != nil {
+		c.JSON(409, gin.H{"error": "Phone number is already used"})
+		return
+	}
+	user.Phone = &phone
+	user.PhoneVerifiedAt = &now
+	h.WriteSuccess(c, user)
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/sms"
+)
+
+// recordingSmsSender records the SMS instead of sending them
+type recordingSmsSender struct {
+	requests []*sms.SmsRequest
+}
+
+func (s *recordingSmsSender) Send(req *sms.SmsRequest) error {
+	s.requests = append(s.requests, req)
+	return nil
+}
+
+// lastCode returns the code of the last SMS sent
+func (s *recordingSmsSender) lastCode(t *testing.T) string {
+	require.NotEmpty(t, s.requests)
+	message := s.requests[len(s.requests)-1].Message
+	return message[strings.LastIndex(message, " ")+1:]
+}
+
+func TestPasswordlessAuthenticationHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	m := &recordingMailer{}
+	handler.SetMailer(m)
+	s := &recordingSmsSender{}
+	handler.SetSmsSender(s)
+
+	t.Run("Magic link signs up and in", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/magic-link", map[string]string{"email": "Magic@Example.com"}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		token := m.lastToken(t)
+		assert.Contains(t, m.requests[len(m.requests)-1].To, "magic@example.com")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/magic-link/verify", map[string]string{"token": token}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, response["token"].(string))
+		assert.Equal(t, 200, w.Code)
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "magic@example.com").First(&user).Error)
+		assert.True(t, user.IsEmailVerified())
+		assert.Equal(t, models.MagicLinkCreatedFrom, user.CreatedFrom)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/magic-link/verify", map[string]string{"token": token}, "")
+		assertErrorResponse(t, w, 400, "Invalid or already used token")
+	})
+
+	t.Run("Magic link drops the password of an unverified user", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/register", map[string]string{
+			"email":    "squatted@example.com",
+			"password": "squatter-password",
+		}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/magic-link", map[string]string{"email": "squatted@example.com"}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/magic-link/verify", map[string]string{"token": m.lastToken(t)}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "squatted@example.com").First(&user).Error)
+		assert.True(t, user.IsEmailVerified())
+		assert.Empty(t, user.PasswordHash)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/login", map[string]string{
+			"email":    "squatted@example.com",
+			"password": "squatter-password",
+		}, "")
+		assert.Equal(t, 401, w.Code, w.Body.String())
+	})
+
+	t.Run("Codes are rate limited per identifier", func(t *testing.T) {
+		for i := 0; i < models.CodeRateLimit; i++ {
+			w := makeAuthenticatedRequest(t, handler, "POST", "/auth/magic-link", map[string]string{"email": "limited@example.com"}, "")
+			require.Equal(t, 200, w.Code, w.Body.String())
+		}
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/magic-link", map[string]string{"email": "limited@example.com"}, "")
+		assertErrorResponse(t, w, 429, "Too many codes requested, try again later")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/magic-link", map[string]string{"email": "unlimited@example.com"}, "")
+		assert.Equal(t, 200, w.Code)
+	})
+
+	user, token := createTestUser(t, db, "sms@example.com")
+
+	t.Run("Phone number is verified before signing in with it", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/sms-otp", map[string]string{"phone": "+1 415 555 0100"}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Empty(t, s.requests)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/profile/phone", map[string]string{"phone": "not a number"}, token)
+		assertErrorResponse(t, w, 400, "Invalid phone number")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/profile/phone", map[string]string{"phone": "+1 (415) 555-0100"}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, "+14155550100", s.requests[0].ToPhoneNumber)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/profile/phone/verify", map[string]string{"phone": "+14155550100", "code": s.lastCode(t)}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		var updated models.User
+		require.NoError(t, db.First(&updated, user.ID).Error)
+		require.NotNil(t, updated.Phone)
+		assert.Equal(t, "+14155550100", *updated.Phone)
+		assert.NotNil(t, updated.PhoneVerifiedAt)
+	})
+
+	t.Run("SMS code signs in", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/sms-otp", map[string]string{"phone": "+14155550100"}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		code := s.lastCode(t)
+		assert.Len(t, code, models.SMSCodeDigits)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/sms-otp/verify", map[string]string{"phone": "+14155550100", "code": code}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, response["token"].(string))
+		require.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), user.Email)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/sms-otp/verify", map[string]string{"phone": "+14155550100", "code": code}, "")
+		assertErrorResponse(t, w, 400, "Invalid or already used token")
+	})
+
+	t.Run("SMS code can only be guessed a few times", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/sms-otp", map[string]string{"phone": "+14155550100"}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		code := s.lastCode(t)
+		wrong := "000000"
+		if code == wrong {
+			wrong = "111111"
+		}
+		for i := 0; i < models.MaxCodeAttempts; i++ {
+			w = makeAuthenticatedRequest(t, handler, "POST", "/auth/sms-otp/verify", map[string]string{"phone": "+14155550100", "code": wrong}, "")
+			assertErrorResponse(t, w, 400, "Invalid or already used token")
+		}
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/sms-otp/verify", map[string]string{"phone": "+14155550100", "code": code}, "")
+		assertErrorResponse(t, w, 400, "Invalid or already used token")
+	})
+}
@@ -3,8 +3,10 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -17,6 +19,8 @@ import (
 
 	"github.com/gsarmaonline/goiter/config"
 	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/payments"
+	"github.com/gsarmaonline/goiter/core/services/signing"
 )
 
 // Test helper functions
@@ -31,6 +35,24 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		&models.Plan{},
 		&models.Feature{},
 		&models.PlanFeature{},
+		&models.Group{},
+		&models.GroupMember{},
+		&models.RoleAccess{},
+		&models.Project{},
+		&models.ProjectMember{},
+		&models.AccountMembership{},
+		&models.AccountInvitation{},
+		&models.Session{},
+		&models.RotatedRefreshToken{},
+		&models.UserToken{},
+		&models.UserIdentity{},
+		&models.APIKey{},
+		&models.RecoveryCode{},
+		&models.OneTimeCode{},
+		&models.ImpersonationLog{},
+		&models.SAMLConfig{},
+		&models.UsageRecord{},
+		&models.OutboxEvent{},
 	)
 	require.NoError(t, err)
 
@@ -57,6 +79,7 @@ func setupTestHandler(t *testing.T) (*Handler, *gorm.DB) {
 	cfg := &config.Config{Mode: config.ModeDev}
 	router := gin.New()
 	handler := NewHandler(router, db, cfg)
+	handler.SetPaymentGateway(payments.NewFakeGateway())
 
 	return handler, db
 }
@@ -65,7 +88,6 @@ func createTestUser(t *testing.T, db *gorm.DB, email string) (*models.User, stri
 	user := &models.User{
 		Email:       email,
 		Name:        "Test User",
-		GoogleID:    "test-google-id-" + email, // Make GoogleID unique
 		UserStatus:  models.ActiveUser,
 		CreatedFrom: "test",
 	}
@@ -74,18 +96,27 @@ func createTestUser(t *testing.T, db *gorm.DB, email string) (*models.User, stri
 	require.NoError(t, err)
 
 	// Create JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"email": user.Email,
-			"exp":   time.Now().Add(time.Hour * 24).Unix(),
-		})
-
-	tokenString, err := token.SignedString([]byte("test-secret-key"))
-	require.NoError(t, err)
+	tokenString := signTestToken(t, user, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour * 24).Unix(),
+	})
 
 	return user, tokenString
 }
 
+// signTestToken signs the claims for the user with the test secret, adding the
+// sub, iss, aud, iat and jti claims the authentication middleware requires
+func signTestToken(t *testing.T, user *models.User, claims jwt.MapClaims) string {
+	claims["sub"] = strconv.FormatUint(uint64(user.ID), 10)
+	claims["iss"] = signing.DefaultIssuer
+	claims["aud"] = signing.DefaultIssuer
+	claims["iat"] = time.Now().Unix()
+	claims["jti"] = fmt.Sprintf("test-%d-%d", user.ID, time.Now().UnixNano())
+
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test-secret-key"))
+	require.NoError(t, err)
+	return tokenString
+}
+
 func makeAuthenticatedRequest(t *testing.T, handler *Handler, method, path string, body interface{}, token string) *httptest.ResponseRecorder {
 	var reqBody *bytes.Buffer
 	if body != nil {
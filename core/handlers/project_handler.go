@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"gorm.io/gorm"
+)
+
+type (
+	ProjectHandler struct {
+		db      *gorm.DB
+		handler *Handler
+	}
+
+	ProjectRequest struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+	}
+
+	ProjectMemberRequest struct {
+		UserID uint                `json:"user_id" binding:"required"`
+		Role   models.ProjectRoleT `json:"role"`
+	}
+)
+
+func NewProjectHandler(handler *Handler) *ProjectHandler {
+	return &ProjectHandler{handler: handler, db: handler.Db}
+}
+
+// getProject returns the project of the URL after checking the user can perform the action on it.
+// Members can read the project while admins can manage it. Other users need a RoleAccess rule.
+func (h *ProjectHandler) getProject(c *gin.Context, action models.ActionT) (project *models.Project, ok bool) {
+	project = &models.Project{}
+	if err := h.db.Where("id = ?", c.Param(DefaultUrlKeyName)).First(project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	userID := h.handler.GetUserFromContext(c).ID
+	allowed := project.IsManageableBy(h.db, userID)
+	if !allowed && action == models.ReadAction {
+		allowed = project.IsAccessibleBy(h.db, userID)
+	}
+	if !allowed && h.handler.Authorise(c, project, action) != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to " + string(action) + " the project"})
+		return
+	}
+	ok = true
+	return
+}
+
+// ListProjects lists the projects of the account along with the ones the user is a member of
+func (h *ProjectHandler) ListProjects(c *gin.Context) {
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	projects := []models.Project{}
+	memberProjectIDs := h.db.Model(&models.ProjectMember{}).
+		Select("project_id").
+		Where("member_id = ?", h.handler.GetUserFromContext(c).ID)
+	if err = h.db.Where("owner_type = ? AND owner_id = ?", models.AccountScopeType, account.ID).
+		Or("id IN (?)", memberProjectIDs).
+		Find(&projects).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list projects")
+		return
+	}
+	h.handler.WriteSuccess(c, projects)
+}
+
+// CreateProject creates a project in the account within the project limit of its plan.
+// The creator becomes an admin of the project.
+func (h *ProjectHandler) CreateProject(c *gin.Context) {
+	var req ProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	if err = h.handler.AuthoriseAccount(c, account, models.UpdateAction); err != nil {
+		h.handler.WriteError(c, err, "Not allowed to create projects in the account")
+		return
+	}
+
+	user := h.handler.GetUserFromContext(c)
+	project := &models.Project{
+		Name:        req.Name,
+		Description: req.Description,
+	}
+	project.UserID = user.ID
+	project.SetOwner(models.AccountScopeType, account.ID)
+	if err = h.db.Transaction(func(tx *gorm.DB) (err error) {
+		if err = h.handler.CheckEntitlementLocked(tx, account, models.ProjectsFeature); err != nil {
+			return
+		}
+		if err = tx.Create(project).Error; err != nil {
+			return
+		}
+		member := &models.ProjectMember{
+			ProjectID: project.ID,
+			MemberID:  user.ID,
+			Role:      models.ProjectAdminRole,
+		}
+		member.UserID = user.ID
+		member.SetOwner(models.ProjectScopeType, project.ID)
+		err = tx.Create(member).Error
+		return
+	}); err != nil {
+		if !h.handler.WriteEntitlementError(c, models.ProjectsFeature, err) {
+			h.handler.WriteError(c, err, "Failed to create project")
+		}
+		return
+	}
+	h.handler.WriteSuccess(c, project)
+}
+
+// GetProject returns a project the user can access
+func (h *ProjectHandler) GetProject(c *gin.Context) {
+	project, ok := h.getProject(c, models.ReadAction)
+	if !ok {
+		return
+	}
+	h.handler.WriteSuccess(c, project)
+}
+
+// UpdateProject updates a project the user can manage
+func (h *ProjectHandler) UpdateProject(c *gin.Context) {
+	var req ProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	project, ok := h.getProject(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	project.Name = req.Name
+	project.Description = req.Description
+	if err := h.db.Model(project).Select("name", "description").Updates(project).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to update project")
+		return
+	}
+	h.handler.WriteSuccess(c, project)
+}
+
+// DeleteProject deletes a project the user can manage along with its memberships
+func (h *ProjectHandler) DeleteProject(c *gin.Context) {
+	project, ok := h.getProject(c, models.DeleteAction)
+	if !ok {
+		return
+	}
+	if err := project.DeleteWithMembers(h.db); err != nil {
+		h.handler.WriteError(c, err, "Failed to delete project")
+		return
+	}
+	h.handler.WriteSuccess(c, gin.H{"message": "Project deleted successfully"})
+}
+
+// ListProjectMembers lists the members of a project the user can access
+func (h *ProjectHandler) ListProjectMembers(c *gin.Context) {
+	project, ok := h.getProject(c, models.ReadAction)
+	if !ok {
+		return
+	}
+	members := []models.ProjectMember{}
+	if err := h.db.Preload("Member").Where("project_id = ?", project.ID).Find(&members).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list project members")
+		return
+	}
+	h.handler.WriteSuccess(c, members)
+}
+
+// AddProjectMember adds an user to a project the user can manage
+func (h *ProjectHandler) AddProjectMember(c *gin.Context) {
+	var (
+		req   ProjectMemberRequest
+		count int64
+	)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.ProjectMemberRole
+	}
+	if !req.Role.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+	project, ok := h.getProject(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	if h.db.Model(&models.User{}).Where("id = ?", req.UserID).Count(&count); count == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	if _, err := project.GetMember(h.db, req.UserID); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a member of the project"})
+		return
+	}
+
+	member := &models.ProjectMember{
+		ProjectID: project.ID,
+		MemberID:  req.UserID,
+		Role:      req.Role,
+	}
+	member.SetOwner(models.ProjectScopeType, project.ID)
+	if err := h.handler.CreateWithUser(c, member); err != nil {
+		h.handler.WriteError(c, err, "Failed to add project member")
+		return
+	}
+	h.handler.WriteSuccess(c, member)
+}
+
+// RemoveProjectMember removes a member from a project the user can manage
+func (h *ProjectHandler) RemoveProjectMember(c *gin.Context) {
+	project, ok := h.getProject(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	member := &models.ProjectMember{}
+	if err := h.db.Where("project_id = ? AND id = ?", project.ID, c.Param("member_id")).First(member).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project member not found"})
+		return
+	}
+	if err := h.db.Delete(member).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to remove project member")
+		return
+	}
+	h.handler.WriteSuccess(c, gin.H{"message": "Project member removed successfully"})
+}
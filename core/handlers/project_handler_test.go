@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/middleware"
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+func createTestProject(t *testing.T, handler *Handler, token, name string) uint {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/projects", map[string]interface{}{
+		"name": name,
+	}, token)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	return parseDataID(t, w)
+}
+
+func TestProjectHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+
+	user, token := createTestUser(t, db, "projects@example.com")
+	member, memberToken := createTestUser(t, db, "projectmember@example.com")
+	_, otherToken := createTestUser(t, db, "otherprojects@example.com")
+
+	var account models.Account
+	require.NoError(t, db.Where("user_id = ?", user.ID).First(&account).Error)
+
+	t.Run("CRUD", func(t *testing.T) {
+		projectID := createTestProject(t, handler, token, "website")
+
+		var project models.Project
+		require.NoError(t, db.First(&project, projectID).Error)
+		assert.Equal(t, user.ID, project.UserID)
+		assert.Equal(t, models.AccountScopeType, project.OwnerType)
+		assert.Equal(t, account.ID, project.OwnerID)
+
+		// The creator is an admin of the project
+		creator, err := project.GetMember(db, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.ProjectAdminRole, creator.Role)
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/projects", nil, token)
+		assert.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response["data"], 1)
+
+		w = makeAuthenticatedRequest(t, handler, "PUT", fmt.Sprintf("/projects/%d", projectID), map[string]interface{}{
+			"name":        "website_v2",
+			"description": "The new website",
+		}, token)
+		assert.Equal(t, 200, w.Code)
+		require.NoError(t, db.First(&project, projectID).Error)
+		assert.Equal(t, "website_v2", project.Name)
+		assert.Equal(t, "The new website", project.Description)
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/projects/%d", projectID), nil, token)
+		assert.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "GET", fmt.Sprintf("/projects/%d", projectID), nil, token)
+		assertErrorResponse(t, w, 404, "Project not found")
+
+		var count int64
+		db.Model(&models.ProjectMember{}).Where("project_id = ?", projectID).Count(&count)
+		assert.Zero(t, count)
+	})
+
+	t.Run("Members", func(t *testing.T) {
+		projectID := createTestProject(t, handler, token, "mobile")
+		projectPath := fmt.Sprintf("/projects/%d", projectID)
+
+		w := makeAuthenticatedRequest(t, handler, "GET", projectPath, nil, memberToken)
+		assertErrorResponse(t, w, 403, "Not allowed to read the project")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", projectPath+"/members", map[string]interface{}{
+			"user_id": member.ID,
+			"role":    "owner",
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid role")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", projectPath+"/members", map[string]interface{}{
+			"user_id": member.ID,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		memberID := parseDataID(t, w)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", projectPath+"/members", map[string]interface{}{
+			"user_id": member.ID,
+		}, token)
+		assertErrorResponse(t, w, 409, "User is already a member of the project")
+
+		// Members can read the project but not manage it
+		w = makeAuthenticatedRequest(t, handler, "GET", projectPath, nil, memberToken)
+		assert.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "GET", "/projects", nil, memberToken)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response["data"], 1)
+		w = makeAuthenticatedRequest(t, handler, "PUT", projectPath, map[string]interface{}{"name": "renamed"}, memberToken)
+		assertErrorResponse(t, w, 403, "Not allowed to update the project")
+
+		w = makeAuthenticatedRequest(t, handler, "GET", projectPath+"/members", nil, memberToken)
+		assert.Equal(t, 200, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response["data"], 2)
+
+		// Users outside the project can't see it
+		w = makeAuthenticatedRequest(t, handler, "GET", projectPath, nil, otherToken)
+		assertErrorResponse(t, w, 403, "Not allowed to read the project")
+		w = makeAuthenticatedRequest(t, handler, "GET", "/projects", nil, otherToken)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response["data"], 0)
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("%s/members/%d", projectPath, memberID), nil, token)
+		assert.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "GET", projectPath, nil, memberToken)
+		assertErrorResponse(t, w, 403, "Not allowed to read the project")
+	})
+
+	t.Run("Plan limit", func(t *testing.T) {
+		limitUser, limitToken := createTestUser(t, db, "projectlimit@example.com")
+		var limitAccount models.Account
+		require.NoError(t, db.Where("user_id = ?", limitUser.ID).First(&limitAccount).Error)
+
+		plan := &models.Plan{Name: "Starter", BillingPeriod: "monthly"}
+		require.NoError(t, db.Create(plan).Error)
+		feature := &models.Feature{Name: models.ProjectsFeature, Limit: 1}
+		require.NoError(t, db.Create(feature).Error)
+		require.NoError(t, db.Create(&models.PlanFeature{PlanID: plan.ID, FeatureID: feature.ID}).Error)
+		require.NoError(t, db.Model(&limitAccount).Update("plan_id", plan.ID).Error)
+
+		createTestProject(t, handler, limitToken, "first")
+		w := makeAuthenticatedRequest(t, handler, "POST", "/projects", map[string]interface{}{
+			"name": "second",
+		}, limitToken)
+		assertErrorResponse(t, w, 403, "Projects limit of the plan reached")
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, LimitReachedCode, response["code"])
+		assert.Equal(t, map[string]interface{}{
+			"feature":   models.ProjectsFeature,
+			"limit":     float64(1),
+			"counted":   true,
+			"used":      float64(1),
+			"remaining": float64(0),
+			"allowed":   false,
+		}, response["entitlement"])
+
+		// Plans without the feature don't allow any
+		require.NoError(t, db.Model(feature).Update("limit", 0).Error)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/projects", map[string]interface{}{
+			"name": "second",
+		}, limitToken)
+		assertErrorResponse(t, w, 402, "Projects isn't included in the plan")
+	})
+
+	t.Run("Current project", func(t *testing.T) {
+		projectID := createTestProject(t, handler, token, "current")
+
+		makeProjectRequest := func(token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/profile", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set(middleware.ProjectHeader, fmt.Sprintf("%d", projectID))
+			w := httptest.NewRecorder()
+			handler.router.ServeHTTP(w, req)
+			return w
+		}
+		assert.Equal(t, 200, makeProjectRequest(token).Code)
+		assertErrorResponse(t, makeProjectRequest(otherToken), 403, "Not a member of the project")
+
+		// Models scoped to projects are created inside the current project
+		var project models.Project
+		require.NoError(t, db.First(&project, projectID).Error)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Set(middleware.UserKey, user)
+		c.Set(middleware.ProjectKey, &project)
+
+		projectMember := &models.ProjectMember{ProjectID: project.ID, MemberID: member.ID, Role: models.ProjectMemberRole}
+		require.NoError(t, handler.CreateWithUser(c, projectMember))
+		assert.Equal(t, models.ProjectScopeType, projectMember.OwnerType)
+		assert.Equal(t, project.ID, projectMember.OwnerID)
+	})
+}
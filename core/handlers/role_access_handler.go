@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"gorm.io/gorm"
+)
+
+type (
+	RoleAccessHandler struct {
+		db      *gorm.DB
+		handler *Handler
+	}
+
+	RoleAccessRequest struct {
+		AccessorType models.ElementT   `json:"accessor_type" binding:"required"`
+		AccessorID   uint              `json:"accessor_id" binding:"required"`
+		ResourceType models.ElementT   `json:"resource_type" binding:"required"`
+		ResourceID   *uint             `json:"resource_id"` // Omitted or 0 for the rules on all the resources of the type
+		Action       models.ActionT    `json:"action" binding:"required"`
+		ScopeType    models.ScopeTypeT `json:"scope_type"`
+		ScopeID      uint              `json:"scope_id"`
+		Effect       models.EffectT    `json:"effect"`
+		Priority     int               `json:"priority"`
+	}
+
+	ExplainRoleAccessRequest struct {
+		UserID       uint           `form:"user_id"`
+		ResourceType string         `form:"resource_type" binding:"required"`
+		ResourceID   uint           `form:"resource_id" binding:"required"`
+		Action       models.ActionT `form:"action" binding:"required"`
+	}
+)
+
+func NewRoleAccessHandler(handler *Handler) *RoleAccessHandler {
+	return &RoleAccessHandler{handler: handler, db: handler.Db}
+}
+
+func (h *RoleAccessHandler) authoriseAccount(c *gin.Context, action models.ActionT) (ok bool) {
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	if err = h.handler.AuthoriseAccount(c, account, action); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage rules of the account"})
+		return
+	}
+	ok = true
+	return
+}
+
+// ListRoleAccesses lists the rules granted in the account
+func (h *RoleAccessHandler) ListRoleAccesses(c *gin.Context) {
+	ok := h.authoriseAccount(c, models.ReadAction)
+	if !ok {
+		return
+	}
+	query := h.handler.AccountScopedDB(c)
+	if resourceType := c.Query("resource_type"); resourceType != "" {
+		query = query.Where("resource_type = ?", resourceType)
+	}
+	if accessorType := c.Query("accessor_type"); accessorType != "" {
+		query = query.Where("accessor_type = ?", accessorType)
+	}
+	roleAccesses := []models.RoleAccess{}
+	if err := query.Find(&roleAccesses).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to list rules")
+		return
+	}
+	h.handler.WriteSuccess(c, roleAccesses)
+}
+
+// GrantRoleAccess allows an user or a group of the account to perform an action on a resource
+func (h *RoleAccessHandler) GrantRoleAccess(c *gin.Context) {
+	var req RoleAccessRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !req.Action.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action"})
+		return
+	}
+	if req.Effect == "" {
+		req.Effect = models.AllowEffect
+	}
+	if !req.Effect.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid effect"})
+		return
+	}
+	ok := h.authoriseAccount(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	if !h.accessorExists(c, req.AccessorType, req.AccessorID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Accessor not found"})
+		return
+	}
+	var resourceID uint
+	if req.ResourceID != nil {
+		resourceID = *req.ResourceID
+	}
+	if resourceID == 0 {
+		// Rules on all the resources of a type only apply inside the account,
+		// unless they're restricted to one of its projects
+		if !h.isResourceType(req.ResourceType) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid resource type"})
+			return
+		}
+		if req.ScopeType == "" {
+			account, err := h.handler.GetAccountFromContext(c)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+				return
+			}
+			req.ScopeType, req.ScopeID = models.AccountScopeType, account.ID
+		}
+	} else if !h.canGrantOnResource(c, req.ResourceType, resourceID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Resource not found"})
+		return
+	}
+	if !h.scopeBelongsToAccount(c, req.ScopeType, req.ScopeID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope"})
+		return
+	}
+
+	roleAccess := &models.RoleAccess{
+		AccessorType: req.AccessorType,
+		AccessorID:   req.AccessorID,
+		ResourceType: req.ResourceType,
+		ResourceID:   resourceID,
+		Scope: models.Scope{
+			ScopeType: req.ScopeType,
+			ScopeID:   req.ScopeID,
+		},
+		Action:   req.Action,
+		Effect:   req.Effect,
+		Priority: req.Priority,
+	}
+	if err := h.handler.CreateInAccount(c, roleAccess); err != nil {
+		h.handler.WriteError(c, err, "Failed to grant rule")
+		return
+	}
+	h.handler.WriteSuccess(c, roleAccess)
+}
+
+// RevokeRoleAccess deletes a rule of the account
+func (h *RoleAccessHandler) RevokeRoleAccess(c *gin.Context) {
+	ok := h.authoriseAccount(c, models.UpdateAction)
+	if !ok {
+		return
+	}
+	roleAccess := &models.RoleAccess{}
+	if err := h.handler.AccountScopedDB(c).Where("id = ?", c.Param(DefaultUrlKeyName)).First(roleAccess).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	}
+	if err := h.db.Delete(roleAccess).Error; err != nil {
+		h.handler.WriteError(c, err, "Failed to revoke rule")
+		return
+	}
+	h.handler.WriteSuccess(c, gin.H{"message": "Rule revoked successfully"})
+}
+
+// ExplainRoleAccess explains which rule and group path decide whether an user can perform
+// an action on a resource of the account. Explaining requires being able to read the resource
+// or to manage the account, and explaining the access of another user requires being able to
+// update the resource.
+func (h *RoleAccessHandler) ExplainRoleAccess(c *gin.Context) {
+	var req ExplainRoleAccessRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request parameters"})
+		return
+	}
+	if !req.Action.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action"})
+		return
+	}
+	resource, err := h.handler.FindResource(req.ResourceType, req.ResourceID)
+	if err != nil || !h.canExplain(c, resource) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Resource not found"})
+		return
+	}
+
+	user := h.handler.GetUserFromContext(c)
+	if req.UserID != 0 && req.UserID != user.ID {
+		if err = h.handler.Authorise(c, resource, models.UpdateAction); err != nil {
+			h.handler.WriteError(c, err, "Not allowed to explain the access of other users")
+			return
+		}
+		user = &models.User{}
+		if err = h.db.Where("id = ?", req.UserID).First(user).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+	}
+
+	decision, err := h.handler.ExplainAccess(user, resource, req.Action)
+	if err != nil {
+		h.handler.WriteError(c, err, "Failed to explain access")
+		return
+	}
+	h.handler.WriteSuccess(c, decision)
+}
+
+// canExplain checks that the resource belongs to the account, unless it's owned by an user,
+// and that the user can read it or manage the account
+func (h *RoleAccessHandler) canExplain(c *gin.Context, resource models.UserOwnedModel) bool {
+	account, role, err := h.handler.GetAccountRoleFromContext(c)
+	if err != nil {
+		return false
+	}
+	inAccount := false
+	if resourceAccount, ok := resource.(*models.Account); ok {
+		if resourceAccount.ID != account.ID {
+			return false
+		}
+		inAccount = true
+	} else if scopedModel, ok := resource.(models.ScopedModel); ok && scopedModel.GetOwnerType() != models.UserScopeType {
+		if !h.scopeBelongsToAccount(c, scopedModel.GetOwnerType(), scopedModel.GetOwnerID()) {
+			return false
+		}
+		inAccount = true
+	}
+	if inAccount && role.CanManageAccount() {
+		return true
+	}
+	return h.handler.Authorise(c, resource, models.ReadAction) == nil
+}
+
+func (h *RoleAccessHandler) accessorExists(c *gin.Context, accessorType models.ElementT, accessorID uint) bool {
+	var count int64
+	switch accessorType {
+	case models.UserElement:
+		h.db.Model(&models.User{}).Where("id = ?", accessorID).Count(&count)
+	case models.GroupElement:
+		h.handler.AccountScopedDB(c).Model(&models.Group{}).Where("id = ?", accessorID).Count(&count)
+	}
+	return count > 0
+}
+
+// canGrantOnResource checks that the resource exists and that the user is allowed
+// to share it, i.e the resource is a group of the account or the user can update it
+func (h *RoleAccessHandler) canGrantOnResource(c *gin.Context, resourceType models.ElementT, resourceID uint) bool {
+	if resourceType == models.GroupElement {
+		var count int64
+		h.handler.AccountScopedDB(c).Model(&models.Group{}).Where("id = ?", resourceID).Count(&count)
+		return count > 0
+	}
+	_, err := h.handler.FindResourceWithAction(c, string(resourceType), resourceID, models.UpdateAction)
+	return err == nil
+}
+
+// isResourceType checks that the rules can be set on the resources of the type
+func (h *RoleAccessHandler) isResourceType(resourceType models.ElementT) bool {
+	if resourceType == models.GroupElement {
+		return true
+	}
+	if h.handler.modelRegistry == nil {
+		return false
+	}
+	_, err := h.handler.modelRegistry.NewModelByType(string(resourceType))
+	return err == nil
+}
+
+// scopeBelongsToAccount checks that the scope of a rule is either empty, the account
+// or one of its projects, so that rules can't be scoped to other tenants
+func (h *RoleAccessHandler) scopeBelongsToAccount(c *gin.Context, scopeType models.ScopeTypeT, scopeID uint) bool {
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
+		return false
+	}
+	switch scopeType {
+	case "":
+		return scopeID == 0
+	case models.AccountScopeType:
+		return scopeID == account.ID
+	case models.ProjectScopeType:
+		var count int64
+		h.handler.AccountScopedDB(c).Model(&models.Project{}).Where("id = ?", scopeID).Count(&count)
+		return count > 0
+	}
+	return false
+}
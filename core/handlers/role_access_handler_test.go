@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+func TestRoleAccessHandler(t *testing.T) {
+	handler := setupGroupTestHandler(t)
+	db := handler.Db
+
+	user, token := createTestUser(t, db, "rules@example.com")
+	accessor, _ := createTestUser(t, db, "rulesaccessor@example.com")
+	_, otherToken := createTestUser(t, db, "otherrules@example.com")
+
+	var account, accessorAccount models.Account
+	require.NoError(t, db.Where("user_id = ?", user.ID).First(&account).Error)
+	require.NoError(t, db.Where("user_id = ?", accessor.ID).First(&accessorAccount).Error)
+
+	t.Run("Grant, list and revoke", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Account",
+			"resource_id":   account.ID,
+			"action":        "read",
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		ruleID := parseDataID(t, w)
+
+		var roleAccess models.RoleAccess
+		require.NoError(t, db.First(&roleAccess, ruleID).Error)
+		assert.Equal(t, models.AccountScopeType, roleAccess.OwnerType)
+		assert.Equal(t, account.ID, roleAccess.OwnerID)
+
+		w = makeAuthenticatedRequest(t, handler, "GET", "/role_accesses?resource_type=Account", nil, token)
+		assert.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response["data"], 1)
+
+		// Other accounts can't see or revoke the rule
+		w = makeAuthenticatedRequest(t, handler, "GET", "/role_accesses", nil, otherToken)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response["data"], 0)
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/role_accesses/%d", ruleID), nil, otherToken)
+		assertErrorResponse(t, w, 404, "Rule not found")
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/role_accesses/%d", ruleID), nil, token)
+		assert.Equal(t, 200, w.Code)
+		var count int64
+		db.Model(&models.RoleAccess{}).Where("id = ?", ruleID).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("Grant to a group on a group", func(t *testing.T) {
+		accessorGroupID := createTestGroup(t, handler, token, "finance", models.UserElementType)
+		resourceGroupID := createTestGroup(t, handler, token, "billing", models.ResourceElementType)
+
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "Group",
+			"accessor_id":   accessorGroupID,
+			"resource_type": "Group",
+			"resource_id":   resourceGroupID,
+			"action":        "update",
+		}, token)
+		assert.Equal(t, 200, w.Code, w.Body.String())
+	})
+
+	t.Run("Invalid action", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Account",
+			"resource_id":   account.ID,
+			"action":        "destroy",
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid action")
+	})
+
+	t.Run("Unknown accessor", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "Group",
+			"accessor_id":   99999,
+			"resource_type": "Account",
+			"resource_id":   account.ID,
+			"action":        "read",
+		}, token)
+		assertErrorResponse(t, w, 400, "Accessor not found")
+	})
+
+	t.Run("Resources of other users can't be shared", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   user.ID,
+			"resource_type": "Account",
+			"resource_id":   accessorAccount.ID,
+			"action":        "update",
+		}, token)
+		assertErrorResponse(t, w, 400, "Resource not found")
+	})
+
+	t.Run("Deny rule with a priority", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Account",
+			"resource_id":   account.ID,
+			"action":        "read",
+			"effect":        "deny",
+			"priority":      5,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		var roleAccess models.RoleAccess
+		require.NoError(t, db.First(&roleAccess, parseDataID(t, w)).Error)
+		assert.Equal(t, models.DenyEffect, roleAccess.Effect)
+		assert.Equal(t, 5, roleAccess.Priority)
+		db.Delete(&roleAccess)
+	})
+
+	t.Run("Type wide rule", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Profile",
+			"action":        "read",
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		// The rule is restricted to the account
+		var roleAccess models.RoleAccess
+		require.NoError(t, db.First(&roleAccess, parseDataID(t, w)).Error)
+		assert.Equal(t, uint(0), roleAccess.ResourceID)
+		assert.Equal(t, models.AccountScopeType, roleAccess.ScopeType)
+		assert.Equal(t, account.ID, roleAccess.ScopeID)
+		db.Delete(&roleAccess)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Unknown",
+			"resource_id":   0,
+			"action":        "read",
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid resource type")
+	})
+
+	t.Run("Scopes of other accounts are rejected", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Profile",
+			"action":        "read",
+			"scope_type":    "Account",
+			"scope_id":      accessorAccount.ID,
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid scope")
+
+		otherProjectID := createTestProject(t, handler, otherToken, "other")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Account",
+			"resource_id":   account.ID,
+			"action":        "read",
+			"scope_type":    "Project",
+			"scope_id":      otherProjectID,
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid scope")
+
+		projectID := createTestProject(t, handler, token, "own")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Account",
+			"resource_id":   account.ID,
+			"action":        "read",
+			"scope_type":    "Project",
+			"scope_id":      projectID,
+		}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		db.Delete(&models.RoleAccess{}, parseDataID(t, w))
+	})
+
+	t.Run("Invalid effect", func(t *testing.T) {
+		w := makeAuthenticatedRequest(t, handler, "POST", "/role_accesses", map[string]interface{}{
+			"accessor_type": "User",
+			"accessor_id":   accessor.ID,
+			"resource_type": "Account",
+			"resource_id":   account.ID,
+			"action":        "read",
+			"effect":        "maybe",
+		}, token)
+		assertErrorResponse(t, w, 400, "Invalid effect")
+	})
+
+	t.Run("Explain", func(t *testing.T) {
+		handler.SetAuthorisationState(true)
+		defer handler.SetAuthorisationState(false)
+		explainPath := func(userID uint) string {
+			return fmt.Sprintf("/role_accesses/explain?resource_type=Account&resource_id=%d&action=read&user_id=%d", account.ID, userID)
+		}
+
+		w := makeAuthenticatedRequest(t, handler, "GET", explainPath(accessor.ID), nil, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		data := response["data"].(map[string]interface{})
+		assert.Equal(t, false, data["allowed"])
+		assert.Equal(t, "no_matching_rule", data["reason"])
+
+		// The resources of other accounts can't be explained, even for oneself
+		w = makeAuthenticatedRequest(t, handler, "GET", explainPath(accessor.ID), nil, otherToken)
+		assertErrorResponse(t, w, 404, "Resource not found")
+		w = makeAuthenticatedRequest(t, handler, "GET", explainPath(0), nil, otherToken)
+		assertErrorResponse(t, w, 404, "Resource not found")
+
+		w = makeAuthenticatedRequest(t, handler, "GET", explainPath(user.ID), nil, token)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		data = response["data"].(map[string]interface{})
+		assert.Equal(t, true, data["allowed"])
+		assert.Equal(t, "owner", data["reason"])
+
+		w = makeAuthenticatedRequest(t, handler, "GET", "/role_accesses/explain?resource_type=Account&resource_id=99999&action=read", nil, token)
+		assertErrorResponse(t, w, 404, "Resource not found")
+	})
+}
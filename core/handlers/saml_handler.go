@@ -0,0 +1,547 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/saml"
+	"gorm.io/gorm"
+)
+
+const (
+	// SAMLStateCookie holds the ID of the request of a SAML sign in until the identity provider posts its response
+	SAMLStateCookie = "saml_state"
+	SAMLStateTTL    = 10 * time.Minute
+)
+
+var (
+	samlDomainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+	errSAMLEmailDomain = errors.New("email isn't in a domain of the identity provider")
+	errSAMLNotMember   = errors.New("user isn't a member of the account")
+)
+
+type (
+	SAMLHandler struct {
+		db      *gorm.DB
+		handler *Handler
+	}
+
+	// SAMLConfigRequest configures the identity provider either with its metadata
+	// or with its entity ID, single sign on URL and certificate, which override the metadata
+	SAMLConfigRequest struct {
+		IdPMetadataXML string              `json:"idp_metadata_xml"`
+		IdPEntityID    string              `json:"idp_entity_id"`
+		IdPSSOURL      string              `json:"idp_sso_url"`
+		IdPCertificate string              `json:"idp_certificate"`
+		EntityID       string              `json:"entity_id"`
+		Domains        []string            `json:"domains" binding:"required"`
+		DefaultRole    models.AccountRoleT `json:"default_role"`
+	}
+
+	// SAMLConfigResponse is the configuration along with the endpoints the identity provider is set up with
+	// and the DNS TXT record the domains publish to be verified
+	SAMLConfigResponse struct {
+		*models.SAMLConfig
+		SPEntityID               string `json:"sp_entity_id"`
+		MetadataURL              string `json:"metadata_url"`
+		ACSURL                   string `json:"acs_url"`
+		LoginURL                 string `json:"login_url"`
+		DomainVerificationRecord string `json:"domain_verification_record"`
+	}
+
+	samlState struct {
+		AccountID uint   `json:"account_id"`
+		RequestID string `json:"request_id"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+)
+
+func NewSAMLHandler(handler *Handler) *SAMLHandler {
+	return &SAMLHandler{handler: handler, db: handler.Db}
+}
+
+// samlURL returns the URL of the SAML endpoint of the account, on API_URL or else the host of the request
+func (h *Handler) samlURL(c *gin.Context, accountID uint, endpoint string) string {
+	baseURL := strings.TrimSuffix(h.cfg.GetKey("API_URL"), "/")
+	if baseURL == "" {
+		scheme := "http"
+		if h.secureCookies(c) {
+			scheme = "https"
+		}
+		baseURL = scheme + "://" + c.Request.Host
+	}
+	return fmt.Sprintf("%s/auth/saml/%d/%s", baseURL, accountID, endpoint)
+}
+
+// samlServiceProvider returns the service provider of the account with its identity provider
+func (h *Handler) samlServiceProvider(c *gin.Context, samlConfig *models.SAMLConfig) (sp *saml.ServiceProvider, err error) {
+	certificates, err := saml.ParseCertificates(samlConfig.IdPCertificate)
+	if err != nil {
+		return
+	}
+	sp = &saml.ServiceProvider{
+		EntityID:        samlConfig.EntityID,
+		ACSURL:          h.samlURL(c, samlConfig.AccountID, "acs"),
+		IdPEntityID:     samlConfig.IdPEntityID,
+		IdPSSOURL:       samlConfig.IdPSSOURL,
+		IdPCertificates: certificates,
+	}
+	if sp.EntityID == "" {
+		sp.EntityID = h.samlURL(c, samlConfig.AccountID, "metadata")
+	}
+	return
+}
+
+// getSAMLServiceProvider loads the SAML configuration of the account of the route
+func (h *Handler) getSAMLServiceProvider(c *gin.Context) (samlConfig *models.SAMLConfig, sp *saml.ServiceProvider, ok bool) {
+	accountID, err := strconv.ParseUint(c.Param("account_id"), 10, 64)
+	samlConfig = &models.SAMLConfig{}
+	if err != nil || h.Db.Where("account_id = ?", accountID).First(samlConfig).Error != nil {
+		c.JSON(404, gin.H{"error": "Single sign on isn't configured for the account"})
+		return
+	}
+	if sp, err = h.samlServiceProvider(c, samlConfig); err != nil {
+		c.JSON(500, gin.H{"error": "Invalid single sign on configuration"})
+		return
+	}
+	ok = true
+	return
+}
+
+// samlSameSite lets the state cookie be sent along with the response the identity provider posts
+// from its own site, which browsers only allow for secure cookies
+func (h *Handler) samlSameSite(c *gin.Context) http.SameSite {
+	if h.secureCookies(c) {
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// handleSAMLMetadata serves the metadata the identity provider of the account is configured with
+func (h *Handler) handleSAMLMetadata(c *gin.Context) {
+	_, sp, ok := h.getSAMLServiceProvider(c)
+	if !ok {
+		return
+	}
+	c.Data(200, "application/samlmetadata+xml", sp.Metadata())
+}
+
+// handleSAMLLogin redirects the user to the identity provider of the account to sign in
+func (h *Handler) handleSAMLLogin(c *gin.Context) {
+	samlConfig, sp, ok := h.getSAMLServiceProvider(c)
+	if !ok {
+		return
+	}
+	redirectURL, requestID, err := sp.AuthnRequestURL("")
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start sign in"})
+		return
+	}
+	state := &samlState{
+		AccountID: samlConfig.AccountID,
+		RequestID: requestID,
+		ExpiresAt: time.Now().Add(SAMLStateTTL).Unix(),
+	}
+	if err = h.setStateCookie(c, SAMLStateCookie, "/auth/saml", h.samlSameSite(c), SAMLStateTTL, state); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start sign in"})
+		return
+	}
+	c.Redirect(http.StatusTemporaryRedirect, redirectURL)
+}
+
+// handleSAMLACS signs the user in with the response the identity provider posts once the user
+// signed in. The response has to answer the request of the browser which started the sign in.
+// Users signing in for the first time are provisioned into the account.
+func (h *Handler) handleSAMLACS(c *gin.Context) {
+	samlConfig, sp, ok := h.getSAMLServiceProvider(c)
+	if !ok {
+		return
+	}
+	state := &samlState{}
+	if !h.popStateCookie(c, SAMLStateCookie, "/auth/saml", h.samlSameSite(c), state) ||
+		state.AccountID != samlConfig.AccountID || time.Now().Unix() > state.ExpiresAt {
+		c.JSON(400, gin.H{"error": "Invalid SAML state"})
+		return
+	}
+	assertion, err := sp.ParseResponse(c.PostForm("SAMLResponse"), state.RequestID)
+	if err != nil {
+		log.Println("Invalid SAML response", samlConfig.AccountID, err)
+		c.JSON(401, gin.H{"error": "Invalid SAML response"})
+		return
+	}
+
+	user, err := h.findOrProvisionSAMLUser(samlConfig, assertion)
+	if err != nil {
+		switch {
+		case errors.Is(err, errSAMLEmailDomain):
+			c.JSON(403, gin.H{"error": "Email isn't in a domain of the account"})
+		case errors.Is(err, errSAMLNotMember):
+			c.JSON(403, gin.H{"error": "User isn't a member of the account"})
+		default:
+			c.JSON(500, gin.H{"error": "Failed to save user"})
+		}
+		return
+	}
+	h.redirectWithLoginCode(c, user)
+}
+
+// handleSAMLDiscover returns the sign in URL of the identity provider of the verified domain of the email
+func (h *Handler) handleSAMLDiscover(c *gin.Context) {
+	var req EmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	email := normaliseEmail(req.Email)
+	index := strings.LastIndex(email, "@")
+	if index == -1 {
+		c.JSON(400, gin.H{"error": "Invalid email"})
+		return
+	}
+	samlConfig, err := models.FindSAMLConfigByDomain(h.Db, email[index+1:])
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Single sign on isn't configured for the domain"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"account_id": samlConfig.AccountID,
+		"login_url":  h.samlURL(c, samlConfig.AccountID, "login"),
+	})
+}
+
+// findOrProvisionSAMLUser returns the user the identity provider signed in, creating them as a
+// member of the account the first time. Only emails of the verified domains of the identity
+// provider are accepted, and existing users have to be members of the account, otherwise the
+// identity provider of any account could sign in as them.
+func (h *Handler) findOrProvisionSAMLUser(samlConfig *models.SAMLConfig, assertion *saml.Assertion) (user *models.User, err error) {
+	email := normaliseEmail(assertion.Email())
+	if !samlConfig.HasVerifiedDomain(email) {
+		err = errSAMLEmailDomain
+		return
+	}
+	user = &models.User{}
+	err = h.Db.Transaction(func(tx *gorm.DB) (err error) {
+		account := &models.Account{}
+		if err = tx.First(account, samlConfig.AccountID).Error; err != nil {
+			return
+		}
+
+		identity := &models.UserIdentity{}
+		err = tx.Where("provider = ? AND subject = ?", samlConfig.ProviderName(), assertion.NameID).First(identity).Error
+		switch {
+		case err == nil:
+			err = tx.First(user, identity.UserID).Error
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			err = tx.Where("LOWER(email) = ?", email).First(user).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				if user, err = h.provisionSAMLUser(tx, samlConfig, account, email, assertion); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+			identity = &models.UserIdentity{
+				Provider: samlConfig.ProviderName(),
+				Subject:  assertion.NameID,
+				Email:    email,
+			}
+			identity.UserID = user.ID
+			err = tx.Create(identity).Error
+		}
+		if err != nil {
+			return
+		}
+
+		// Members removed from the account can't sign in with its identity provider anymore
+		if _, err = account.GetRole(tx, user.ID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				err = errSAMLNotMember
+			}
+			return
+		}
+		if name := assertion.Name(); name != "" {
+			user.Name = name
+		}
+		user.UserStatus = models.ActiveUser
+		user.CurrentAccountID = account.ID
+		if err = tx.Save(user).Error; err != nil {
+			return
+		}
+		// The account proved owning the domain, so its identity provider vouches for the emails
+		err = user.ClaimEmail(tx)
+		return
+	})
+	return
+}
+
+// provisionSAMLUser creates the user signing in with the identity provider for the first time
+// and adds them to the account with the default role of the identity provider
+func (h *Handler) provisionSAMLUser(tx *gorm.DB, samlConfig *models.SAMLConfig, account *models.Account, email string, assertion *saml.Assertion) (user *models.User, err error) {
+	name := assertion.Name()
+	if name == "" {
+		name = strings.Split(email, "@")[0]
+	}
+	user = &models.User{
+		Email:       email,
+		Name:        name,
+		UserStatus:  models.ActiveUser,
+		CreatedFrom: models.SAMLCreatedFrom,
+	}
+	if err = tx.Create(user).Error; err != nil {
+		return
+	}
+	_, err = account.AddMember(tx, user.ID, samlConfig.DefaultRole)
+	return
+}
+
+// samlConfigResponse adds the endpoints of the account to its configuration
+func (h *SAMLHandler) samlConfigResponse(c *gin.Context, samlConfig *models.SAMLConfig) *SAMLConfigResponse {
+	response := &SAMLConfigResponse{
+		SAMLConfig:  samlConfig,
+		SPEntityID:  samlConfig.EntityID,
+		MetadataURL: h.handler.samlURL(c, samlConfig.AccountID, "metadata"),
+		ACSURL:      h.handler.samlURL(c, samlConfig.AccountID, "acs"),
+		LoginURL:    h.handler.samlURL(c, samlConfig.AccountID, "login"),
+
+		DomainVerificationRecord: samlConfig.DomainVerificationRecord(),
+	}
+	if response.SPEntityID == "" {
+		response.SPEntityID = response.MetadataURL
+	}
+	return response
+}
+
+// getManagedAccount returns the current account if the user can manage its single sign on
+func (h *SAMLHandler) getManagedAccount(c *gin.Context) (account *models.Account, ok bool) {
+	if !h.handler.rejectAPIKey(c, "API keys can't manage single sign on") {
+		return
+	}
+	account, role, err := h.handler.GetAccountRoleFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	if !role.CanManageAccount() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to manage single sign on"})
+		return
+	}
+	ok = true
+	return
+}
+
+// GetSAMLConfig returns the single sign on configuration of the current account
+func (h *SAMLHandler) GetSAMLConfig(c *gin.Context) {
+	account, ok := h.getManagedAccount(c)
+	if !ok {
+		return
+	}
+	samlConfig := &models.SAMLConfig{}
+	if err := h.db.Where("account_id = ?", account.ID).First(samlConfig).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign on isn't configured for the account"})
+		return
+	}
+	h.handler.WriteSuccess(c, h.samlConfigResponse(c, samlConfig))
+}
+
+// UpdateSAMLConfig configures the identity provider of the current account and the email domains
+// routed to it once verified. The domains already verified stay verified.
+func (h *SAMLHandler) UpdateSAMLConfig(c *gin.Context) {
+	account, ok := h.getManagedAccount(c)
+	if !ok {
+		return
+	}
+	if !h.handler.CheckEntitlement(c, account, models.SAMLFeature) {
+		return
+	}
+	var req SAMLConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	samlConfig := &models.SAMLConfig{}
+	if err := h.db.Where("account_id = ?", account.ID).First(samlConfig).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			h.handler.WriteError(c, err, "Failed to load the single sign on configuration")
+			return
+		}
+		samlConfig = &models.SAMLConfig{AccountID: account.ID}
+		samlConfig.UserID = h.handler.GetUserFromContext(c).ID
+		samlConfig.SetOwner(models.AccountScopeType, account.ID)
+	}
+	if samlConfig.DomainVerificationToken == "" {
+		if err := samlConfig.GenerateDomainVerificationToken(); err != nil {
+			h.handler.WriteError(c, err, "Failed to save the single sign on configuration")
+			return
+		}
+	}
+	samlConfig.IdPMetadataXML = req.IdPMetadataXML
+	samlConfig.IdPEntityID = req.IdPEntityID
+	samlConfig.IdPSSOURL = req.IdPSSOURL
+	samlConfig.IdPCertificate = req.IdPCertificate
+	samlConfig.EntityID = req.EntityID
+	if req.IdPMetadataXML != "" {
+		metadata, err := saml.ParseIdPMetadata([]byte(req.IdPMetadataXML))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity provider metadata"})
+			return
+		}
+		if samlConfig.IdPEntityID == "" {
+			samlConfig.IdPEntityID = metadata.EntityID
+		}
+		if samlConfig.IdPSSOURL == "" {
+			samlConfig.IdPSSOURL = metadata.SSOURL
+		}
+		if samlConfig.IdPCertificate == "" {
+			samlConfig.IdPCertificate = metadata.Certificates
+		}
+	}
+	if samlConfig.IdPEntityID == "" || samlConfig.IdPSSOURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The identity provider metadata or its entity ID and single sign on URL are required"})
+		return
+	}
+	if ssoURL, err := url.Parse(samlConfig.IdPSSOURL); err != nil || (ssoURL.Scheme != "https" && ssoURL.Scheme != "http") || ssoURL.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid single sign on URL"})
+		return
+	}
+	if _, err := saml.ParseCertificates(samlConfig.IdPCertificate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity provider certificate"})
+		return
+	}
+
+	domains := []string{}
+	verifiedDomains := []string{}
+	for _, domain := range req.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if !samlDomainPattern.MatchString(domain) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid domain " + domain})
+			return
+		}
+		domains = append(domains, domain)
+		if samlConfig.IsDomainVerified(domain) {
+			verifiedDomains = append(verifiedDomains, domain)
+		}
+	}
+	samlConfig.Domains = domains
+	samlConfig.VerifiedDomains = verifiedDomains
+	if len(samlConfig.Domains) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one domain is required"})
+		return
+	}
+	samlConfig.DefaultRole = req.DefaultRole
+	if samlConfig.DefaultRole == "" {
+		samlConfig.DefaultRole = models.AccountMemberRole
+	}
+	if !samlConfig.DefaultRole.IsValid() || samlConfig.DefaultRole == models.AccountOwnerRole {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) (err error) {
+		if err = samlConfig.CheckDomainsAvailable(tx); err != nil {
+			return
+		}
+		err = tx.Save(samlConfig).Error
+		return
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrSAMLDomainTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain is used by the single sign on of another account"})
+			return
+		}
+		h.handler.WriteError(c, err, "Failed to save the single sign on configuration")
+		return
+	}
+	h.handler.WriteSuccess(c, h.samlConfigResponse(c, samlConfig))
+}
+
+// VerifySAMLDomains verifies the domains of the single sign on of the current account which
+// publish the DNS TXT record of the account. Until then a domain isn't routed to the identity
+// provider, otherwise any account could take over the users of a domain it doesn't own.
+func (h *SAMLHandler) VerifySAMLDomains(c *gin.Context) {
+	account, ok := h.getManagedAccount(c)
+	if !ok {
+		return
+	}
+	samlConfig := &models.SAMLConfig{}
+	if err := h.db.Where("account_id = ?", account.ID).First(samlConfig).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign on isn't configured for the account"})
+		return
+	}
+	// The configurations saved before the domains were verified don't have a token yet
+	if samlConfig.DomainVerificationToken == "" {
+		if err := samlConfig.GenerateDomainVerificationToken(); err != nil {
+			h.handler.WriteError(c, err, "Failed to verify the domains")
+			return
+		}
+	}
+	verifiedDomains := []string{}
+	for _, domain := range samlConfig.Domains {
+		if samlConfig.IsDomainVerified(domain) || h.hasVerificationRecord(samlConfig, domain) {
+			verifiedDomains = append(verifiedDomains, domain)
+		}
+	}
+	samlConfig.VerifiedDomains = verifiedDomains
+
+	err := h.db.Transaction(func(tx *gorm.DB) (err error) {
+		if err = samlConfig.CheckDomainsAvailable(tx); err != nil {
+			return
+		}
+		err = tx.Save(samlConfig).Error
+		return
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrSAMLDomainTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain is used by the single sign on of another account"})
+			return
+		}
+		h.handler.WriteError(c, err, "Failed to verify the domains")
+		return
+	}
+	h.handler.WriteSuccess(c, h.samlConfigResponse(c, samlConfig))
+}
+
+// hasVerificationRecord checks if the domain publishes the DNS TXT record of the account
+func (h *SAMLHandler) hasVerificationRecord(samlConfig *models.SAMLConfig, domain string) bool {
+	records, err := h.handler.lookupTXT(domain)
+	if err != nil {
+		log.Println("Failed to look the TXT records of the domain up", domain, err)
+		return false
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == samlConfig.DomainVerificationRecord() {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteSAMLConfig removes the single sign on of the current account. The users it
+// provisioned stay members of the account and can sign in with the other methods.
+func (h *SAMLHandler) DeleteSAMLConfig(c *gin.Context) {
+	account, ok := h.getManagedAccount(c)
+	if !ok {
+		return
+	}
+	result := h.db.Unscoped().Where("account_id = ?", account.ID).Delete(&models.SAMLConfig{})
+	if result.Error != nil {
+		h.handler.WriteError(c, result.Error, "Failed to delete the single sign on configuration")
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign on isn't configured for the account"})
+		return
+	}
+	h.handler.WriteSuccess(c, gin.H{"message": "Single sign on removed"})
+}
@@ -0,0 +1,298 @@
+package handlers_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/handlers"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/testutils"
+)
+
+// startSAMLLogin starts a sign in with the identity provider of the account and returns
+// the request the identity provider received along with the state cookie
+func startSAMLLogin(t *testing.T, env *testutils.TestEnvironment, idp *testutils.MockSAMLIdP, accountID uint) (request testutils.MockSAMLRequest, stateCookie *http.Cookie) {
+	w := env.NewTestClient().MakeRequest(t, "GET", fmt.Sprintf("/auth/saml/%d/login", accountID), nil, nil)
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code, w.Body.String())
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == handlers.SAMLStateCookie {
+			stateCookie = cookie
+		}
+	}
+	require.NotNil(t, stateCookie)
+	return idp.ParseRequest(t, w.Header().Get("Location")), stateCookie
+}
+
+// postSAMLResponse posts the response of the identity provider to the ACS as the browser would
+func postSAMLResponse(t *testing.T, env *testutils.TestEnvironment, acsURL, samlResponse string, stateCookie *http.Cookie) *httptest.ResponseRecorder {
+	parsedURL, err := url.Parse(acsURL)
+	require.NoError(t, err)
+	form := url.Values{"SAMLResponse": {samlResponse}}
+	req := httptest.NewRequest("POST", parsedURL.RequestURI(), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if stateCookie != nil {
+		req.AddCookie(stateCookie)
+	}
+	w := httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	return w
+}
+
+// editSAMLResponse rewrites the decoded response, keeping its signature
+func editSAMLResponse(t *testing.T, samlResponse, old, new string) string {
+	data, err := base64.StdEncoding.DecodeString(samlResponse)
+	require.NoError(t, err)
+	require.Contains(t, string(data), old)
+	return base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(string(data), old, new)))
+}
+
+func TestSAMLHandler(t *testing.T) {
+	env := testutils.SetupTestEnvironment(t)
+	defer env.Cleanup()
+	client := env.NewTestClient()
+	db := env.DB
+	auth := testutils.NewAuthTestHelper(env)
+
+	idp := testutils.NewMockSAMLIdP(t)
+	owner, account := auth.CreateUserWithAccount(t, "owner@acme.com")
+	owner.Token = auth.CreateJWTForUser(t, owner.User)
+	accountPath := fmt.Sprintf("/auth/saml/%d", account.ID)
+
+	t.Run("Configure the identity provider", func(t *testing.T) {
+		member := env.CreateTestUser(t, "member@acme.com")
+		member.Token = auth.CreateJWTForUser(t, member.User)
+		_, err := account.AddMember(db, member.User.ID, models.AccountMemberRole)
+		require.NoError(t, err)
+		require.NoError(t, db.Model(member.User).Update("current_account_id", account.ID).Error)
+
+		config := map[string]interface{}{"idp_metadata_xml": idp.Metadata(), "domains": []string{"Acme.com"}}
+		w := client.MakeRequest(t, "PUT", "/account/saml", config, member)
+		client.AssertErrorResponse(t, w, 403, "Not allowed to manage single sign on")
+
+		w = client.MakeRequest(t, "GET", "/account/saml", nil, owner)
+		client.AssertErrorResponse(t, w, 404, "Single sign on isn't configured for the account")
+
+		// Plans can leave single sign on out
+		plan := env.CreateTestPlan(t, "Basic", 0)
+		feature := &models.Feature{Name: models.SAMLFeature, Limit: 0}
+		require.NoError(t, db.Create(feature).Error)
+		require.NoError(t, db.Create(&models.PlanFeature{PlanID: plan.ID, FeatureID: feature.ID}).Error)
+		require.NoError(t, db.Model(account).Update("plan_id", plan.ID).Error)
+		w = client.MakeRequest(t, "PUT", "/account/saml", config, owner)
+		client.AssertErrorResponse(t, w, 402, "SAML isn't included in the plan")
+		require.NoError(t, db.Model(account).Update("plan_id", 1).Error)
+
+		w = client.MakeRequest(t, "PUT", "/account/saml", map[string]interface{}{"idp_metadata_xml": "<invalid", "domains": []string{"acme.com"}}, owner)
+		client.AssertErrorResponse(t, w, 400, "Invalid identity provider metadata")
+		w = client.MakeRequest(t, "PUT", "/account/saml", map[string]interface{}{"idp_metadata_xml": idp.Metadata(), "domains": []string{"*.acme.com"}}, owner)
+		client.AssertErrorResponse(t, w, 400, "Invalid domain *.acme.com")
+		w = client.MakeRequest(t, "PUT", "/account/saml", map[string]interface{}{"idp_metadata_xml": idp.Metadata(), "domains": []string{"acme.com"}, "default_role": "owner"}, owner)
+		client.AssertErrorResponse(t, w, 400, "Invalid role")
+
+		w = client.MakeRequest(t, "PUT", "/account/saml", config, owner)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, idp.EntityID, response["data"]["idp_entity_id"])
+		assert.Equal(t, idp.SSOURL, response["data"]["idp_sso_url"])
+		assert.Equal(t, []interface{}{"acme.com"}, response["data"]["domains"])
+		assert.Equal(t, "member", response["data"]["default_role"])
+		assert.Equal(t, "http://example.com"+accountPath+"/acs", response["data"]["acs_url"])
+		assert.Equal(t, "http://example.com"+accountPath+"/metadata", response["data"]["sp_entity_id"])
+
+		// Domains are only routed once their DNS proves the account owns them
+		assert.Equal(t, []interface{}{}, response["data"]["verified_domains"])
+		record, _ := response["data"]["domain_verification_record"].(string)
+		assert.True(t, strings.HasPrefix(record, models.SAMLDomainVerificationPrefix))
+		w = client.MakeRequest(t, "POST", "/auth/saml/discover", map[string]string{"email": "jane@acme.com"}, nil)
+		client.AssertErrorResponse(t, w, 404, "Single sign on isn't configured for the domain")
+
+		lookups := []string{}
+		env.Handler.SetTXTResolver(func(name string) ([]string, error) {
+			lookups = append(lookups, name)
+			return []string{"v=spf1 -all", models.SAMLDomainVerificationPrefix + "other"}, nil
+		})
+		w = client.MakeRequest(t, "POST", "/account/saml/verify_domains", nil, member)
+		client.AssertErrorResponse(t, w, 403, "Not allowed to manage single sign on")
+		w = client.MakeRequest(t, "POST", "/account/saml/verify_domains", nil, owner)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, []interface{}{}, response["data"]["verified_domains"])
+		assert.Equal(t, []string{"acme.com"}, lookups)
+
+		env.Handler.SetTXTResolver(func(name string) ([]string, error) {
+			return []string{"v=spf1 -all", record}, nil
+		})
+		w = client.MakeRequest(t, "POST", "/account/saml/verify_domains", nil, owner)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, []interface{}{"acme.com"}, response["data"]["verified_domains"])
+
+		// Saving the configuration again keeps the domains verified
+		w = client.MakeRequest(t, "PUT", "/account/saml", config, owner)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, []interface{}{"acme.com"}, response["data"]["verified_domains"])
+		assert.Equal(t, record, response["data"]["domain_verification_record"])
+
+		// Verified domains are routed to a single account
+		_, otherAccount := auth.CreateUserWithAccount(t, "owner@other.com")
+		otherOwner := env.CreateTestUser(t, "admin@other.com")
+		otherOwner.Token = auth.CreateJWTForUser(t, otherOwner.User)
+		_, err = otherAccount.AddMember(db, otherOwner.User.ID, models.AccountAdminRole)
+		require.NoError(t, err)
+		require.NoError(t, db.Model(otherOwner.User).Update("current_account_id", otherAccount.ID).Error)
+		w = client.MakeRequest(t, "PUT", "/account/saml", config, otherOwner)
+		client.AssertErrorResponse(t, w, 409, "Domain is used by the single sign on of another account")
+	})
+
+	t.Run("Serve the service provider metadata", func(t *testing.T) {
+		w := client.MakeRequest(t, "GET", accountPath+"/metadata", nil, nil)
+		require.Equal(t, 200, w.Code)
+		assert.Equal(t, "application/samlmetadata+xml", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Body.String(), `entityID="http://example.com`+accountPath+`/metadata"`)
+		assert.Contains(t, w.Body.String(), `Location="http://example.com`+accountPath+`/acs"`)
+
+		w = client.MakeRequest(t, "GET", "/auth/saml/999999/metadata", nil, nil)
+		client.AssertErrorResponse(t, w, 404, "Single sign on isn't configured for the account")
+	})
+
+	t.Run("Route emails to the identity provider of their domain", func(t *testing.T) {
+		w := client.MakeRequest(t, "POST", "/auth/saml/discover", map[string]string{"email": "Jane@ACME.com"}, nil)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, float64(account.ID), response["account_id"])
+		assert.Equal(t, "http://example.com"+accountPath+"/login", response["login_url"])
+
+		w = client.MakeRequest(t, "POST", "/auth/saml/discover", map[string]string{"email": "jane@gmail.com"}, nil)
+		client.AssertErrorResponse(t, w, 404, "Single sign on isn't configured for the domain")
+	})
+
+	t.Run("Sign in and provision users into the account", func(t *testing.T) {
+		request, stateCookie := startSAMLLogin(t, env, idp, account.ID)
+		assert.Equal(t, "http://example.com"+accountPath+"/acs", request.ACSURL)
+		assert.Equal(t, "http://example.com"+accountPath+"/metadata", request.Issuer)
+
+		acsResponse := postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{}), stateCookie)
+		token := exchangeLoginCode(t, env, acsResponse)
+		w := meRequest(t, env, token)
+		require.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "jane@acme.com")
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "jane@acme.com").First(&user).Error)
+		assert.Equal(t, models.SAMLCreatedFrom, user.CreatedFrom)
+		assert.Equal(t, "Jane Doe", user.Name)
+		assert.True(t, user.IsEmailVerified())
+		assert.Equal(t, account.ID, user.CurrentAccountID)
+		role, err := account.GetRole(db, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.AccountMemberRole, role)
+
+		// The state cookie is cleared by the ACS and signing in again reuses the user
+		clearedCookie := false
+		for _, cookie := range acsResponse.Result().Cookies() {
+			clearedCookie = clearedCookie || (cookie.Name == handlers.SAMLStateCookie && cookie.MaxAge < 0)
+		}
+		assert.True(t, clearedCookie)
+		w = postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{}), nil)
+		client.AssertErrorResponse(t, w, 400, "Invalid SAML state")
+		request, stateCookie = startSAMLLogin(t, env, idp, account.ID)
+		w = postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{}), stateCookie)
+		exchangeLoginCode(t, env, w)
+		var count int64
+		db.Model(&models.User{}).Where("email = ?", "jane@acme.com").Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Responses have to be signed by the identity provider", func(t *testing.T) {
+		request, stateCookie := startSAMLLogin(t, env, idp, account.ID)
+		w := postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{Unsigned: true}), stateCookie)
+		client.AssertErrorResponse(t, w, 401, "Invalid SAML response")
+
+		request, stateCookie = startSAMLLogin(t, env, idp, account.ID)
+		tampered := editSAMLResponse(t, idp.Respond(t, request, testutils.MockSAMLResponse{}), "jane@acme.com", "owner@acme.com")
+		w = postSAMLResponse(t, env, request.ACSURL, tampered, stateCookie)
+		client.AssertErrorResponse(t, w, 401, "Invalid SAML response")
+
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		request, stateCookie = startSAMLLogin(t, env, idp, account.ID)
+		w = postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{Key: otherKey}), stateCookie)
+		client.AssertErrorResponse(t, w, 401, "Invalid SAML response")
+
+		request, stateCookie = startSAMLLogin(t, env, idp, account.ID)
+		w = postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{Audience: "https://other.example.com"}), stateCookie)
+		client.AssertErrorResponse(t, w, 401, "Invalid SAML response")
+
+		// Comments don't change the signed content nor the values read from it
+		request, stateCookie = startSAMLLogin(t, env, idp, account.ID)
+		commented := editSAMLResponse(t, idp.Respond(t, request, testutils.MockSAMLResponse{}), ">jane@acme.com<", "><!---->jane@acme<!---->.com<!----><")
+		w = postSAMLResponse(t, env, request.ACSURL, commented, stateCookie)
+		w = meRequest(t, env, exchangeLoginCode(t, env, w))
+		assert.Contains(t, w.Body.String(), `"email":"jane@acme.com"`)
+
+		// The signed assertion can't be moved aside for a forged one
+		request, stateCookie = startSAMLLogin(t, env, idp, account.ID)
+		data, err := base64.StdEncoding.DecodeString(idp.Respond(t, request, testutils.MockSAMLResponse{}))
+		require.NoError(t, err)
+		start, end := strings.Index(string(data), "<saml:Assertion"), strings.Index(string(data), "</saml:Assertion>")+len("</saml:Assertion>")
+		signed := string(data[start:end])
+		forged := strings.ReplaceAll(signed, "jane@acme.com", "owner@acme.com")
+		wrapped := string(data[:start]) + "<samlp:Extensions>" + signed + "</samlp:Extensions>" + forged + string(data[end:])
+		w = postSAMLResponse(t, env, request.ACSURL, base64.StdEncoding.EncodeToString([]byte(wrapped)), stateCookie)
+		client.AssertErrorResponse(t, w, 401, "Invalid SAML response")
+
+		// Responses answer the request of the state cookie
+		request, _ = startSAMLLogin(t, env, idp, account.ID)
+		_, otherCookie := startSAMLLogin(t, env, idp, account.ID)
+		w = postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{}), otherCookie)
+		client.AssertErrorResponse(t, w, 401, "Invalid SAML response")
+	})
+
+	t.Run("Only users of the domains and members of the account sign in", func(t *testing.T) {
+		idp.User = testutils.MockSAMLUser{NameID: "mallory@evil.com", Email: "mallory@evil.com", Name: "Mallory"}
+		request, stateCookie := startSAMLLogin(t, env, idp, account.ID)
+		w := postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{}), stateCookie)
+		client.AssertErrorResponse(t, w, 403, "Email isn't in a domain of the account")
+
+		// Neither are the users of the domains which aren't verified
+		config := map[string]interface{}{"idp_metadata_xml": idp.Metadata(), "domains": []string{"acme.com", "beta.com"}}
+		w = client.MakeRequest(t, "PUT", "/account/saml", config, owner)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		idp.User = testutils.MockSAMLUser{NameID: "jane@beta.com", Email: "jane@beta.com"}
+		request, stateCookie = startSAMLLogin(t, env, idp, account.ID)
+		w = postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{}), stateCookie)
+		client.AssertErrorResponse(t, w, 403, "Email isn't in a domain of the account")
+
+		// Existing users aren't added to the account by its identity provider
+		outsider := env.CreateTestUser(t, "outsider@acme.com")
+		idp.User = testutils.MockSAMLUser{NameID: "outsider@acme.com", Email: "outsider@acme.com"}
+		request, stateCookie = startSAMLLogin(t, env, idp, account.ID)
+		w = postSAMLResponse(t, env, request.ACSURL, idp.Respond(t, request, testutils.MockSAMLResponse{}), stateCookie)
+		client.AssertErrorResponse(t, w, 403, "User isn't a member of the account")
+		_, err := account.GetRole(db, outsider.User.ID)
+		assert.Error(t, err)
+	})
+
+	t.Run("Remove the identity provider", func(t *testing.T) {
+		w := client.MakeRequest(t, "DELETE", "/account/saml", nil, owner)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		w = client.MakeRequest(t, "GET", accountPath+"/login", nil, nil)
+		client.AssertErrorResponse(t, w, 404, "Single sign on isn't configured for the account")
+		w = client.MakeRequest(t, "POST", "/auth/saml/discover", map[string]string{"email": "jane@acme.com"}, nil)
+		client.AssertErrorResponse(t, w, 404, "Single sign on isn't configured for the domain")
+	})
+}
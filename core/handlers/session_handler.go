@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+type (
+	// SessionResponse is an active session of the user
+	SessionResponse struct {
+		*models.Session
+		Current bool `json:"current"`
+	}
+)
+
+// handleListSessions lists the active sessions of the user across devices
+func (h *Handler) handleListSessions(c *gin.Context) {
+	sessions := []*models.Session{}
+	if err := h.OwnerScopedDB(c).
+		Where("revoked_at IS NULL AND expires_at > ?", time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error; err != nil {
+		h.WriteError(c, err, "Failed to list sessions")
+		return
+	}
+
+	var currentID uint
+	if current := h.GetSessionFromContext(c); current != nil {
+		currentID = current.ID
+	}
+	response := []SessionResponse{}
+	for _, session := range sessions {
+		response = append(response, SessionResponse{Session: session, Current: session.ID == currentID})
+	}
+	h.WriteSuccess(c, response)
+}
+
+// handleRevokeSession revokes a session of the user, signing the device out
+func (h *Handler) handleRevokeSession(c *gin.Context) {
+	session := &models.Session{}
+	if err := h.OwnerScopedDB(c).Where("id = ?", c.Param(DefaultUrlKeyName)).First(session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err := session.Revoke(h.Db, models.UserRevokeReason); err != nil {
+		h.WriteError(c, err, "Failed to revoke session")
+		return
+	}
+	h.WriteSuccess(c, session)
+}
+
+// handleRevokeOtherSessions revokes all the sessions of the user except the current one
+func (h *Handler) handleRevokeOtherSessions(c *gin.Context) {
+	var currentID uint
+	if current := h.GetSessionFromContext(c); current != nil {
+		currentID = current.ID
+	}
+	if err := models.RevokeUserSessions(h.Db, h.GetUserFromContext(c).ID, currentID, models.UserRevokeReason); err != nil {
+		h.WriteError(c, err, "Failed to revoke sessions")
+		return
+	}
+	h.WriteSuccess(c, gin.H{"message": "Other sessions revoked successfully"})
+}
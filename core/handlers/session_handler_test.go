@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/middleware"
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+// loginTestUser signs the user in with the short circuit login and returns the session tokens
+func loginTestUser(t *testing.T, handler *Handler, email string) (accessToken, refreshToken string) {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/auth/shortcircuitlogin", map[string]string{"email": email}, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response["token"].(string), response["refresh_token"].(string)
+}
+
+// refreshTestSession refreshes the session and returns the new session tokens
+func refreshTestSession(t *testing.T, handler *Handler, refreshToken string) (accessToken, newRefreshToken string) {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/auth/refresh", map[string]string{"refresh_token": refreshToken}, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var response map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response["data"]["token"].(string), response["data"]["refresh_token"].(string)
+}
+
+func TestSessionHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+
+	t.Run("Refresh rotates the refresh token", func(t *testing.T) {
+		accessToken, refreshToken := loginTestUser(t, handler, "refresh@example.com")
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, accessToken)
+		assert.Equal(t, 200, w.Code)
+
+		newAccessToken, newRefreshToken := refreshTestSession(t, handler, refreshToken)
+		assert.NotEqual(t, refreshToken, newRefreshToken)
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, newAccessToken)
+		assert.Equal(t, 200, w.Code)
+
+		// Reusing the rotated token revokes the whole session
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/refresh", map[string]string{"refresh_token": refreshToken}, "")
+		assertErrorResponse(t, w, 401, "Refresh token was already used, the session has been revoked")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/refresh", map[string]string{"refresh_token": newRefreshToken}, "")
+		assertErrorResponse(t, w, 401, "Session was revoked or has expired")
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, newAccessToken)
+		assertErrorResponse(t, w, 401, "Session revoked")
+
+		var session models.Session
+		require.NoError(t, db.Joins("JOIN users ON users.id = sessions.user_id").
+			Where("users.email = ?", "refresh@example.com").First(&session).Error)
+		assert.Equal(t, models.RefreshReuseRevokeReason, session.RevokedReason)
+	})
+
+	t.Run("Invalid refresh token", func(t *testing.T) {
+		for _, refreshToken := range []string{"invalid", "999999.abcdef", "abc.def"} {
+			w := makeAuthenticatedRequest(t, handler, "POST", "/auth/refresh", map[string]string{"refresh_token": refreshToken}, "")
+			assertErrorResponse(t, w, 401, "Invalid refresh token")
+		}
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/refresh", map[string]string{}, "")
+		assertErrorResponse(t, w, 400, "Invalid request")
+	})
+
+	t.Run("Forged refresh tokens leave the session active", func(t *testing.T) {
+		accessToken, refreshToken := loginTestUser(t, handler, "forged@example.com")
+		sessionID := strings.SplitN(refreshToken, ".", 2)[0]
+
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/refresh", map[string]string{"refresh_token": sessionID + ".garbage"}, "")
+		assertErrorResponse(t, w, 401, "Invalid refresh token")
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, accessToken)
+		assert.Equal(t, 200, w.Code)
+		refreshTestSession(t, handler, refreshToken)
+	})
+
+	t.Run("Logout revokes the session", func(t *testing.T) {
+		accessToken, refreshToken := loginTestUser(t, handler, "sessionlogout@example.com")
+		w := makeAuthenticatedRequest(t, handler, "POST", "/logout", nil, accessToken)
+		require.Equal(t, 200, w.Code)
+
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, accessToken)
+		assertErrorResponse(t, w, 401, "Session revoked")
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/refresh", map[string]string{"refresh_token": refreshToken}, "")
+		assertErrorResponse(t, w, 401, "Session was revoked or has expired")
+	})
+
+	t.Run("List and revoke sessions", func(t *testing.T) {
+		laptopToken, _ := loginTestUser(t, handler, "devices@example.com")
+		phoneToken, _ := loginTestUser(t, handler, "devices@example.com")
+		tabletToken, _ := loginTestUser(t, handler, "devices@example.com")
+		otherToken, _ := loginTestUser(t, handler, "otherdevices@example.com")
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/sessions", nil, laptopToken)
+		require.Equal(t, 200, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		sessions := response["data"].([]interface{})
+		require.Len(t, sessions, 3)
+
+		var deviceSessionID uint
+		currentSessions := 0
+		for _, session := range sessions {
+			session := session.(map[string]interface{})
+			if session["current"].(bool) {
+				currentSessions++
+			} else if deviceSessionID == 0 {
+				deviceSessionID = uint(session["id"].(float64))
+			}
+		}
+		assert.Equal(t, 1, currentSessions)
+
+		// Sessions of other users can't be revoked
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/sessions/%d", deviceSessionID), nil, otherToken)
+		assertErrorResponse(t, w, 404, "Session not found")
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", fmt.Sprintf("/sessions/%d", deviceSessionID), nil, laptopToken)
+		require.Equal(t, 200, w.Code)
+		revokedTokens := 0
+		for _, token := range []string{phoneToken, tabletToken} {
+			if makeAuthenticatedRequest(t, handler, "GET", "/me", nil, token).Code == 401 {
+				revokedTokens++
+			}
+		}
+		assert.Equal(t, 1, revokedTokens)
+
+		w = makeAuthenticatedRequest(t, handler, "DELETE", "/sessions", nil, laptopToken)
+		require.Equal(t, 200, w.Code)
+		assert.Equal(t, 401, makeAuthenticatedRequest(t, handler, "GET", "/me", nil, phoneToken).Code)
+		assert.Equal(t, 401, makeAuthenticatedRequest(t, handler, "GET", "/me", nil, tabletToken).Code)
+		assert.Equal(t, 200, makeAuthenticatedRequest(t, handler, "GET", "/me", nil, laptopToken).Code)
+		assert.Equal(t, 200, makeAuthenticatedRequest(t, handler, "GET", "/me", nil, otherToken).Code)
+	})
+
+	t.Run("Session cookie mode", func(t *testing.T) {
+		handler.cfg.SessionCookies = true
+		defer func() { handler.cfg.SessionCookies = false }()
+
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/shortcircuitlogin", map[string]string{"email": "cookies@example.com"}, "")
+		require.Equal(t, 200, w.Code)
+		assert.NotContains(t, w.Body.String(), "refresh_token")
+		cookies := map[string]*http.Cookie{}
+		for _, cookie := range w.Result().Cookies() {
+			cookies[cookie.Name] = cookie
+		}
+		require.Contains(t, cookies, middleware.AccessTokenCookie)
+		require.Contains(t, cookies, middleware.RefreshTokenCookie)
+		require.Contains(t, cookies, middleware.CSRFCookie)
+		assert.True(t, cookies[middleware.AccessTokenCookie].HttpOnly)
+		assert.True(t, cookies[middleware.RefreshTokenCookie].HttpOnly)
+		assert.Equal(t, "/auth/refresh", cookies[middleware.RefreshTokenCookie].Path)
+		assert.False(t, cookies[middleware.CSRFCookie].HttpOnly)
+
+		cookieRequest := func(method, path string, csrfToken string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, nil)
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+			if csrfToken != "" {
+				req.Header.Set(middleware.CSRFHeader, csrfToken)
+			}
+			w := httptest.NewRecorder()
+			handler.router.ServeHTTP(w, req)
+			return w
+		}
+		assert.Equal(t, 200, cookieRequest("GET", "/me", "").Code)
+
+		// Requests changing state need the CSRF token
+		assertErrorResponse(t, cookieRequest("POST", "/logout", ""), 403, "Invalid CSRF token")
+		assertErrorResponse(t, cookieRequest("POST", "/logout", "forged"), 403, "Invalid CSRF token")
+
+		w = cookieRequest("POST", "/auth/refresh", "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.NotContains(t, w.Body.String(), "refresh_token")
+		for _, cookie := range w.Result().Cookies() {
+			cookies[cookie.Name] = cookie
+		}
+
+		w = cookieRequest("POST", "/logout", cookies[middleware.CSRFCookie].Value)
+		require.Equal(t, 200, w.Code)
+		for _, cookie := range w.Result().Cookies() {
+			assert.Negative(t, cookie.MaxAge, cookie.Name)
+		}
+		assertErrorResponse(t, cookieRequest("GET", "/me", ""), 401, "Session revoked")
+	})
+}
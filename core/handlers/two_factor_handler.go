@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gsarmaonline/goiter/core/middleware"
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+const (
+	// DefaultTOTPIssuer names the app in the authenticator apps unless TOTP_ISSUER is set
+	DefaultTOTPIssuer = "Goiter"
+)
+
+type (
+	MFACodeRequest struct {
+		// Code is a TOTP code or, when verifying a sign in or disabling, a recovery code
+		Code string `json:"code" binding:"required"`
+	}
+
+	MFAVerifyRequest struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+)
+
+// completeLogin signs the user in once the first factor succeeded. Users who enabled two
+// factor authentication are only given a short lived token to verify their second factor with.
+func (h *Handler) completeLogin(c *gin.Context, message string, user *models.User) {
+	if user.IsTOTPEnabled() {
+		mfaToken, err := h.signJWT(jwt.MapClaims{
+			"sub":                      subject(user),
+			"exp":                      time.Now().Add(models.MFAPendingTTL).Unix(),
+			middleware.MFAPendingClaim: true,
+		})
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create token"})
+			return
+		}
+		c.JSON(200, gin.H{
+			"message":      "Two factor authentication required",
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int(models.MFAPendingTTL.Seconds()),
+		})
+		return
+	}
+	// Failed logins are only cleared once every factor succeeded, otherwise the
+	// password would restart the count of guesses of the second factor
+	if err := user.ResetFailedLogins(h.Db); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to log in"})
+		return
+	}
+	tokens, err := h.startSession(c, user)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create token"})
+		return
+	}
+	h.writeSessionTokens(c, message, tokens)
+}
+
+// handleVerifyMFA completes a sign in with the TOTP code or a recovery code of the user.
+// Wrong codes count as failed logins.
+func (h *Handler) handleVerifyMFA(c *gin.Context) {
+	var req MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	token, err := h.middleware.ParseToken(req.MFAToken)
+	if err != nil || !token.Valid {
+		c.JSON(401, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	userID, err := strconv.ParseUint(claims["sub"].(string), 10, 64)
+	if pending, _ := claims[middleware.MFAPendingClaim].(bool); !pending || err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	user := &models.User{}
+	if err = h.Db.First(user, userID).Error; err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	if user.IsLocked() {
+		c.JSON(423, gin.H{"error": "Too many failed logins, try again later"})
+		return
+	}
+
+	if err = user.VerifySecondFactor(h.Db, req.Code); err != nil {
+		if errors.Is(err, models.ErrInvalidMFACode) {
+			if err = user.RegisterFailedLogin(h.Db); err != nil {
+				log.Println("Failed to record the failed login", user.ID, err)
+			}
+			c.JSON(401, gin.H{"error": "Invalid two factor code"})
+			return
+		}
+		if errors.Is(err, models.ErrTOTPNotEnrolled) {
+			c.JSON(401, gin.H{"error": "Invalid or expired MFA token"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to verify the two factor code"})
+		return
+	}
+	if err = user.ResetFailedLogins(h.Db); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to log in"})
+		return
+	}
+	tokens, err := h.startSession(c, user)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create token"})
+		return
+	}
+	h.writeSessionTokens(c, "Login successful", tokens)
+}
+
+// handleEnrollTOTP generates a new TOTP secret for the user to add to their authenticator app
+func (h *Handler) handleEnrollTOTP(c *gin.Context) {
+	if !h.rejectAPIKey(c, "API keys can't manage two factor authentication") {
+		return
+	}
+	issuer := h.cfg.GetKey("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = DefaultTOTPIssuer
+	}
+	secret, uri, err := h.GetUserFromContext(c).EnrollTOTP(h.Db, issuer)
+	if err != nil {
+		if errors.Is(err, models.ErrTOTPAlreadyEnabled) {
+			c.JSON(409, gin.H{"error": "Two factor authentication is already enabled"})
+			return
+		}
+		h.WriteError(c, err, "Failed to enroll two factor authentication")
+		return
+	}
+	h.WriteSuccess(c, gin.H{
+		"secret": secret,
+		"uri":    uri,
+	})
+}
+
+// handleEnableTOTP enables the enrolled secret with a code of the authenticator app
+// and returns the recovery codes, which aren't shown again
+func (h *Handler) handleEnableTOTP(c *gin.Context) {
+	if !h.rejectAPIKey(c, "API keys can't manage two factor authentication") {
+		return
+	}
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	recoveryCodes, err := h.GetUserFromContext(c).EnableTOTP(h.Db, req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrTOTPAlreadyEnabled):
+			c.JSON(409, gin.H{"error": "Two factor authentication is already enabled"})
+		case errors.Is(err, models.ErrTOTPNotEnrolled):
+			c.JSON(400, gin.H{"error": "Two factor authentication isn't enrolled"})
+		case errors.Is(err, models.ErrInvalidMFACode):
+			c.JSON(400, gin.H{"error": "Invalid two factor code"})
+		default:
+			h.WriteError(c, err, "Failed to enable two factor authentication")
+		}
+		return
+	}
+	h.WriteSuccess(c, gin.H{"recovery_codes": recoveryCodes})
+}
+
+// handleDisableTOTP disables two factor authentication after checking a code of the user.
+// Members of an account requiring it can't disable it.
+func (h *Handler) handleDisableTOTP(c *gin.Context) {
+	if !h.rejectAPIKey(c, "API keys can't manage two factor authentication") {
+		return
+	}
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := h.GetUserFromContext(c)
+	required, err := user.IsMFARequired(h.Db)
+	if err != nil {
+		h.WriteError(c, err, "Failed to disable two factor authentication")
+		return
+	}
+	if required {
+		c.JSON(403, gin.H{"error": "Two factor authentication is required by an account of the user"})
+		return
+	}
+	if !h.checkSecondFactor(c, user, req.Code) {
+		return
+	}
+	if err = user.DisableTOTP(h.Db); err != nil {
+		h.WriteError(c, err, "Failed to disable two factor authentication")
+		return
+	}
+	c.JSON(200, gin.H{"message": "Two factor authentication disabled"})
+}
+
+// handleRegenerateRecoveryCodes replaces the recovery codes of the user after checking a code of the user
+func (h *Handler) handleRegenerateRecoveryCodes(c *gin.Context) {
+	if !h.rejectAPIKey(c, "API keys can't manage two factor authentication") {
+		return
+	}
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := h.GetUserFromContext(c)
+	if !h.checkSecondFactor(c, user, req.Code) {
+		return
+	}
+	recoveryCodes, err := user.GenerateRecoveryCodes(h.Db)
+	if err != nil {
+		h.WriteError(c, err, "Failed to generate recovery codes")
+		return
+	}
+	h.WriteSuccess(c, gin.H{"recovery_codes": recoveryCodes})
+}
+
+// checkSecondFactor checks a TOTP or recovery code of the signed in user
+func (h *Handler) checkSecondFactor(c *gin.Context, user *models.User, code string) (ok bool) {
+	if err := user.VerifySecondFactor(h.Db, code); err != nil {
+		switch {
+		case errors.Is(err, models.ErrTOTPNotEnrolled):
+			c.JSON(400, gin.H{"error": "Two factor authentication isn't enabled"})
+		case errors.Is(err, models.ErrInvalidMFACode):
+			c.JSON(400, gin.H{"error": "Invalid two factor code"})
+		default:
+			h.WriteError(c, err, "Failed to verify the two factor code")
+		}
+		return
+	}
+	ok = true
+	return
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsarmaonline/goiter/core/middleware"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/totp"
+)
+
+// enableTestTOTP enables two factor authentication of the user and returns its secret and recovery codes
+func enableTestTOTP(t *testing.T, handler *Handler, token string) (secret string, recoveryCodes []string) {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/enroll", nil, token)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var enrollResponse map[string]map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enrollResponse))
+	secret = enrollResponse["data"]["secret"]
+	assert.True(t, strings.HasPrefix(enrollResponse["data"]["uri"], "otpauth://totp/"))
+
+	w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/enable", map[string]string{"code": totpCode(t, secret, 0)}, token)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var enableResponse map[string]map[string][]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enableResponse))
+	recoveryCodes = enableResponse["data"]["recovery_codes"]
+	return
+}
+
+// totpCode returns the code of the secret the given number of periods from now
+func totpCode(t *testing.T, secret string, offset int64) string {
+	code, err := totp.Code(secret, totp.Counter(time.Now())+offset)
+	require.NoError(t, err)
+	return code
+}
+
+// startMFALogin signs the user in with the short circuit login and returns the MFA token
+func startMFALogin(t *testing.T, handler *Handler, email string) string {
+	w := makeAuthenticatedRequest(t, handler, "POST", "/auth/shortcircuitlogin", map[string]string{"email": email}, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, true, response["mfa_required"])
+	assert.Nil(t, response["token"])
+	return response["mfa_token"].(string)
+}
+
+func TestTwoFactorHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+	user, token := createTestUser(t, db, "twofactor@example.com")
+
+	t.Run("Enable requires a valid code", func(t *testing.T) {
+		_, otherToken := createTestUser(t, db, "twofactorinvalid@example.com")
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/enable", map[string]string{"code": "123456"}, otherToken)
+		assertErrorResponse(t, w, 400, "Two factor authentication isn't enrolled")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/enroll", nil, otherToken)
+		require.Equal(t, 200, w.Code)
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/enable", map[string]string{"code": "abcdef"}, otherToken)
+		assertErrorResponse(t, w, 400, "Invalid two factor code")
+	})
+
+	secret, recoveryCodes := enableTestTOTP(t, handler, token)
+	require.Len(t, recoveryCodes, models.RecoveryCodeCount)
+
+	t.Run("Login waits for the second factor", func(t *testing.T) {
+		mfaToken := startMFALogin(t, handler, user.Email)
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, mfaToken)
+		assertErrorResponse(t, w, 401, "Two factor authentication required")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/verify", map[string]string{"mfa_token": mfaToken, "code": "000000"}, "")
+		assertErrorResponse(t, w, 401, "Invalid two factor code")
+		// The code which enabled two factor authentication can't be replayed
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/verify", map[string]string{"mfa_token": mfaToken, "code": totpCode(t, secret, 0)}, "")
+		assertErrorResponse(t, w, 401, "Invalid two factor code")
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/verify", map[string]string{"mfa_token": mfaToken, "code": totpCode(t, secret, 1)}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, response["token"].(string))
+		assert.Equal(t, 200, w.Code)
+
+		var updated models.User
+		require.NoError(t, db.First(&updated, user.ID).Error)
+		assert.Equal(t, 0, updated.FailedLogins)
+	})
+
+	t.Run("Recovery codes can only be used once", func(t *testing.T) {
+		mfaToken := startMFALogin(t, handler, user.Email)
+		w := makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/verify", map[string]string{"mfa_token": mfaToken, "code": strings.ToUpper(recoveryCodes[0])}, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/verify", map[string]string{"mfa_token": mfaToken, "code": recoveryCodes[0]}, "")
+		assertErrorResponse(t, w, 401, "Invalid two factor code")
+
+		var recoveryCode models.RecoveryCode
+		require.NoError(t, db.Where("user_id = ? AND used_at IS NOT NULL", user.ID).First(&recoveryCode).Error)
+		assert.NotContains(t, recoveryCode.CodeHash, strings.ReplaceAll(recoveryCodes[0], "-", ""))
+	})
+
+	t.Run("Accounts can require two factor authentication", func(t *testing.T) {
+		var account models.Account
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&account).Error)
+		member, memberToken := createTestUser(t, db, "twofactormember@example.com")
+		_, err := account.AddMember(db, member.ID, models.AccountMemberRole)
+		require.NoError(t, err)
+
+		// Admins without two factor authentication can't require it
+		w := makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"name": "Member", "require_mfa": true}, memberToken)
+		assertErrorResponse(t, w, 400, "Enable two factor authentication before requiring it")
+
+		w = makeAuthenticatedRequest(t, handler, "PUT", "/account", map[string]interface{}{"name": account.Name, "require_mfa": true}, token)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		accountRequest := func(token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/account", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set(middleware.AccountHeader, fmt.Sprint(account.ID))
+			w := httptest.NewRecorder()
+			handler.router.ServeHTTP(w, req)
+			return w
+		}
+		assertErrorResponse(t, accountRequest(memberToken), 403, "Two factor authentication is required by the account")
+		assert.Equal(t, 200, accountRequest(token).Code)
+
+		// Members can still enable it, after which they can act on the account
+		enableTestTOTP(t, handler, memberToken)
+		assert.Equal(t, 200, accountRequest(memberToken).Code)
+
+		w = makeAuthenticatedRequest(t, handler, "POST", "/auth/2fa/disable", map[string]string{"code": totpCode(t, secret, -1)}, token)
+		assertErrorResponse(t, w, 403, "Two factor authentication is required by an account of the user")
+	})
+}
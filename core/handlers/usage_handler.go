@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/middleware"
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/usage"
+)
+
+const (
+	// UsageOverLimitHeader names the features whose soft limit the usage of the request exceeded
+	UsageOverLimitHeader = "X-Usage-Over-Limit"
+)
+
+// UsageMeter returns the meter recording the usage of the metered features, which
+// reports it to the payment gateway when run
+//
+//	go h.UsageMeter().Run(usage.DefaultReportInterval)
+func (h *Handler) UsageMeter() *usage.Meter {
+	return h.usage
+}
+
+// RecordUsage records the quantity of usage of the metered feature by the account of the
+// request. It answers with a 403 when the quantity exceeds the hard limit of the plan, and
+// flags the response with the UsageOverLimitHeader when it exceeds a soft one.
+func (h *Handler) RecordUsage(c *gin.Context, feature string, quantity int64) (ok bool) {
+	account, err := h.GetAccountFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	total, err := h.usage.Record(account, h.GetUserFromContext(c).ID, feature, quantity)
+	if errors.Is(err, usage.ErrHardLimitReached) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": feature + " limit of the plan reached",
+			"code":  LimitReachedCode,
+			"usage": total,
+		})
+		return
+	}
+	if err != nil {
+		h.WriteError(c, err, "Failed to record the usage")
+		return
+	}
+	if total.OverLimit {
+		c.Writer.Header().Add(UsageOverLimitHeader, feature)
+	}
+	ok = true
+	return
+}
+
+// MeterUsage returns a middleware which records one use of the metered feature by the
+// account of the request before the handler runs
+//
+//	routes.POST("/exports", h.MeterUsage("Exports"), handler)
+func (h *Handler) MeterUsage(feature string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.RecordUsage(c, feature, 1) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// meterAPICalls records the requests authenticated with an API key as API calls of the account
+func (h *Handler) meterAPICalls() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if middleware.GetAPIKey(c) == nil {
+			c.Next()
+			return
+		}
+		if !h.RecordUsage(c, models.APICallsFeature, 1) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetUsage returns the usage of the metered features by the current account during its billing period
+func (h *BillingHandler) GetUsage(c *gin.Context) {
+	account, err := h.handler.GetAccountFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	summary, err := h.handler.usage.Summary(account)
+	if err != nil {
+		h.handler.WriteError(c, err, "Failed to load the usage of the account")
+		return
+	}
+	h.handler.WriteSuccess(c, summary)
+}
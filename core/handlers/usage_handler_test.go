@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/payments"
+)
+
+// setTestPlanFeatures moves the account of the user to a new plan with the features
+func setTestPlanFeatures(t *testing.T, db *gorm.DB, user *models.User, features ...*models.Feature) (account *models.Account) {
+	plan := &models.Plan{Name: "Metered " + user.Email, BillingPeriod: "monthly"}
+	require.NoError(t, db.Create(plan).Error)
+	for _, feature := range features {
+		require.NoError(t, db.Create(feature).Error)
+		require.NoError(t, db.Create(&models.PlanFeature{PlanID: plan.ID, FeatureID: feature.ID}).Error)
+	}
+	account = &models.Account{}
+	require.NoError(t, db.Where("user_id = ?", user.ID).First(account).Error)
+	require.NoError(t, db.Model(account).Update("plan_id", plan.ID).Error)
+	return
+}
+
+// getTestUsage returns the usage of the feature from GET /billing/usage
+func getTestUsage(t *testing.T, handler *Handler, token, feature string) (total map[string]interface{}) {
+	w := makeAuthenticatedRequest(t, handler, "GET", "/billing/usage", nil, token)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var envelope struct {
+		Data struct {
+			Period   map[string]string        `json:"period"`
+			Features []map[string]interface{} `json:"features"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	response := envelope.Data
+	assert.NotEmpty(t, response.Period["start"])
+	assert.NotEmpty(t, response.Period["end"])
+	for _, total = range response.Features {
+		if total["feature"] == feature {
+			return
+		}
+	}
+	t.Fatalf("no usage of %s in %s", feature, w.Body.String())
+	return
+}
+
+func TestUsageHandler(t *testing.T) {
+	handler, db := setupTestHandler(t)
+
+	t.Run("Hard limits reject the API calls over them", func(t *testing.T) {
+		user, token := createTestUser(t, db, "hardlimit@example.com")
+		setTestPlanFeatures(t, db, user, &models.Feature{Name: models.APICallsFeature, Limit: 2, Metered: true, HardLimit: true})
+		_, key := createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":   "Metered",
+			"scopes": []string{"read"},
+		})
+
+		for i := 0; i < 2; i++ {
+			w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, key)
+			require.Equal(t, 200, w.Code, w.Body.String())
+		}
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, key)
+		assertErrorResponse(t, w, 403, "API Calls limit of the plan reached")
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, LimitReachedCode, response["code"])
+
+		// Only the requests authenticated with an API key are API calls
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, token)
+		require.Equal(t, 200, w.Code)
+
+		total := getTestUsage(t, handler, token, models.APICallsFeature)
+		assert.Equal(t, float64(2), total["used"])
+		assert.Equal(t, float64(0), total["remaining"])
+		assert.Equal(t, false, total["over_limit"])
+	})
+
+	t.Run("Soft limits flag the overage", func(t *testing.T) {
+		user, token := createTestUser(t, db, "softlimit@example.com")
+		setTestPlanFeatures(t, db, user, &models.Feature{Name: models.APICallsFeature, Limit: 1, Metered: true})
+		_, key := createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":   "Metered",
+			"scopes": []string{"read"},
+		})
+
+		w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, key)
+		require.Equal(t, 200, w.Code)
+		assert.Empty(t, w.Header().Get(UsageOverLimitHeader))
+		w = makeAuthenticatedRequest(t, handler, "GET", "/me", nil, key)
+		require.Equal(t, 200, w.Code)
+		assert.Equal(t, models.APICallsFeature, w.Header().Get(UsageOverLimitHeader))
+
+		total := getTestUsage(t, handler, token, models.APICallsFeature)
+		assert.Equal(t, float64(2), total["used"])
+		assert.Equal(t, float64(1), total["overage"])
+		assert.Equal(t, true, total["over_limit"])
+	})
+
+	t.Run("Seats follow the members", func(t *testing.T) {
+		user, token := createTestUser(t, db, "seats@example.com")
+		member, _ := createTestUser(t, db, "seatmember@example.com")
+		account := setTestPlanFeatures(t, db, user, &models.Feature{Name: models.SeatsFeature, Limit: 5, Metered: true})
+		assert.Equal(t, float64(1), getTestUsage(t, handler, token, models.SeatsFeature)["used"])
+
+		membership := &models.AccountMembership{AccountID: account.ID, MemberID: member.ID, Role: models.AccountMemberRole}
+		membership.UserID = user.ID
+		require.NoError(t, db.Create(membership).Error)
+		assert.Equal(t, float64(2), getTestUsage(t, handler, token, models.SeatsFeature)["used"])
+
+		require.NoError(t, db.Delete(membership).Error)
+		assert.Equal(t, float64(1), getTestUsage(t, handler, token, models.SeatsFeature)["used"])
+	})
+
+	t.Run("Usage is reported once", func(t *testing.T) {
+		gateway := payments.NewFakeGateway()
+		handler.SetPaymentGateway(gateway)
+		gateway.AddSubscription(&payments.Subscription{ID: "sub_metered", Status: payments.ActiveSubscription})
+		// Drop the usage of the other tests, which have no subscription
+		_, err := handler.UsageMeter().Report()
+		require.NoError(t, err)
+
+		user, token := createTestUser(t, db, "reported@example.com")
+		account := setTestPlanFeatures(t, db, user,
+			&models.Feature{Name: models.APICallsFeature, Limit: -1, Metered: true, StripePriceID: "price_calls"},
+			&models.Feature{Name: models.SeatsFeature, Limit: -1, Metered: true, StripePriceID: "price_seats"},
+		)
+		require.NoError(t, db.Model(account).Update("stripe_subscription_id", "sub_metered").Error)
+		_, key := createTestAPIKey(t, handler, token, map[string]interface{}{
+			"name":   "Metered",
+			"scopes": []string{"read"},
+		})
+		for i := 0; i < 3; i++ {
+			w := makeAuthenticatedRequest(t, handler, "GET", "/me", nil, key)
+			require.Equal(t, 200, w.Code)
+		}
+
+		reported, err := handler.UsageMeter().Report()
+		require.NoError(t, err)
+		assert.Equal(t, 4, reported)
+		require.Len(t, gateway.Usage, 2)
+		assert.Equal(t, "sub_metered", gateway.Usage[0].SubscriptionID)
+		assert.Equal(t, "price_seats", gateway.Usage[0].PriceID)
+		assert.Equal(t, payments.SetUsage, gateway.Usage[0].Action)
+		assert.Equal(t, int64(1), gateway.Usage[0].Quantity)
+		assert.Equal(t, "price_calls", gateway.Usage[1].PriceID)
+		assert.Equal(t, payments.IncrementUsage, gateway.Usage[1].Action)
+		assert.Equal(t, int64(3), gateway.Usage[1].Quantity)
+		assert.NotEqual(t, gateway.Usage[0].IdempotencyKey, gateway.Usage[1].IdempotencyKey)
+
+		var unreported int64
+		require.NoError(t, db.Model(&models.UsageRecord{}).Where("reported_at IS NULL").Count(&unreported).Error)
+		assert.Equal(t, int64(0), unreported)
+		reported, err = handler.UsageMeter().Report()
+		require.NoError(t, err)
+		assert.Equal(t, 0, reported)
+		assert.Len(t, gateway.Usage, 2)
+	})
+
+	t.Run("Failed reports are retried with the same batch", func(t *testing.T) {
+		gateway := payments.NewFakeGateway()
+		handler.SetPaymentGateway(gateway)
+		gateway.AddSubscription(&payments.Subscription{ID: "sub_retried", Status: payments.ActiveSubscription})
+		_, err := handler.UsageMeter().Report()
+		require.NoError(t, err)
+
+		user, _ := createTestUser(t, db, "retried@example.com")
+		account := setTestPlanFeatures(t, db, user, &models.Feature{Name: "Exports", Limit: -1, Metered: true, StripePriceID: "price_exports"})
+		require.NoError(t, db.Model(account).Update("stripe_subscription_id", "sub_retried").Error)
+		record := func(action models.UsageActionT, quantity int64) {
+			_, err := models.NewUsageRecord(db, account.ID, user.ID, "Exports", action, quantity)
+			require.NoError(t, err)
+		}
+
+		// The increments before a set are replaced by it
+		record(models.IncrementUsage, 5)
+		record(models.SetUsage, 10)
+		record(models.IncrementUsage, 2)
+		gateway.FailNext(nil)
+		gateway.FailNext(errors.New("stripe is down"))
+		_, err = handler.UsageMeter().Report()
+		require.Error(t, err)
+		require.Len(t, gateway.Usage, 1)
+		assert.Equal(t, payments.SetUsage, gateway.Usage[0].Action)
+		assert.Equal(t, int64(10), gateway.Usage[0].Quantity)
+
+		// The usage recorded meanwhile is reported on its own
+		record(models.IncrementUsage, 3)
+		reported, err := handler.UsageMeter().Report()
+		require.NoError(t, err)
+		assert.Equal(t, 4, reported)
+		require.Len(t, gateway.Usage, 3)
+		assert.Equal(t, payments.IncrementUsage, gateway.Usage[1].Action)
+		assert.Equal(t, int64(2), gateway.Usage[1].Quantity)
+		assert.Equal(t, int64(3), gateway.Usage[2].Quantity)
+		assert.Equal(t, strings.TrimSuffix(gateway.Usage[0].IdempotencyKey, "-set"), strings.TrimSuffix(gateway.Usage[1].IdempotencyKey, "-increment"))
+		assert.NotEqual(t, gateway.Usage[1].IdempotencyKey, gateway.Usage[2].IdempotencyKey)
+	})
+}
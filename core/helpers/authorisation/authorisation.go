@@ -1,16 +1,37 @@
 package authorisation
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+
 	"github.com/gin-gonic/gin"
 	"github.com/gsarmaonline/goiter/core/models"
 	"gorm.io/gorm"
 )
 
+const (
+	// ActionKey is the context key under which the AuthorisationMiddleware
+	// stores the action requested by the route
+	ActionKey = "authorisation_action"
+
+	// CacheCallbackName is the name of the GORM callback invalidating the cache
+	CacheCallbackName = "authorisation:invalidate_cache"
+)
+
+var (
+	ErrForbidden = errors.New("forbidden")
+)
+
 type (
 	Authorisation struct {
 		handler                  HandlerInterface
+		db                       *gorm.DB
 		AllowImplicitOwnerAccess bool
 		IsEnabled                bool
+
+		cache *DecisionCache
 	}
 
 	HandlerInterface interface {
@@ -22,20 +43,125 @@ type (
 		User     *models.User
 		Resource models.UserOwnedModel
 		Action   models.ActionT
+		Scope    *models.Scope
 	}
 )
 
-func NewAuthorisation(handler HandlerInterface) *Authorisation {
+func NewAuthorisation(handler HandlerInterface, db *gorm.DB) *Authorisation {
 	return &Authorisation{
 		handler:                  handler,
+		db:                       db,
 		AllowImplicitOwnerAccess: true,
 		IsEnabled:                false,
 	}
 }
 
+// SetCache caches the decisions and the group ancestries in the cache.
+// The cache is invalidated once the writes to the models the decisions depend on committed,
+// see invalidateCacheCallback.
+func (a *Authorisation) SetCache(cache *DecisionCache) {
+	if cache != nil {
+		a.registerCacheCallbacks()
+	}
+	a.cache = cache
+}
+
+// InvalidateCache drops the cached decisions, if any. It has to be called once a transaction
+// which changed a Group, a GroupMember or a RoleAccess committed.
+func (a *Authorisation) InvalidateCache() {
+	if a.cache == nil {
+		return
+	}
+	if err := a.cache.Invalidate(); err != nil {
+		log.Println(err, "Failed to invalidate the authorisation cache")
+	}
+}
+
+// registerCacheCallbacks registers invalidateCacheCallback on the writes of the database of the
+// authorisation, replacing the one of a previous authorisation on the same database
+func (a *Authorisation) registerCacheCallbacks() {
+	callbacks := a.db.Callback()
+	if callbacks.Create().Get(CacheCallbackName) != nil {
+		callbacks.Create().Replace(CacheCallbackName, a.invalidateCacheCallback)
+		callbacks.Update().Replace(CacheCallbackName, a.invalidateCacheCallback)
+		callbacks.Delete().Replace(CacheCallbackName, a.invalidateCacheCallback)
+		return
+	}
+	callbacks.Create().After("gorm:commit_or_rollback_transaction").Register(CacheCallbackName, a.invalidateCacheCallback)
+	callbacks.Update().After("gorm:commit_or_rollback_transaction").Register(CacheCallbackName, a.invalidateCacheCallback)
+	callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register(CacheCallbackName, a.invalidateCacheCallback)
+}
+
+// invalidateCacheCallback invalidates the cache after the successful writes to a Group, a
+// GroupMember or a RoleAccess. It runs once the transaction GORM opens for the write committed,
+// so that concurrent reads can't cache the state before the write. The writes made inside the
+// transactions of the callers are invalidated right away, and have to be invalidated again with
+// InvalidateCache once the transaction committed.
+// Failures of the cache are logged rather than failing the write.
+func (a *Authorisation) invalidateCacheCallback(tx *gorm.DB) {
+	if a.cache == nil || tx.Error != nil || tx.Statement.Schema == nil {
+		return
+	}
+	switch tx.Statement.Schema.ModelType {
+	case reflect.TypeOf(models.Group{}), reflect.TypeOf(models.GroupMember{}), reflect.TypeOf(models.RoleAccess{}):
+		a.InvalidateCache()
+	}
+}
+
+// GetCache returns the cache of the decisions, if any
+func (a *Authorisation) GetCache() *DecisionCache {
+	return a.cache
+}
+
+// ActionForMethod maps the HTTP method of a request to the action it performs
+func ActionForMethod(method string) models.ActionT {
+	switch method {
+	case "POST":
+		return models.CreateAction
+	case "PUT", "PATCH":
+		return models.UpdateAction
+	case "DELETE":
+		return models.DeleteAction
+	default:
+		return models.ReadAction
+	}
+}
+
+// GetActionFromContext returns the action stored by the AuthorisationMiddleware.
+// It defaults to the action derived from the request method.
+func GetActionFromContext(c *gin.Context) models.ActionT {
+	if action, exists := c.Get(ActionKey); exists {
+		return action.(models.ActionT)
+	}
+	return ActionForMethod(c.Request.Method)
+}
+
+// UserScopedDB scopes the query to the resources the user can read
 func (a *Authorisation) UserScopedDB(c *gin.Context, db *gorm.DB) *gorm.DB {
-	db = db.Where("user_id = ?", a.handler.GetUserFromContext(c).ID)
-	return db
+	return a.ActionScopedDB(c, db, models.ReadAction)
+}
+
+// ActionScopedDB scopes the query to the resources the user can perform the action on.
+// When the authorisation is enabled, these are the resources owned by the user along with
+// the ones shared via RoleAccess rules, directly or through the group ancestry of the user
+// and the resource. The rules are evaluated as a single SQL subquery.
+func (a *Authorisation) ActionScopedDB(c *gin.Context, db *gorm.DB, action models.ActionT) *gorm.DB {
+	user := a.handler.GetUserFromContext(c)
+	if a.IsEnabled == false {
+		return db.Where("user_id = ?", user.ID)
+	}
+	return db.Scopes(func(tx *gorm.DB) *gorm.DB {
+		model, ok := getModelFromStatement(tx.Statement)
+		if !ok {
+			return tx.Where("user_id = ?", user.ID)
+		}
+		if err := tx.Statement.Parse(model); err != nil {
+			tx.AddError(err)
+			return tx
+		}
+		query, vars := a.permittedResourcesQuery(tx.Statement, model, user, action)
+		return tx.Where(query, vars)
+	})
 }
 
 func (a *Authorisation) UpdateWithUser(c *gin.Context, model models.UserOwnedModel) (err error) {
@@ -43,9 +169,287 @@ func (a *Authorisation) UpdateWithUser(c *gin.Context, model models.UserOwnedMod
 	return
 }
 
+// CanAccessResource checks if the user in the context can perform the action
+// requested by the route on the model
 func (a *Authorisation) CanAccessResource(c *gin.Context, model models.UserOwnedModel) bool {
-	if a.handler.GetUserFromContext(c).ID == model.GetUserID() {
-		return true
+	return a.CanPerformAction(c, model, GetActionFromContext(c))
+}
+
+// CanPerformAction checks if the user in the context can perform the action on the model
+func (a *Authorisation) CanPerformAction(c *gin.Context, model models.UserOwnedModel, action models.ActionT) bool {
+	canAccess, err := a.CanAccess(&AuthorisationRequest{
+		Db:       a.db,
+		User:     a.handler.GetUserFromContext(c),
+		Resource: model,
+		Action:   action,
+		Scope:    GetScopeForModel(model),
+	})
+	if err != nil {
+		return false
+	}
+	return canAccess
+}
+
+// ExplainForUser explains whether the user can perform the action on the model
+func (a *Authorisation) ExplainForUser(user *models.User, model models.UserOwnedModel, action models.ActionT) (decision *Decision, err error) {
+	return a.Explain(&AuthorisationRequest{
+		Db:       a.db,
+		User:     user,
+		Resource: model,
+		Action:   action,
+		Scope:    GetScopeForModel(model),
+	})
+}
+
+// Authorise returns ErrForbidden if the user in the context can't perform the action on the model
+func (a *Authorisation) Authorise(c *gin.Context, model models.UserOwnedModel, action models.ActionT) (err error) {
+	if !a.CanPerformAction(c, model, action) {
+		err = ErrForbidden
+	}
+	return
+}
+
+// CanAccess is the entrypoint for all authorisation checks.
+// See Explain for how the rules are evaluated.
+func (a *Authorisation) CanAccess(authReq *AuthorisationRequest) (canAccess bool, err error) {
+	var decision *Decision
+	if decision, err = a.Explain(authReq); err != nil {
+		return
+	}
+	canAccess = decision.Allowed
+	return
+}
+
+// Explain evaluates the request and returns the decision along with the rule
+// and the group paths which produced it.
+// The request is allowed if the accessor created the resource and implicit owner
+// access is allowed. Otherwise, all the RoleAccess rules between the user, or the
+// groups of the user, and the resource, or the groups of the resource, are ordered
+// by precedence and the first one decides:
+//   - Rules with a higher priority win
+//   - More specific rules win over the ones inherited via groups, the closest group first
+//   - Deny rules win over allow rules
+//
+// When the authorisation is disabled, only the ownership of the resource is checked.
+func (a *Authorisation) Explain(authReq *AuthorisationRequest) (decision *Decision, err error) {
+	var (
+		accessorAncestry []*models.GroupAncestor
+		resourceAncestry []*models.GroupAncestor
+		rules            []*models.RoleAccess
+	)
+	isOwner := authReq.Resource.GetUserID() == authReq.User.GetID()
+	if a.IsEnabled == false {
+		decision = &Decision{Allowed: isOwner, Reason: DisabledReason}
+		if isOwner {
+			decision.Reason = OwnerReason
+		}
+		return
+	}
+
+	// If the accessor is the owner of the resource, allow access
+	if a.AllowImplicitOwnerAccess && isOwner {
+		decision = &Decision{Allowed: true, Reason: OwnerReason}
+		return
+	}
+
+	cacheKey := decisionCacheKey(authReq)
+	if a.cache != nil && a.cache.get(cacheKey, &decision) {
+		return
+	}
+
+	if accessorAncestry, err = a.getGroupAncestry(authReq.Db, models.UserMemberType, authReq.User.GetID()); err != nil {
+		return
+	}
+	if resourceAncestry, err = a.getResourceAncestry(authReq.Db, authReq.Resource); err != nil {
+		return
+	}
+	accessors := newAncestryIndex(accessorAncestry)
+	resources := newAncestryIndex(resourceAncestry)
+
+	if err = a.matchingRulesQuery(authReq, accessors.groupIDs(), resources.groupIDs()).Find(&rules).Error; err != nil {
+		return
+	}
+	matches := make([]*RuleMatch, 0, len(rules))
+	for _, rule := range rules {
+		matches = append(matches, newRuleMatch(rule, accessors, resources))
+	}
+	decision = decide(matches)
+	if a.cache != nil {
+		a.cache.set(cacheKey, decision)
+	}
+	return
+}
+
+// getResourceAncestry returns the groups of the resource.
+// Rules on a group also apply to the groups nested inside it, so a group
+// resource is part of its own ancestry.
+func (a *Authorisation) getResourceAncestry(db *gorm.DB, resource models.UserOwnedModel) (ancestry []*models.GroupAncestor, err error) {
+	group, ok := resource.(*models.Group)
+	if !ok {
+		return a.getGroupAncestry(db, models.ElementTypeT(resource.GetConfig().Name), resource.GetID())
+	}
+	if ancestry, err = a.getGroupAncestry(db, models.GroupMemberType, group.ID); err != nil {
+		return
+	}
+	for _, ancestor := range ancestry {
+		ancestor.Path = append([]uint{group.ID}, ancestor.Path...)
+	}
+	ancestry = append([]*models.GroupAncestor{{Group: group, Depth: 0, Path: []uint{group.ID}}}, ancestry...)
+	return
+}
+
+// getGroupAncestry returns the group ancestry of the element from the cache, if any
+func (a *Authorisation) getGroupAncestry(db *gorm.DB, memberType models.ElementTypeT, memberID uint) (ancestry []*models.GroupAncestor, err error) {
+	cacheKey := ancestryCacheKey(memberType, memberID)
+	if a.cache != nil && a.cache.get(cacheKey, &ancestry) {
+		return
+	}
+	if ancestry, err = models.GetGroupAncestry(db, memberType, memberID); err != nil {
+		return
+	}
+	if a.cache != nil {
+		a.cache.set(cacheKey, ancestry)
+	}
+	return
+}
+
+func (a *Authorisation) matchingRulesQuery(authReq *AuthorisationRequest, accessorGroupIDs, resourceGroupIDs []uint) (tx *gorm.DB) {
+	db := authReq.Db.Session(&gorm.Session{NewDB: true})
+
+	accessorQuery := db.Where("accessor_type = ? AND accessor_id = ?", models.UserElement, authReq.User.GetID())
+	if len(accessorGroupIDs) > 0 {
+		accessorQuery = accessorQuery.Or("accessor_type = ? AND accessor_id IN ?", models.GroupElement, accessorGroupIDs)
+	}
+
+	resourceType := authReq.Resource.GetConfig().Name
+	resourceQuery := db.Where("resource_type = ? AND resource_id IN ?", resourceType, []uint{authReq.Resource.GetID(), 0})
+	if len(resourceGroupIDs) > 0 {
+		resourceQuery = resourceQuery.Or("resource_type = ? AND resource_id IN ?", models.GroupElement, resourceGroupIDs)
+	}
+
+	tx = db.Model(&models.RoleAccess{}).
+		Where("action = ?", authReq.Action).
+		Where(accessorQuery).
+		Where(resourceQuery)
+
+	if authReq.Scope != nil && authReq.Scope.ScopeType != "" {
+		tx = tx.Where(db.Where("scope_type = ?", "").
+			Or("scope_type IS NULL").
+			Or("scope_type = ? AND scope_id = ?", authReq.Scope.ScopeType, authReq.Scope.ScopeID))
+	} else {
+		tx = tx.Where(db.Where("scope_type = ?", "").Or("scope_type IS NULL"))
+	}
+	return
+}
+
+// permittedResourcesQuery builds the condition which matches the rows of the model's table
+// that are either owned by the user or allowed by the matching RoleAccess rule with
+// the highest precedence, following the same order as Explain.
+//
+// The rules are resolved by the following recursive CTEs:
+//   - accessor_groups: the groups the user belongs to, directly or via nested groups
+//   - granted_groups: the groups, along with their nested groups, on which a rule is set
+//   - grants: the resources with a rule set directly or as members of the granted groups
+//   - decisions: the rules of every resource ranked by precedence
+func (a *Authorisation) permittedResourcesQuery(stmt *gorm.Statement, model models.UserOwnedModel, user *models.User, action models.ActionT) (query string, vars map[string]interface{}) {
+	table := stmt.Quote(stmt.Table)
+	resourceType := model.GetConfig().Name
+
+	accessorMatch := "((ra.accessor_type = @user_element AND ra.accessor_id = @user_id) OR " +
+		"(ra.accessor_type = @group_element AND ra.accessor_id IN (SELECT id FROM accessor_groups)))"
+	accessorDepth := "CASE WHEN ra.accessor_type = @user_element THEN 0 " +
+		"ELSE (SELECT MIN(depth) FROM accessor_groups WHERE id = ra.accessor_id) END"
+
+	// Resources without a scope only match the rules without a scope
+	scopeMatch := "COALESCE(g.scope_type, '') = ''"
+	if _, ok := model.(models.ScopedModel); ok {
+		scopeMatch = "(COALESCE(g.scope_type, '') = '' OR (g.scope_type = r.owner_type AND g.scope_id = r.owner_id))"
+	}
+
+	ownerMatch := ""
+	if a.AllowImplicitOwnerAccess {
+		ownerMatch = fmt.Sprintf("%s.user_id = @user_id OR ", table)
+	}
+
+	query = fmt.Sprintf(`%[5]s%[1]s.id IN (
+		WITH RECURSIVE accessor_groups(id, depth) AS (
+			SELECT group_id, 1 FROM group_members WHERE member_type = @user_element AND member_id = @user_id
+			UNION
+			SELECT gm.group_id, ag.depth + 1 FROM group_members gm
+				JOIN accessor_groups ag ON gm.member_type = @group_element AND gm.member_id = ag.id
+				WHERE ag.depth < @max_depth
+		),
+		granted_groups(id, rule_id, effect, priority, accessor_depth, scope_type, scope_id, depth) AS (
+			SELECT ra.resource_id, ra.id, ra.effect, ra.priority, %[3]s, ra.scope_type, ra.scope_id, 1 FROM role_accesses ra
+				WHERE ra.resource_type = @group_element AND ra.resource_id <> 0 AND ra.action = @action AND %[2]s
+			UNION
+			SELECT gm.member_id, gg.rule_id, gg.effect, gg.priority, gg.accessor_depth, gg.scope_type, gg.scope_id, gg.depth + 1
+				FROM group_members gm JOIN granted_groups gg ON gm.group_id = gg.id
+				WHERE gm.member_type = @group_element AND gg.depth < @max_depth
+		),
+		grants(resource_id, rule_id, effect, priority, accessor_depth, resource_depth, scope_type, scope_id) AS (
+			SELECT ra.resource_id, ra.id, ra.effect, ra.priority, %[3]s,
+				CASE WHEN ra.resource_id = 0 THEN @type_wide_depth ELSE 0 END, ra.scope_type, ra.scope_id
+				FROM role_accesses ra
+				WHERE ra.resource_type = @resource_type AND ra.action = @action AND %[2]s
+			UNION
+			SELECT gm.member_id, gg.rule_id, gg.effect, gg.priority, gg.accessor_depth, gg.depth, gg.scope_type, gg.scope_id
+				FROM group_members gm JOIN granted_groups gg ON gm.group_id = gg.id
+				WHERE gm.member_type = @resource_type
+		),
+		decisions(id, effect, position) AS (
+			SELECT r.id, g.effect, ROW_NUMBER() OVER (
+				PARTITION BY r.id
+				ORDER BY g.priority DESC, g.accessor_depth, g.resource_depth,
+					CASE WHEN g.effect = @deny_effect THEN 0 ELSE 1 END, g.rule_id
+			)
+			FROM %[1]s r JOIN grants g ON (g.resource_id = r.id OR g.resource_id = 0) AND %[4]s
+		)
+		SELECT id FROM decisions WHERE position = 1 AND COALESCE(effect, '') <> @deny_effect
+	)`, table, accessorMatch, accessorDepth, scopeMatch, ownerMatch)
+
+	vars = map[string]interface{}{
+		"user_id":         user.ID,
+		"user_element":    models.UserElement,
+		"group_element":   models.GroupElement,
+		"resource_type":   resourceType,
+		"action":          action,
+		"deny_effect":     models.DenyEffect,
+		"max_depth":       models.MaxGroupDepth,
+		"type_wide_depth": TypeWideDepth,
 	}
-	return false
+	return
+}
+
+// getModelFromStatement returns a new instance of the model the statement is querying
+func getModelFromStatement(stmt *gorm.Statement) (model models.UserOwnedModel, ok bool) {
+	target := stmt.Model
+	if target == nil {
+		target = stmt.Dest
+	}
+	if target == nil {
+		return
+	}
+	modelType := reflect.TypeOf(target)
+	for modelType.Kind() == reflect.Ptr || modelType.Kind() == reflect.Slice || modelType.Kind() == reflect.Array {
+		modelType = modelType.Elem()
+	}
+	if modelType.Kind() != reflect.Struct {
+		return
+	}
+	model, ok = reflect.New(modelType).Interface().(models.UserOwnedModel)
+	return
+}
+
+// GetScopeForModel returns the scope the model belongs to, if any
+func GetScopeForModel(model models.UserOwnedModel) (scope *models.Scope) {
+	scopedModel, ok := model.(models.ScopedModel)
+	if !ok || scopedModel.GetOwnerID() == 0 {
+		return
+	}
+	scope = &models.Scope{
+		ScopeType: scopedModel.GetOwnerType(),
+		ScopeID:   scopedModel.GetOwnerID(),
+	}
+	return
 }
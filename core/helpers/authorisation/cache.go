@@ -0,0 +1,105 @@
+package authorisation
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+type (
+	// CacheBackend stores the serialised entries of the DecisionCache.
+	// Invalidate has to make all the existing entries unreachable.
+	CacheBackend interface {
+		Get(key string) (value []byte, found bool, err error)
+		Set(key string, value []byte) error
+		Invalidate() error
+	}
+
+	// DecisionCache caches the authorisation decisions and the group ancestries
+	// of the elements. All entries are invalidated whenever a Group, a GroupMember
+	// or a RoleAccess changes.
+	DecisionCache struct {
+		backend CacheBackend
+		hits    atomic.Uint64
+		misses  atomic.Uint64
+	}
+
+	CacheStats struct {
+		Hits   uint64 `json:"hits"`
+		Misses uint64 `json:"misses"`
+	}
+)
+
+func NewDecisionCache(backend CacheBackend) *DecisionCache {
+	return &DecisionCache{backend: backend}
+}
+
+// Stats returns the number of hits and misses since the cache was created
+func (dc *DecisionCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   dc.hits.Load(),
+		Misses: dc.misses.Load(),
+	}
+}
+
+// Invalidate drops all the entries of the cache
+func (dc *DecisionCache) Invalidate() (err error) {
+	return dc.backend.Invalidate()
+}
+
+// get loads the entry into value and returns false on misses.
+// Backend failures are treated as misses.
+func (dc *DecisionCache) get(key string, value interface{}) (found bool) {
+	var (
+		data []byte
+		err  error
+	)
+	if data, found, err = dc.backend.Get(key); err != nil {
+		log.Println(err, "Failed to read the authorisation cache")
+		found = false
+	}
+	if found {
+		if err = json.Unmarshal(data, value); err != nil {
+			log.Println(err, "Failed to decode the authorisation cache entry")
+			found = false
+		}
+	}
+	if found {
+		dc.hits.Add(1)
+	} else {
+		dc.misses.Add(1)
+	}
+	return
+}
+
+func (dc *DecisionCache) set(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Println(err, "Failed to encode the authorisation cache entry")
+		return
+	}
+	if err = dc.backend.Set(key, data); err != nil {
+		log.Println(err, "Failed to write the authorisation cache")
+	}
+}
+
+func decisionCacheKey(authReq *AuthorisationRequest) string {
+	scope := ""
+	if authReq.Scope != nil {
+		scope = fmt.Sprintf("%s:%d", authReq.Scope.ScopeType, authReq.Scope.ScopeID)
+	}
+	return fmt.Sprintf("decision:%d:%s:%d:%s:%s",
+		authReq.User.GetID(),
+		authReq.Resource.GetConfig().Name,
+		authReq.Resource.GetID(),
+		authReq.Action,
+		scope,
+	)
+}
+
+func ancestryCacheKey(memberType models.ElementTypeT, memberID uint) string {
+	return fmt.Sprintf("ancestry:%s:%d", memberType, memberID)
+}
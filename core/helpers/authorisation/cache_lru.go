@@ -0,0 +1,84 @@
+package authorisation
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	DefaultLRUCacheSize = 10000
+)
+
+type (
+	// LRUCacheBackend is an in-process CacheBackend which evicts
+	// the least recently used entries once it's full
+	LRUCacheBackend struct {
+		size    int
+		entries map[string]*list.Element
+		order   *list.List
+		mu      sync.Mutex
+	}
+
+	lruEntry struct {
+		key   string
+		value []byte
+	}
+)
+
+func NewLRUCacheBackend(size int) *LRUCacheBackend {
+	if size <= 0 {
+		size = DefaultLRUCacheSize
+	}
+	return &LRUCacheBackend{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (lru *LRUCacheBackend) Get(key string) (value []byte, found bool, err error) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	element, found := lru.entries[key]
+	if !found {
+		return
+	}
+	lru.order.MoveToFront(element)
+	value = element.Value.(*lruEntry).value
+	return
+}
+
+func (lru *LRUCacheBackend) Set(key string, value []byte) (err error) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if element, found := lru.entries[key]; found {
+		element.Value.(*lruEntry).value = value
+		lru.order.MoveToFront(element)
+		return
+	}
+	lru.entries[key] = lru.order.PushFront(&lruEntry{key: key, value: value})
+	if lru.order.Len() > lru.size {
+		oldest := lru.order.Back()
+		lru.order.Remove(oldest)
+		delete(lru.entries, oldest.Value.(*lruEntry).key)
+	}
+	return
+}
+
+func (lru *LRUCacheBackend) Invalidate() (err error) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.entries = make(map[string]*list.Element)
+	lru.order.Init()
+	return
+}
+
+// Len returns the number of entries in the cache
+func (lru *LRUCacheBackend) Len() int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.order.Len()
+}
@@ -0,0 +1,86 @@
+package authorisation
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/gsarmaonline/goiter/core/services/cache"
+)
+
+const (
+	DefaultRedisCachePrefix = "goiter:authorisation"
+	DefaultRedisCacheTTL    = 10 * time.Minute
+)
+
+type (
+	// RedisCacheBackend is a CacheBackend shared by all the instances of the server.
+	// The keys are namespaced by a generation number which is incremented to
+	// invalidate all the entries at once, the stale ones expire with the TTL.
+	RedisCacheBackend struct {
+		cache  *cache.Cache
+		prefix string
+		ttl    time.Duration
+	}
+)
+
+func NewRedisCacheBackend(redisCache *cache.Cache) *RedisCacheBackend {
+	return &RedisCacheBackend{
+		cache:  redisCache,
+		prefix: DefaultRedisCachePrefix,
+		ttl:    DefaultRedisCacheTTL,
+	}
+}
+
+func (rc *RedisCacheBackend) generationKey() string {
+	return rc.prefix + ":generation"
+}
+
+func (rc *RedisCacheBackend) getGeneration(conn redis.Conn) (generation uint64, err error) {
+	if generation, err = redis.Uint64(conn.Do("GET", rc.generationKey())); err == redis.ErrNil {
+		err = nil
+	}
+	return
+}
+
+func (rc *RedisCacheBackend) entryKey(generation uint64, key string) string {
+	return fmt.Sprintf("%s:%d:%s", rc.prefix, generation, key)
+}
+
+func (rc *RedisCacheBackend) Get(key string) (value []byte, found bool, err error) {
+	var generation uint64
+	conn := rc.cache.Pool.Get()
+	defer conn.Close()
+
+	if generation, err = rc.getGeneration(conn); err != nil {
+		return
+	}
+	if value, err = redis.Bytes(conn.Do("GET", rc.entryKey(generation, key))); err != nil {
+		if err == redis.ErrNil {
+			err = nil
+		}
+		return
+	}
+	found = true
+	return
+}
+
+func (rc *RedisCacheBackend) Set(key string, value []byte) (err error) {
+	var generation uint64
+	conn := rc.cache.Pool.Get()
+	defer conn.Close()
+
+	if generation, err = rc.getGeneration(conn); err != nil {
+		return
+	}
+	_, err = conn.Do("SET", rc.entryKey(generation, key), value, "EX", int(rc.ttl.Seconds()))
+	return
+}
+
+func (rc *RedisCacheBackend) Invalidate() (err error) {
+	conn := rc.cache.Pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("INCR", rc.generationKey())
+	return
+}
@@ -0,0 +1,140 @@
+package authorisation
+
+import (
+	"sort"
+
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+const (
+	OwnerReason    DecisionReasonT = "owner"
+	RuleReason     DecisionReasonT = "rule"
+	NoRuleReason   DecisionReasonT = "no_matching_rule"
+	DisabledReason DecisionReasonT = "authorisation_disabled"
+
+	// TypeWideDepth is the resource depth of the rules which apply to all
+	// resources of a type, making them less specific than any group rule
+	TypeWideDepth = models.MaxGroupDepth + 1
+)
+
+type (
+	DecisionReasonT string
+
+	// RuleMatch is a rule which applies to the request along with how it applies.
+	// The depths are 0 for rules on the user or the resource itself and the depth
+	// of the group otherwise.
+	RuleMatch struct {
+		Rule          *models.RoleAccess `json:"rule"`
+		AccessorDepth int                `json:"accessor_depth"`
+		ResourceDepth int                `json:"resource_depth"`
+		// AccessorPath lists the groups leading from the user to the accessor group of the rule
+		AccessorPath []*models.Group `json:"accessor_path,omitempty"`
+		// ResourcePath lists the groups leading from the resource to the resource group of the rule
+		ResourcePath []*models.Group `json:"resource_path,omitempty"`
+	}
+
+	// Decision explains the outcome of an authorisation check
+	Decision struct {
+		Allowed bool            `json:"allowed"`
+		Reason  DecisionReasonT `json:"reason"`
+		// Match is the rule which produced the decision, if any
+		Match *RuleMatch `json:"match,omitempty"`
+		// Matches lists all the rules which apply to the request in precedence order
+		Matches []*RuleMatch `json:"matches"`
+	}
+
+	// ancestryIndex indexes the group ancestry of an element by group ID
+	ancestryIndex struct {
+		ancestors map[uint]*models.GroupAncestor
+		groups    map[uint]*models.Group
+	}
+)
+
+func newAncestryIndex(ancestors []*models.GroupAncestor) (index *ancestryIndex) {
+	index = &ancestryIndex{
+		ancestors: make(map[uint]*models.GroupAncestor),
+		groups:    make(map[uint]*models.Group),
+	}
+	for _, ancestor := range ancestors {
+		index.ancestors[ancestor.Group.ID] = ancestor
+		index.groups[ancestor.Group.ID] = ancestor.Group
+	}
+	return
+}
+
+func (index *ancestryIndex) groupIDs() (groupIDs []uint) {
+	for groupID := range index.ancestors {
+		groupIDs = append(groupIDs, groupID)
+	}
+	return
+}
+
+func (index *ancestryIndex) path(groupID uint) (groups []*models.Group) {
+	for _, pathGroupID := range index.ancestors[groupID].Path {
+		groups = append(groups, index.groups[pathGroupID])
+	}
+	return
+}
+
+// newRuleMatch computes how the rule applies to the accessor and the resource
+func newRuleMatch(rule *models.RoleAccess, accessors, resources *ancestryIndex) (match *RuleMatch) {
+	match = &RuleMatch{Rule: rule}
+	if rule.AccessorType == models.GroupElement {
+		match.AccessorDepth = accessors.ancestors[rule.AccessorID].Depth
+		match.AccessorPath = accessors.path(rule.AccessorID)
+	}
+	switch {
+	case rule.ResourceType == models.GroupElement:
+		if ancestor, ok := resources.ancestors[rule.ResourceID]; ok {
+			match.ResourceDepth = ancestor.Depth
+			match.ResourcePath = resources.path(rule.ResourceID)
+			break
+		}
+		// Rules on the Group model which don't apply via the ancestry
+		// apply to the group resource itself or all groups
+		if rule.ResourceID == 0 {
+			match.ResourceDepth = TypeWideDepth
+		}
+	case rule.ResourceID == 0:
+		match.ResourceDepth = TypeWideDepth
+	}
+	return
+}
+
+// sortMatches orders the matches by precedence:
+//   - Higher priority first
+//   - Rules on the user before the ones inherited via the closest groups
+//   - Rules on the resource before the ones on its closest groups, then the ones on all resources
+//   - Deny rules before allow rules
+//   - Older rules first, to keep the order deterministic
+func sortMatches(matches []*RuleMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Rule.Priority != b.Rule.Priority {
+			return a.Rule.Priority > b.Rule.Priority
+		}
+		if a.AccessorDepth != b.AccessorDepth {
+			return a.AccessorDepth < b.AccessorDepth
+		}
+		if a.ResourceDepth != b.ResourceDepth {
+			return a.ResourceDepth < b.ResourceDepth
+		}
+		if a.Rule.IsDeny() != b.Rule.IsDeny() {
+			return a.Rule.IsDeny()
+		}
+		return a.Rule.ID < b.Rule.ID
+	})
+}
+
+// decide picks the rule with the highest precedence
+func decide(matches []*RuleMatch) (decision *Decision) {
+	sortMatches(matches)
+	decision = &Decision{Reason: NoRuleReason, Matches: matches}
+	if len(matches) == 0 {
+		return
+	}
+	decision.Reason = RuleReason
+	decision.Match = matches[0]
+	decision.Allowed = !matches[0].Rule.IsDeny()
+	return
+}
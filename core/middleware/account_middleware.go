@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+const (
+	AccountKey = "account"
+
+	// AccountHeader selects the active account of the request
+	AccountHeader = "X-Account-ID"
+	// AccountClaim selects the active account of the requests authenticated with the token
+	AccountClaim = "account_id"
+)
+
+// AccountMiddleware resolves the active account of the request and stores it beside the user.
+// The account is selected, in order, by the X-Account-ID header, the account_id claim of the
+// token or the subdomain of TENANT_DOMAIN the request is sent to. Requests which don't select
+// an account act on the current account of the user.
+// Selecting an account the user doesn't belong to is rejected with a 403, as is selecting
+// another account than the one of an account API key. Accounts requiring two factor
+// authentication reject the users who haven't enabled it.
+func (m *Middleware) AccountMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var (
+			account *models.Account
+			err     error
+		)
+		user := c.MustGet(UserKey).(*models.User)
+		selected := true
+		apiKey := GetAPIKey(c)
+
+		if apiKey != nil && apiKey.IsAccountKey() {
+			if header := c.GetHeader(AccountHeader); header != "" && header != strconv.FormatUint(uint64(apiKey.OwnerID), 10) {
+				c.JSON(403, gin.H{"error": "API key belongs to another account"})
+				c.Abort()
+				return
+			}
+			account, err = user.GetAccount(m.db, apiKey.OwnerID)
+		} else if header := c.GetHeader(AccountHeader); header != "" {
+			accountID, parseErr := strconv.ParseUint(header, 10, 64)
+			if parseErr != nil {
+				c.JSON(400, gin.H{"error": "Invalid account ID"})
+				c.Abort()
+				return
+			}
+			account, err = user.GetAccount(m.db, uint(accountID))
+		} else if accountID := getAccountClaim(c); accountID != 0 {
+			account, err = user.GetAccount(m.db, accountID)
+		} else if subdomain := getTenantSubdomain(c.Request.Host); subdomain != "" {
+			account, err = user.GetAccountBySubdomain(m.db, subdomain)
+		} else {
+			selected = false
+			account, err = user.GetCurrentAccount(m.db)
+		}
+
+		if err != nil {
+			if selected {
+				c.JSON(403, gin.H{"error": "Not a member of the account"})
+				c.Abort()
+				return
+			}
+			// Users without any account are left to the handlers
+			c.Next()
+			return
+		}
+
+		if account.RequireMFA && !user.IsTOTPEnabled() {
+			c.JSON(403, gin.H{"error": "Two factor authentication is required by the account"})
+			c.Abort()
+			return
+		}
+
+		c.Set(AccountKey, account)
+		c.Next()
+	}
+}
+
+// getAccountClaim returns the account selected by the token of the request, if any
+func getAccountClaim(c *gin.Context) (accountID uint) {
+	cObj, exists := c.Get(ClaimsKey)
+	if !exists {
+		return
+	}
+	claims, ok := cObj.(jwt.MapClaims)
+	if !ok {
+		return
+	}
+	if claim, ok := claims[AccountClaim].(float64); ok && claim > 0 {
+		accountID = uint(claim)
+	}
+	return
+}
+
+// getTenantSubdomain returns the subdomain of TENANT_DOMAIN the request is sent to, if any
+func getTenantSubdomain(host string) (subdomain string) {
+	tenantDomain := os.Getenv("TENANT_DOMAIN")
+	if tenantDomain == "" {
+		return
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if !strings.HasSuffix(host, "."+tenantDomain) {
+		return
+	}
+	subdomain = strings.TrimSuffix(host, "."+tenantDomain)
+	// Only the first level of subdomains, which aren't reserved, selects an account
+	if strings.Contains(subdomain, ".") || models.IsReservedSubdomain(subdomain) {
+		subdomain = ""
+	}
+	return
+}
@@ -1,8 +1,11 @@
 package middleware
 
 import (
-	"fmt"
-	"os"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -10,24 +13,39 @@ import (
 	"github.com/gsarmaonline/goiter/core/models"
 )
 
-// AuthenticationMiddleware is a middleware that checks if the user is authenticated
+// AuthenticationMiddleware is a middleware that checks if the user is authenticated.
+// Requests are authenticated with a JWT, either in the Authorization header or the session
+// cookie, or with an API key sent as "Authorization: Bearer gk_...".
 func (m *Middleware) AuthenticationMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		var tokenString string
+		if authHeader := c.GetHeader("Authorization"); authHeader != "" {
+			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+			if tokenString == authHeader {
+				c.JSON(401, gin.H{"error": "Invalid token format"})
+				c.Abort()
+				return
+			}
+			if strings.HasPrefix(tokenString, models.APIKeyPrefix) {
+				m.authenticateAPIKey(c, tokenString)
+				return
+			}
+		} else if cookie, err := c.Cookie(AccessTokenCookie); err == nil && cookie != "" {
+			// Browsers send the cookies along with cross site requests, so the ones
+			// changing state have to prove they come from the frontend
+			if !isSafeMethod(c.Request.Method) && !hasValidCSRFToken(c) {
+				c.JSON(403, gin.H{"error": "Invalid CSRF token"})
+				c.Abort()
+				return
+			}
+			tokenString = cookie
+		} else {
 			c.JSON(401, gin.H{"error": "Not authenticated"})
 			c.Abort()
 			return
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		if tokenString == authHeader {
-			c.JSON(401, gin.H{"error": "Invalid token format"})
-			c.Abort()
-			return
-		}
-
-		token, err := m.parseToken(tokenString)
+		token, err := m.ParseToken(tokenString)
 		if err != nil {
 			c.JSON(401, gin.H{"error": "Invalid token"})
 			c.Abort()
@@ -35,17 +53,59 @@ func (m *Middleware) AuthenticationMiddleware() gin.HandlerFunc {
 		}
 
 		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			email := claims["email"].(string)
+			if pending, _ := claims[MFAPendingClaim].(bool); pending {
+				c.JSON(401, gin.H{"error": "Two factor authentication required"})
+				c.Abort()
+				return
+			}
+			// The subject is the ID of the user, which unlike the email never changes
+			userID, err := strconv.ParseUint(claims["sub"].(string), 10, 64)
+			if err != nil {
+				c.JSON(401, gin.H{"error": "Invalid token"})
+				c.Abort()
+				return
+			}
 			var user models.User
-			if err := m.db.Where("email = ?", email).First(&user).Error; err != nil {
+			if err := m.db.First(&user, userID).Error; err != nil {
 				c.JSON(401, gin.H{"error": "User not found"})
 				c.Abort()
 				return
 			}
 
+			// Tokens issued for a session are rejected once the session is revoked
+			if sessionID, ok := claims[SessionClaim].(float64); ok {
+				session, err := models.GetActiveSession(m.db, uint(sessionID), user.ID)
+				if err != nil {
+					c.JSON(401, gin.H{"error": "Session revoked"})
+					c.Abort()
+					return
+				}
+				c.Set(SessionKey, session)
+			}
+
+			// Impersonation tokens are rejected once the impersonator isn't a superuser anymore
+			var impersonator *models.User
+			if actor, ok := claims[ActorClaim].(map[string]interface{}); ok {
+				if impersonator, err = m.getImpersonator(actor, &user); err != nil {
+					c.JSON(401, gin.H{"error": "Impersonation isn't allowed"})
+					c.Abort()
+					return
+				}
+				c.Set(ImpersonatorKey, impersonator)
+			}
+
 			// Set user in context for use in handlers
 			c.Set(UserKey, &user)
+			c.Set(ClaimsKey, claims)
 			c.Next()
+
+			// Every request made while impersonating is recorded, including the rejected ones
+			if impersonator != nil {
+				if err := models.RecordImpersonation(m.db, impersonator.ID, user.ID, c.Request.Method,
+					c.Request.URL.Path, c.Writer.Status(), c.ClientIP()); err != nil {
+					log.Println("Failed to record the impersonated request", impersonator.ID, user.ID, err)
+				}
+			}
 		} else {
 			c.JSON(401, gin.H{"error": "Invalid token"})
 			c.Abort()
@@ -54,15 +114,97 @@ func (m *Middleware) AuthenticationMiddleware() gin.HandlerFunc {
 	}
 }
 
-func (m *Middleware) parseToken(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+// getImpersonator loads the superuser of the actor claim of an impersonation token
+func (m *Middleware) getImpersonator(actor map[string]interface{}, user *models.User) (impersonator *models.User, err error) {
+	sub, _ := actor["sub"].(string)
+	impersonatorID, err := strconv.ParseUint(sub, 10, 64)
+	if err != nil {
+		return
+	}
+	impersonator = &models.User{}
+	if err = m.db.First(impersonator, impersonatorID).Error; err != nil {
+		return
+	}
+	if !impersonator.CanImpersonate(user) {
+		err = errors.New("user can't be impersonated")
+	}
+	return
+}
+
+// GetImpersonator returns the superuser impersonating the user of the request, if any
+func GetImpersonator(c *gin.Context) (impersonator *models.User) {
+	if cObj, exists := c.Get(ImpersonatorKey); exists {
+		impersonator = cObj.(*models.User)
+	}
+	return
+}
+
+// BlockImpersonation rejects the requests made while impersonating, for the routes
+// whose effects only the user should cause, e.g. billing changes
+func (m *Middleware) BlockImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if GetImpersonator(c) != nil {
+			c.JSON(403, gin.H{"error": "Not allowed while impersonating"})
+			c.Abort()
+			return
 		}
-		secret := os.Getenv("JWT_SECRET")
-		if secret == "" {
-			return nil, fmt.Errorf("JWT secret not configured")
+		c.Next()
+	}
+}
+
+// SuperuserMiddleware only lets superusers signed in as themselves through
+func (m *Middleware) SuperuserMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cObj, exists := c.Get(UserKey)
+		if !exists || !cObj.(*models.User).IsSuperuser || GetAPIKey(c) != nil || GetImpersonator(c) != nil {
+			c.JSON(403, gin.H{"error": "Superuser access required"})
+			c.Abort()
+			return
 		}
-		return []byte(secret), nil
-	})
+		c.Next()
+	}
+}
+
+// authenticateAPIKey authenticates the request as the user of the API key
+func (m *Middleware) authenticateAPIKey(c *gin.Context, token string) {
+	apiKey, user, err := models.AuthenticateAPIKey(m.db, token)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	}
+	c.Set(UserKey, user)
+	c.Set(APIKeyKey, apiKey)
+	c.Next()
+}
+
+// GetAPIKey returns the API key the request is authenticated with, if any
+func GetAPIKey(c *gin.Context) (apiKey *models.APIKey) {
+	if cObj, exists := c.Get(APIKeyKey); exists {
+		apiKey = cObj.(*models.APIKey)
+	}
+	return
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// hasValidCSRFToken checks the CSRF header against the CSRF cookie
+func hasValidCSRFToken(c *gin.Context) bool {
+	cookie, err := c.Cookie(CSRFCookie)
+	if err != nil || cookie == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(c.GetHeader(CSRFHeader))) == 1
+}
+
+// ParseToken verifies the signature of a JWT with the key of its kid and validates
+// its iss, aud, sub, iat, jti and exp claims
+func (m *Middleware) ParseToken(tokenString string) (token *jwt.Token, err error) {
+	keySet, err := m.keys.KeySet()
+	if err != nil {
+		return
+	}
+	return keySet.Parse(tokenString)
 }
@@ -2,23 +2,51 @@ package middleware
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/services/signing"
 	"gorm.io/gorm"
 )
 
 const (
 	UserKey = "user"
+	// ClaimsKey stores the claims of the token the request is authenticated with
+	ClaimsKey = "claims"
+	// SessionKey stores the session of the token the request is authenticated with
+	SessionKey = "session"
+	// APIKeyKey stores the API key the request is authenticated with
+	APIKeyKey = "api_key"
+	// ImpersonatorKey stores the superuser acting as the user of the request, if any
+	ImpersonatorKey = "impersonator"
+
+	// SessionClaim is the claim holding the session ID of an access token
+	SessionClaim = "sid"
+	// MFAPendingClaim marks the tokens of a sign in awaiting its second factor,
+	// which are only accepted to verify it
+	MFAPendingClaim = "mfa_pending"
+	// ActorClaim holds the sub of the superuser who impersonates the user of the token,
+	// as the act claim of RFC 8693
+	ActorClaim = "act"
+
+	// Cookies of the session cookie mode. The CSRF token is readable by the frontend,
+	// which sends it back in the CSRFHeader of the requests changing state.
+	AccessTokenCookie  = "access_token"
+	RefreshTokenCookie = "refresh_token"
+	CSRFCookie         = "csrf_token"
+	CSRFHeader         = "X-CSRF-Token"
 )
 
 type (
 	Middleware struct {
 		router *gin.Engine
 		db     *gorm.DB
+		// keys verify the tokens the requests are authenticated with
+		keys *signing.KeyManager
 	}
 )
 
-func NewMiddleware(router *gin.Engine, db *gorm.DB) *Middleware {
+func NewMiddleware(router *gin.Engine, db *gorm.DB, keys *signing.KeyManager) *Middleware {
 	return &Middleware{
 		router: router,
 		db:     db,
+		keys:   keys,
 	}
 }
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goiter/core/models"
+)
+
+const (
+	ProjectKey = "project"
+
+	// ProjectHeader selects the current project of the request
+	ProjectHeader = "X-Project-ID"
+	// ProjectUrlKeyName selects the current project of the routes nested under a project
+	ProjectUrlKeyName = "project_id"
+)
+
+// ProjectMiddleware loads the current project of the request, if any, from the
+// project_id URL param or the X-Project-ID header and checks that the user can access it.
+// Models registered with ProjectScopeType are then created inside the project.
+func (m *Middleware) ProjectMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		projectID := c.Param(ProjectUrlKeyName)
+		if projectID == "" {
+			projectID = c.GetHeader(ProjectHeader)
+		}
+		if projectID == "" {
+			c.Next()
+			return
+		}
+
+		project := &models.Project{}
+		if err := m.db.Where("id = ?", projectID).First(project).Error; err != nil {
+			c.JSON(404, gin.H{"error": "Project not found"})
+			c.Abort()
+			return
+		}
+		user := c.MustGet(UserKey).(*models.User)
+		if !project.IsAccessibleBy(m.db, user.ID) {
+			c.JSON(403, gin.H{"error": "Not a member of the project"})
+			c.Abort()
+			return
+		}
+
+		c.Set(ProjectKey, project)
+		c.Next()
+	}
+}
@@ -1,14 +1,30 @@
 package models
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"reflect"
+	"regexp"
+	"time"
 
-	"github.com/stripe/stripe-go/v74"
-	"github.com/stripe/stripe-go/v74/customer"
-	"github.com/stripe/stripe-go/v74/paymentmethod"
-	"github.com/stripe/stripe-go/v74/subscription"
+	"github.com/gsarmaonline/goiter/core/services/payments"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNoSubscription    = errors.New("no subscription found for account")
+	ErrAlreadyOnPlan     = errors.New("account is already on the plan")
+	ErrPlanNotBillable   = errors.New("plan has no Stripe price")
+	ErrInvalidSubdomain  = errors.New("subdomain must be a lowercase DNS label")
+	ErrReservedSubdomain = errors.New("subdomain is reserved")
+
+	// subdomainPattern matches the DNS labels, i.e up to 63 letters, digits and hyphens
+	// which don't start or end with a hyphen
+	subdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+	// ReservedSubdomains can't be taken by the accounts as they serve the application itself
+	ReservedSubdomains = []string{"www", "api", "app", "admin", "auth", "mail", "static", "assets", "status", "docs"}
 )
 
 // Account represents an organization or workspace that can contain multiple projects
@@ -17,6 +33,11 @@ type Account struct {
 
 	Name        string `json:"name" gorm:"not null"`
 	Description string `json:"description"`
+	// Subdomain selects the account on requests sent to <subdomain>.TENANT_DOMAIN.
+	// Accounts without one store NULL, which the unique index doesn't compare.
+	Subdomain *string `json:"subdomain" gorm:"uniqueIndex"`
+	// RequireMFA only lets the members who enabled two factor authentication act on the account
+	RequireMFA bool `json:"require_mfa" gorm:"not null;default:false"`
 
 	PlanID uint  `json:"plan_id"`
 	Plan   *Plan `json:"plan" gorm:"foreignKey:PlanID"`
@@ -24,6 +45,9 @@ type Account struct {
 	StripeCustomerID     string `json:"-"`
 	StripeSubscriptionID string `json:"-"`
 	SubscriptionStatus   string `json:"subscription_status" gorm:"default:'active'"`
+	// CurrentPeriodStart and CurrentPeriodEnd are the billing period of the subscription
+	CurrentPeriodStart *time.Time `json:"current_period_start"`
+	CurrentPeriodEnd   *time.Time `json:"current_period_end"`
 }
 
 func (a Account) GetConfig() ModelConfig {
@@ -33,6 +57,27 @@ func (a Account) GetConfig() ModelConfig {
 	}
 }
 
+// ValidateSubdomain checks that the subdomain is a lowercase DNS label which isn't reserved
+func ValidateSubdomain(subdomain string) (err error) {
+	if !subdomainPattern.MatchString(subdomain) {
+		return ErrInvalidSubdomain
+	}
+	if IsReservedSubdomain(subdomain) {
+		return ErrReservedSubdomain
+	}
+	return
+}
+
+// IsReservedSubdomain checks if the subdomain is one of the ReservedSubdomains
+func IsReservedSubdomain(subdomain string) bool {
+	for _, reserved := range ReservedSubdomains {
+		if subdomain == reserved {
+			return true
+		}
+	}
+	return false
+}
+
 // BeforeCreate is a GORM hook that ensures new accounts have the free plan
 func (a *Account) BeforeCreate(tx *gorm.DB) error {
 	plan, err := GetDefaultPlan(tx)
@@ -43,31 +88,77 @@ func (a *Account) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// BeforeUpdate records the cancellation of the subscription of the accounts moved to the free
+// plan in the outbox, which cancels it at the end of its period once the update is committed.
+// The updates which leave the plan as is don't touch the subscription.
 func (account *Account) BeforeUpdate(tx *gorm.DB) (err error) {
-	if account.PlanID == 1 && account.StripeSubscriptionID != "" {
-		err = account.CancelStripeSubscription(tx)
+	if account.StripeSubscriptionID == "" {
+		return
+	}
+	planID, changed := updatedPlanID(tx)
+	if !changed {
+		return
+	}
+	plan, err := GetDefaultPlan(tx)
+	if err != nil || planID != plan.ID {
+		return
+	}
+	if err = EnqueueOutboxEvent(tx, CancelSubscriptionOutboxKind, account.ID,
+		fmt.Sprintf("account-%d-cancel-%s", account.ID, account.StripeSubscriptionID),
+		&CancelSubscriptionPayload{SubscriptionID: account.StripeSubscriptionID}); err != nil {
+		return
+	}
+	tx.Statement.SetColumn("subscription_status", "canceling")
+	return
+}
+
+// updatedPlanID returns the plan an update of an account moves it to, if it changes its plan
+func updatedPlanID(tx *gorm.DB) (planID uint, changed bool) {
+	if !tx.Statement.Changed("PlanID") {
+		return
+	}
+	switch dest := tx.Statement.Dest.(type) {
+	case map[string]interface{}:
+		value, ok := dest["plan_id"]
+		if !ok {
+			value = dest["PlanID"]
+		}
+		planValue := reflect.Indirect(reflect.ValueOf(value))
+		switch {
+		case planValue.CanUint():
+			planID = uint(planValue.Uint())
+		case planValue.CanInt():
+			planID = uint(planValue.Int())
+		}
+	case *Account:
+		planID = dest.PlanID
+	case Account:
+		planID = dest.PlanID
 	}
+	changed = planID != 0
+	return
+}
+
+// LockAccount locks the row of the account until the transaction ends, so that the concurrent
+// transactions checking a limit of the account wait for it and count what it created
+func LockAccount(tx *gorm.DB, accountID uint) (err error) {
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&Account{}, accountID).Error
 	return
 }
 
-func (account *Account) CreateStripeCustomer(tx *gorm.DB) (*stripe.Customer, error) {
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+func (account *Account) CreateStripeCustomer(tx *gorm.DB) (*payments.Customer, error) {
 	user := &User{}
 	if err := tx.First(user, "id = ?", account.UserID).Error; err != nil {
 		return nil, fmt.Errorf("failed to get user: %v", err)
 	}
 
-	params := &stripe.CustomerParams{
-		Email: stripe.String(user.Email),
-		Name:  stripe.String(user.Name),
-		Params: stripe.Params{
-			Metadata: map[string]string{
-				"user_id": fmt.Sprintf("%d", user.ID),
-			},
+	customer, err := paymentGateway.CreateCustomer(&payments.CustomerParams{
+		Email: user.Email,
+		Name:  user.Name,
+		Metadata: map[string]string{
+			"user_id": fmt.Sprintf("%d", user.ID),
 		},
-	}
-
-	customer, err := customer.New(params)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Stripe customer: %v", err)
 	}
@@ -81,10 +172,9 @@ func (account *Account) CreateStripeCustomer(tx *gorm.DB) (*stripe.Customer, err
 }
 
 // CreateStripeSubscription creates a subscription for an account
-func (account *Account) CreateStripeSubscription(tx *gorm.DB, plan *Plan, paymentMethodID string) (*stripe.Subscription, error) {
+func (account *Account) CreateStripeSubscription(tx *gorm.DB, plan *Plan, paymentMethodID string) (*payments.Subscription, error) {
 	// Get or create Stripe customer
 	var stripeCustomerID string
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
 
 	if account.HasActiveSubscription(tx) {
 		return nil, fmt.Errorf("account already has an active subscription")
@@ -101,33 +191,20 @@ func (account *Account) CreateStripeSubscription(tx *gorm.DB, plan *Plan, paymen
 	}
 
 	// Attach payment method to customer
-	attachParams := &stripe.PaymentMethodAttachParams{
-		Customer: stripe.String(stripeCustomerID),
-	}
-
-	_, err := paymentmethod.Attach(paymentMethodID, attachParams)
-	if err != nil {
+	if err := paymentGateway.AttachPaymentMethod(paymentMethodID, stripeCustomerID); err != nil {
 		return nil, fmt.Errorf("failed to attach payment method to customer: %v", err)
 	}
 
 	// Create subscription
-	params := &stripe.SubscriptionParams{
-		Customer: stripe.String(stripeCustomerID),
-		Items: []*stripe.SubscriptionItemsParams{
-			{
-				Price: stripe.String(plan.StripePriceID),
-			},
+	sub, err := paymentGateway.CreateSubscription(&payments.SubscriptionParams{
+		CustomerID:      stripeCustomerID,
+		PriceID:         plan.StripePriceID,
+		PaymentMethodID: paymentMethodID,
+		Metadata: map[string]string{
+			"account_id": fmt.Sprintf("%d", account.ID),
+			"plan_id":    fmt.Sprintf("%d", plan.ID),
 		},
-		DefaultPaymentMethod: stripe.String(paymentMethodID),
-		Params: stripe.Params{
-			Metadata: map[string]string{
-				"account_id": fmt.Sprintf("%d", account.ID),
-				"plan_id":    fmt.Sprintf("%d", plan.ID),
-			},
-		},
-	}
-
-	sub, err := subscription.New(params)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create subscription: %v", err)
 	}
@@ -144,17 +221,11 @@ func (account *Account) CreateStripeSubscription(tx *gorm.DB, plan *Plan, paymen
 }
 
 func (account *Account) CancelStripeSubscription(tx *gorm.DB) error {
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
 	if account.StripeSubscriptionID == "" {
-		return fmt.Errorf("no subscription found for account")
+		return ErrNoSubscription
 	}
 
-	params := &stripe.SubscriptionParams{
-		CancelAtPeriodEnd: stripe.Bool(true),
-	}
-
-	_, err := subscription.Update(account.StripeSubscriptionID, params)
-	if err != nil {
+	if _, err := paymentGateway.CancelSubscription(account.StripeSubscriptionID, true); err != nil {
 		return fmt.Errorf("failed to cancel subscription: %v", err)
 	}
 
@@ -166,15 +237,129 @@ func (account *Account) CancelStripeSubscription(tx *gorm.DB) error {
 	return nil
 }
 
+// ChangeStripeSubscriptionPlan moves the subscription of the account to the price of the plan,
+// prorating the change according to the behavior. The plan of the account follows the price of
+// the updated subscription, like it does on the webhook events of the change.
+func (account *Account) ChangeStripeSubscriptionPlan(tx *gorm.DB, plan *Plan, behavior payments.ProrationBehaviorT, prorationDate time.Time) (*payments.Subscription, error) {
+	params, err := account.planChangeParams(tx, plan, behavior, prorationDate)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := paymentGateway.ChangeSubscriptionPrice(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to change subscription: %v", err)
+	}
+	if err := SyncStripeSubscription(tx, sub); err != nil {
+		return nil, fmt.Errorf("failed to update account: %v", err)
+	}
+	return sub, nil
+}
+
+// PreviewStripeSubscriptionPlan returns the upcoming invoice of the account if its subscription
+// was moved to the plan, along with the proration date to change it with for the same amounts
+func (account *Account) PreviewStripeSubscriptionPlan(tx *gorm.DB, plan *Plan, behavior payments.ProrationBehaviorT, prorationDate time.Time) (*payments.ProrationPreview, error) {
+	params, err := account.planChangeParams(tx, plan, behavior, prorationDate)
+	if err != nil {
+		return nil, err
+	}
+	preview, err := paymentGateway.PreviewSubscriptionChange(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to preview subscription change: %v", err)
+	}
+	return preview, nil
+}
+
+// planChangeParams returns the change of the item of the subscription of the account billing
+// its plan to the price of the plan
+func (account *Account) planChangeParams(tx *gorm.DB, plan *Plan, behavior payments.ProrationBehaviorT, prorationDate time.Time) (*payments.SubscriptionChangeParams, error) {
+	if account.StripeSubscriptionID == "" {
+		return nil, ErrNoSubscription
+	}
+	if plan.ID == account.PlanID {
+		return nil, ErrAlreadyOnPlan
+	}
+	if plan.StripePriceID == "" {
+		return nil, ErrPlanNotBillable
+	}
+
+	sub, err := paymentGateway.GetSubscription(account.StripeSubscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %v", err)
+	}
+	_, item, err := GetSubscriptionPlan(tx, sub)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, fmt.Errorf("subscription %s doesn't bill a plan", sub.ID)
+	}
+
+	return &payments.SubscriptionChangeParams{
+		SubscriptionID:    sub.ID,
+		ItemID:            item.ID,
+		PriceID:           plan.StripePriceID,
+		ProrationBehavior: behavior,
+		ProrationDate:     prorationDate,
+		Metadata: map[string]string{
+			"account_id": fmt.Sprintf("%d", account.ID),
+			"plan_id":    fmt.Sprintf("%d", plan.ID),
+		},
+	}, nil
+}
+
+// GetSubscriptionPlan returns the plan billed by the subscription along with the item billing
+// it, nil if none of its items has the price of a plan, like its metered items
+func GetSubscriptionPlan(tx *gorm.DB, sub *payments.Subscription) (plan *Plan, item *payments.SubscriptionItem, err error) {
+	var priceIDs []string
+	for _, subscriptionItem := range sub.Items {
+		if subscriptionItem.PriceID != "" {
+			priceIDs = append(priceIDs, subscriptionItem.PriceID)
+		}
+	}
+	if len(priceIDs) == 0 {
+		return
+	}
+	plan = &Plan{}
+	if err = tx.Where("stripe_price_id IN ?", priceIDs).Order("id").First(plan).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	item = sub.GetItem(plan.StripePriceID)
+	return
+}
+
+// SyncStripeSubscription stores the status, the billing period and the plan of the subscription
+// in the account it bills. The plan is reconciled from the price of the subscription, so that
+// the changes of plan follow the subscription whether they were made by the app or not.
+func SyncStripeSubscription(tx *gorm.DB, sub *payments.Subscription) (err error) {
+	updates := map[string]interface{}{
+		"subscription_status": sub.Status,
+	}
+	if !sub.CurrentPeriodStart.IsZero() && !sub.CurrentPeriodEnd.IsZero() {
+		updates["current_period_start"] = sub.CurrentPeriodStart
+		updates["current_period_end"] = sub.CurrentPeriodEnd
+	}
+	plan, _, err := GetSubscriptionPlan(tx, sub)
+	if err != nil {
+		return
+	}
+	if plan != nil {
+		updates["plan_id"] = plan.ID
+	}
+	err = tx.Model(&Account{}).Where("stripe_subscription_id = ?", sub.ID).Updates(updates).Error
+	return
+}
+
 func (account *Account) HasActiveSubscription(tx *gorm.DB) (hasActiveSubscription bool) {
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
 	if account.StripeSubscriptionID == "" {
 		return
 	}
-	sub, err := subscription.Get(account.StripeSubscriptionID, nil)
+	sub, err := paymentGateway.GetSubscription(account.StripeSubscriptionID)
 	if err != nil {
 		return
 	}
-	hasActiveSubscription = sub.Status == "active"
+	hasActiveSubscription = sub.Status == payments.ActiveSubscription
 	return
 }
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// InvitationTTL is how long an invitation can be accepted for
+	InvitationTTL = 7 * 24 * time.Hour
+
+	// Invitation statuses
+	InvitationPending  InvitationStatusT = "pending"
+	InvitationAccepted InvitationStatusT = "accepted"
+	InvitationRevoked  InvitationStatusT = "revoked"
+	InvitationExpired  InvitationStatusT = "expired"
+)
+
+var (
+	ErrInvitationNotPending = errors.New("invitation is no longer pending")
+	ErrInvitationEmail      = errors.New("invitation was sent to another email")
+)
+
+type (
+	InvitationStatusT string
+
+	// AccountInvitation invites an email to join an account with a role.
+	// Only the hash of the token is stored, the token itself is emailed.
+	AccountInvitation struct {
+		BaseModelWithUser
+
+		AccountID  uint         `json:"account_id" gorm:"index"`
+		Email      string       `json:"email" gorm:"not null;index"`
+		Role       AccountRoleT `json:"role" gorm:"not null;default:'member'"`
+		TokenHash  string       `json:"-" gorm:"uniqueIndex"`
+		ExpiresAt  time.Time    `json:"expires_at"`
+		AcceptedAt *time.Time   `json:"accepted_at"`
+		RevokedAt  *time.Time   `json:"revoked_at"`
+
+		Status InvitationStatusT `json:"status" gorm:"-"`
+	}
+)
+
+func (accountInvitation AccountInvitation) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "AccountInvitation",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// NewAccountInvitation creates an invitation to the account along with its token
+func NewAccountInvitation(tx *gorm.DB, account *Account, inviterID uint, email string, role AccountRoleT) (invitation *AccountInvitation, token string, err error) {
+	tokenBytes := make([]byte, 32)
+	if _, err = rand.Read(tokenBytes); err != nil {
+		return
+	}
+	token = hex.EncodeToString(tokenBytes)
+
+	invitation = &AccountInvitation{
+		AccountID: account.ID,
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		Role:      role,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(InvitationTTL),
+		Status:    InvitationPending,
+	}
+	invitation.UserID = inviterID
+	invitation.SetOwner(AccountScopeType, account.ID)
+	err = tx.Create(invitation).Error
+	return
+}
+
+// GetInvitationByToken returns the invitation sent with the token
+func GetInvitationByToken(tx *gorm.DB, token string) (invitation *AccountInvitation, err error) {
+	invitation = &AccountInvitation{}
+	err = tx.Where("token_hash = ?", hashToken(token)).First(invitation).Error
+	return
+}
+
+// AfterFind is a GORM hook that computes the status of the loaded invitation
+func (invitation *AccountInvitation) AfterFind(tx *gorm.DB) (err error) {
+	invitation.Status = invitation.GetStatus()
+	return
+}
+
+// GetStatus returns the status of the invitation
+func (invitation *AccountInvitation) GetStatus() InvitationStatusT {
+	switch {
+	case invitation.AcceptedAt != nil:
+		return InvitationAccepted
+	case invitation.RevokedAt != nil:
+		return InvitationRevoked
+	case time.Now().After(invitation.ExpiresAt):
+		return InvitationExpired
+	}
+	return InvitationPending
+}
+
+// Revoke prevents a pending invitation from being accepted
+func (invitation *AccountInvitation) Revoke(tx *gorm.DB) (err error) {
+	if invitation.GetStatus() != InvitationPending {
+		return ErrInvitationNotPending
+	}
+	now := time.Now()
+	invitation.RevokedAt = &now
+	invitation.Status = InvitationRevoked
+	err = tx.Model(invitation).Update("revoked_at", now).Error
+	return
+}
+
+// Accept adds the user to the account of the invitation. The user needs to
+// have the email the invitation was sent to.
+func (invitation *AccountInvitation) Accept(tx *gorm.DB, user *User) (membership *AccountMembership, err error) {
+	if invitation.GetStatus() != InvitationPending {
+		err = ErrInvitationNotPending
+		return
+	}
+	if !strings.EqualFold(invitation.Email, user.Email) {
+		err = ErrInvitationEmail
+		return
+	}
+	err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		account := &Account{}
+		if err = tx.Where("id = ?", invitation.AccountID).First(account).Error; err != nil {
+			return
+		}
+		// Users who already belong to the account keep their membership
+		if membership, err = account.GetMembership(tx, user.ID); errors.Is(err, gorm.ErrRecordNotFound) {
+			membership, err = account.AddMember(tx, user.ID, invitation.Role)
+		}
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		invitation.AcceptedAt = &now
+		invitation.Status = InvitationAccepted
+		err = tx.Model(invitation).Update("accepted_at", now).Error
+		return
+	})
+	return
+}
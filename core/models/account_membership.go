@@ -0,0 +1,150 @@
+package models
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// Account roles
+	AccountOwnerRole   AccountRoleT = "owner"
+	AccountAdminRole   AccountRoleT = "admin"
+	AccountMemberRole  AccountRoleT = "member"
+	AccountBillingRole AccountRoleT = "billing"
+)
+
+type (
+	AccountRoleT string
+
+	// AccountMembership gives an user access to an account with a role.
+	// The user who created the account is its owner even without a membership.
+	AccountMembership struct {
+		BaseModelWithUser
+
+		AccountID uint         `json:"account_id" gorm:"index"`
+		Account   *Account     `json:"account,omitempty" gorm:"foreignKey:AccountID"`
+		MemberID  uint         `json:"member_id" gorm:"index"`
+		Member    *User        `json:"member,omitempty" gorm:"foreignKey:MemberID"`
+		Role      AccountRoleT `json:"role" gorm:"not null;default:'member'"`
+	}
+)
+
+func (accountMembership AccountMembership) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "AccountMembership",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// IsValid checks if the role is a supported one
+func (role AccountRoleT) IsValid() bool {
+	switch role {
+	case AccountOwnerRole, AccountAdminRole, AccountMemberRole, AccountBillingRole:
+		return true
+	}
+	return false
+}
+
+// CanManageMembers checks if the role can invite and remove the members of the account
+func (role AccountRoleT) CanManageMembers() bool {
+	return role == AccountOwnerRole || role == AccountAdminRole
+}
+
+// CanManageAccount checks if the role can update the account
+func (role AccountRoleT) CanManageAccount() bool {
+	return role == AccountOwnerRole || role == AccountAdminRole
+}
+
+// CanManageBilling checks if the role can change the subscription of the account
+func (role AccountRoleT) CanManageBilling() bool {
+	return role == AccountOwnerRole || role == AccountAdminRole || role == AccountBillingRole
+}
+
+// GetMembership returns the membership of the user in the account
+func (account *Account) GetMembership(tx *gorm.DB, userID uint) (membership *AccountMembership, err error) {
+	membership = &AccountMembership{}
+	err = tx.Where("account_id = ? AND member_id = ?", account.ID, userID).First(membership).Error
+	return
+}
+
+// GetRole returns the role of the user in the account.
+// It returns gorm.ErrRecordNotFound if the user doesn't belong to the account.
+func (account *Account) GetRole(tx *gorm.DB, userID uint) (role AccountRoleT, err error) {
+	if account.UserID == userID {
+		role = AccountOwnerRole
+		return
+	}
+	membership, err := account.GetMembership(tx, userID)
+	if err != nil {
+		return
+	}
+	role = membership.Role
+	return
+}
+
+// AddMember adds the user to the account with the role
+func (account *Account) AddMember(tx *gorm.DB, userID uint, role AccountRoleT) (membership *AccountMembership, err error) {
+	membership = &AccountMembership{
+		AccountID: account.ID,
+		MemberID:  userID,
+		Role:      role,
+	}
+	membership.UserID = userID
+	membership.SetOwner(AccountScopeType, account.ID)
+	err = tx.Create(membership).Error
+	return
+}
+
+// accountsOfUser scopes the query to the accounts the user created or is a member of
+func accountsOfUser(tx *gorm.DB, userID uint) *gorm.DB {
+	memberAccountIDs := tx.Session(&gorm.Session{NewDB: true}).
+		Model(&AccountMembership{}).
+		Select("account_id").
+		Where("member_id = ?", userID)
+	return tx.Where("accounts.user_id = ? OR accounts.id IN (?)", userID, memberAccountIDs)
+}
+
+// GetAccounts returns the accounts the user created or is a member of
+func (u *User) GetAccounts(tx *gorm.DB) (accounts []*Account, err error) {
+	err = accountsOfUser(tx, u.ID).Preload("Plan").Order("accounts.id").Find(&accounts).Error
+	return
+}
+
+// GetCurrentAccount returns the account the user switched to. Users who
+// didn't switch, or who left that account, act on the first account they belong to.
+func (u *User) GetCurrentAccount(tx *gorm.DB) (account *Account, err error) {
+	account = &Account{}
+	if u.CurrentAccountID != 0 {
+		if err = accountsOfUser(tx, u.ID).Where("accounts.id = ?", u.CurrentAccountID).First(account).Error; err == nil {
+			return
+		}
+	}
+	err = accountsOfUser(tx, u.ID).Order("accounts.id").First(account).Error
+	return
+}
+
+// GetAccount returns the account if the user belongs to it
+func (u *User) GetAccount(tx *gorm.DB, accountID uint) (account *Account, err error) {
+	account = &Account{}
+	err = accountsOfUser(tx, u.ID).Where("accounts.id = ?", accountID).First(account).Error
+	return
+}
+
+// GetAccountBySubdomain returns the account with the subdomain if the user belongs to it
+func (u *User) GetAccountBySubdomain(tx *gorm.DB, subdomain string) (account *Account, err error) {
+	account = &Account{}
+	err = accountsOfUser(tx, u.ID).Where("accounts.subdomain = ?", strings.ToLower(subdomain)).First(account).Error
+	return
+}
+
+// SwitchAccount makes the account the current account of the user
+func (u *User) SwitchAccount(tx *gorm.DB, accountID uint) (account *Account, err error) {
+	if account, err = u.GetAccount(tx, accountID); err != nil {
+		return
+	}
+	if err = tx.Model(u).Update("current_account_id", account.ID).Error; err != nil {
+		return
+	}
+	return
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// APIKeyPrefix starts every API key so that they can be told apart from JWTs
+	APIKeyPrefix = "gk_"
+	// apiKeyDisplayLength is the length of the start of the key which is stored in clear
+	// so that the user can recognise their keys
+	apiKeyDisplayLength = len(APIKeyPrefix) + 8
+	// APIKeyUsageInterval limits how often the last use of a key is written
+	APIKeyUsageInterval = time.Minute
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	ErrInvalidScopes = errors.New("scopes must be a non empty list of actions")
+)
+
+type (
+	// APIKey authenticates the requests of scripts and integrations on behalf of the user
+	// who created it. Keys owned by an account act on that account only. Only the hash of
+	// the key is stored, it's shown to the user once when it's created.
+	APIKey struct {
+		BaseModelWithUser
+
+		Name       string     `json:"name" gorm:"not null"`
+		Prefix     string     `json:"prefix" gorm:"type:varchar(16);not null"`
+		TokenHash  string     `json:"-" gorm:"not null;uniqueIndex"`
+		Scopes     []ActionT  `json:"scopes" gorm:"serializer:json"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		RevokedAt  *time.Time `json:"revoked_at"`
+	}
+)
+
+func (apiKey APIKey) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "APIKey",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// NewAPIKey creates a key of the user, owned by the user or by one of their accounts,
+// and returns it along with its secret token
+func NewAPIKey(tx *gorm.DB, user *User, ownerType ScopeTypeT, ownerID uint, name string, scopes []ActionT, expiresAt *time.Time) (apiKey *APIKey, token string, err error) {
+	if len(scopes) == 0 {
+		err = ErrInvalidScopes
+		return
+	}
+	for _, scope := range scopes {
+		if !scope.IsValid() {
+			err = ErrInvalidScopes
+			return
+		}
+	}
+	secret := make([]byte, 24)
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+	token = APIKeyPrefix + hex.EncodeToString(secret)
+
+	apiKey = &APIKey{
+		Name:      name,
+		Prefix:    token[:apiKeyDisplayLength],
+		TokenHash: hashToken(token),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	apiKey.UserID = user.ID
+	apiKey.SetOwner(ownerType, ownerID)
+	err = tx.Create(apiKey).Error
+	return
+}
+
+// AuthenticateAPIKey returns the active key of the token along with its user
+func AuthenticateAPIKey(tx *gorm.DB, token string) (apiKey *APIKey, user *User, err error) {
+	if !strings.HasPrefix(token, APIKeyPrefix) {
+		err = ErrInvalidAPIKey
+		return
+	}
+	apiKey = &APIKey{}
+	if err = tx.Where("token_hash = ?", hashToken(token)).First(apiKey).Error; err != nil {
+		err = ErrInvalidAPIKey
+		return
+	}
+	if !apiKey.IsActive() {
+		err = ErrInvalidAPIKey
+		return
+	}
+	user = &User{}
+	if err = tx.Where("id = ?", apiKey.UserID).First(user).Error; err != nil {
+		err = ErrInvalidAPIKey
+		return
+	}
+
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > APIKeyUsageInterval {
+		apiKey.LastUsedAt = &now
+		err = tx.Model(apiKey).UpdateColumn("last_used_at", now).Error
+	}
+	return
+}
+
+// IsActive checks if the key wasn't revoked and hasn't expired
+func (apiKey *APIKey) IsActive() bool {
+	return apiKey.RevokedAt == nil && (apiKey.ExpiresAt == nil || time.Now().Before(*apiKey.ExpiresAt))
+}
+
+// IsAccountKey checks if the key is owned by an account rather than its user
+func (apiKey *APIKey) IsAccountKey() bool {
+	return apiKey.OwnerType == AccountScopeType
+}
+
+// Allows checks if the action is one of the scopes of the key
+func (apiKey *APIKey) Allows(action ActionT) bool {
+	for _, scope := range apiKey.Scopes {
+		if scope == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoke disables the key, rejecting the requests authenticated with it
+func (apiKey *APIKey) Revoke(tx *gorm.DB) (err error) {
+	if apiKey.RevokedAt != nil {
+		return
+	}
+	now := time.Now()
+	apiKey.RevokedAt = &now
+	err = tx.Model(apiKey).Update("revoked_at", now).Error
+	return
+}
+
+// RevokeUserAPIKeys disables all the keys created by the user
+func RevokeUserAPIKeys(tx *gorm.DB, userID uint) (err error) {
+	err = tx.Model(&APIKey{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+	return
+}
@@ -0,0 +1,68 @@
+package models
+
+const (
+	// Element types used by RoleAccess rules to identify the accessor and the resource
+	UserElement  ElementT = "User"
+	GroupElement ElementT = "Group"
+
+	// Effects of a RoleAccess rule
+	AllowEffect EffectT = "allow"
+	DenyEffect  EffectT = "deny"
+)
+
+type (
+	EffectT string
+
+	// RoleAccess is a rule which allows or denies the accessor to perform
+	// the action on the resource.
+	// The accessor can either be a User or a Group of users.
+	// The resource can either be a specific object, all objects of a type
+	// (ResourceID = 0) or a Group of objects.
+	// When multiple rules match, the rule with the highest Priority wins,
+	// then the most specific one and deny rules win over allow rules.
+	RoleAccess struct {
+		BaseModelWithUser
+
+		AccessorType ElementT `json:"accessor_type" gorm:"index:idx_role_access_accessor"`
+		AccessorID   uint     `json:"accessor_id" gorm:"index:idx_role_access_accessor"`
+
+		ResourceType ElementT `json:"resource_type" gorm:"index:idx_role_access_resource"`
+		ResourceID   uint     `json:"resource_id" gorm:"index:idx_role_access_resource"`
+
+		Scope
+
+		Action ActionT `json:"action" gorm:"index"`
+
+		Effect   EffectT `json:"effect" gorm:"not null;default:'allow'"`
+		Priority int     `json:"priority" gorm:"not null;default:0"`
+	}
+
+	// Scope restricts a RoleAccess rule to a tenant like an Account or a Project.
+	// Rules without a scope type apply to all scopes.
+	Scope struct {
+		ScopeType ScopeTypeT `json:"scope_type"`
+		ScopeID   uint       `json:"scope_id"`
+	}
+)
+
+func (roleAccess RoleAccess) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "RoleAccess",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// IsValid checks if the effect is a supported one
+func (effect EffectT) IsValid() bool {
+	switch effect {
+	case AllowEffect, DenyEffect:
+		return true
+	}
+	return false
+}
+
+// IsDeny returns true if the rule denies the action.
+// Rules without an effect allow the action.
+func (roleAccess *RoleAccess) IsDeny() bool {
+	return roleAccess.Effect == DenyEffect
+}
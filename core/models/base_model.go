@@ -14,6 +14,8 @@ const (
 	// Scope types
 	ProjectScopeType ScopeTypeT = "Project"
 	AccountScopeType ScopeTypeT = "Account"
+	// UserScopeType is the default owner type of the models owned by their user
+	UserScopeType ScopeTypeT = "user"
 )
 
 type (
@@ -26,6 +28,12 @@ type (
 		SetUserID(uint)
 		GetConfig() ModelConfig
 	}
+	// ScopedModel is implemented by models which belong to a scope like an Account or a Project
+	ScopedModel interface {
+		GetOwnerType() ScopeTypeT
+		GetOwnerID() uint
+		SetOwner(ScopeTypeT, uint)
+	}
 	BaseModel struct {
 		ID        uint      `json:"id" gorm:"primary_key"`
 		CreatedAt time.Time `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
@@ -51,6 +59,15 @@ type (
 	}
 )
 
+// IsValid checks if the action is one of the supported actions
+func (action ActionT) IsValid() bool {
+	switch action {
+	case ReadAction, CreateAction, UpdateAction, DeleteAction:
+		return true
+	}
+	return false
+}
+
 func (b *BaseModelWithUser) GetUserID() uint {
 	return b.UserID
 }
@@ -59,6 +76,19 @@ func (b *BaseModelWithUser) SetUserID(userID uint) {
 	b.UserID = userID
 }
 
+func (b *BaseModelWithUser) SetOwner(ownerType ScopeTypeT, ownerID uint) {
+	b.OwnerType = ownerType
+	b.OwnerID = ownerID
+}
+
+func (b *BaseModelWithUser) GetOwnerType() ScopeTypeT {
+	return b.OwnerType
+}
+
+func (b *BaseModelWithUser) GetOwnerID() uint {
+	return b.OwnerID
+}
+
 func (b *BaseModelWithoutUser) GetUserID() uint {
 	return 0
 }
@@ -26,6 +26,22 @@ var (
 		&PlanFeature{},
 		&Group{},
 		&GroupMember{},
+		&RoleAccess{},
+		&Project{},
+		&ProjectMember{},
+		&AccountMembership{},
+		&AccountInvitation{},
+		&Session{},
+		&RotatedRefreshToken{},
+		&UserToken{},
+		&UserIdentity{},
+		&APIKey{},
+		&RecoveryCode{},
+		&OneTimeCode{},
+		&ImpersonationLog{},
+		&SAMLConfig{},
+		&UsageRecord{},
+		&OutboxEvent{},
 	}
 )
 
@@ -85,6 +101,17 @@ func (dbMgr *DbManager) GetModelByType(modelName string) (model interface{}, err
 	return
 }
 
+// NewModelByType returns a new instance of the registered model with the given name
+func (dbMgr *DbManager) NewModelByType(modelName string) (model UserOwnedModel, err error) {
+	registered, ok := dbMgr.models[modelName]
+	if !ok {
+		err = fmt.Errorf("no model found by the name %s", modelName)
+		return
+	}
+	model = reflect.New(reflect.TypeOf(registered).Elem()).Interface().(UserOwnedModel)
+	return
+}
+
 func (dbMgr *DbManager) GetModels() (models []UserOwnedModel) {
 	for _, model := range dbMgr.models {
 		models = append(models, model)
@@ -157,6 +184,10 @@ func (dbMgr *DbManager) Setup() (err error) {
 }
 
 func (dbMgr *DbManager) Migrate() (err error) {
+	if err = dbMgr.PreMigrate(); err != nil {
+		log.Println("Pre migration failed:", err)
+		return
+	}
 	models := dbMgr.GetModels()
 	var ifaceModels []interface{}
 	for _, m := range models {
@@ -174,6 +205,24 @@ func (dbMgr *DbManager) Migrate() (err error) {
 	return
 }
 
+// PreMigrate prepares the existing rows for the migration of the models
+func (dbMgr *DbManager) PreMigrate() (err error) {
+	// Accounts without a subdomain used to store an empty one, which the unique index rejects
+	if dbMgr.Db.Migrator().HasTable(&Account{}) {
+		if err = dbMgr.Db.Model(&Account{}).Where("subdomain = ?", "").UpdateColumn("subdomain", nil).Error; err != nil {
+			return
+		}
+	}
+	// Users who didn't sign in with Google used to store a placeholder, like password:<email>
+	if dbMgr.Db.Migrator().HasTable(&User{}) {
+		if err = dbMgr.Db.Model(&User{}).Where("google_id = ? OR google_id LIKE ?", "", "%:%").
+			UpdateColumn("google_id", nil).Error; err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (dbMgr *DbManager) PostMigrate() (err error) {
 	if err = dbMgr.seeder.Seed(); err != nil {
 		return
@@ -2,6 +2,9 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"gorm.io/gorm"
 )
@@ -9,6 +12,37 @@ import (
 const (
 	UserElementType     ElementTypeT = "user_element"
 	ResourceElementType ElementTypeT = "resource_element"
+
+	// GroupMemberType is the member type used for nested groups
+	GroupMemberType ElementTypeT = "Group"
+	// UserMemberType is the member type used for users
+	UserMemberType ElementTypeT = "User"
+
+	// MaxGroupDepth is the maximum depth of nested groups which is traversed
+	MaxGroupDepth = 10
+)
+
+// The recursive CTEs walk the group memberships up (ancestors) or down (descendants).
+// Every row carries the path of group IDs it was reached by, formatted as "/1/2/3/",
+// which is used to stop at cycles. The depth is limited to MaxGroupDepth.
+// Both are supported by Postgres and SQLite.
+const (
+	groupAncestorsCTE = `WITH RECURSIVE ancestors(id, depth, path) AS (
+		SELECT group_id, 1, '/' || CAST(group_id AS TEXT) || '/' FROM group_members
+			WHERE member_type = @member_type AND member_id = @member_id
+		UNION ALL
+		SELECT gm.group_id, a.depth + 1, a.path || CAST(gm.group_id AS TEXT) || '/' FROM group_members gm
+			JOIN ancestors a ON gm.member_type = @group_type AND gm.member_id = a.id
+			WHERE a.depth < @max_depth AND a.path NOT LIKE '%/' || CAST(gm.group_id AS TEXT) || '/%'
+	) `
+
+	groupDescendantsCTE = `WITH RECURSIVE descendants(id, depth, path) AS (
+		SELECT id, 0, '/' || CAST(id AS TEXT) || '/' FROM groups WHERE id = @group_id
+		UNION ALL
+		SELECT gm.member_id, d.depth + 1, d.path || CAST(gm.member_id AS TEXT) || '/' FROM group_members gm
+			JOIN descendants d ON gm.group_id = d.id AND gm.member_type = @group_type
+			WHERE d.depth < @max_depth AND d.path NOT LIKE '%/' || CAST(gm.member_id AS TEXT) || '/%'
+	) `
 )
 
 type (
@@ -30,12 +64,29 @@ type (
 		BaseModelWithUser
 
 		GroupID uint `json:"group_id"`
-		// The MemberType refers to the type of the member
+		// The MemberType refers to the type of the member, i.e the model name
+		// like "User" or "ModelOne".
 		// It can also be "Group" to allow nested groups
 		MemberType ElementTypeT `json:"member_type"`
 		MemberID   uint         `json:"member_id"`
 	}
 
+	// GroupAncestor is a group an element belongs to, directly or via nested groups
+	GroupAncestor struct {
+		Group *Group `json:"group"`
+		// Depth is 1 for the groups the element is a direct member of
+		Depth int `json:"depth"`
+		// Path lists the IDs of the groups leading from the element to the group
+		Path []uint `json:"path"`
+	}
+
+	// groupPathRow is a row returned by the recursive group CTEs
+	groupPathRow struct {
+		ID    uint
+		Depth int
+		Path  string
+	}
+
 	// This struct is used to fetch groups for a given model
 	GroupFetcher struct {
 		tx    *gorm.DB
@@ -57,90 +108,97 @@ func (groupMember GroupMember) GetConfig() ModelConfig {
 	}
 }
 
-func (group *Group) GetGroupMembers(tx *gorm.DB, memberType ElementTypeT, members *[]GroupMember) (err error) {
-	return group.getGroupMembersRecursive(tx, memberType, members)
+// GetElementType returns the kind of element the member refers to
+func (groupMember *GroupMember) GetElementType() ElementTypeT {
+	switch groupMember.MemberType {
+	case UserMemberType:
+		return UserElementType
+	case GroupMemberType:
+		return GroupMemberType
+	}
+	return ResourceElementType
 }
 
-func (group *Group) getGroupMembersRecursive(tx *gorm.DB, memberType ElementTypeT, members *[]GroupMember) (err error) {
-	childGroupIDs := []uint{}
-	childGroups := []Group{}
-
-	// Find the direct members of the group
-	if db := tx.Where("group_id = ? AND member_type = ?", group.ID, memberType).Find(members); db.Error != nil {
-		err = db.Error
-		return
-	}
-	for _, member := range *members {
-		// If the member is a group, we need to fetch its members recursively
-		if member.MemberType == "Group" {
-			childGroupIDs = append(childGroupIDs, member.MemberID)
-		} else {
-			*members = append(*members, member)
+// ValidateMember checks if the member can be added to the group.
+// Nested groups are only allowed if they don't introduce a cycle and
+// restrict their members to the same type as the parent group.
+func (group *Group) ValidateMember(tx *gorm.DB, member *GroupMember) (err error) {
+	if member.GetElementType() != GroupMemberType {
+		if group.RestrictToMemberType != "" && group.RestrictToMemberType != member.GetElementType() {
+			err = fmt.Errorf("group only allows members of type %s", group.RestrictToMemberType)
 		}
+		return
 	}
 
-	// Fetch members of child groups recursively
-	if len(childGroupIDs) > 0 {
+	childGroup := &Group{}
+	if err = tx.Where("id = ?", member.MemberID).First(childGroup).Error; err != nil {
 		return
 	}
-
-	if db := tx.Where("id IN ?", childGroupIDs).Find(&childGroups); db.Error != nil {
-		err = db.Error
+	if group.RestrictToMemberType != "" && group.RestrictToMemberType != childGroup.RestrictToMemberType {
+		err = fmt.Errorf("group only allows members of type %s", group.RestrictToMemberType)
 		return
 	}
 
-	// Recursively fetch members of each child group
-	for _, childGroup := range childGroups {
-		if err = childGroup.getGroupMembersRecursive(tx, memberType, members); err != nil {
+	// Adding the child group creates a cycle if the child is already
+	// the group itself or one of its ancestors
+	ancestors := []*Group{group}
+	if err = group.GetGroupsAncestors(tx, &ancestors); err != nil {
+		return
+	}
+	for _, ancestor := range ancestors {
+		if ancestor.ID == childGroup.ID {
+			err = fmt.Errorf("group %d can't be nested inside its own descendant %d", childGroup.ID, group.ID)
 			return
 		}
 	}
 	return
 }
 
-func (group *Group) GetGroupsAncestors(tx *gorm.DB, existingGroups *[]*Group) (err error) {
-	return group.getGroupsAncestorsRecursive(tx, existingGroups, make(map[uint]bool))
-}
-
-func (group *Group) getGroupsAncestorsRecursive(tx *gorm.DB, existingGroups *[]*Group, visitedGroups map[uint]bool) (err error) {
-	if _, ok := visitedGroups[group.ID]; ok {
-		return
-	}
-	visitedGroups[group.ID] = true
-
-	// Query for group members where this group is a member of other groups
-	belongsToGroups := []*GroupMember{}
-	if db := tx.Where("member_type = ? AND member_id = ?", "Group", group.ID).Find(&belongsToGroups); db.Error != nil {
-		err = db.Error
+// DeleteWithMembers deletes the group along with its memberships and
+// the RoleAccess rules which refer to it
+func (group *Group) DeleteWithMembers(tx *gorm.DB) (err error) {
+	return tx.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Where("group_id = ?", group.ID).Delete(&GroupMember{}).Error; err != nil {
+			return
+		}
+		if err = tx.Where("member_type = ? AND member_id = ?", GroupMemberType, group.ID).Delete(&GroupMember{}).Error; err != nil {
+			return
+		}
+		if err = tx.Where("(accessor_type = ? AND accessor_id = ?) OR (resource_type = ? AND resource_id = ?)",
+			GroupElement, group.ID, GroupElement, group.ID).Delete(&RoleAccess{}).Error; err != nil {
+			return
+		}
+		err = tx.Delete(group).Error
 		return
-	}
+	})
+}
 
-	// Extract the group IDs that this group belongs to
-	ancestorGroupIDs := []uint{}
-	for _, bg := range belongsToGroups {
-		ancestorGroupIDs = append(ancestorGroupIDs, bg.GroupID)
-	}
+// GetGroupMembers returns the members of the given type of the group and of its nested groups.
+// Members reachable via multiple nested groups are returned once.
+func (group *Group) GetGroupMembers(tx *gorm.DB, memberType ElementTypeT, members *[]GroupMember) (err error) {
+	err = tx.Raw(groupDescendantsCTE+`
+		SELECT * FROM group_members WHERE id IN (
+			SELECT MIN(gm.id) FROM group_members gm
+				WHERE gm.member_type = @member_type AND gm.group_id IN (SELECT id FROM descendants)
+				GROUP BY gm.member_id
+		) ORDER BY id`,
+		map[string]interface{}{
+			"group_id":    group.ID,
+			"group_type":  GroupMemberType,
+			"member_type": memberType,
+			"max_depth":   MaxGroupDepth,
+		}).Scan(members).Error
+	return
+}
 
-	// Only proceed if we found any ancestor groups
-	ancestorGroups := []*Group{}
-	if len(ancestorGroupIDs) == 0 {
-		return
-	}
-	if db := tx.Where("id IN ?", ancestorGroupIDs).Find(&ancestorGroups); db.Error != nil {
-		err = db.Error
+// GetGroupsAncestors appends the groups the group is nested inside, directly
+// or via other groups, to the existing groups
+func (group *Group) GetGroupsAncestors(tx *gorm.DB, existingGroups *[]*Group) (err error) {
+	var ancestry []*GroupAncestor
+	if ancestry, err = GetGroupAncestry(tx, GroupMemberType, group.ID); err != nil {
 		return
 	}
-
-	// Append the found ancestor groups to our result list
-	*existingGroups = append(*existingGroups, ancestorGroups...)
-
-	// Recursively find ancestors of each ancestor group
-	for _, ancestorGroup := range ancestorGroups {
-		if err = ancestorGroup.getGroupsAncestorsRecursive(tx, existingGroups, visitedGroups); err != nil {
-			return
-		}
-	}
-
+	*existingGroups = appendAncestorGroups(*existingGroups, ancestry)
 	return
 }
 
@@ -152,32 +210,99 @@ func NewGroupFetcher(tx *gorm.DB, model UserOwnedModel) *GroupFetcher {
 	}
 }
 
-// GetGroups returns all groups for a given model
+// GetGroups returns all groups for a given model, directly or via nested groups
 func (gf *GroupFetcher) GetGroups() (groups []*Group, err error) {
+	var ancestry []*GroupAncestor
 	if gf.model.GetConfig().Name == "Group" {
 		err = errors.New("cannot fetch groups for Group model by GroupFetcher")
 		return
 	}
-	groupMembers := []GroupMember{}
-	if db := gf.tx.Where("group_id = ? AND group_type = ?",
-		gf.model.GetID(),
-		gf.model.GetConfig().Name).Find(&groupMembers); db.Error != nil {
+	if ancestry, err = gf.GetAncestry(); err != nil {
+		return
+	}
+	groups = appendAncestorGroups(groups, ancestry)
+	return
+}
+
+// GetAncestry returns all groups for a given model along with the depth and the path
+// via which the model belongs to them. Each group is returned once, at its shortest depth.
+func (gf *GroupFetcher) GetAncestry() (ancestors []*GroupAncestor, err error) {
+	return GetGroupAncestry(gf.tx, ElementTypeT(gf.model.GetConfig().Name), gf.model.GetID())
+}
 
-		err = db.Error
+// GetGroupAncestry returns the groups the element belongs to, directly or via nested groups,
+// up to MaxGroupDepth levels. Each group is returned once, at its shortest depth.
+func GetGroupAncestry(tx *gorm.DB, memberType ElementTypeT, memberID uint) (ancestors []*GroupAncestor, err error) {
+	var (
+		rows   []groupPathRow
+		groups []*Group
+	)
+	if err = tx.Raw(groupAncestorsCTE+`SELECT id, depth, path FROM ancestors ORDER BY depth, path`,
+		map[string]interface{}{
+			"member_type": memberType,
+			"member_id":   memberID,
+			"group_type":  GroupMemberType,
+			"max_depth":   MaxGroupDepth,
+		}).Scan(&rows).Error; err != nil {
 		return
 	}
-	groupIds := []uint{}
-	for _, gm := range groupMembers {
-		groupIds = append(groupIds, gm.GroupID)
+	if len(rows) == 0 {
+		return
 	}
-	if db := gf.tx.Where("id IN ?", groupIds).Find(&groups); db.Error != nil {
-		err = db.Error
+
+	ancestorsByID := make(map[uint]*GroupAncestor)
+	groupIDs := []uint{}
+	for _, row := range rows {
+		if _, ok := ancestorsByID[row.ID]; ok {
+			continue
+		}
+		ancestor := &GroupAncestor{Depth: row.Depth, Path: row.groupIDs()}
+		ancestorsByID[row.ID] = ancestor
+		ancestors = append(ancestors, ancestor)
+		groupIDs = append(groupIDs, row.ID)
+	}
+
+	if err = tx.Where("id IN ?", groupIDs).Find(&groups).Error; err != nil {
 		return
 	}
-	for _, g := range groups {
-		if err = g.GetGroupsAncestors(gf.tx, &groups); err != nil {
-			return
+	for _, group := range groups {
+		ancestorsByID[group.ID].Group = group
+	}
+	// Skip the memberships of groups which don't exist anymore
+	existingAncestors := ancestors[:0]
+	for _, ancestor := range ancestors {
+		if ancestor.Group != nil {
+			existingAncestors = append(existingAncestors, ancestor)
 		}
 	}
+	ancestors = existingAncestors
 	return
 }
+
+// groupIDs parses the path of the row, which is formatted as "/1/2/3/"
+func (row groupPathRow) groupIDs() (groupIDs []uint) {
+	for _, part := range strings.Split(strings.Trim(row.Path, "/"), "/") {
+		groupID, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			continue
+		}
+		groupIDs = append(groupIDs, uint(groupID))
+	}
+	return
+}
+
+// appendAncestorGroups appends the groups of the ancestry which aren't part of the groups yet
+func appendAncestorGroups(groups []*Group, ancestry []*GroupAncestor) []*Group {
+	existingIDs := make(map[uint]bool)
+	for _, group := range groups {
+		existingIDs[group.ID] = true
+	}
+	for _, ancestor := range ancestry {
+		if existingIDs[ancestor.Group.ID] {
+			continue
+		}
+		existingIDs[ancestor.Group.ID] = true
+		groups = append(groups, ancestor.Group)
+	}
+	return groups
+}
@@ -0,0 +1,201 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// groupEdge nests the child group inside the parent group
+type groupEdge struct {
+	parent string
+	child  string
+}
+
+func setupGroupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&Group{}, &GroupMember{}))
+	return db
+}
+
+// createGroupGraph creates the groups of the edges and returns them by name
+func createGroupGraph(t *testing.T, db *gorm.DB, edges []groupEdge) (groups map[string]*Group) {
+	groups = make(map[string]*Group)
+	getGroup := func(name string) *Group {
+		if group, ok := groups[name]; ok {
+			return group
+		}
+		group := &Group{Name: name}
+		require.NoError(t, db.Create(group).Error)
+		groups[name] = group
+		return group
+	}
+	for _, edge := range edges {
+		parent := getGroup(edge.parent)
+		child := getGroup(edge.child)
+		require.NoError(t, db.Create(&GroupMember{GroupID: parent.ID, MemberType: GroupMemberType, MemberID: child.ID}).Error)
+	}
+	return
+}
+
+// chainEdges nests g1 inside g0, g2 inside g1 and so on
+func chainEdges(length int) (edges []groupEdge) {
+	for i := 1; i < length; i++ {
+		edges = append(edges, groupEdge{parent: fmt.Sprintf("g%d", i-1), child: fmt.Sprintf("g%d", i)})
+	}
+	return
+}
+
+func groupNames(groups []*Group) (names []string) {
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestGroupTraversal(t *testing.T) {
+	tests := []struct {
+		name  string
+		edges []groupEdge
+		// The user is added to the leaf group and the resource to the root group
+		leaf string
+		root string
+
+		expectedAncestors []string
+		// The ancestors of the leaf group, when they differ from the ones of the user
+		expectedGroupAncestors []string
+		expectedDepths         map[string]int
+		expectedUsers          int
+	}{
+		{
+			name:              "Nested",
+			edges:             []groupEdge{{"finance", "finance_execs"}, {"finance_execs", "finance_leads"}},
+			leaf:              "finance_leads",
+			root:              "finance",
+			expectedAncestors: []string{"finance", "finance_execs", "finance_leads"},
+			expectedDepths:    map[string]int{"finance_leads": 1, "finance_execs": 2, "finance": 3},
+			expectedUsers:     1,
+		},
+		{
+			name:              "Diamond",
+			edges:             []groupEdge{{"top", "left"}, {"top", "right"}, {"left", "bottom"}, {"right", "bottom"}},
+			leaf:              "bottom",
+			root:              "top",
+			expectedAncestors: []string{"bottom", "left", "right", "top"},
+			expectedDepths:    map[string]int{"bottom": 1, "left": 2, "right": 2, "top": 3},
+			expectedUsers:     1,
+		},
+		{
+			name:              "Cyclic",
+			edges:             []groupEdge{{"a", "b"}, {"b", "c"}, {"c", "a"}},
+			leaf:              "c",
+			root:              "a",
+			expectedAncestors: []string{"a", "b", "c"},
+			expectedDepths:    map[string]int{"c": 1, "b": 2, "a": 3},
+			expectedUsers:     1,
+		},
+		{
+			name:              "Self nested",
+			edges:             []groupEdge{{"a", "a"}},
+			leaf:              "a",
+			root:              "a",
+			expectedAncestors: []string{"a"},
+			expectedDepths:    map[string]int{"a": 1},
+			expectedUsers:     1,
+		},
+		{
+			name:  "Deeper than the maximum depth",
+			edges: chainEdges(MaxGroupDepth + 2),
+			leaf:  fmt.Sprintf("g%d", MaxGroupDepth+1),
+			root:  "g0",
+			// g0 is MaxGroupDepth + 2 levels away from the user
+			expectedAncestors:      []string{"g10", "g11", "g2", "g3", "g4", "g5", "g6", "g7", "g8", "g9"},
+			expectedGroupAncestors: []string{"g1", "g10", "g11", "g2", "g3", "g4", "g5", "g6", "g7", "g8", "g9"},
+			expectedDepths:         map[string]int{"g11": 1, "g2": MaxGroupDepth},
+			expectedUsers:          0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupGroupTestDB(t)
+			groups := createGroupGraph(t, db, tt.edges)
+			leaf, root := groups[tt.leaf], groups[tt.root]
+
+			userID := uint(42)
+			require.NoError(t, db.Create(&GroupMember{GroupID: leaf.ID, MemberType: UserMemberType, MemberID: userID}).Error)
+
+			t.Run("Ancestry", func(t *testing.T) {
+				ancestry, err := GetGroupAncestry(db, UserMemberType, userID)
+				require.NoError(t, err)
+
+				ancestorGroups := []*Group{}
+				for _, ancestor := range ancestry {
+					ancestorGroups = append(ancestorGroups, ancestor.Group)
+					// The path leads from the direct group of the user to the ancestor
+					assert.Equal(t, ancestor.Depth, len(ancestor.Path))
+					assert.Equal(t, leaf.ID, ancestor.Path[0])
+					assert.Equal(t, ancestor.Group.ID, ancestor.Path[len(ancestor.Path)-1])
+				}
+				assert.Equal(t, tt.expectedAncestors, groupNames(ancestorGroups))
+
+				for _, ancestor := range ancestry {
+					if depth, ok := tt.expectedDepths[ancestor.Group.Name]; ok {
+						assert.Equal(t, depth, ancestor.Depth, ancestor.Group.Name)
+					}
+				}
+			})
+
+			t.Run("Members", func(t *testing.T) {
+				members := []GroupMember{}
+				require.NoError(t, root.GetGroupMembers(db, UserMemberType, &members))
+				assert.Len(t, members, tt.expectedUsers)
+			})
+
+			t.Run("Ancestors of a group", func(t *testing.T) {
+				ancestors := []*Group{leaf}
+				require.NoError(t, leaf.GetGroupsAncestors(db, &ancestors))
+
+				expectedAncestors := tt.expectedGroupAncestors
+				if expectedAncestors == nil {
+					expectedAncestors = tt.expectedAncestors
+				}
+				assert.Equal(t, expectedAncestors, groupNames(ancestors))
+			})
+		})
+	}
+}
+
+func TestGroupMembersOfType(t *testing.T) {
+	db := setupGroupTestDB(t)
+	groups := createGroupGraph(t, db, []groupEdge{{"billing", "invoices"}, {"billing", "receipts"}})
+
+	require.NoError(t, db.Create(&GroupMember{GroupID: groups["billing"].ID, MemberType: "Account", MemberID: 1}).Error)
+	require.NoError(t, db.Create(&GroupMember{GroupID: groups["invoices"].ID, MemberType: "Account", MemberID: 2}).Error)
+	require.NoError(t, db.Create(&GroupMember{GroupID: groups["receipts"].ID, MemberType: "Account", MemberID: 2}).Error)
+	require.NoError(t, db.Create(&GroupMember{GroupID: groups["receipts"].ID, MemberType: UserMemberType, MemberID: 3}).Error)
+
+	members := []GroupMember{}
+	require.NoError(t, groups["billing"].GetGroupMembers(db, "Account", &members))
+	memberIDs := []uint{}
+	for _, member := range members {
+		memberIDs = append(memberIDs, member.MemberID)
+	}
+	assert.ElementsMatch(t, []uint{1, 2}, memberIDs)
+
+	nestedGroups := []GroupMember{}
+	require.NoError(t, groups["billing"].GetGroupMembers(db, GroupMemberType, &nestedGroups))
+	assert.Len(t, nestedGroups, 2)
+
+	// A group without members
+	members = []GroupMember{}
+	require.NoError(t, groups["invoices"].GetGroupMembers(db, UserMemberType, &members))
+	assert.Empty(t, members)
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// ImpersonationTTL is how long an impersonation token is valid for, it can't be refreshed
+	ImpersonationTTL = 30 * time.Minute
+)
+
+type (
+	// ImpersonationLog records a request a superuser made as another user
+	ImpersonationLog struct {
+		BaseModelWithoutUser
+
+		ImpersonatorID uint   `json:"impersonator_id" gorm:"not null;index"`
+		UserID         uint   `json:"user_id" gorm:"not null;index"`
+		Method         string `json:"method" gorm:"type:varchar(10);not null"`
+		Path           string `json:"path" gorm:"not null"`
+		StatusCode     int    `json:"status_code"`
+		IPAddress      string `json:"ip_address"`
+	}
+)
+
+func (impersonationLog ImpersonationLog) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "ImpersonationLog",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// CanImpersonate checks if the user can act as the target. Only superusers can
+// impersonate, and only users who aren't superusers themselves.
+func (u *User) CanImpersonate(target *User) bool {
+	return u.IsSuperuser && !target.IsSuperuser && u.ID != target.ID
+}
+
+// RecordImpersonation records the request the impersonator made as the user
+func RecordImpersonation(tx *gorm.DB, impersonatorID, userID uint, method, path string, statusCode int, ipAddress string) (err error) {
+	err = tx.Create(&ImpersonationLog{
+		ImpersonatorID: impersonatorID,
+		UserID:         userID,
+		Method:         method,
+		Path:           path,
+		StatusCode:     statusCode,
+		IPAddress:      ipAddress,
+	}).Error
+	return
+}
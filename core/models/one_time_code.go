@@ -0,0 +1,185 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// One time code purposes
+	MagicLinkPurpose         OneTimeCodePurposeT = "magic_link"
+	SMSLoginPurpose          OneTimeCodePurposeT = "sms_login"
+	PhoneVerificationPurpose OneTimeCodePurposeT = "phone_verification"
+
+	MagicLinkTTL = 15 * time.Minute
+	SMSCodeTTL   = 5 * time.Minute
+	// SMSCodeDigits is the length of the codes sent by SMS
+	SMSCodeDigits = 6
+	// MaxCodeAttempts is the number of guesses a code can be tried with
+	MaxCodeAttempts = 5
+
+	// At most CodeRateLimit codes are sent to an identifier within CodeRateLimitWindow
+	CodeRateLimit       = 5
+	CodeRateLimitWindow = 15 * time.Minute
+)
+
+var (
+	ErrCodeRateLimited = errors.New("too many codes requested")
+)
+
+type (
+	OneTimeCodePurposeT string
+
+	// OneTimeCode is a single use secret sent to an email or a phone number, the identifier,
+	// which may not belong to any user yet. Only the hash of the secret is stored.
+	OneTimeCode struct {
+		BaseModelWithoutUser
+
+		Purpose    OneTimeCodePurposeT `json:"purpose" gorm:"type:varchar(32);not null;index:idx_one_time_code_identifier"`
+		Identifier string              `json:"identifier" gorm:"not null;index:idx_one_time_code_identifier"`
+		// UserID is the user who requested the code, if they were signed in
+		UserID    uint       `json:"user_id"`
+		CodeHash  string     `json:"-" gorm:"not null;index"`
+		Attempts  int        `json:"-" gorm:"not null;default:0"`
+		ExpiresAt time.Time  `json:"expires_at"`
+		UsedAt    *time.Time `json:"used_at"`
+	}
+)
+
+func (oneTimeCode OneTimeCode) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "OneTimeCode",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// usesShortCode checks if the codes of the purpose are typed by the user rather than sent in a link
+func (purpose OneTimeCodePurposeT) usesShortCode() bool {
+	return purpose != MagicLinkPurpose
+}
+
+func (purpose OneTimeCodePurposeT) ttl() time.Duration {
+	if purpose == MagicLinkPurpose {
+		return MagicLinkTTL
+	}
+	return SMSCodeTTL
+}
+
+// NewOneTimeCode issues a code of the purpose for the identifier and returns its secret.
+// The unused codes previously issued for the same purpose and identifier can't be used anymore.
+// It returns ErrCodeRateLimited once too many codes were sent to the identifier.
+func NewOneTimeCode(tx *gorm.DB, purpose OneTimeCodePurposeT, identifier string, userID uint) (oneTimeCode *OneTimeCode, secret string, err error) {
+	var count int64
+	if err = tx.Model(&OneTimeCode{}).
+		Where("identifier = ? AND created_at > ?", identifier, time.Now().Add(-CodeRateLimitWindow)).
+		Count(&count).Error; err != nil {
+		return
+	}
+	if count >= CodeRateLimit {
+		err = ErrCodeRateLimited
+		return
+	}
+
+	if purpose.usesShortCode() {
+		var value *big.Int
+		if value, err = rand.Int(rand.Reader, big.NewInt(1000000)); err != nil {
+			return
+		}
+		secret = fmt.Sprintf("%0*d", SMSCodeDigits, value.Int64())
+	} else {
+		secretBytes := make([]byte, 32)
+		if _, err = rand.Read(secretBytes); err != nil {
+			return
+		}
+		secret = hex.EncodeToString(secretBytes)
+	}
+
+	oneTimeCode = &OneTimeCode{
+		Purpose:    purpose,
+		Identifier: identifier,
+		UserID:     userID,
+		CodeHash:   hashToken(secret),
+		ExpiresAt:  time.Now().Add(purpose.ttl()),
+	}
+	err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Model(&OneTimeCode{}).
+			Where("purpose = ? AND identifier = ? AND used_at IS NULL", purpose, identifier).
+			Update("used_at", time.Now()).Error; err != nil {
+			return
+		}
+		err = tx.Create(oneTimeCode).Error
+		return
+	})
+	return
+}
+
+// ConsumeMagicLink marks the magic link with the secret as used and returns it
+func ConsumeMagicLink(tx *gorm.DB, secret string) (oneTimeCode *OneTimeCode, err error) {
+	oneTimeCode = &OneTimeCode{}
+	if err = tx.Where("code_hash = ? AND purpose = ?", hashToken(secret), MagicLinkPurpose).First(oneTimeCode).Error; err != nil {
+		err = ErrInvalidUserToken
+		return
+	}
+	err = oneTimeCode.use(tx)
+	return
+}
+
+// ConsumeOneTimeCode checks the code typed for the identifier against the latest code sent to it
+// and marks it as used. Guesses are counted and the code is discarded after MaxCodeAttempts.
+func ConsumeOneTimeCode(tx *gorm.DB, purpose OneTimeCodePurposeT, identifier, secret string) (oneTimeCode *OneTimeCode, err error) {
+	oneTimeCode = &OneTimeCode{}
+	if err = tx.Where("purpose = ? AND identifier = ? AND used_at IS NULL", purpose, identifier).
+		Order("id DESC").First(oneTimeCode).Error; err != nil {
+		err = ErrInvalidUserToken
+		return
+	}
+	// The attempt is counted before the code is compared so that concurrent guesses can't exceed the limit
+	result := tx.Model(&OneTimeCode{}).
+		Where("id = ? AND attempts < ?", oneTimeCode.ID, MaxCodeAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if err = result.Error; err != nil {
+		return
+	}
+	if result.RowsAffected == 0 {
+		err = ErrInvalidUserToken
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(oneTimeCode.CodeHash), []byte(hashToken(secret))) != 1 {
+		err = ErrInvalidUserToken
+		return
+	}
+	err = oneTimeCode.use(tx)
+	return
+}
+
+// use marks the code as used, only once even by concurrent requests
+func (oneTimeCode *OneTimeCode) use(tx *gorm.DB) (err error) {
+	if oneTimeCode.UsedAt != nil {
+		err = ErrInvalidUserToken
+		return
+	}
+	if time.Now().After(oneTimeCode.ExpiresAt) {
+		err = ErrUserTokenExpired
+		return
+	}
+	now := time.Now()
+	result := tx.Model(&OneTimeCode{}).
+		Where("id = ? AND used_at IS NULL", oneTimeCode.ID).
+		Update("used_at", now)
+	if err = result.Error; err != nil {
+		return
+	}
+	if result.RowsAffected == 0 {
+		err = ErrInvalidUserToken
+		return
+	}
+	oneTimeCode.UsedAt = &now
+	return
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Kinds of the side effects recorded in the outbox
+	CreatePlanPriceOutboxKind    OutboxKindT = "plan.create_price"
+	CancelSubscriptionOutboxKind OutboxKindT = "account.cancel_subscription"
+
+	// PendingOutboxEvent events are processed once their RunAt is due, ProcessingOutboxEvent
+	// ones are claimed by a worker until their RunAt, after which they're claimed again
+	PendingOutboxEvent    OutboxStatusT = "pending"
+	ProcessingOutboxEvent OutboxStatusT = "processing"
+	DoneOutboxEvent       OutboxStatusT = "done"
+	// FailedOutboxEvent events failed MaxOutboxAttempts times and aren't retried anymore
+	FailedOutboxEvent OutboxStatusT = "failed"
+
+	MaxOutboxAttempts = 10
+)
+
+type (
+	OutboxKindT   string
+	OutboxStatusT string
+
+	// OutboxEvent is a side effect on the payment provider, recorded in the transaction
+	// which caused it so that it's only performed once the transaction committed.
+	// The events are processed by the outbox.Processor, which retries them until they succeed.
+	OutboxEvent struct {
+		BaseModelWithoutUser
+
+		Kind OutboxKindT `json:"kind" gorm:"type:varchar(64);not null"`
+		// SubjectID is the plan or the account the event is about, depending on its kind
+		SubjectID uint   `json:"subject_id" gorm:"not null"`
+		Payload   string `json:"payload"`
+		// IdempotencyKey recording the same side effect twice records a single event, and is
+		// sent to the payment provider so that a retried event isn't performed twice
+		IdempotencyKey string        `json:"idempotency_key" gorm:"not null;uniqueIndex"`
+		Status         OutboxStatusT `json:"status" gorm:"type:varchar(16);not null;default:'pending';index:idx_outbox_event_due"`
+		RunAt          time.Time     `json:"run_at" gorm:"not null;index:idx_outbox_event_due"`
+		Attempts       int           `json:"attempts" gorm:"not null;default:0"`
+		LastError      string        `json:"last_error"`
+		ProcessedAt    *time.Time    `json:"processed_at"`
+	}
+
+	// CancelSubscriptionPayload is the payload of the CancelSubscriptionOutboxKind events
+	CancelSubscriptionPayload struct {
+		SubscriptionID string `json:"subscription_id"`
+	}
+)
+
+func (outboxEvent OutboxEvent) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "OutboxEvent",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// EnqueueOutboxEvent records the side effect in the transaction, unless an event with the same
+// idempotency key was already recorded. The payload is stored as JSON.
+func EnqueueOutboxEvent(tx *gorm.DB, kind OutboxKindT, subjectID uint, idempotencyKey string, payload interface{}) (err error) {
+	event := &OutboxEvent{
+		Kind:           kind,
+		SubjectID:      subjectID,
+		IdempotencyKey: idempotencyKey,
+		Status:         PendingOutboxEvent,
+		RunAt:          time.Now(),
+	}
+	if payload != nil {
+		var data []byte
+		if data, err = json.Marshal(payload); err != nil {
+			return
+		}
+		event.Payload = string(data)
+	}
+	err = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(event).Error
+	return
+}
+
+// DecodePayload unmarshals the payload of the event into dest
+func (outboxEvent *OutboxEvent) DecodePayload(dest interface{}) (err error) {
+	err = json.Unmarshal([]byte(outboxEvent.Payload), dest)
+	return
+}
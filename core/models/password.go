@@ -0,0 +1,135 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	MinPasswordLength = 8
+	// bcrypt ignores the bytes of a password past the 72nd
+	MaxPasswordLength = 72
+
+	// Users are locked out for LockoutDuration after MaxFailedLogins failed logins in a row
+	MaxFailedLogins = 5
+	LockoutDuration = 15 * time.Minute
+
+	// How the users were created
+	ShortCircuitCreatedFrom = "login"
+	GoogleCreatedFrom       = "google"
+	PasswordCreatedFrom     = "password"
+	MagicLinkCreatedFrom    = "magic_link"
+	SAMLCreatedFrom         = "saml"
+)
+
+var (
+	ErrInvalidPassword = errors.New("password must be between 8 and 72 characters")
+)
+
+// SetPassword stores the bcrypt hash of the password
+func (u *User) SetPassword(password string) (err error) {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+	u.PasswordHash = string(hash)
+	return
+}
+
+// CheckPassword checks the password against the stored hash.
+// Users without a password, e.g. created with Google, never match.
+func (u *User) CheckPassword(password string) bool {
+	if u.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// IsLocked checks if the user is locked out after too many failed logins
+func (u *User) IsLocked() bool {
+	return u.LockedUntil != nil && time.Now().Before(*u.LockedUntil)
+}
+
+// IsEmailVerified checks if the user proved they own the email
+func (u *User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// RegisterFailedLogin counts a failed login and locks the user out once there are too many
+func (u *User) RegisterFailedLogin(tx *gorm.DB) (err error) {
+	// The count restarts once a lockout is over
+	if u.LockedUntil != nil && !u.IsLocked() {
+		u.FailedLogins = 0
+		u.LockedUntil = nil
+	}
+	u.FailedLogins++
+	if u.FailedLogins >= MaxFailedLogins {
+		lockedUntil := time.Now().Add(LockoutDuration)
+		u.LockedUntil = &lockedUntil
+	}
+	err = tx.Model(u).Updates(map[string]interface{}{
+		"failed_logins": u.FailedLogins,
+		"locked_until":  u.LockedUntil,
+	}).Error
+	return
+}
+
+// ResetFailedLogins clears the failed logins and the lockout of the user
+func (u *User) ResetFailedLogins(tx *gorm.DB) (err error) {
+	if u.FailedLogins == 0 && u.LockedUntil == nil {
+		return
+	}
+	u.FailedLogins = 0
+	u.LockedUntil = nil
+	err = tx.Model(u).Updates(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  nil,
+	}).Error
+	return
+}
+
+// VerifyEmail records that the user proved they own the email
+func (u *User) VerifyEmail(tx *gorm.DB) (err error) {
+	if u.IsEmailVerified() {
+		return
+	}
+	now := time.Now()
+	u.EmailVerifiedAt = &now
+	err = tx.Model(u).Update("email_verified_at", now).Error
+	return
+}
+
+// ClaimEmail verifies the email of the user once a sign in proved owning it, like a verified
+// email of an identity provider or a magic link. An unverified user may have been registered
+// by someone else waiting for the owner of the email to sign in, so that everything set up
+// before the email was verified is dropped: the password, the sessions, the API keys and the
+// two factor authentication.
+func (u *User) ClaimEmail(tx *gorm.DB) (err error) {
+	if u.IsEmailVerified() {
+		return
+	}
+	err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		u.PasswordHash = ""
+		if err = tx.Model(u).Update("password_hash", "").Error; err != nil {
+			return
+		}
+		if err = RevokeUserSessions(tx, u.ID, 0, EmailClaimedRevokeReason); err != nil {
+			return
+		}
+		if err = RevokeUserAPIKeys(tx, u.ID); err != nil {
+			return
+		}
+		if err = u.DisableTOTP(tx); err != nil {
+			return
+		}
+		err = u.VerifyEmail(tx)
+		return
+	})
+	return
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"os"
+
+	"github.com/gsarmaonline/goiter/core/services/payments"
+)
+
+var (
+	// paymentGateway creates the billing objects of the plans and the accounts
+	paymentGateway payments.PaymentGateway = payments.NewStripeGateway(os.Getenv)
+)
+
+// SetPaymentGateway replaces the gateway the plans and the accounts are billed with
+func SetPaymentGateway(gateway payments.PaymentGateway) {
+	paymentGateway = gateway
+}
+
+// GetPaymentGateway returns the gateway the plans and the accounts are billed with
+func GetPaymentGateway() payments.PaymentGateway {
+	return paymentGateway
+}
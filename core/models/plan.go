@@ -2,11 +2,8 @@ package models
 
 import (
 	"fmt"
-	"os"
 
-	"github.com/stripe/stripe-go/v74"
-	"github.com/stripe/stripe-go/v74/price"
-	"github.com/stripe/stripe-go/v74/product"
+	"github.com/gsarmaonline/goiter/core/services/payments"
 	"gorm.io/gorm"
 )
 
@@ -32,10 +29,17 @@ type (
 	Feature struct {
 		BaseModelWithoutUser
 
-		Name        string  `json:"name" gorm:"not null"`
-		Description string  `json:"description"`
-		Limit       int     `json:"limit" gorm:"not null;default:-1"` // -1 means unlimited
-		Plans       []*Plan `json:"plans" gorm:"many2many:plan_features;"`
+		Name        string `json:"name" gorm:"not null"`
+		Description string `json:"description"`
+		// Limit is -1 for unlimited features and 0 for features the plan doesn't include.
+		// It has no column default, which GORM would write instead of a zero limit.
+		Limit int `json:"limit" gorm:"not null"`
+		// Metered features limit the usage recorded per billing period, see UsageRecord.
+		// Usage over the limit is billed with StripePriceID unless the limit is a hard one.
+		Metered       bool    `json:"metered" gorm:"not null;default:false"`
+		HardLimit     bool    `json:"hard_limit" gorm:"not null;default:false"`
+		StripePriceID string  `json:"stripe_price_id"`
+		Plans         []*Plan `json:"plans" gorm:"many2many:plan_features;"`
 	}
 
 	// PlanFeature is the explicit join table for the many-to-many relationship
@@ -78,82 +82,108 @@ func GetDefaultPlan(db *gorm.DB) (plan *Plan, err error) {
 	return
 }
 
-func (plan *Plan) GetStripeInterval() (interval stripe.PriceRecurringInterval) {
+// GetFeature returns the feature of the plan with the name, nil if the plan doesn't have it
+func (plan *Plan) GetFeature(tx *gorm.DB, featureName string) (feature *Feature, err error) {
+	feature = &Feature{}
+	err = tx.Joins("JOIN plan_features ON plan_features.feature_id = features.id").
+		Where("plan_features.plan_id = ? AND features.name = ?", plan.ID, featureName).
+		First(feature).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	return
+}
+
+// GetFeatureLimit returns the limit of the feature for the plan.
+// Features which aren't part of the plan are unlimited.
+func (plan *Plan) GetFeatureLimit(tx *gorm.DB, featureName string) (limit int, err error) {
+	limit = -1
+	feature, err := plan.GetFeature(tx, featureName)
+	if err != nil || feature == nil {
+		return
+	}
+	limit = feature.Limit
+	return
+}
+
+// GetBillingInterval returns the interval of the recurring price of the plan
+func (plan *Plan) GetBillingInterval() (interval payments.IntervalT) {
 	switch plan.BillingPeriod {
 	case "monthly":
-		interval = stripe.PriceRecurringIntervalMonth
+		interval = payments.MonthInterval
 	case "yearly":
-		interval = stripe.PriceRecurringIntervalYear
+		interval = payments.YearInterval
 	case "weekly":
-		interval = stripe.PriceRecurringIntervalWeek
+		interval = payments.WeekInterval
 	case "daily":
-		interval = stripe.PriceRecurringIntervalDay
+		interval = payments.DayInterval
 	default:
-		interval = stripe.PriceRecurringIntervalMonth // Default to monthly
+		interval = payments.MonthInterval // Default to monthly
 	}
 	return
 }
 
-// CreatePrice creates a Stripe Price object for a plan
-func (plan *Plan) BeforeCreate(tx *gorm.DB) (err error) {
-	var (
-		stripePrice   *stripe.Price
-		stripeProduct *stripe.Product
-	)
+// AfterCreate records the creation of the Stripe product and price of the paid plans in the
+// outbox, so that they're only created once the plan is committed
+func (plan *Plan) AfterCreate(tx *gorm.DB) (err error) {
 	if plan.Price == 0 {
 		return
 	}
+	err = EnqueueOutboxEvent(tx, CreatePlanPriceOutboxKind, plan.ID, fmt.Sprintf("plan-%d-price", plan.ID), nil)
+	return
+}
 
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-
-	if stripeProduct, err = plan.CreateStripeProduct(); err != nil {
-		return
+// SyncStripePrice creates the Stripe product and price of the plan which it doesn't have yet.
+// Both are stored as soon as they're created, and created with idempotency keys derived from
+// the one given, so that retrying after a failure doesn't create them twice.
+func (plan *Plan) SyncStripePrice(tx *gorm.DB, idempotencyKey string) (err error) {
+	var (
+		stripePrice   *payments.Price
+		stripeProduct *payments.Product
+	)
+	if plan.StripeProductID == "" {
+		if stripeProduct, err = plan.CreateStripeProduct(idempotencyKey + "-product"); err != nil {
+			return
+		}
+		plan.StripeProductID = stripeProduct.ID
+		if err = tx.Model(plan).UpdateColumn("stripe_product_id", plan.StripeProductID).Error; err != nil {
+			return
+		}
 	}
-	plan.StripeProductID = stripeProduct.ID
 
-	if stripePrice, err = plan.CreateStripePrice(); err != nil {
-		return
+	if plan.StripePriceID == "" {
+		if stripePrice, err = plan.CreateStripePrice(idempotencyKey + "-price"); err != nil {
+			return
+		}
+		plan.StripePriceID = stripePrice.ID
+		if err = tx.Model(plan).UpdateColumn("stripe_price_id", plan.StripePriceID).Error; err != nil {
+			return
+		}
 	}
-	plan.StripePriceID = stripePrice.ID
-
 	return
 }
 
-func (plan *Plan) CreateStripeProduct() (stripeProduct *stripe.Product, err error) {
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	stripeProduct, err = product.New(&stripe.ProductParams{
-		Name: stripe.String(plan.Name),
+func (plan *Plan) CreateStripeProduct(idempotencyKey string) (stripeProduct *payments.Product, err error) {
+	stripeProduct, err = paymentGateway.CreateProduct(&payments.ProductParams{
+		Name:           plan.Name,
+		IdempotencyKey: idempotencyKey,
 	})
 	return
 }
 
-func (plan *Plan) CreateStripePrice() (stripePrice *stripe.Price, err error) {
-	var (
-		interval stripe.PriceRecurringInterval
-	)
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	interval = plan.GetStripeInterval()
-
-	// Create price parameters
-	params := &stripe.PriceParams{
-		Currency: stripe.String("usd"),
-		Product:  stripe.String(plan.StripeProductID),
-		Recurring: &stripe.PriceRecurringParams{
-			Interval: stripe.String(string(interval)),
-		},
-		UnitAmount: stripe.Int64(int64(plan.Price * 100)), // Convert to cents
-		Params: stripe.Params{
-			Metadata: map[string]string{
-				"plan_id":   fmt.Sprintf("%d", plan.ID),
-				"plan_name": plan.Name,
-			},
-		},
-	}
-
+// CreateStripePrice creates a Stripe Price object for a plan
+func (plan *Plan) CreateStripePrice(idempotencyKey string) (stripePrice *payments.Price, err error) {
 	// Create the price in Stripe
-	if stripePrice, err = price.New(params); err != nil {
-		return
-	}
+	stripePrice, err = paymentGateway.CreatePrice(&payments.PriceParams{
+		ProductID:  plan.StripeProductID,
+		Currency:   payments.DefaultCurrency,
+		Interval:   plan.GetBillingInterval(),
+		UnitAmount: int64(plan.Price * 100), // Convert to cents
+		Metadata: map[string]string{
+			"plan_id":   fmt.Sprintf("%d", plan.ID),
+			"plan_name": plan.Name,
+		},
+		IdempotencyKey: idempotencyKey,
+	})
 	return
-
 }
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+const (
+	// ProjectsFeature is the plan feature which limits the number of projects of an account
+	ProjectsFeature = "Projects"
+
+	// Project roles
+	ProjectAdminRole  ProjectRoleT = "admin"
+	ProjectMemberRole ProjectRoleT = "member"
+)
+
+type (
+	ProjectRoleT string
+
+	// Project belongs to an Account via OwnerType/OwnerID and scopes
+	// the models registered with ProjectScopeType
+	Project struct {
+		BaseModelWithUser
+
+		Name        string `json:"name" gorm:"not null"`
+		Description string `json:"description"`
+	}
+
+	// ProjectMember gives an user access to a project.
+	// Admins can manage the project and its members.
+	ProjectMember struct {
+		BaseModelWithUser
+
+		ProjectID uint         `json:"project_id" gorm:"index"`
+		MemberID  uint         `json:"member_id" gorm:"index"`
+		Member    *User        `json:"member,omitempty" gorm:"foreignKey:MemberID"`
+		Role      ProjectRoleT `json:"role" gorm:"not null;default:'member'"`
+	}
+)
+
+func (project Project) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "Project",
+		ScopeType: AccountScopeType,
+	}
+}
+
+func (projectMember ProjectMember) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "ProjectMember",
+		ScopeType: ProjectScopeType,
+	}
+}
+
+// IsValid checks if the role is a supported one
+func (role ProjectRoleT) IsValid() bool {
+	switch role {
+	case ProjectAdminRole, ProjectMemberRole:
+		return true
+	}
+	return false
+}
+
+// GetMember returns the membership of the user in the project
+func (project *Project) GetMember(tx *gorm.DB, userID uint) (member *ProjectMember, err error) {
+	member = &ProjectMember{}
+	err = tx.Where("project_id = ? AND member_id = ?", project.ID, userID).First(member).Error
+	return
+}
+
+// isAccountAdmin checks if the user can manage the account the project belongs to,
+// i.e if the user is an owner or an admin of it
+func (project *Project) isAccountAdmin(tx *gorm.DB, userID uint) bool {
+	if project.OwnerType != AccountScopeType {
+		return false
+	}
+	account := &Account{}
+	if err := tx.Where("id = ?", project.OwnerID).First(account).Error; err != nil {
+		return false
+	}
+	role, err := account.GetRole(tx, userID)
+	return err == nil && role.CanManageAccount()
+}
+
+// IsAccessibleBy checks if the user created the project, manages its account or is a member of it
+func (project *Project) IsAccessibleBy(tx *gorm.DB, userID uint) bool {
+	if project.UserID == userID || project.isAccountAdmin(tx, userID) {
+		return true
+	}
+	_, err := project.GetMember(tx, userID)
+	return err == nil
+}
+
+// IsManageableBy checks if the user created the project, manages its account or is an admin of it
+func (project *Project) IsManageableBy(tx *gorm.DB, userID uint) bool {
+	if project.UserID == userID || project.isAccountAdmin(tx, userID) {
+		return true
+	}
+	member, err := project.GetMember(tx, userID)
+	return err == nil && member.Role == ProjectAdminRole
+}
+
+// DeleteWithMembers deletes the project along with its memberships
+func (project *Project) DeleteWithMembers(tx *gorm.DB) (err error) {
+	return tx.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Where("project_id = ?", project.ID).Delete(&ProjectMember{}).Error; err != nil {
+			return
+		}
+		err = tx.Delete(project).Error
+		return
+	})
+}
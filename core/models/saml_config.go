@@ -0,0 +1,126 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// SAMLFeature is the plan feature which enables the single sign on of the accounts
+	SAMLFeature = "SAML"
+
+	// SAMLDomainVerificationPrefix starts the DNS TXT record of a domain proving the account owns it
+	SAMLDomainVerificationPrefix = "goiter-domain-verification="
+)
+
+var (
+	ErrSAMLDomainTaken = errors.New("domain is used by the single sign on of another account")
+)
+
+type (
+	// SAMLConfig signs the members of the account in with the SAML identity provider of the account.
+	// The users with an email of one of its verified domains are routed to the identity provider,
+	// which provisions them into the account the first time they sign in.
+	SAMLConfig struct {
+		BaseModelWithUser
+
+		AccountID uint `json:"account_id" gorm:"not null;uniqueIndex"`
+
+		// IdPMetadataXML is the metadata the identity provider settings were read from, if any
+		IdPMetadataXML string `json:"idp_metadata_xml" gorm:"type:text"`
+		IdPEntityID    string `json:"idp_entity_id" gorm:"not null"`
+		IdPSSOURL      string `json:"idp_sso_url" gorm:"not null"`
+		// IdPCertificate holds the PEM certificates verifying the signatures of the identity provider
+		IdPCertificate string `json:"idp_certificate" gorm:"type:text;not null"`
+
+		// EntityID identifies the account to the identity provider, the URL of its metadata if empty
+		EntityID string `json:"entity_id"`
+
+		// Domains are the email domains of the users signing in with the identity provider
+		Domains []string `json:"domains" gorm:"serializer:json"`
+		// VerifiedDomains are the domains whose DNS proved the account owns them. Only they are
+		// routed to the identity provider and have their users provisioned.
+		VerifiedDomains []string `json:"verified_domains" gorm:"serializer:json"`
+		// DomainVerificationToken is published in a DNS TXT record of the domains to verify them
+		DomainVerificationToken string `json:"-"`
+		// DefaultRole is the role of the users provisioned into the account
+		DefaultRole AccountRoleT `json:"default_role" gorm:"not null;default:'member'"`
+	}
+)
+
+func (samlConfig SAMLConfig) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "SAMLConfig",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// ProviderName is the provider of the identities of the users signed in with the identity provider
+func (samlConfig *SAMLConfig) ProviderName() string {
+	return fmt.Sprintf("saml:%d", samlConfig.AccountID)
+}
+
+// HasVerifiedDomain checks if the email belongs to one of the verified domains of the identity provider
+func (samlConfig *SAMLConfig) HasVerifiedDomain(email string) bool {
+	index := strings.LastIndex(email, "@")
+	if index == -1 {
+		return false
+	}
+	return samlConfig.IsDomainVerified(strings.ToLower(email[index+1:]))
+}
+
+// IsDomainVerified checks if the account proved owning the domain
+func (samlConfig *SAMLConfig) IsDomainVerified(domain string) bool {
+	for _, verifiedDomain := range samlConfig.VerifiedDomains {
+		if verifiedDomain == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// DomainVerificationRecord is the DNS TXT record the domains have to publish to be verified
+func (samlConfig *SAMLConfig) DomainVerificationRecord() string {
+	return SAMLDomainVerificationPrefix + samlConfig.DomainVerificationToken
+}
+
+// GenerateDomainVerificationToken sets the random token of the DNS TXT record of the domains
+func (samlConfig *SAMLConfig) GenerateDomainVerificationToken() (err error) {
+	token := make([]byte, 16)
+	if _, err = rand.Read(token); err != nil {
+		return
+	}
+	samlConfig.DomainVerificationToken = hex.EncodeToString(token)
+	return
+}
+
+// FindSAMLConfigByDomain returns the SAML configuration routing the users of the verified email domain
+func FindSAMLConfigByDomain(tx *gorm.DB, domain string) (samlConfig *SAMLConfig, err error) {
+	samlConfig = &SAMLConfig{}
+	// The domains are stored as a JSON array of validated domains, which can't contain quotes or wildcards
+	err = tx.Where("verified_domains LIKE ?", `%"`+strings.ToLower(domain)+`"%`).First(samlConfig).Error
+	return
+}
+
+// CheckDomainsAvailable returns ErrSAMLDomainTaken if another account verified one of the domains.
+// Any account can list a domain, only the first one proving it owns the domain routes it.
+func (samlConfig *SAMLConfig) CheckDomainsAvailable(tx *gorm.DB) (err error) {
+	for _, domain := range samlConfig.Domains {
+		other, err := FindSAMLConfigByDomain(tx, domain)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if other.AccountID != samlConfig.AccountID {
+			return ErrSAMLDomainTaken
+		}
+	}
+	return
+}
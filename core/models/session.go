@@ -0,0 +1,229 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// AccessTokenTTL is how long the access tokens of a session are valid for
+	AccessTokenTTL = 15 * time.Minute
+	// RefreshTokenTTL is how long a session can be refreshed for without signing in again
+	RefreshTokenTTL = 30 * 24 * time.Hour
+
+	// Reasons for revoking a session
+	LogoutRevokeReason        = "logout"
+	UserRevokeReason          = "revoked_by_user"
+	RefreshReuseRevokeReason  = "refresh_token_reuse"
+	PasswordResetRevokeReason = "password_reset"
+	EmailClaimedRevokeReason  = "email_claimed"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+	ErrSessionInactive     = errors.New("session was revoked or has expired")
+)
+
+type (
+	// Session is a sign in of the user on a device. The access tokens issued for the
+	// session are rejected once it's revoked. Its refresh token is rotated on every
+	// refresh, the hashes of the rotated ones are kept to detect their reuse.
+	Session struct {
+		BaseModelWithUser
+
+		RefreshTokenHash string     `json:"-" gorm:"index"`
+		UserAgent        string     `json:"user_agent"`
+		IPAddress        string     `json:"ip_address"`
+		ExpiresAt        time.Time  `json:"expires_at"`
+		LastUsedAt       time.Time  `json:"last_used_at"`
+		RevokedAt        *time.Time `json:"revoked_at"`
+		RevokedReason    string     `json:"revoked_reason,omitempty"`
+	}
+
+	// RotatedRefreshToken is the hash of a refresh token of the session which was rotated.
+	// It tells the reuse of a token which was really issued apart from a forged one.
+	RotatedRefreshToken struct {
+		BaseModelWithoutUser
+
+		SessionID uint   `json:"session_id" gorm:"not null;index"`
+		TokenHash string `json:"-" gorm:"not null;uniqueIndex"`
+	}
+)
+
+func (session Session) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "Session",
+		ScopeType: AccountScopeType,
+	}
+}
+
+func (rotatedRefreshToken RotatedRefreshToken) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "RotatedRefreshToken",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// hashToken returns the hash under which a secret token is stored
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// newRefreshToken generates a refresh token of the session.
+// The token is prefixed by the session ID so that reused tokens can be traced to their session.
+func newRefreshToken(sessionID uint) (token string, err error) {
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+	token = fmt.Sprintf("%d.%s", sessionID, hex.EncodeToString(secret))
+	return
+}
+
+// NewSession starts a session of the user and returns its refresh token
+func NewSession(tx *gorm.DB, user *User, userAgent, ipAddress string) (session *Session, refreshToken string, err error) {
+	now := time.Now()
+	session = &Session{
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
+		LastUsedAt: now,
+	}
+	session.UserID = user.ID
+	err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Create(session).Error; err != nil {
+			return
+		}
+		if refreshToken, err = newRefreshToken(session.ID); err != nil {
+			return
+		}
+		session.RefreshTokenHash = hashToken(refreshToken)
+		err = tx.Model(session).Update("refresh_token_hash", session.RefreshTokenHash).Error
+		return
+	})
+	return
+}
+
+// GetActiveSession returns the session of the user if it wasn't revoked and hasn't expired
+func GetActiveSession(tx *gorm.DB, sessionID, userID uint) (session *Session, err error) {
+	session = &Session{}
+	if err = tx.Where("id = ? AND user_id = ?", sessionID, userID).First(session).Error; err != nil {
+		return
+	}
+	if !session.IsActive() {
+		err = ErrSessionInactive
+	}
+	return
+}
+
+// RefreshSession rotates the refresh token of its session. Presenting a refresh token
+// which was already rotated means it leaked, so the whole session is revoked. Tokens
+// which were never issued are only rejected, since anyone can forge one for a session.
+func RefreshSession(tx *gorm.DB, refreshToken string) (session *Session, newToken string, err error) {
+	parts := strings.SplitN(refreshToken, ".", 2)
+	if len(parts) != 2 {
+		err = ErrInvalidRefreshToken
+		return
+	}
+	sessionID, parseErr := strconv.ParseUint(parts[0], 10, 64)
+	if parseErr != nil {
+		err = ErrInvalidRefreshToken
+		return
+	}
+	session = &Session{}
+	if err = tx.Where("id = ?", sessionID).First(session).Error; err != nil {
+		err = ErrInvalidRefreshToken
+		return
+	}
+	if !session.IsActive() {
+		err = ErrSessionInactive
+		return
+	}
+
+	tokenHash := hashToken(refreshToken)
+	if newToken, err = newRefreshToken(session.ID); err != nil {
+		return
+	}
+	var (
+		now     = time.Now()
+		rotated bool
+	)
+	if err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		// The hash is compared in the update so that concurrent refreshes with the same token can't both succeed
+		result := tx.Model(&Session{}).
+			Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, tokenHash).
+			Updates(map[string]interface{}{
+				"refresh_token_hash": hashToken(newToken),
+				"last_used_at":       now,
+			})
+		if err = result.Error; err != nil || result.RowsAffected == 0 {
+			return
+		}
+		rotated = true
+		err = tx.Create(&RotatedRefreshToken{SessionID: session.ID, TokenHash: tokenHash}).Error
+		return
+	}); err != nil {
+		return
+	}
+	if !rotated {
+		var count int64
+		if err = tx.Model(&RotatedRefreshToken{}).
+			Where("session_id = ? AND token_hash = ?", session.ID, tokenHash).
+			Count(&count).Error; err != nil {
+			return
+		}
+		if count == 0 {
+			err = ErrInvalidRefreshToken
+			return
+		}
+		if err = session.Revoke(tx, RefreshReuseRevokeReason); err != nil {
+			return
+		}
+		err = ErrRefreshTokenReused
+		return
+	}
+	session.RefreshTokenHash = hashToken(newToken)
+	session.LastUsedAt = now
+	return
+}
+
+// IsActive checks if the session wasn't revoked and hasn't expired
+func (session *Session) IsActive() bool {
+	return session.RevokedAt == nil && time.Now().Before(session.ExpiresAt)
+}
+
+// Revoke ends the session, rejecting its access and refresh tokens
+func (session *Session) Revoke(tx *gorm.DB, reason string) (err error) {
+	if session.RevokedAt != nil {
+		return
+	}
+	now := time.Now()
+	session.RevokedAt = &now
+	session.RevokedReason = reason
+	err = tx.Model(session).Updates(map[string]interface{}{
+		"revoked_at":     now,
+		"revoked_reason": reason,
+	}).Error
+	return
+}
+
+// RevokeUserSessions ends all the sessions of the user except the one to keep, if any
+func RevokeUserSessions(tx *gorm.DB, userID, keepSessionID uint, reason string) (err error) {
+	err = tx.Model(&Session{}).
+		Where("user_id = ? AND id != ? AND revoked_at IS NULL", userID, keepSessionID).
+		Updates(map[string]interface{}{
+			"revoked_at":     time.Now(),
+			"revoked_reason": reason,
+		}).Error
+	return
+}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gsarmaonline/goiter/core/services/totp"
+	"gorm.io/gorm"
+)
+
+const (
+	// RecoveryCodeCount is the number of recovery codes generated at a time
+	RecoveryCodeCount = 10
+	// MFAPendingTTL is how long the second factor can be verified for after the first one
+	MFAPendingTTL = 5 * time.Minute
+)
+
+var (
+	ErrInvalidMFACode     = errors.New("invalid two factor code")
+	ErrTOTPNotEnrolled    = errors.New("two factor authentication isn't enrolled")
+	ErrTOTPAlreadyEnabled = errors.New("two factor authentication is already enabled")
+)
+
+type (
+	// RecoveryCode signs the user in once in place of a TOTP code, e.g. when their
+	// device is lost. Only the hash of the code is stored.
+	RecoveryCode struct {
+		BaseModelWithUser
+
+		CodeHash string     `json:"-" gorm:"not null;index"`
+		UsedAt   *time.Time `json:"used_at"`
+	}
+)
+
+func (recoveryCode RecoveryCode) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "RecoveryCode",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// normaliseRecoveryCode ignores the case and the separators of a recovery code
+func normaliseRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// IsTOTPEnabled checks if the user signs in with a TOTP code as a second factor
+func (u *User) IsTOTPEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// EnrollTOTP generates a new TOTP secret of the user and returns it along with its
+// otpauth URI. The secret is only enabled once EnableTOTP verifies a code of it.
+func (u *User) EnrollTOTP(tx *gorm.DB, issuer string) (secret, uri string, err error) {
+	if u.IsTOTPEnabled() {
+		err = ErrTOTPAlreadyEnabled
+		return
+	}
+	if secret, err = totp.GenerateSecret(); err != nil {
+		return
+	}
+	u.TOTPSecret = secret
+	if err = tx.Model(u).Update("totp_secret", secret).Error; err != nil {
+		return
+	}
+	uri = totp.URI(issuer, u.Email, secret)
+	return
+}
+
+// EnableTOTP enables the enrolled secret once the code proves the authenticator app holds it.
+// It returns the recovery codes of the user, which are only shown this once.
+func (u *User) EnableTOTP(tx *gorm.DB, code string) (recoveryCodes []string, err error) {
+	if u.IsTOTPEnabled() {
+		err = ErrTOTPAlreadyEnabled
+		return
+	}
+	if u.TOTPSecret == "" {
+		err = ErrTOTPNotEnrolled
+		return
+	}
+	err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		if err = u.useTOTPCode(tx, code); err != nil {
+			return
+		}
+		now := time.Now()
+		u.TOTPEnabledAt = &now
+		if err = tx.Model(u).Update("totp_enabled_at", now).Error; err != nil {
+			return
+		}
+		recoveryCodes, err = u.GenerateRecoveryCodes(tx)
+		return
+	})
+	return
+}
+
+// DisableTOTP removes the TOTP secret and the recovery codes of the user
+func (u *User) DisableTOTP(tx *gorm.DB) (err error) {
+	err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		u.TOTPSecret = ""
+		u.TOTPEnabledAt = nil
+		u.TOTPLastCounter = 0
+		if err = tx.Model(u).Updates(map[string]interface{}{
+			"totp_secret":       "",
+			"totp_enabled_at":   nil,
+			"totp_last_counter": 0,
+		}).Error; err != nil {
+			return
+		}
+		err = tx.Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error
+		return
+	})
+	return
+}
+
+// VerifySecondFactor checks a TOTP code or, failing that, an unused recovery code which is used up.
+// Each TOTP code can only be used once.
+func (u *User) VerifySecondFactor(tx *gorm.DB, code string) (err error) {
+	if !u.IsTOTPEnabled() {
+		err = ErrTOTPNotEnrolled
+		return
+	}
+	if err = u.useTOTPCode(tx, code); !errors.Is(err, ErrInvalidMFACode) {
+		return
+	}
+	err = u.useRecoveryCode(tx, code)
+	return
+}
+
+// useTOTPCode checks the code against the secret and records its time step so that it can't be replayed
+func (u *User) useTOTPCode(tx *gorm.DB, code string) (err error) {
+	counter, ok := totp.Validate(u.TOTPSecret, code, time.Now())
+	if !ok || counter <= u.TOTPLastCounter {
+		err = ErrInvalidMFACode
+		return
+	}
+	// The counter is compared in the update so that concurrent requests can't use the same code
+	result := tx.Model(&User{}).
+		Where("id = ? AND totp_last_counter < ?", u.ID, counter).
+		Update("totp_last_counter", counter)
+	if err = result.Error; err != nil {
+		return
+	}
+	if result.RowsAffected != 1 {
+		err = ErrInvalidMFACode
+		return
+	}
+	u.TOTPLastCounter = counter
+	return
+}
+
+// useRecoveryCode uses up an unused recovery code of the user
+func (u *User) useRecoveryCode(tx *gorm.DB, code string) (err error) {
+	code = normaliseRecoveryCode(code)
+	if code == "" {
+		err = ErrInvalidMFACode
+		return
+	}
+	result := tx.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", u.ID, hashToken(code)).
+		Update("used_at", time.Now())
+	if err = result.Error; err != nil {
+		return
+	}
+	if result.RowsAffected != 1 {
+		err = ErrInvalidMFACode
+	}
+	return
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of the user and returns the new ones
+func (u *User) GenerateRecoveryCodes(tx *gorm.DB) (codes []string, err error) {
+	err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error; err != nil {
+			return
+		}
+		for i := 0; i < RecoveryCodeCount; i++ {
+			secret := make([]byte, 5)
+			if _, err = rand.Read(secret); err != nil {
+				return
+			}
+			code := hex.EncodeToString(secret)
+			recoveryCode := &RecoveryCode{CodeHash: hashToken(code)}
+			recoveryCode.UserID = u.ID
+			recoveryCode.SetOwner(UserScopeType, u.ID)
+			if err = tx.Create(recoveryCode).Error; err != nil {
+				return
+			}
+			codes = append(codes, code[:5]+"-"+code[5:])
+		}
+		return
+	})
+	return
+}
+
+// IsMFARequired checks if any account the user belongs to requires two factor authentication
+func (u *User) IsMFARequired(tx *gorm.DB) (required bool, err error) {
+	var count int64
+	err = accountsOfUser(tx.Model(&Account{}), u.ID).Where("accounts.require_mfa = ?", true).Count(&count).Error
+	required = count > 0
+	return
+}
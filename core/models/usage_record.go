@@ -0,0 +1,142 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// APICallsFeature is the metered plan feature charging the accounts per API call
+	APICallsFeature = "API Calls"
+	// SeatsFeature is the metered plan feature charging the accounts per member
+	SeatsFeature = "Seats"
+
+	// IncrementUsage adds the quantity to the usage of the period
+	IncrementUsage UsageActionT = "increment"
+	// SetUsage replaces the usage of the period with the quantity, like the number of seats
+	SetUsage UsageActionT = "set"
+)
+
+type (
+	UsageActionT string
+
+	// UsageRecord is a usage event of a metered feature by an account. The records are
+	// rolled up per billing period and reported to the payment provider in batches.
+	UsageRecord struct {
+		BaseModelWithUser
+
+		AccountID  uint         `json:"account_id" gorm:"not null;index:idx_usage_record_account_feature"`
+		Feature    string       `json:"feature" gorm:"not null;index:idx_usage_record_account_feature"`
+		Action     UsageActionT `json:"action" gorm:"not null;default:'increment'"`
+		Quantity   int64        `json:"quantity" gorm:"not null"`
+		RecordedAt time.Time    `json:"recorded_at" gorm:"not null;index"`
+		// ReportBatch groups the records reported together. It's set before the report so that
+		// a failed report is retried with the same records and idempotency key.
+		ReportBatch *string `json:"-" gorm:"index"`
+		// ReportedAt is set once the record was processed by the usage reporter
+		ReportedAt *time.Time `json:"reported_at" gorm:"index"`
+	}
+
+	// UsagePeriod is a billing period of an account
+	UsagePeriod struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	}
+)
+
+func (usageRecord UsageRecord) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "UsageRecord",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// NewUsageRecord records the usage of the feature by the account on behalf of the user
+func NewUsageRecord(tx *gorm.DB, accountID, userID uint, feature string, action UsageActionT, quantity int64) (record *UsageRecord, err error) {
+	record = &UsageRecord{
+		AccountID:  accountID,
+		Feature:    feature,
+		Action:     action,
+		Quantity:   quantity,
+		RecordedAt: time.Now(),
+	}
+	record.UserID = userID
+	record.SetOwner(AccountScopeType, accountID)
+	err = tx.Create(record).Error
+	return
+}
+
+// SumUsage returns the usage of the feature by the account during the period. Set records
+// replace the usage recorded before them, even in previous periods, and increments add to it.
+func SumUsage(tx *gorm.DB, accountID uint, feature string, period UsagePeriod) (total int64, err error) {
+	records := tx.Model(&UsageRecord{}).Where("account_id = ? AND feature = ?", accountID, feature).Session(&gorm.Session{})
+	increments := records.Where("action = ? AND recorded_at >= ? AND recorded_at < ?", IncrementUsage, period.Start, period.End)
+
+	lastSet := &UsageRecord{}
+	err = records.Where("action = ? AND recorded_at < ?", SetUsage, period.End).Order("recorded_at DESC, id DESC").First(lastSet).Error
+	switch err {
+	case nil:
+		total = lastSet.Quantity
+		increments = increments.Where("id > ?", lastSet.ID)
+	case gorm.ErrRecordNotFound:
+		err = nil
+	default:
+		return
+	}
+	var incremented int64
+	if err = increments.Select("COALESCE(SUM(quantity), 0)").Scan(&incremented).Error; err != nil {
+		return
+	}
+	total += incremented
+	return
+}
+
+// CurrentPeriod returns the billing period of the account at the time. Accounts with a
+// subscription follow its period, the others calendar periods of the billing period of the plan.
+func (account *Account) CurrentPeriod(plan *Plan, now time.Time) (period UsagePeriod) {
+	if account.CurrentPeriodStart != nil && account.CurrentPeriodEnd != nil &&
+		!now.Before(*account.CurrentPeriodStart) && now.Before(*account.CurrentPeriodEnd) {
+		return UsagePeriod{Start: *account.CurrentPeriodStart, End: *account.CurrentPeriodEnd}
+	}
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch plan.BillingPeriod {
+	case "yearly":
+		period.Start = time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+		period.End = period.Start.AddDate(1, 0, 0)
+	case "weekly":
+		period.Start = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		period.End = period.Start.AddDate(0, 0, 7)
+	case "daily":
+		period.Start = day
+		period.End = day.AddDate(0, 0, 1)
+	default:
+		period.Start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		period.End = period.Start.AddDate(0, 1, 0)
+	}
+	return
+}
+
+// recordSeats records the number of members of the account as its seats
+func recordSeats(tx *gorm.DB, accountID, userID uint) (err error) {
+	var seats int64
+	if err = tx.Model(&AccountMembership{}).Where("account_id = ?", accountID).Count(&seats).Error; err != nil {
+		return
+	}
+	_, err = NewUsageRecord(tx, accountID, userID, SeatsFeature, SetUsage, seats)
+	return
+}
+
+// AfterCreate records the seats of the account the member joined
+func (accountMembership *AccountMembership) AfterCreate(tx *gorm.DB) (err error) {
+	return recordSeats(tx, accountMembership.AccountID, accountMembership.UserID)
+}
+
+// AfterDelete records the seats of the account the member left
+func (accountMembership *AccountMembership) AfterDelete(tx *gorm.DB) (err error) {
+	if accountMembership.AccountID == 0 {
+		return
+	}
+	return recordSeats(tx, accountMembership.AccountID, accountMembership.UserID)
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -11,32 +13,44 @@ const (
 
 type UserStatus string
 
-type GoogleUserInfo struct {
-	ID            string `json:"id"`
-	Email         string `json:"email"`
-	VerifiedEmail bool   `json:"verified_email"`
-
-	Name       string `json:"name"`
-	GivenName  string `json:"given_name"`
-	FamilyName string `json:"family_name"`
-
-	Picture string `json:"picture"`
-}
-
 type User struct {
 	BaseModelWithoutUser
 
-	GoogleID string `json:"-" gorm:"uniqueIndex"`
-	Email    string `json:"email" gorm:"uniqueIndex"`
-	Name     string `json:"name"`
+	// GoogleID is only set for the users who signed in with Google
+	GoogleID *string `json:"-" gorm:"uniqueIndex"`
+	Email    string  `json:"email" gorm:"uniqueIndex"`
+	Name     string  `json:"name"`
 
 	Picture     string `json:"picture"`
 	AccessToken string `json:"-"`
 
 	UserStatus UserStatus `json:"user_status" gorm:"type:varchar(20);not null;default:'active'"`
 
+	// IsSuperuser lets support staff use the admin routes, e.g. to impersonate users
+	IsSuperuser bool `json:"is_superuser" gorm:"not null;default:false"`
+
+	// Email and password authentication
+	PasswordHash    string     `json:"-"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	FailedLogins    int        `json:"-" gorm:"not null;default:0"`
+	LockedUntil     *time.Time `json:"-"`
+
+	// Two factor authentication, the secret is only enabled once a code of it is verified.
+	// TOTPLastCounter is the time step of the last code used, which can't be used again.
+	TOTPSecret      string     `json:"-"`
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at"`
+	TOTPLastCounter int64      `json:"-" gorm:"not null;default:0"`
+
+	// Phone is the number, in E.164 format, the user can sign in with once it's verified
+	Phone           *string    `json:"phone" gorm:"uniqueIndex"`
+	PhoneVerifiedAt *time.Time `json:"phone_verified_at"`
+
+	// CreatedFrom records how the user signed up, e.g. google or password
 	CreatedFrom string `json:"-" gorm:"type:varchar(20);not null;default:'login'"`
 
+	// CurrentAccountID is the account the user switched to
+	CurrentAccountID uint `json:"current_account_id"`
+
 	Profile Profile `json:"-" gorm:"foreignKey:UserID"`
 }
 
@@ -47,7 +61,8 @@ func (u User) GetConfig() ModelConfig {
 	}
 }
 
-// AfterCreate hook to create a profile and account when a new user is created
+// AfterCreate hook to create a profile and account when a new user is created.
+// The user owns the account and acts on it until switching to another one.
 func (u *User) AfterCreate(tx *gorm.DB) error {
 	// Create profile
 	profile := Profile{
@@ -69,6 +84,13 @@ func (u *User) AfterCreate(tx *gorm.DB) error {
 	if err := tx.Create(&account).Error; err != nil {
 		return err
 	}
+	if _, err := account.AddMember(tx, u.ID, AccountOwnerRole); err != nil {
+		return err
+	}
+	u.CurrentAccountID = account.ID
+	if err := tx.Model(u).Update("current_account_id", account.ID).Error; err != nil {
+		return err
+	}
 
 	return nil
 }
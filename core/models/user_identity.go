@@ -0,0 +1,20 @@
+package models
+
+type (
+	// UserIdentity links the user to their account at an OAuth provider.
+	// The Subject is the ID of the user at the provider, which unlike the email never changes.
+	UserIdentity struct {
+		BaseModelWithUser
+
+		Provider string `json:"provider" gorm:"type:varchar(32);not null;uniqueIndex:idx_user_identity_provider_subject"`
+		Subject  string `json:"-" gorm:"not null;uniqueIndex:idx_user_identity_provider_subject"`
+		Email    string `json:"email"`
+	}
+)
+
+func (userIdentity UserIdentity) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "UserIdentity",
+		ScopeType: AccountScopeType,
+	}
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// User token purposes
+	EmailVerificationPurpose UserTokenPurposeT = "email_verification"
+	PasswordResetPurpose     UserTokenPurposeT = "password_reset"
+	// LoginCodePurpose is the one time code handed to the frontend after an OAuth sign in
+	LoginCodePurpose UserTokenPurposeT = "login_code"
+
+	EmailVerificationTTL = 24 * time.Hour
+	PasswordResetTTL     = time.Hour
+	LoginCodeTTL         = time.Minute
+)
+
+var (
+	ErrInvalidUserToken = errors.New("invalid or already used token")
+	ErrUserTokenExpired = errors.New("token has expired")
+)
+
+type (
+	UserTokenPurposeT string
+
+	// UserToken is a single use secret handed to the user, e.g. emailed to prove they own
+	// the email. Only the hash of the secret is stored.
+	UserToken struct {
+		BaseModelWithUser
+
+		Purpose   UserTokenPurposeT `json:"purpose" gorm:"type:varchar(32);not null;index"`
+		TokenHash string            `json:"-" gorm:"uniqueIndex"`
+		ExpiresAt time.Time         `json:"expires_at"`
+		UsedAt    *time.Time        `json:"used_at"`
+	}
+)
+
+func (userToken UserToken) GetConfig() ModelConfig {
+	return ModelConfig{
+		Name:      "UserToken",
+		ScopeType: AccountScopeType,
+	}
+}
+
+// NewUserToken issues a token of the user for the purpose and returns its secret.
+// The unused tokens previously issued for the same purpose can't be used anymore.
+func NewUserToken(tx *gorm.DB, user *User, purpose UserTokenPurposeT, ttl time.Duration) (userToken *UserToken, secret string, err error) {
+	secretBytes := make([]byte, 32)
+	if _, err = rand.Read(secretBytes); err != nil {
+		return
+	}
+	secret = hex.EncodeToString(secretBytes)
+
+	userToken = &UserToken{
+		Purpose:   purpose,
+		TokenHash: hashToken(secret),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	userToken.UserID = user.ID
+	err = tx.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Model(&UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).
+			Update("used_at", time.Now()).Error; err != nil {
+			return
+		}
+		err = tx.Create(userToken).Error
+		return
+	})
+	return
+}
+
+// ConsumeUserToken marks the token with the secret as used and returns it.
+// A token can only be consumed once, even by concurrent requests.
+func ConsumeUserToken(tx *gorm.DB, purpose UserTokenPurposeT, secret string) (userToken *UserToken, err error) {
+	userToken = &UserToken{}
+	if err = tx.Where("token_hash = ? AND purpose = ?", hashToken(secret), purpose).First(userToken).Error; err != nil {
+		err = ErrInvalidUserToken
+		return
+	}
+	if userToken.UsedAt != nil {
+		err = ErrInvalidUserToken
+		return
+	}
+	if time.Now().After(userToken.ExpiresAt) {
+		err = ErrUserTokenExpired
+		return
+	}
+
+	now := time.Now()
+	result := tx.Model(&UserToken{}).
+		Where("id = ? AND used_at IS NULL", userToken.ID).
+		Update("used_at", now)
+	if err = result.Error; err != nil {
+		return
+	}
+	if result.RowsAffected == 0 {
+		err = ErrInvalidUserToken
+		return
+	}
+	userToken.UsedAt = &now
+	return
+}
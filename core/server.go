@@ -9,7 +9,12 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gsarmaonline/goiter/config"
 	"github.com/gsarmaonline/goiter/core/handlers"
+	"github.com/gsarmaonline/goiter/core/helpers/authorisation"
 	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/cache"
+	"github.com/gsarmaonline/goiter/core/services/outbox"
+	"github.com/gsarmaonline/goiter/core/services/payments"
+	"github.com/gsarmaonline/goiter/core/services/usage"
 )
 
 type (
@@ -63,6 +68,29 @@ func NewServer(cfg *config.Config) *Server {
 		Handler: handlers.NewHandler(router, dbMgr.Db, cfg),
 		Cfg:     cfg,
 	}
+	server.Handler.SetModelRegistry(dbMgr)
+
+	// Invalid JWT keys would otherwise only surface when the first token is signed
+	if err = server.Handler.LoadSigningKeys(); err != nil {
+		log.Fatalf("Failed to load the JWT keys: %v", err)
+	}
+
+	// Configure the authorisation cache
+	switch cfg.GetKey("AUTHORISATION_CACHE") {
+	case "lru":
+		server.Handler.SetAuthorisationCache(authorisation.NewLRUCacheBackend(authorisation.DefaultLRUCacheSize))
+	case "redis":
+		server.Handler.SetAuthorisationCache(authorisation.NewRedisCacheBackend(cache.NewCache()))
+	}
+
+	// Bill with Stripe unless the fake gateway runs the app offline. Its webhook secret is
+	// public, so that it would let anyone post events, and it's only allowed in dev mode.
+	if cfg.GetKey("PAYMENT_GATEWAY") == "fake" {
+		if cfg.Mode != config.ModeDev {
+			log.Fatalf("PAYMENT_GATEWAY=fake is only allowed in the %s mode", config.ModeDev)
+		}
+		server.Handler.SetPaymentGateway(payments.NewFakeGateway())
+	}
 
 	return server
 }
@@ -71,5 +99,15 @@ func (s *Server) Start() (err error) {
 	if err = s.DbMgr.Migrate(); err != nil {
 		return
 	}
+	// Report the usage of the metered features and perform the billing side effects of the
+	// committed changes with the payment gateway in the background
+	if s.Cfg.GetKey("STRIPE_SECRET_KEY") != "" || s.Cfg.GetKey("PAYMENT_GATEWAY") == "fake" {
+		go s.Handler.UsageMeter().Run(usage.DefaultReportInterval)
+		go func() {
+			if err := s.Handler.BillingOutbox().Run(outbox.DefaultPollInterval); err != nil {
+				log.Printf("Failed to run the billing outbox: %v", err)
+			}
+		}()
+	}
 	return s.Router.Run(fmt.Sprintf(":%s", s.Cfg.Port))
 }
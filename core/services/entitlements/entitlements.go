@@ -0,0 +1,194 @@
+package entitlements
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gsarmaonline/goiter/core/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// Unlimited is the limit of the features without a limit, and their remaining quota
+	Unlimited = -1
+)
+
+var (
+	ErrLimitReached       = errors.New("limit of the plan reached")
+	ErrFeatureNotIncluded = errors.New("feature isn't included in the plan")
+)
+
+type (
+	// Counter counts the usage of a feature by the account
+	Counter func(tx *gorm.DB, account *models.Account) (count int64, err error)
+
+	// Entitlement is what the plan of an account allows of a feature. Features with a counter
+	// are limited in quantity, the others are only switched on or off by their limit of 0.
+	Entitlement struct {
+		Feature string `json:"feature"`
+		Limit   int    `json:"limit"`
+		// Counted features report their usage and the remaining quota, Unlimited without a limit
+		Counted   bool  `json:"counted"`
+		Used      int64 `json:"used"`
+		Remaining int64 `json:"remaining"`
+		Allowed   bool  `json:"allowed"`
+	}
+
+	// LimitError is returned when the plan doesn't allow one more use of the feature
+	LimitError struct {
+		Entitlement *Entitlement
+		Err         error
+	}
+
+	// Service resolves the entitlements of the accounts from the features of their plan
+	Service struct {
+		db *gorm.DB
+
+		mu       sync.RWMutex
+		counters map[string]Counter
+	}
+)
+
+func NewService(db *gorm.DB) *Service {
+	return &Service{db: db, counters: map[string]Counter{}}
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("%s: %v", err.Entitlement.Feature, err.Err)
+}
+
+func (err *LimitError) Unwrap() error {
+	return err.Err
+}
+
+// CountModel counts the rows of the model owned by the account
+func CountModel(model models.UserOwnedModel) Counter {
+	return func(tx *gorm.DB, account *models.Account) (count int64, err error) {
+		err = tx.Model(model).
+			Where("owner_type = ? AND owner_id = ?", models.AccountScopeType, account.ID).
+			Count(&count).Error
+		return
+	}
+}
+
+// RegisterCounter limits the feature in quantity, counting its usage with the counter
+func (s *Service) RegisterCounter(feature string, counter Counter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[feature] = counter
+}
+
+func (s *Service) getCounter(feature string) (counter Counter, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counter, ok = s.counters[feature]
+	return
+}
+
+// ForAccount returns the entitlements of the features of the plan of the account along with
+// the counted features the plan doesn't limit, sorted by feature
+func (s *Service) ForAccount(account *models.Account) (entitlements []*Entitlement, err error) {
+	plan := &models.Plan{}
+	if err = s.db.Preload("Features").First(plan, account.PlanID).Error; err != nil {
+		return
+	}
+	limits := map[string]int{}
+	for _, feature := range plan.Features {
+		limits[feature.Name] = feature.Limit
+	}
+	s.mu.RLock()
+	for feature := range s.counters {
+		if _, ok := limits[feature]; !ok {
+			limits[feature] = Unlimited
+		}
+	}
+	s.mu.RUnlock()
+
+	for feature, limit := range limits {
+		var entitlement *Entitlement
+		if entitlement, err = s.resolve(s.db, account, feature, limit); err != nil {
+			return
+		}
+		entitlements = append(entitlements, entitlement)
+	}
+	sort.Slice(entitlements, func(i, j int) bool {
+		return entitlements[i].Feature < entitlements[j].Feature
+	})
+	return
+}
+
+// Get returns the entitlement of the account to the feature.
+// Features which aren't part of the plan are unlimited.
+func (s *Service) Get(account *models.Account, feature string) (entitlement *Entitlement, err error) {
+	return s.get(s.db, account, feature)
+}
+
+func (s *Service) get(tx *gorm.DB, account *models.Account, feature string) (entitlement *Entitlement, err error) {
+	plan := &models.Plan{}
+	plan.ID = account.PlanID
+	limit, err := plan.GetFeatureLimit(tx, feature)
+	if err != nil {
+		return
+	}
+	return s.resolve(tx, account, feature, limit)
+}
+
+// Check returns a LimitError if the plan of the account doesn't allow one more use of the feature.
+// Concurrent requests may both pass the check, use CheckLocked where the limit can't be exceeded.
+func (s *Service) Check(account *models.Account, feature string) (entitlement *Entitlement, err error) {
+	return s.check(s.db, account, feature)
+}
+
+// CheckLocked checks the feature like Check within the transaction using it, once the row of the
+// account is locked. The concurrent transactions checking the account wait for it to commit and
+// then count its usage, so that the limit can't be exceeded.
+func (s *Service) CheckLocked(tx *gorm.DB, account *models.Account, feature string) (entitlement *Entitlement, err error) {
+	if err = models.LockAccount(tx, account.ID); err != nil {
+		return
+	}
+	return s.check(tx, account, feature)
+}
+
+func (s *Service) check(tx *gorm.DB, account *models.Account, feature string) (entitlement *Entitlement, err error) {
+	if entitlement, err = s.get(tx, account, feature); err != nil {
+		return
+	}
+	if entitlement.Allowed {
+		return
+	}
+	limitErr := &LimitError{Entitlement: entitlement, Err: ErrLimitReached}
+	if entitlement.Limit == 0 {
+		limitErr.Err = ErrFeatureNotIncluded
+	}
+	err = limitErr
+	return
+}
+
+// resolve counts the usage of the feature against its limit
+func (s *Service) resolve(tx *gorm.DB, account *models.Account, feature string, limit int) (entitlement *Entitlement, err error) {
+	entitlement = &Entitlement{
+		Feature:   feature,
+		Limit:     limit,
+		Remaining: Unlimited,
+		Allowed:   limit != 0,
+	}
+	counter, ok := s.getCounter(feature)
+	if !ok {
+		return
+	}
+	entitlement.Counted = true
+	if entitlement.Used, err = counter(tx, account); err != nil {
+		return
+	}
+	if limit < 0 {
+		return
+	}
+	entitlement.Remaining = int64(limit) - entitlement.Used
+	if entitlement.Remaining < 0 {
+		entitlement.Remaining = 0
+	}
+	entitlement.Allowed = entitlement.Remaining > 0
+	return
+}
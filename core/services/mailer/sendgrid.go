@@ -15,14 +15,36 @@ type (
 		PlainText   string
 		HtmlContent string
 	}
+
+	// Mailer delivers the emails sent by the handlers
+	Mailer interface {
+		Send(req *MailerRequest) error
+	}
+
+	// SendgridMailer delivers the emails with SendGrid
+	SendgridMailer struct{}
 )
 
+func NewSendgridMailer() *SendgridMailer {
+	return &SendgridMailer{}
+}
+
+func (m *SendgridMailer) Send(req *MailerRequest) (err error) {
+	return req.SendEmail()
+}
+
 func (s *MailerRequest) SendEmail() (err error) {
 	s.From = os.Getenv("SENDGRID_FROM_EMAIL")
-	message := mail.NewSingleEmail(mail.NewEmail(s.From, s.From), s.Subject, mail.NewEmail(s.From, s.From), s.PlainText, s.HtmlContent)
 	client := sendgrid.NewSendClient(os.Getenv("SENDGRID_API_KEY"))
-	if _, err = client.Send(message); err != nil {
-		return
+	recipients := s.To
+	if len(recipients) == 0 {
+		recipients = []string{s.From}
+	}
+	for _, to := range recipients {
+		message := mail.NewSingleEmail(mail.NewEmail(s.From, s.From), s.Subject, mail.NewEmail(to, to), s.PlainText, s.HtmlContent)
+		if _, err = client.Send(message); err != nil {
+			return
+		}
 	}
 	return
 }
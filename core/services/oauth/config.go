@@ -0,0 +1,104 @@
+package oauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	GoogleProviderName    = "google"
+	MicrosoftProviderName = "microsoft"
+	GitHubProviderName    = "github"
+
+	GoogleIssuerURL = "https://accounts.google.com"
+)
+
+type (
+	// ProviderConfig configures a provider. The endpoints of OIDC providers are
+	// discovered from the IssuerURL unless they are set.
+	ProviderConfig struct {
+		Name         string
+		ClientID     string
+		ClientSecret string
+		RedirectURL  string
+		Scopes       []string
+
+		IssuerURL   string
+		AuthURL     string
+		TokenURL    string
+		UserInfoURL string
+		JWKSURL     string
+	}
+)
+
+// NewProviderFromConfig builds the provider of the name from the <NAME>_* config keys:
+//
+//	<NAME>_CLIENT_ID, <NAME>_CLIENT_SECRET, <NAME>_CALLBACK_URL, <NAME>_SCOPES (space separated)
+//	<NAME>_ISSUER_URL for OIDC providers other than google, microsoft and github
+//	<NAME>_TENANT for microsoft, common by default
+func NewProviderFromConfig(name string, getKey func(string) string) (provider Provider, err error) {
+	prefix := strings.ToUpper(name) + "_"
+	cfg := &ProviderConfig{
+		Name:         name,
+		ClientID:     getKey(prefix + "CLIENT_ID"),
+		ClientSecret: getKey(prefix + "CLIENT_SECRET"),
+		RedirectURL:  getKey(prefix + "CALLBACK_URL"),
+		IssuerURL:    getKey(prefix + "ISSUER_URL"),
+	}
+	if scopes := getKey(prefix + "SCOPES"); scopes != "" {
+		cfg.Scopes = strings.Fields(scopes)
+	}
+
+	switch name {
+	case GoogleProviderName:
+		if cfg.IssuerURL == "" {
+			cfg.IssuerURL = GoogleIssuerURL
+			cfg.AuthURL = "https://accounts.google.com/o/oauth2/v2/auth"
+			cfg.TokenURL = "https://oauth2.googleapis.com/token"
+			cfg.UserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+			cfg.JWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+		}
+	case MicrosoftProviderName:
+		if cfg.IssuerURL == "" {
+			tenant := getKey(prefix + "TENANT")
+			if tenant == "" {
+				tenant = "common"
+			}
+			cfg.IssuerURL = fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", tenant)
+		}
+	case GitHubProviderName:
+	default:
+		if cfg.IssuerURL == "" {
+			err = ErrUnknownProvider
+			return
+		}
+	}
+
+	if cfg.ClientID == "" {
+		err = fmt.Errorf("%s client ID not configured", displayName(name))
+		return
+	}
+	if cfg.RedirectURL == "" {
+		err = fmt.Errorf("%s callback URL not configured", displayName(name))
+		return
+	}
+
+	if name == GitHubProviderName {
+		provider = NewGitHubProvider(cfg)
+		return
+	}
+	provider = NewOIDCProvider(cfg)
+	return
+}
+
+func displayName(name string) string {
+	switch name {
+	case GoogleProviderName:
+		return "Google"
+	case MicrosoftProviderName:
+		return "Microsoft"
+	case GitHubProviderName:
+		return "GitHub"
+	}
+	return name
+}
@@ -0,0 +1,105 @@
+package oauth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	GitHubAuthURL  = "https://github.com/login/oauth/authorize"
+	GitHubTokenURL = "https://github.com/login/oauth/access_token"
+	GitHubAPIURL   = "https://api.github.com"
+)
+
+type (
+	// GitHubProvider signs users in with GitHub, which supports OAuth 2.0 but not OpenID Connect.
+	// The user is read from the API instead of an ID token.
+	GitHubProvider struct {
+		cfg    *ProviderConfig
+		client *http.Client
+	}
+
+	gitHubUser struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+
+	gitHubEmail struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+)
+
+// NewGitHubProvider builds a GitHub provider. The AuthURL, TokenURL and the API URL,
+// set as the UserInfoURL, default to GitHub's and can be pointed at GitHub Enterprise.
+func NewGitHubProvider(cfg *ProviderConfig) *GitHubProvider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"read:user", "user:email"}
+	}
+	if cfg.AuthURL == "" {
+		cfg.AuthURL = GitHubAuthURL
+	}
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = GitHubTokenURL
+	}
+	if cfg.UserInfoURL == "" {
+		cfg.UserInfoURL = GitHubAPIURL
+	}
+	return &GitHubProvider{cfg: cfg, client: newHTTPClient()}
+}
+
+// SetHTTPClient replaces the client used to call GitHub
+func (p *GitHubProvider) SetHTTPClient(client *http.Client) {
+	p.client = client
+}
+
+func (p *GitHubProvider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *GitHubProvider) AuthCodeURL(ctx context.Context, req *AuthRequest) (string, error) {
+	return authCodeURL(p.cfg.AuthURL, p.cfg, req, nil)
+}
+
+func (p *GitHubProvider) Authenticate(ctx context.Context, code string, req *AuthRequest) (userInfo *UserInfo, err error) {
+	token, err := exchangeCode(ctx, p.client, p.cfg.TokenURL, p.cfg, code, req)
+	if err != nil {
+		return
+	}
+	apiURL := strings.TrimSuffix(p.cfg.UserInfoURL, "/")
+
+	user := &gitHubUser{}
+	if err = getJSON(ctx, p.client, apiURL+"/user", token.AccessToken, user); err != nil {
+		return
+	}
+	// The public email of the profile may be missing or unverified, so the primary email is used
+	emails := []gitHubEmail{}
+	if err = getJSON(ctx, p.client, apiURL+"/user/emails", token.AccessToken, &emails); err != nil {
+		return
+	}
+
+	name := user.Name
+	if name == "" {
+		name = user.Login
+	}
+	userInfo = &UserInfo{
+		Subject: strconv.FormatInt(user.ID, 10),
+		Name:    name,
+		Picture: user.AvatarURL,
+	}
+	for _, email := range emails {
+		if email.Primary {
+			userInfo.Email = email.Email
+			userInfo.EmailVerified = email.Verified
+		}
+	}
+	if userInfo.Email == "" {
+		err = ErrNoEmail
+	}
+	return
+}
@@ -0,0 +1,181 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown provider")
+	ErrInvalidIDToken  = errors.New("invalid id token")
+	ErrNoEmail         = errors.New("provider didn't return an email")
+)
+
+type (
+	// Provider signs users in with an OAuth 2.0 authorization code flow
+	Provider interface {
+		// Name is the name of the provider in the routes, e.g. google for /auth/google
+		Name() string
+		// AuthCodeURL returns the URL of the provider the user is sent to for signing in
+		AuthCodeURL(ctx context.Context, req *AuthRequest) (string, error)
+		// Authenticate exchanges the code of the callback and returns the signed in user
+		Authenticate(ctx context.Context, code string, req *AuthRequest) (*UserInfo, error)
+	}
+
+	// AuthRequest holds the secrets of a sign in which are checked in its callback
+	AuthRequest struct {
+		// State ties the callback to the browser which started the sign in
+		State string `json:"state"`
+		// Nonce ties the ID token to the sign in
+		Nonce string `json:"nonce"`
+		// CodeVerifier is the PKCE secret, only its challenge is sent with the auth code URL
+		CodeVerifier string `json:"code_verifier"`
+	}
+
+	// UserInfo is the user signed in with the provider
+	UserInfo struct {
+		// Subject is the ID of the user at the provider
+		Subject       string
+		Email         string
+		EmailVerified bool
+		Name          string
+		Picture       string
+	}
+
+	// Token is the response of the token endpoint
+	Token struct {
+		AccessToken      string `json:"access_token"`
+		IDToken          string `json:"id_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		TokenType        string `json:"token_type"`
+		Scope            string `json:"scope"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+)
+
+// NewAuthRequest generates the state, nonce and PKCE verifier of a sign in
+func NewAuthRequest() (req *AuthRequest, err error) {
+	req = &AuthRequest{}
+	if req.State, err = randomString(); err != nil {
+		return
+	}
+	if req.Nonce, err = randomString(); err != nil {
+		return
+	}
+	req.CodeVerifier, err = randomString()
+	return
+}
+
+// CodeChallenge returns the S256 PKCE challenge of the verifier
+func (req *AuthRequest) CodeChallenge() string {
+	hash := sha256.Sum256([]byte(req.CodeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func randomString() (value string, err error) {
+	bytes := make([]byte, 32)
+	if _, err = rand.Read(bytes); err != nil {
+		return
+	}
+	value = base64.RawURLEncoding.EncodeToString(bytes)
+	return
+}
+
+// authCodeURL builds the URL of the authorization endpoint with the PKCE challenge
+func authCodeURL(endpoint string, cfg *ProviderConfig, req *AuthRequest, extra url.Values) (string, error) {
+	authURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	query := authURL.Query()
+	query.Set("client_id", cfg.ClientID)
+	query.Set("redirect_uri", cfg.RedirectURL)
+	query.Set("response_type", "code")
+	query.Set("scope", strings.Join(cfg.Scopes, " "))
+	query.Set("state", req.State)
+	query.Set("code_challenge", req.CodeChallenge())
+	query.Set("code_challenge_method", "S256")
+	for key, values := range extra {
+		query[key] = values
+	}
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// exchangeCode exchanges the code of the callback for the tokens of the user
+func exchangeCode(ctx context.Context, client *http.Client, endpoint string, cfg *ProviderConfig, code string, req *AuthRequest) (token *Token, err error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.RedirectURL},
+		"client_id":     {cfg.ClientID},
+		"code_verifier": {req.CodeVerifier},
+	}
+	if cfg.ClientSecret != "" {
+		form.Set("client_secret", cfg.ClientSecret)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	token = &Token{}
+	if err = doJSON(client, httpReq, token); err != nil {
+		return
+	}
+	if token.Error != "" {
+		err = fmt.Errorf("token exchange failed: %s %s", token.Error, token.ErrorDescription)
+		return
+	}
+	if token.AccessToken == "" {
+		err = errors.New("token exchange returned no access token")
+	}
+	return
+}
+
+// getJSON fetches the JSON document at the URL, with the access token if any
+func getJSON(ctx context.Context, client *http.Client, endpoint, accessToken string, value interface{}) (err error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return
+	}
+	if accessToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return doJSON(client, httpReq, value)
+}
+
+func doJSON(client *http.Client, httpReq *http.Request, value interface{}) (err error) {
+	httpReq.Header.Set("Accept", "application/json")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return
+	}
+	// The token endpoints answer errors with a 400 and a JSON error
+	if resp.StatusCode >= 300 && !(resp.StatusCode == http.StatusBadRequest && json.Valid(body)) {
+		return fmt.Errorf("%s %s returned %d", httpReq.Method, httpReq.URL.Path, resp.StatusCode)
+	}
+	return json.Unmarshal(body, value)
+}
+
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: 10 * time.Second}
+}
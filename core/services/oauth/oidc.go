@@ -0,0 +1,348 @@
+package oauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// How long the discovery documents and key sets are cached for
+	discoveryTTL = time.Hour
+	// Unknown key IDs refetch the key set, at most once per keySetRefreshInterval
+	keySetRefreshInterval = time.Minute
+)
+
+var (
+	// The caches are shared by all the providers since they are built per request
+	discoveryCache = &documentCache{documents: map[string]*cachedDocument{}}
+	keySetCache    = &documentCache{documents: map[string]*cachedDocument{}}
+
+	idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+)
+
+type (
+	// OIDCProvider signs users in with OpenID Connect and verifies their ID tokens
+	OIDCProvider struct {
+		cfg    *ProviderConfig
+		client *http.Client
+	}
+
+	discoveryDocument struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	jsonWebKeySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	jsonWebKey struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+
+	userInfoResponse struct {
+		Subject       string      `json:"sub"`
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+		Name          string      `json:"name"`
+		Picture       string      `json:"picture"`
+	}
+
+	cachedDocument struct {
+		value     interface{}
+		fetchedAt time.Time
+	}
+
+	documentCache struct {
+		mu        sync.Mutex
+		documents map[string]*cachedDocument
+	}
+)
+
+func NewOIDCProvider(cfg *ProviderConfig) *OIDCProvider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{cfg: cfg, client: newHTTPClient()}
+}
+
+// SetHTTPClient replaces the client used to call the provider
+func (p *OIDCProvider) SetHTTPClient(client *http.Client) {
+	p.client = client
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, req *AuthRequest) (string, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return authCodeURL(doc.AuthorizationEndpoint, p.cfg, req, url.Values{"nonce": {req.Nonce}})
+}
+
+func (p *OIDCProvider) Authenticate(ctx context.Context, code string, req *AuthRequest) (userInfo *UserInfo, err error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return
+	}
+	token, err := exchangeCode(ctx, p.client, doc.TokenEndpoint, p.cfg, code, req)
+	if err != nil {
+		return
+	}
+	if token.IDToken == "" {
+		err = fmt.Errorf("%w: token exchange returned no id token", ErrInvalidIDToken)
+		return
+	}
+	claims, err := p.verifyIDToken(ctx, doc, token.IDToken, req.Nonce)
+	if err != nil {
+		return
+	}
+
+	userInfo = &UserInfo{
+		Subject:       stringClaim(claims, "sub"),
+		Email:         stringClaim(claims, "email"),
+		EmailVerified: isTrue(claims["email_verified"]),
+		Name:          stringClaim(claims, "name"),
+		Picture:       stringClaim(claims, "picture"),
+	}
+	// Some providers only return the email from the userinfo endpoint
+	if userInfo.Email == "" && doc.UserInfoEndpoint != "" {
+		resp := &userInfoResponse{}
+		if err = getJSON(ctx, p.client, doc.UserInfoEndpoint, token.AccessToken, resp); err != nil {
+			return
+		}
+		if resp.Subject != userInfo.Subject {
+			err = fmt.Errorf("%w: userinfo subject doesn't match", ErrInvalidIDToken)
+			return
+		}
+		userInfo.Email = resp.Email
+		userInfo.EmailVerified = isTrue(resp.EmailVerified)
+		if userInfo.Name == "" {
+			userInfo.Name = resp.Name
+		}
+		if userInfo.Picture == "" {
+			userInfo.Picture = resp.Picture
+		}
+	}
+	if userInfo.Email == "" {
+		err = ErrNoEmail
+	}
+	return
+}
+
+// discover returns the endpoints of the provider, from the config or the discovery document
+func (p *OIDCProvider) discover(ctx context.Context) (doc *discoveryDocument, err error) {
+	if p.cfg.AuthURL != "" && p.cfg.TokenURL != "" && p.cfg.JWKSURL != "" {
+		doc = &discoveryDocument{
+			Issuer:                p.cfg.IssuerURL,
+			AuthorizationEndpoint: p.cfg.AuthURL,
+			TokenEndpoint:         p.cfg.TokenURL,
+			UserInfoEndpoint:      p.cfg.UserInfoURL,
+			JWKSURI:               p.cfg.JWKSURL,
+		}
+		return
+	}
+
+	discoveryURL := strings.TrimSuffix(p.cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+	value, err := discoveryCache.get(discoveryURL, discoveryTTL, func() (interface{}, error) {
+		doc := &discoveryDocument{}
+		if err := getJSON(ctx, p.client, discoveryURL, "", doc); err != nil {
+			return nil, err
+		}
+		// Multi-tenant issuers, e.g. Microsoft's common tenant, are templated by the tenant of the user
+		if doc.Issuer != strings.TrimSuffix(p.cfg.IssuerURL, "/") && !strings.Contains(doc.Issuer, "{tenantid}") {
+			return nil, fmt.Errorf("discovered issuer %s doesn't match %s", doc.Issuer, p.cfg.IssuerURL)
+		}
+		return doc, nil
+	})
+	if err != nil {
+		return
+	}
+	discovered := *value.(*discoveryDocument)
+	doc = &discovered
+	if p.cfg.AuthURL != "" {
+		doc.AuthorizationEndpoint = p.cfg.AuthURL
+	}
+	if p.cfg.TokenURL != "" {
+		doc.TokenEndpoint = p.cfg.TokenURL
+	}
+	if p.cfg.UserInfoURL != "" {
+		doc.UserInfoEndpoint = p.cfg.UserInfoURL
+	}
+	if p.cfg.JWKSURL != "" {
+		doc.JWKSURI = p.cfg.JWKSURL
+	}
+	return
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of the ID token
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, doc *discoveryDocument, idToken, nonce string) (claims jwt.MapClaims, err error) {
+	claims = jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(ctx, doc.JWKSURI, kid)
+	},
+		jwt.WithValidMethods(idTokenAlgorithms),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+		return
+	}
+
+	issuer := strings.ReplaceAll(doc.Issuer, "{tenantid}", stringClaim(claims, "tid"))
+	if stringClaim(claims, "iss") != issuer {
+		err = fmt.Errorf("%w: unexpected issuer", ErrInvalidIDToken)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(stringClaim(claims, "nonce")), []byte(nonce)) != 1 {
+		err = fmt.Errorf("%w: nonce doesn't match", ErrInvalidIDToken)
+		return
+	}
+	if stringClaim(claims, "sub") == "" {
+		err = fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+	return
+}
+
+// getKey returns the signing key with the ID. The key set is refetched for unknown IDs
+// since providers rotate their keys.
+func (p *OIDCProvider) getKey(ctx context.Context, jwksURL, kid string) (key interface{}, err error) {
+	fetch := func() (interface{}, error) {
+		keySet := &jsonWebKeySet{}
+		if err := getJSON(ctx, p.client, jwksURL, "", keySet); err != nil {
+			return nil, err
+		}
+		return keySet, nil
+	}
+	value, err := keySetCache.get(jwksURL, discoveryTTL, fetch)
+	if err != nil {
+		return
+	}
+	if key, err = findKey(value.(*jsonWebKeySet), kid); err == nil {
+		return
+	}
+	if value, err = keySetCache.refresh(jwksURL, keySetRefreshInterval, fetch); err != nil {
+		return
+	}
+	return findKey(value.(*jsonWebKeySet), kid)
+}
+
+func findKey(keySet *jsonWebKeySet, kid string) (key interface{}, err error) {
+	for _, jwk := range keySet.Keys {
+		// Tokens without a kid can only be checked against a key set with a single key
+		if jwk.Kid == kid || (kid == "" && len(keySet.Keys) == 1) {
+			return jwk.publicKey()
+		}
+	}
+	return nil, fmt.Errorf("no key with ID %q", kid)
+}
+
+func (jwk *jsonWebKey) publicKey() (key interface{}, err error) {
+	switch jwk.Kty {
+	case "RSA":
+		var n, e []byte
+		if n, err = base64.RawURLEncoding.DecodeString(jwk.N); err != nil {
+			return
+		}
+		if e, err = base64.RawURLEncoding.DecodeString(jwk.E); err != nil {
+			return
+		}
+		key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		var x, y []byte
+		if x, err = base64.RawURLEncoding.DecodeString(jwk.X); err != nil {
+			return
+		}
+		if y, err = base64.RawURLEncoding.DecodeString(jwk.Y); err != nil {
+			return
+		}
+		key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	default:
+		err = fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+	return
+}
+
+// get returns the cached document, fetching it if it's missing or older than the ttl
+func (cache *documentCache) get(key string, ttl time.Duration, fetch func() (interface{}, error)) (value interface{}, err error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if document, ok := cache.documents[key]; ok && time.Since(document.fetchedAt) < ttl {
+		return document.value, nil
+	}
+	return cache.fetch(key, fetch)
+}
+
+// refresh refetches the document unless it was fetched within the interval
+func (cache *documentCache) refresh(key string, interval time.Duration, fetch func() (interface{}, error)) (value interface{}, err error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if document, ok := cache.documents[key]; ok && time.Since(document.fetchedAt) < interval {
+		return document.value, nil
+	}
+	return cache.fetch(key, fetch)
+}
+
+func (cache *documentCache) fetch(key string, fetch func() (interface{}, error)) (value interface{}, err error) {
+	if value, err = fetch(); err != nil {
+		return
+	}
+	cache.documents[key] = &cachedDocument{value: value, fetchedAt: time.Now()}
+	return
+}
+
+func stringClaim(claims jwt.MapClaims, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// isTrue reads the boolean claims, which some providers send as strings
+func isTrue(value interface{}) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
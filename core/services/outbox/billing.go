@@ -0,0 +1,37 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gsarmaonline/goiter/core/models"
+	"gorm.io/gorm"
+)
+
+// createPlanPrice creates the Stripe product and price of the plan of the event.
+// Plans deleted in the meantime are skipped.
+func createPlanPrice(tx *gorm.DB, event *models.OutboxEvent) (err error) {
+	plan := &models.Plan{}
+	if err = tx.First(plan, event.SubjectID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return
+	}
+	err = plan.SyncStripePrice(tx, event.IdempotencyKey)
+	return
+}
+
+// cancelSubscription cancels the subscription of the event at the end of its period.
+// Canceling a subscription which is already canceling doesn't change it, so that the
+// event can be retried.
+func cancelSubscription(tx *gorm.DB, event *models.OutboxEvent) (err error) {
+	payload := &models.CancelSubscriptionPayload{}
+	if err = event.DecodePayload(payload); err != nil {
+		return
+	}
+	if _, err = models.GetPaymentGateway().CancelSubscription(payload.SubscriptionID, true); err != nil {
+		return fmt.Errorf("failed to cancel subscription: %v", err)
+	}
+	return
+}
@@ -0,0 +1,195 @@
+package outbox
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/workerpool"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultPollInterval is how often Run looks for due events
+	DefaultPollInterval = 10 * time.Second
+	// BatchSize is the number of events claimed at most per poll
+	BatchSize = 100
+	// LockTTL is how long a claimed event is left to its worker before being claimed again,
+	// in case the worker died while processing it
+	LockTTL = 5 * time.Minute
+
+	// The failed events are retried after RetryBackoff, doubled on every attempt up to MaxRetryBackoff
+	RetryBackoff    = 30 * time.Second
+	MaxRetryBackoff = time.Hour
+
+	// OutboxJob is the job of the worker pool processing the claimed events
+	OutboxJob workerpool.EventTypeT = "outbox.event"
+)
+
+type (
+	// HandlerFunc performs the side effect of an event. The events are retried until their
+	// handler succeeds, so that the handlers have to be idempotent.
+	HandlerFunc func(tx *gorm.DB, event *models.OutboxEvent) error
+
+	// Processor performs the side effects recorded in the outbox once their transaction
+	// committed, retrying the failed ones with an exponential backoff
+	Processor struct {
+		db       *gorm.DB
+		handlers map[models.OutboxKindT]HandlerFunc
+	}
+)
+
+// NewProcessor returns a processor handling the billing events
+func NewProcessor(db *gorm.DB) (processor *Processor) {
+	processor = &Processor{
+		db:       db,
+		handlers: map[models.OutboxKindT]HandlerFunc{},
+	}
+	processor.Register(models.CreatePlanPriceOutboxKind, createPlanPrice)
+	processor.Register(models.CancelSubscriptionOutboxKind, cancelSubscription)
+	return
+}
+
+// Register sets the handler of the events of the kind
+func (p *Processor) Register(kind models.OutboxKindT, handler HandlerFunc) {
+	p.handlers[kind] = handler
+}
+
+// Process claims the due events and processes them one after the other. It returns the
+// number of events which succeeded, and the first error of the ones which failed.
+func (p *Processor) Process() (processed int, err error) {
+	events, err := p.claim()
+	if err != nil {
+		return
+	}
+	for _, event := range events {
+		if eventErr := p.process(event); eventErr != nil {
+			if err == nil {
+				err = eventErr
+			}
+			continue
+		}
+		processed++
+	}
+	return
+}
+
+// Run claims the due events every interval and processes them in a worker pool, until the
+// process exits
+func (p *Processor) Run(interval time.Duration) (err error) {
+	pool, err := workerpool.NewWorkerPool("outbox", p.db)
+	if err != nil {
+		return
+	}
+	pool.RegisterJob(OutboxJob, func(input *workerpool.Event) error {
+		return p.process(input.Data.(*models.OutboxEvent))
+	})
+	pool.StartWorkers()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		events, claimErr := p.claim()
+		if claimErr != nil {
+			log.Printf("Failed to claim the outbox events: %v", claimErr)
+			continue
+		}
+		for _, event := range events {
+			pool.EmitAsync(&workerpool.Event{
+				EventType:  OutboxJob,
+				SourceType: "OutboxEvent",
+				SourceID:   fmt.Sprintf("%d", event.ID),
+				Data:       event,
+				EmittedAt:  time.Now(),
+			})
+		}
+	}
+	return
+}
+
+// claim returns the due events after marking them as processing, skipping the ones claimed
+// by another processor in the meantime
+func (p *Processor) claim() (events []*models.OutboxEvent, err error) {
+	now := time.Now()
+	statuses := []models.OutboxStatusT{models.PendingOutboxEvent, models.ProcessingOutboxEvent}
+	var due []*models.OutboxEvent
+	if err = p.db.Where("status IN ? AND run_at <= ?", statuses, now).
+		Order("id").Limit(BatchSize).Find(&due).Error; err != nil {
+		return
+	}
+	for _, event := range due {
+		// Claiming pushes the run_at of the event past now, so only one processor claims it
+		result := p.db.Model(&models.OutboxEvent{}).
+			Where("id = ? AND status IN ? AND run_at <= ?", event.ID, statuses, now).
+			Updates(map[string]interface{}{
+				"status":   models.ProcessingOutboxEvent,
+				"run_at":   now.Add(LockTTL),
+				"attempts": gorm.Expr("attempts + 1"),
+			})
+		if result.Error != nil {
+			err = result.Error
+			return
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		event.Status = models.ProcessingOutboxEvent
+		event.Attempts++
+		events = append(events, event)
+	}
+	return
+}
+
+// process runs the handler of the claimed event, and marks it as done or schedules its retry
+func (p *Processor) process(event *models.OutboxEvent) (err error) {
+	handler, ok := p.handlers[event.Kind]
+	if !ok {
+		err = fmt.Errorf("no handler for the outbox events of kind %s", event.Kind)
+	} else {
+		err = p.runHandler(handler, event)
+	}
+
+	updates := map[string]interface{}{}
+	if err == nil {
+		updates["status"] = models.DoneOutboxEvent
+		updates["processed_at"] = time.Now()
+		updates["last_error"] = ""
+	} else {
+		log.Printf("Failed to process the outbox event %d (%s), attempt %d: %v", event.ID, event.Kind, event.Attempts, err)
+		updates["last_error"] = err.Error()
+		if event.Attempts >= models.MaxOutboxAttempts {
+			updates["status"] = models.FailedOutboxEvent
+		} else {
+			updates["status"] = models.PendingOutboxEvent
+			updates["run_at"] = time.Now().Add(Backoff(event.Attempts))
+		}
+	}
+	if updateErr := p.db.Model(event).Updates(updates).Error; updateErr != nil && err == nil {
+		err = updateErr
+	}
+	return
+}
+
+// runHandler runs the handler, turning its panics into errors
+func (p *Processor) runHandler(handler HandlerFunc, event *models.OutboxEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic recovered in outbox handler: %v", r)
+		}
+	}()
+	err = handler(p.db, event)
+	return
+}
+
+// Backoff returns how long to wait before retrying an event after its attempt
+func Backoff(attempt int) (backoff time.Duration) {
+	backoff = RetryBackoff
+	for i := 1; i < attempt && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRetryBackoff {
+		backoff = MaxRetryBackoff
+	}
+	return
+}
@@ -0,0 +1,450 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// FakeWebhookSecret signs the webhook events of the FakeGateway
+	FakeWebhookSecret = "whsec_fake"
+	// FakeDeclinedPaymentMethod is the payment method the FakeGateway declines
+	FakeDeclinedPaymentMethod = "pm_card_declined"
+)
+
+type (
+	// FakeGateway is a deterministic in-memory PaymentGateway for the tests and local runs.
+	// Its objects get sequential IDs like cus_fake_1, and SetNow fixes the periods of its
+	// subscriptions. Its maps are only read by the tests once the calls returned.
+	FakeGateway struct {
+		mu sync.Mutex
+
+		now      time.Time
+		sequence int
+		failures []error
+
+		Customers      map[string]*Customer
+		Products       map[string]*Product
+		Prices         map[string]*Price
+		PaymentMethods map[string]string
+		Subscriptions  map[string]*Subscription
+		// Prorations lists the proration lines invoiced per subscription by the changes of price
+		Prorations map[string][]*InvoiceLine
+		// Usage lists the usage reports, once per idempotency key
+		Usage          []*UsageReport
+		idempotencyKey map[string]bool
+		// idempotentIDs are the IDs of the objects created with an idempotency key
+		idempotentIDs map[string]string
+	}
+
+	// UsageReport is a usage report received by the FakeGateway
+	UsageReport struct {
+		SubscriptionID string
+		PriceID        string
+		Action         UsageActionT
+		Quantity       int64
+		IdempotencyKey string
+	}
+)
+
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		now:            time.Now().UTC().Truncate(time.Second),
+		Customers:      map[string]*Customer{},
+		Products:       map[string]*Product{},
+		Prices:         map[string]*Price{},
+		PaymentMethods: map[string]string{},
+		Subscriptions:  map[string]*Subscription{},
+		Prorations:     map[string][]*InvoiceLine{},
+		idempotencyKey: map[string]bool{},
+		idempotentIDs:  map[string]string{},
+	}
+}
+
+// SetNow moves the clock which sets the periods of the subscriptions
+func (g *FakeGateway) SetNow(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.now = now
+}
+
+// FailNext makes the next call to the gateway return the error
+func (g *FakeGateway) FailNext(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failures = append(g.failures, err)
+}
+
+// nextFailure returns the next failure queued by FailNext, if any
+func (g *FakeGateway) nextFailure() (err error) {
+	if len(g.failures) > 0 {
+		err, g.failures = g.failures[0], g.failures[1:]
+	}
+	return
+}
+
+func (g *FakeGateway) newID(prefix string) string {
+	g.sequence++
+	return fmt.Sprintf("%s_fake_%d", prefix, g.sequence)
+}
+
+func (g *FakeGateway) CreateCustomer(params *CustomerParams) (customer *Customer, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	customer = &Customer{ID: g.newID("cus"), Email: params.Email, Name: params.Name}
+	g.Customers[customer.ID] = customer
+	return
+}
+
+func (g *FakeGateway) CreateProduct(params *ProductParams) (product *Product, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	if id, ok := g.idempotentIDs[params.IdempotencyKey]; ok && params.IdempotencyKey != "" {
+		return g.Products[id], nil
+	}
+	product = &Product{ID: g.newID("prod"), Name: params.Name}
+	g.Products[product.ID] = product
+	g.rememberIdempotencyKey(params.IdempotencyKey, product.ID)
+	return
+}
+
+func (g *FakeGateway) CreatePrice(params *PriceParams) (price *Price, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	if _, ok := g.Products[params.ProductID]; !ok {
+		return nil, fmt.Errorf("product %s: %w", params.ProductID, ErrNotFound)
+	}
+	if id, ok := g.idempotentIDs[params.IdempotencyKey]; ok && params.IdempotencyKey != "" {
+		return g.Prices[id], nil
+	}
+	price = &Price{
+		ID:         g.newID("price"),
+		ProductID:  params.ProductID,
+		Currency:   params.Currency,
+		UnitAmount: params.UnitAmount,
+		Interval:   params.Interval,
+	}
+	g.Prices[price.ID] = price
+	g.rememberIdempotencyKey(params.IdempotencyKey, price.ID)
+	return
+}
+
+func (g *FakeGateway) AttachPaymentMethod(paymentMethodID, customerID string) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	if _, ok := g.Customers[customerID]; !ok {
+		return fmt.Errorf("customer %s: %w", customerID, ErrNotFound)
+	}
+	if paymentMethodID == FakeDeclinedPaymentMethod {
+		return ErrCardDeclined
+	}
+	g.PaymentMethods[paymentMethodID] = customerID
+	return
+}
+
+func (g *FakeGateway) CreateSubscription(params *SubscriptionParams) (subscription *Subscription, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	if _, ok := g.Customers[params.CustomerID]; !ok {
+		return nil, fmt.Errorf("customer %s: %w", params.CustomerID, ErrNotFound)
+	}
+	price, ok := g.Prices[params.PriceID]
+	if !ok {
+		return nil, fmt.Errorf("price %s: %w", params.PriceID, ErrNotFound)
+	}
+	if g.PaymentMethods[params.PaymentMethodID] != params.CustomerID {
+		return nil, fmt.Errorf("payment method %s isn't attached to the customer", params.PaymentMethodID)
+	}
+	subscription = &Subscription{
+		ID:                 g.newID("sub"),
+		CustomerID:         params.CustomerID,
+		Status:             ActiveSubscription,
+		Items:              []*SubscriptionItem{{ID: g.newID("si"), PriceID: price.ID}},
+		CurrentPeriodStart: g.now,
+		CurrentPeriodEnd:   addInterval(g.now, price.Interval),
+		Metadata:           params.Metadata,
+	}
+	g.Subscriptions[subscription.ID] = subscription
+	subscription = subscription.copy()
+	return
+}
+
+func (g *FakeGateway) GetSubscription(subscriptionID string) (subscription *Subscription, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	if subscription, err = g.getSubscription(subscriptionID); err != nil {
+		return
+	}
+	subscription = subscription.copy()
+	return
+}
+
+func (g *FakeGateway) ChangeSubscriptionPrice(params *SubscriptionChangeParams) (subscription *Subscription, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	subscription, item, preview, err := g.prorate(params)
+	if err != nil {
+		return
+	}
+	oldPrice, newPrice := g.Prices[item.PriceID], g.Prices[params.PriceID]
+	item.PriceID = newPrice.ID
+	if oldPrice != nil && oldPrice.Interval != newPrice.Interval {
+		// Changing the interval starts a new period right away
+		subscription.CurrentPeriodStart = preview.ProrationDate
+		subscription.CurrentPeriodEnd = addInterval(preview.ProrationDate, newPrice.Interval)
+	}
+	for key, value := range params.Metadata {
+		if subscription.Metadata == nil {
+			subscription.Metadata = map[string]string{}
+		}
+		subscription.Metadata[key] = value
+	}
+	for _, line := range preview.Lines {
+		if line.Proration {
+			g.Prorations[subscription.ID] = append(g.Prorations[subscription.ID], line)
+		}
+	}
+	subscription = subscription.copy()
+	return
+}
+
+func (g *FakeGateway) PreviewSubscriptionChange(params *SubscriptionChangeParams) (preview *ProrationPreview, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	_, _, preview, err = g.prorate(params)
+	return
+}
+
+// prorate returns the upcoming invoice of the subscription once the price of its item changed.
+// The unused time of the previous price is credited and the rest of the period charged at the
+// new price, or the whole new price when the change starts a new period.
+func (g *FakeGateway) prorate(params *SubscriptionChangeParams) (subscription *Subscription, item *SubscriptionItem, preview *ProrationPreview, err error) {
+	if subscription, err = g.getSubscription(params.SubscriptionID); err != nil {
+		return
+	}
+	for _, subscriptionItem := range subscription.Items {
+		if subscriptionItem.ID == params.ItemID {
+			item = subscriptionItem
+		}
+	}
+	if item == nil {
+		err = fmt.Errorf("subscription item %s: %w", params.ItemID, ErrNotFound)
+		return
+	}
+	newPrice, ok := g.Prices[params.PriceID]
+	if !ok {
+		err = fmt.Errorf("price %s: %w", params.PriceID, ErrNotFound)
+		return
+	}
+	oldPrice, ok := g.Prices[item.PriceID]
+	if !ok {
+		oldPrice = &Price{ID: item.PriceID, Interval: newPrice.Interval}
+	}
+
+	preview = &ProrationPreview{
+		ProrationDate: params.ProrationDate,
+		Currency:      newPrice.Currency,
+		Lines:         []*InvoiceLine{},
+	}
+	if preview.ProrationDate.IsZero() {
+		preview.ProrationDate = g.now
+	}
+	period := subscription.CurrentPeriodEnd.Sub(subscription.CurrentPeriodStart)
+	remaining := subscription.CurrentPeriodEnd.Sub(preview.ProrationDate)
+	prorated := params.ProrationBehavior != NoProrations && period > 0 && remaining > 0 && remaining <= period
+	prorate := func(amount int64) int64 {
+		return int64(math.Round(float64(amount) * float64(remaining) / float64(period)))
+	}
+
+	if prorated {
+		preview.Lines = append(preview.Lines, &InvoiceLine{
+			Description: fmt.Sprintf("Unused time on %s", oldPrice.ID),
+			Amount:      -prorate(oldPrice.UnitAmount),
+			Proration:   true,
+		})
+	}
+	switch {
+	case oldPrice.Interval != newPrice.Interval:
+		preview.Lines = append(preview.Lines, &InvoiceLine{Description: newPrice.ID, Amount: newPrice.UnitAmount})
+	case prorated:
+		preview.Lines = append(preview.Lines, &InvoiceLine{
+			Description: fmt.Sprintf("Remaining time on %s", newPrice.ID),
+			Amount:      prorate(newPrice.UnitAmount),
+			Proration:   true,
+		}, &InvoiceLine{Description: newPrice.ID, Amount: newPrice.UnitAmount})
+	default:
+		preview.Lines = append(preview.Lines, &InvoiceLine{Description: newPrice.ID, Amount: newPrice.UnitAmount})
+	}
+	for _, line := range preview.Lines {
+		if line.Proration {
+			preview.ProrationAmount += line.Amount
+		}
+		preview.AmountDue += line.Amount
+	}
+	if preview.AmountDue < 0 {
+		// Credits over the amount due are kept for the following invoices
+		preview.AmountDue = 0
+	}
+	return
+}
+
+func (g *FakeGateway) CancelSubscription(subscriptionID string, atPeriodEnd bool) (subscription *Subscription, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	if subscription, err = g.getSubscription(subscriptionID); err != nil {
+		return
+	}
+	if atPeriodEnd {
+		subscription.CancelAtPeriodEnd = true
+	} else {
+		subscription.Status = CanceledSubscription
+	}
+	subscription = subscription.copy()
+	return
+}
+
+func (g *FakeGateway) ReportUsage(subscriptionID, priceID string, action UsageActionT, quantity int64, idempotencyKey string) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	subscription, err := g.getSubscription(subscriptionID)
+	if err != nil {
+		return
+	}
+	if subscription.GetItem(priceID) == nil {
+		// Metered prices are added to the fake subscriptions on their first report
+		subscription.Items = append(subscription.Items, &SubscriptionItem{ID: g.newID("si"), PriceID: priceID})
+	}
+	if g.idempotencyKey[idempotencyKey] {
+		return
+	}
+	g.idempotencyKey[idempotencyKey] = true
+	g.Usage = append(g.Usage, &UsageReport{
+		SubscriptionID: subscriptionID,
+		PriceID:        priceID,
+		Action:         action,
+		Quantity:       quantity,
+		IdempotencyKey: idempotencyKey,
+	})
+	return
+}
+
+// AddSubscription adds a subscription to the gateway as if it was created outside of the
+// app, like in the dashboard of the provider
+func (g *FakeGateway) AddSubscription(subscription *Subscription) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if subscription.ID == "" {
+		subscription.ID = g.newID("sub")
+	}
+	g.Subscriptions[subscription.ID] = subscription.copy()
+}
+
+func (g *FakeGateway) ConstructEvent(payload []byte, signature string) (event *Event, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err = g.nextFailure(); err != nil {
+		return
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignFakeEvent(payload))) {
+		return nil, ErrInvalidSignature
+	}
+	event = &Event{}
+	if err = json.Unmarshal(payload, event); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event: %v", err)
+	}
+	return
+}
+
+// NewEvent returns the payload and the signature of a webhook event of the gateway
+func (g *FakeGateway) NewEvent(event *Event) (payload []byte, signature string) {
+	g.mu.Lock()
+	if event.ID == "" {
+		event.ID = g.newID("evt")
+	}
+	g.mu.Unlock()
+	payload, _ = json.Marshal(event)
+	signature = SignFakeEvent(payload)
+	return
+}
+
+// SignFakeEvent signs the webhook payload with the FakeWebhookSecret
+func SignFakeEvent(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(FakeWebhookSecret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// rememberIdempotencyKey records the object created with the idempotency key, if any
+func (g *FakeGateway) rememberIdempotencyKey(idempotencyKey, id string) {
+	if idempotencyKey != "" {
+		g.idempotentIDs[idempotencyKey] = id
+	}
+}
+
+func (g *FakeGateway) getSubscription(subscriptionID string) (subscription *Subscription, err error) {
+	subscription, ok := g.Subscriptions[subscriptionID]
+	if !ok {
+		return nil, fmt.Errorf("subscription %s: %w", subscriptionID, ErrNotFound)
+	}
+	return
+}
+
+// copy returns a copy of the subscription the callers can't change the gateway through
+func (subscription *Subscription) copy() *Subscription {
+	copied := *subscription
+	copied.Items = nil
+	for _, item := range subscription.Items {
+		copiedItem := *item
+		copied.Items = append(copied.Items, &copiedItem)
+	}
+	return &copied
+}
+
+func addInterval(t time.Time, interval IntervalT) time.Time {
+	switch interval {
+	case DayInterval:
+		return t.AddDate(0, 0, 1)
+	case WeekInterval:
+		return t.AddDate(0, 0, 7)
+	case YearInterval:
+		return t.AddDate(1, 0, 0)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
@@ -0,0 +1,205 @@
+package payments
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// Billing intervals of the recurring prices
+	DayInterval   IntervalT = "day"
+	WeekInterval  IntervalT = "week"
+	MonthInterval IntervalT = "month"
+	YearInterval  IntervalT = "year"
+
+	// IncrementUsage adds the quantity to the usage of a metered price, SetUsage replaces it
+	IncrementUsage UsageActionT = "increment"
+	SetUsage       UsageActionT = "set"
+
+	// Proration behaviors of the changes of price of the subscriptions. CreateProrations credits
+	// the unused time of the previous price and charges the rest of the period at the new one on
+	// the next invoice, AlwaysInvoiceProrations invoices them right away and NoProrations
+	// switches the price at the next period without prorating it.
+	CreateProrations        ProrationBehaviorT = "create_prorations"
+	AlwaysInvoiceProrations ProrationBehaviorT = "always_invoice"
+	NoProrations            ProrationBehaviorT = "none"
+
+	// Statuses of the subscriptions the billing handlers act on
+	ActiveSubscription   = "active"
+	PastDueSubscription  = "past_due"
+	CanceledSubscription = "canceled"
+
+	// Types of the webhook events of the payment providers
+	SubscriptionCreatedEvent     EventTypeT = "customer.subscription.created"
+	SubscriptionUpdatedEvent     EventTypeT = "customer.subscription.updated"
+	SubscriptionDeletedEvent     EventTypeT = "customer.subscription.deleted"
+	InvoicePaymentSucceededEvent EventTypeT = "invoice.payment_succeeded"
+	InvoicePaymentFailedEvent    EventTypeT = "invoice.payment_failed"
+
+	// DefaultCurrency is the currency of the prices of the plans
+	DefaultCurrency = "usd"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrNotFound         = errors.New("billing object not found")
+	ErrCardDeclined     = errors.New("card declined")
+)
+
+type (
+	IntervalT          string
+	UsageActionT       string
+	EventTypeT         string
+	ProrationBehaviorT string
+
+	// PaymentGateway creates and manages the billing objects of the accounts with a payment
+	// provider. Stripe is the default one, the FakeGateway keeps them in memory for the tests.
+	PaymentGateway interface {
+		CreateCustomer(params *CustomerParams) (*Customer, error)
+		CreateProduct(params *ProductParams) (*Product, error)
+		CreatePrice(params *PriceParams) (*Price, error)
+		AttachPaymentMethod(paymentMethodID, customerID string) error
+		CreateSubscription(params *SubscriptionParams) (*Subscription, error)
+		GetSubscription(subscriptionID string) (*Subscription, error)
+		// ChangeSubscriptionPrice replaces the price of the item of the subscription, prorating
+		// the change according to its proration behavior
+		ChangeSubscriptionPrice(params *SubscriptionChangeParams) (*Subscription, error)
+		// PreviewSubscriptionChange returns the upcoming invoice of the subscription after the
+		// change of price, without changing the subscription
+		PreviewSubscriptionChange(params *SubscriptionChangeParams) (*ProrationPreview, error)
+		// CancelSubscription cancels the subscription right away, or at the end of its period
+		CancelSubscription(subscriptionID string, atPeriodEnd bool) (*Subscription, error)
+		// ReportUsage reports the usage of the metered price of the subscription. Retrying
+		// with the same idempotency key doesn't report the usage twice.
+		ReportUsage(subscriptionID, priceID string, action UsageActionT, quantity int64, idempotencyKey string) error
+		// ConstructEvent verifies the signature of the webhook payload and parses its event
+		ConstructEvent(payload []byte, signature string) (*Event, error)
+	}
+
+	CustomerParams struct {
+		Email    string
+		Name     string
+		Metadata map[string]string
+	}
+
+	Customer struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+
+	// ProductParams describe a product. Retrying with the same idempotency key returns the
+	// product created by the first call instead of creating another one.
+	ProductParams struct {
+		Name           string
+		IdempotencyKey string
+	}
+
+	Product struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	// PriceParams describe a recurring price, with its amount in cents. Like for the
+	// products, retrying with the same idempotency key doesn't create another price.
+	PriceParams struct {
+		ProductID      string
+		Currency       string
+		UnitAmount     int64
+		Interval       IntervalT
+		Metadata       map[string]string
+		IdempotencyKey string
+	}
+
+	Price struct {
+		ID         string    `json:"id"`
+		ProductID  string    `json:"product_id"`
+		Currency   string    `json:"currency"`
+		UnitAmount int64     `json:"unit_amount"`
+		Interval   IntervalT `json:"interval"`
+	}
+
+	SubscriptionParams struct {
+		CustomerID      string
+		PriceID         string
+		PaymentMethodID string
+		Metadata        map[string]string
+	}
+
+	Subscription struct {
+		ID                 string              `json:"id"`
+		CustomerID         string              `json:"customer_id"`
+		Status             string              `json:"status"`
+		Items              []*SubscriptionItem `json:"items"`
+		CancelAtPeriodEnd  bool                `json:"cancel_at_period_end"`
+		CurrentPeriodStart time.Time           `json:"current_period_start"`
+		CurrentPeriodEnd   time.Time           `json:"current_period_end"`
+		Metadata           map[string]string   `json:"metadata"`
+	}
+
+	// SubscriptionChangeParams replace the price of an item of a subscription. Passing the
+	// ProrationDate of a preview prorates the change like the preview did, it's now otherwise.
+	SubscriptionChangeParams struct {
+		SubscriptionID    string
+		ItemID            string
+		PriceID           string
+		ProrationBehavior ProrationBehaviorT
+		ProrationDate     time.Time
+		Metadata          map[string]string
+	}
+
+	// ProrationPreview is the upcoming invoice of a subscription after a change of its price.
+	// ProrationAmount is the sum of its proration lines, negative when the change is a credit,
+	// and the amounts are in cents.
+	ProrationPreview struct {
+		ProrationDate   time.Time      `json:"proration_date"`
+		ProrationAmount int64          `json:"proration_amount"`
+		AmountDue       int64          `json:"amount_due"`
+		Currency        string         `json:"currency"`
+		Lines           []*InvoiceLine `json:"lines"`
+	}
+
+	InvoiceLine struct {
+		Description string `json:"description"`
+		Amount      int64  `json:"amount"`
+		Proration   bool   `json:"proration"`
+	}
+
+	SubscriptionItem struct {
+		ID      string `json:"id"`
+		PriceID string `json:"price_id"`
+	}
+
+	Invoice struct {
+		ID             string `json:"id"`
+		SubscriptionID string `json:"subscription_id"`
+		Status         string `json:"status"`
+	}
+
+	// Event is a webhook event, carrying the subscription or the invoice it's about
+	Event struct {
+		ID           string        `json:"id"`
+		Type         EventTypeT    `json:"type"`
+		Subscription *Subscription `json:"subscription,omitempty"`
+		Invoice      *Invoice      `json:"invoice,omitempty"`
+	}
+)
+
+// GetItem returns the item of the subscription billed with the price, nil if there's none
+func (subscription *Subscription) GetItem(priceID string) (item *SubscriptionItem) {
+	for _, item = range subscription.Items {
+		if item.PriceID == priceID {
+			return
+		}
+	}
+	return nil
+}
+
+// IsValid checks if the proration behavior is one of the supported behaviors
+func (behavior ProrationBehaviorT) IsValid() bool {
+	switch behavior {
+	case CreateProrations, AlwaysInvoiceProrations, NoProrations:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/client"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+type (
+	// StripeGateway is the PaymentGateway of Stripe. It reads STRIPE_SECRET_KEY and
+	// STRIPE_WEBHOOK_SECRET on every call instead of setting the global stripe.Key.
+	StripeGateway struct {
+		getKey func(string) string
+	}
+)
+
+func NewStripeGateway(getKey func(string) string) *StripeGateway {
+	return &StripeGateway{getKey: getKey}
+}
+
+func (g *StripeGateway) client() *client.API {
+	return client.New(g.getKey("STRIPE_SECRET_KEY"), nil)
+}
+
+func (g *StripeGateway) CreateCustomer(params *CustomerParams) (customer *Customer, err error) {
+	stripeParams := &stripe.CustomerParams{
+		Email: stripe.String(params.Email),
+		Name:  stripe.String(params.Name),
+	}
+	stripeParams.Metadata = params.Metadata
+	stripeCustomer, err := g.client().Customers.New(stripeParams)
+	if err != nil {
+		return
+	}
+	customer = &Customer{ID: stripeCustomer.ID, Email: stripeCustomer.Email, Name: stripeCustomer.Name}
+	return
+}
+
+func (g *StripeGateway) CreateProduct(params *ProductParams) (product *Product, err error) {
+	stripeParams := &stripe.ProductParams{
+		Name: stripe.String(params.Name),
+	}
+	if params.IdempotencyKey != "" {
+		stripeParams.SetIdempotencyKey(params.IdempotencyKey)
+	}
+	stripeProduct, err := g.client().Products.New(stripeParams)
+	if err != nil {
+		return
+	}
+	product = &Product{ID: stripeProduct.ID, Name: stripeProduct.Name}
+	return
+}
+
+func (g *StripeGateway) CreatePrice(params *PriceParams) (price *Price, err error) {
+	stripeParams := &stripe.PriceParams{
+		Currency: stripe.String(params.Currency),
+		Product:  stripe.String(params.ProductID),
+		Recurring: &stripe.PriceRecurringParams{
+			Interval: stripe.String(string(params.Interval)),
+		},
+		UnitAmount: stripe.Int64(params.UnitAmount),
+	}
+	stripeParams.Metadata = params.Metadata
+	if params.IdempotencyKey != "" {
+		stripeParams.SetIdempotencyKey(params.IdempotencyKey)
+	}
+	stripePrice, err := g.client().Prices.New(stripeParams)
+	if err != nil {
+		return
+	}
+	price = &Price{
+		ID:         stripePrice.ID,
+		ProductID:  params.ProductID,
+		Currency:   string(stripePrice.Currency),
+		UnitAmount: stripePrice.UnitAmount,
+		Interval:   params.Interval,
+	}
+	return
+}
+
+func (g *StripeGateway) AttachPaymentMethod(paymentMethodID, customerID string) (err error) {
+	_, err = g.client().PaymentMethods.Attach(paymentMethodID, &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	})
+	return
+}
+
+func (g *StripeGateway) CreateSubscription(params *SubscriptionParams) (subscription *Subscription, err error) {
+	stripeParams := &stripe.SubscriptionParams{
+		Customer: stripe.String(params.CustomerID),
+		Items: []*stripe.SubscriptionItemsParams{
+			{Price: stripe.String(params.PriceID)},
+		},
+		DefaultPaymentMethod: stripe.String(params.PaymentMethodID),
+	}
+	stripeParams.Metadata = params.Metadata
+	stripeSubscription, err := g.client().Subscriptions.New(stripeParams)
+	if err != nil {
+		return
+	}
+	subscription = fromStripeSubscription(stripeSubscription)
+	return
+}
+
+func (g *StripeGateway) GetSubscription(subscriptionID string) (subscription *Subscription, err error) {
+	stripeSubscription, err := g.client().Subscriptions.Get(subscriptionID, nil)
+	if err != nil {
+		return
+	}
+	subscription = fromStripeSubscription(stripeSubscription)
+	return
+}
+
+func (g *StripeGateway) ChangeSubscriptionPrice(params *SubscriptionChangeParams) (subscription *Subscription, err error) {
+	stripeParams := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(params.ItemID), Price: stripe.String(params.PriceID)},
+		},
+		ProrationBehavior: stripe.String(string(params.ProrationBehavior)),
+	}
+	if !params.ProrationDate.IsZero() {
+		stripeParams.ProrationDate = stripe.Int64(params.ProrationDate.Unix())
+	}
+	stripeParams.Metadata = params.Metadata
+	stripeSubscription, err := g.client().Subscriptions.Update(params.SubscriptionID, stripeParams)
+	if err != nil {
+		return
+	}
+	subscription = fromStripeSubscription(stripeSubscription)
+	return
+}
+
+func (g *StripeGateway) PreviewSubscriptionChange(params *SubscriptionChangeParams) (preview *ProrationPreview, err error) {
+	prorationDate := params.ProrationDate
+	if prorationDate.IsZero() {
+		// The proration date is returned so that the change can be prorated like the preview
+		prorationDate = time.Now().UTC().Truncate(time.Second)
+	}
+	stripeInvoice, err := g.client().Invoices.Upcoming(&stripe.InvoiceUpcomingParams{
+		Subscription: stripe.String(params.SubscriptionID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(params.ItemID), Price: stripe.String(params.PriceID)},
+		},
+		SubscriptionProrationBehavior: stripe.String(string(params.ProrationBehavior)),
+		SubscriptionProrationDate:     stripe.Int64(prorationDate.Unix()),
+	})
+	if err != nil {
+		return
+	}
+	preview = &ProrationPreview{
+		ProrationDate: prorationDate,
+		AmountDue:     stripeInvoice.AmountDue,
+		Currency:      string(stripeInvoice.Currency),
+		Lines:         []*InvoiceLine{},
+	}
+	if stripeInvoice.Lines != nil {
+		for _, stripeLine := range stripeInvoice.Lines.Data {
+			preview.Lines = append(preview.Lines, &InvoiceLine{
+				Description: stripeLine.Description,
+				Amount:      stripeLine.Amount,
+				Proration:   stripeLine.Proration,
+			})
+			if stripeLine.Proration {
+				preview.ProrationAmount += stripeLine.Amount
+			}
+		}
+	}
+	return
+}
+
+func (g *StripeGateway) CancelSubscription(subscriptionID string, atPeriodEnd bool) (subscription *Subscription, err error) {
+	var stripeSubscription *stripe.Subscription
+	if atPeriodEnd {
+		stripeSubscription, err = g.client().Subscriptions.Update(subscriptionID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+	} else {
+		stripeSubscription, err = g.client().Subscriptions.Cancel(subscriptionID, nil)
+	}
+	if err != nil {
+		return
+	}
+	subscription = fromStripeSubscription(stripeSubscription)
+	return
+}
+
+func (g *StripeGateway) ReportUsage(subscriptionID, priceID string, action UsageActionT, quantity int64, idempotencyKey string) (err error) {
+	subscription, err := g.GetSubscription(subscriptionID)
+	if err != nil {
+		return fmt.Errorf("failed to get the subscription: %v", err)
+	}
+	item := subscription.GetItem(priceID)
+	if item == nil {
+		return fmt.Errorf("subscription %s has no item with the price %s", subscriptionID, priceID)
+	}
+
+	params := &stripe.UsageRecordParams{
+		SubscriptionItem: stripe.String(item.ID),
+		Action:           stripe.String(string(action)),
+		Quantity:         stripe.Int64(quantity),
+		TimestampNow:     stripe.Bool(true),
+	}
+	params.SetIdempotencyKey(idempotencyKey)
+	if _, err = g.client().UsageRecords.New(params); err != nil {
+		return fmt.Errorf("failed to report usage: %v", err)
+	}
+	return
+}
+
+func (g *StripeGateway) ConstructEvent(payload []byte, signature string) (event *Event, err error) {
+	stripeEvent, err := webhook.ConstructEvent(payload, signature, g.getKey("STRIPE_WEBHOOK_SECRET"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	event = &Event{ID: stripeEvent.ID, Type: EventTypeT(stripeEvent.Type)}
+	switch event.Type {
+	case SubscriptionCreatedEvent, SubscriptionUpdatedEvent, SubscriptionDeletedEvent:
+		stripeSubscription := &stripe.Subscription{}
+		if err = json.Unmarshal(stripeEvent.Data.Raw, stripeSubscription); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal subscription: %v", err)
+		}
+		event.Subscription = fromStripeSubscription(stripeSubscription)
+	case InvoicePaymentSucceededEvent, InvoicePaymentFailedEvent:
+		stripeInvoice := &stripe.Invoice{}
+		if err = json.Unmarshal(stripeEvent.Data.Raw, stripeInvoice); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal invoice: %v", err)
+		}
+		event.Invoice = &Invoice{ID: stripeInvoice.ID, Status: string(stripeInvoice.Status)}
+		if stripeInvoice.Subscription != nil {
+			event.Invoice.SubscriptionID = stripeInvoice.Subscription.ID
+		}
+	}
+	return
+}
+
+func fromStripeSubscription(stripeSubscription *stripe.Subscription) (subscription *Subscription) {
+	subscription = &Subscription{
+		ID:                stripeSubscription.ID,
+		Status:            string(stripeSubscription.Status),
+		CancelAtPeriodEnd: stripeSubscription.CancelAtPeriodEnd,
+		Metadata:          stripeSubscription.Metadata,
+	}
+	if stripeSubscription.Customer != nil {
+		subscription.CustomerID = stripeSubscription.Customer.ID
+	}
+	if stripeSubscription.CurrentPeriodStart != 0 && stripeSubscription.CurrentPeriodEnd != 0 {
+		subscription.CurrentPeriodStart = time.Unix(stripeSubscription.CurrentPeriodStart, 0).UTC()
+		subscription.CurrentPeriodEnd = time.Unix(stripeSubscription.CurrentPeriodEnd, 0).UTC()
+	}
+	if stripeSubscription.Items != nil {
+		for _, stripeItem := range stripeSubscription.Items.Data {
+			item := &SubscriptionItem{ID: stripeItem.ID}
+			if stripeItem.Price != nil {
+				item.PriceID = stripeItem.Price.ID
+			}
+			subscription.Items = append(subscription.Items, item)
+		}
+	}
+	return
+}
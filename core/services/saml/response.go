@@ -0,0 +1,216 @@
+package saml
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+var (
+	// Attributes the identity providers commonly send the email and the name of the user in
+	emailAttributes = []string{"email", "mail", "emailaddress", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress", "urn:oid:0.9.2342.19200300.100.1.3"}
+	nameAttributes  = []string{"name", "displayname", "http://schemas.microsoft.com/identity/claims/displayname", "urn:oid:2.16.840.1.113730.3.1.241"}
+)
+
+type (
+	// Assertion is the user the identity provider signed in
+	Assertion struct {
+		// NameID identifies the user at the identity provider
+		NameID       string
+		NameIDFormat string
+		SessionIndex string
+		// Attributes are the values of the attributes by their name
+		Attributes map[string][]string
+	}
+)
+
+// Email returns the email of the user, the NameID in the email format or else an email attribute
+func (assertion *Assertion) Email() string {
+	if assertion.NameIDFormat == EmailNameIDFormat || strings.Contains(assertion.NameID, "@") {
+		return assertion.NameID
+	}
+	return assertion.attribute(emailAttributes)
+}
+
+// Name returns the display name of the user, if the identity provider sent one
+func (assertion *Assertion) Name() string {
+	return assertion.attribute(nameAttributes)
+}
+
+func (assertion *Assertion) attribute(names []string) string {
+	for _, name := range names {
+		for attributeName, values := range assertion.Attributes {
+			if strings.EqualFold(attributeName, name) && len(values) > 0 {
+				return values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// ParseResponse validates the base64 response posted by the identity provider to the ACS and
+// returns its assertion. The response has to answer the request and either it or its assertion
+// has to be signed by the identity provider. The assertion is only read from the signed content.
+func (sp *ServiceProvider) ParseResponse(encoded, requestID string) (assertion *Assertion, err error) {
+	data, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	response, err := parseXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if !response.is(ProtocolNamespace, "Response") {
+		return nil, fmt.Errorf("%w: not a response", ErrInvalidResponse)
+	}
+	if destination := response.Attr("Destination"); destination != "" && destination != sp.ACSURL {
+		return nil, fmt.Errorf("%w: sent to %s", ErrInvalidResponse, destination)
+	}
+	if requestID == "" || response.Attr("InResponseTo") != requestID {
+		return nil, fmt.Errorf("%w: doesn't answer the sign in request", ErrInvalidResponse)
+	}
+	if issuer := response.child(AssertionNamespace, "Issuer"); issuer != nil && issuer.Text() != sp.IdPEntityID {
+		return nil, fmt.Errorf("%w: issued by %s", ErrInvalidResponse, issuer.Text())
+	}
+	status := response.child(ProtocolNamespace, "Status")
+	if status == nil {
+		return nil, fmt.Errorf("%w: no status", ErrInvalidResponse)
+	}
+	if statusCode := status.child(ProtocolNamespace, "StatusCode"); statusCode == nil || statusCode.Attr("Value") != SuccessStatus {
+		return nil, fmt.Errorf("%w: sign in failed at the identity provider", ErrInvalidResponse)
+	}
+	if response.child(AssertionNamespace, "EncryptedAssertion") != nil {
+		return nil, fmt.Errorf("%w: encrypted assertions aren't supported", ErrInvalidResponse)
+	}
+	assertions := response.children(AssertionNamespace, "Assertion")
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("%w: expected one assertion, got %d", ErrInvalidResponse, len(assertions))
+	}
+
+	doc := etree.NewDocument()
+	if err = doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	signedAssertion := etreeChild(doc.Root(), AssertionNamespace, "Assertion")
+	if signedAssertion == nil {
+		return nil, fmt.Errorf("%w: no assertion", ErrInvalidResponse)
+	}
+
+	// Every signature present has to be valid and at least one of them has to cover the assertion,
+	// which is read from the signed content so that unsigned elements can't be slipped in
+	var verified *element
+	if response.child(DSigNamespace, "Signature") != nil {
+		verifiedResponse, err := verifySignature(doc.Root(), sp.IdPCertificates)
+		if err != nil {
+			return nil, err
+		}
+		if assertions = verifiedResponse.children(AssertionNamespace, "Assertion"); len(assertions) != 1 {
+			return nil, fmt.Errorf("%w: expected one signed assertion, got %d", ErrInvalidResponse, len(assertions))
+		}
+		verified = assertions[0]
+	}
+	if etreeChild(signedAssertion, DSigNamespace, "Signature") != nil {
+		if verified, err = verifySignature(signedAssertion, sp.IdPCertificates); err != nil {
+			return
+		}
+	}
+	if verified == nil {
+		return nil, fmt.Errorf("%w: the assertion isn't signed", ErrInvalidSignature)
+	}
+	return sp.validateAssertion(verified, requestID, time.Now())
+}
+
+// validateAssertion checks the assertion was issued by the identity provider for us and is still valid
+func (sp *ServiceProvider) validateAssertion(el *element, requestID string, now time.Time) (assertion *Assertion, err error) {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidResponse, fmt.Sprintf(format, args...))
+	}
+	if issuer := el.child(AssertionNamespace, "Issuer"); issuer == nil || issuer.Text() != sp.IdPEntityID {
+		return nil, invalid("the assertion isn't issued by the identity provider")
+	}
+
+	subject := el.child(AssertionNamespace, "Subject")
+	if subject == nil {
+		return nil, invalid("no subject")
+	}
+	nameID := subject.child(AssertionNamespace, "NameID")
+	if nameID == nil || nameID.Text() == "" {
+		return nil, invalid("no NameID")
+	}
+	confirmed := false
+	for _, confirmation := range subject.children(AssertionNamespace, "SubjectConfirmation") {
+		data := confirmation.child(AssertionNamespace, "SubjectConfirmationData")
+		if confirmation.Attr("Method") != BearerConfirmation || data == nil {
+			continue
+		}
+		if data.Attr("Recipient") != sp.ACSURL {
+			continue
+		}
+		if inResponseTo := data.Attr("InResponseTo"); inResponseTo != "" && inResponseTo != requestID {
+			continue
+		}
+		if notOnOrAfter, err := parseTime(data.Attr("NotOnOrAfter")); err != nil || !now.Before(notOnOrAfter.Add(MaxClockSkew)) {
+			continue
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		return nil, invalid("the subject isn't confirmed for the assertion consumer service")
+	}
+
+	conditions := el.child(AssertionNamespace, "Conditions")
+	if conditions == nil {
+		return nil, invalid("no conditions")
+	}
+	if value := conditions.Attr("NotBefore"); value != "" {
+		notBefore, err := parseTime(value)
+		if err != nil || now.Add(MaxClockSkew).Before(notBefore) {
+			return nil, invalid("the assertion isn't valid yet")
+		}
+	}
+	if value := conditions.Attr("NotOnOrAfter"); value != "" {
+		notOnOrAfter, err := parseTime(value)
+		if err != nil || !now.Before(notOnOrAfter.Add(MaxClockSkew)) {
+			return nil, invalid("the assertion has expired")
+		}
+	}
+	audienceRestrictions := conditions.children(AssertionNamespace, "AudienceRestriction")
+	if len(audienceRestrictions) == 0 {
+		return nil, invalid("no audience restriction")
+	}
+	// Each restriction has to include us
+	for _, restriction := range audienceRestrictions {
+		allowed := false
+		for _, audience := range restriction.children(AssertionNamespace, "Audience") {
+			allowed = allowed || audience.Text() == sp.EntityID
+		}
+		if !allowed {
+			return nil, invalid("the assertion is meant for another service provider")
+		}
+	}
+
+	assertion = &Assertion{
+		NameID:       nameID.Text(),
+		NameIDFormat: nameID.Attr("Format"),
+		Attributes:   map[string][]string{},
+	}
+	if authnStatement := el.child(AssertionNamespace, "AuthnStatement"); authnStatement != nil {
+		assertion.SessionIndex = authnStatement.Attr("SessionIndex")
+	}
+	for _, statement := range el.children(AssertionNamespace, "AttributeStatement") {
+		for _, attribute := range statement.children(AssertionNamespace, "Attribute") {
+			name := attribute.Attr("Name")
+			for _, value := range attribute.children(AssertionNamespace, "AttributeValue") {
+				assertion.Attributes[name] = append(assertion.Attributes[name], value.Text())
+			}
+		}
+	}
+	return
+}
+
+// parseTime parses the xs:dateTime of the SAML messages
+func parseTime(value string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, value)
+}
@@ -0,0 +1,201 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	MetadataNamespace  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	AssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	ProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	DSigNamespace      = "http://www.w3.org/2000/09/xmldsig#"
+
+	RedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	PostBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	EmailNameIDFormat  = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	SuccessStatus      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	BearerConfirmation = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// MaxClockSkew is the difference tolerated between the clocks of the identity provider and ours
+	MaxClockSkew = 3 * time.Minute
+)
+
+var (
+	ErrInvalidMetadata    = errors.New("invalid identity provider metadata")
+	ErrInvalidCertificate = errors.New("invalid identity provider certificate")
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrInvalidResponse    = errors.New("invalid SAML response")
+)
+
+type (
+	// ServiceProvider signs the users of an account in with its identity provider
+	ServiceProvider struct {
+		// EntityID identifies us to the identity provider
+		EntityID string
+		// ACSURL is the assertion consumer service the identity provider posts the responses to
+		ACSURL string
+
+		IdPEntityID string
+		IdPSSOURL   string
+		// IdPCertificates verify the signatures of the identity provider, several of them
+		// can be trusted while the identity provider rotates its key
+		IdPCertificates []*x509.Certificate
+	}
+
+	// IdPMetadata is the configuration of the identity provider read from its metadata
+	IdPMetadata struct {
+		EntityID string
+		SSOURL   string
+		// Certificates are the PEM signing certificates
+		Certificates string
+	}
+
+	entityDescriptorXML struct {
+		XMLName          xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+		EntityID         string   `xml:"entityID,attr"`
+		IDPSSODescriptor *struct {
+			KeyDescriptors []struct {
+				Use     string `xml:"use,attr"`
+				KeyInfo struct {
+					X509Data []struct {
+						Certificates []string `xml:"http://www.w3.org/2000/09/xmldsig# X509Certificate"`
+					} `xml:"http://www.w3.org/2000/09/xmldsig# X509Data"`
+				} `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+			} `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+			SingleSignOnServices []struct {
+				Binding  string `xml:"Binding,attr"`
+				Location string `xml:"Location,attr"`
+			} `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+	}
+)
+
+// ParseIdPMetadata reads the entity ID, the HTTP-Redirect single sign on URL and the
+// signing certificates from the metadata of the identity provider
+func ParseIdPMetadata(data []byte) (metadata *IdPMetadata, err error) {
+	if _, err = parseXML(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+	descriptor := &entityDescriptorXML{}
+	if err = xml.Unmarshal(data, descriptor); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+	if descriptor.EntityID == "" || descriptor.IDPSSODescriptor == nil {
+		return nil, fmt.Errorf("%w: not the metadata of an identity provider", ErrInvalidMetadata)
+	}
+	metadata = &IdPMetadata{EntityID: descriptor.EntityID}
+	for _, service := range descriptor.IDPSSODescriptor.SingleSignOnServices {
+		if service.Binding == RedirectBinding {
+			metadata.SSOURL = service.Location
+		}
+	}
+	if metadata.SSOURL == "" {
+		return nil, fmt.Errorf("%w: no HTTP-Redirect single sign on service", ErrInvalidMetadata)
+	}
+	certificates := &strings.Builder{}
+	for _, keyDescriptor := range descriptor.IDPSSODescriptor.KeyDescriptors {
+		// Keys without a use are used for both signing and encryption
+		if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" {
+			continue
+		}
+		for _, x509Data := range keyDescriptor.KeyInfo.X509Data {
+			for _, certificate := range x509Data.Certificates {
+				der, err := decodeBase64(certificate)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+				}
+				pem.Encode(certificates, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+			}
+		}
+	}
+	metadata.Certificates = certificates.String()
+	if _, err = ParseCertificates(metadata.Certificates); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// ParseCertificates parses the PEM certificates
+func ParseCertificates(data string) (certificates []*x509.Certificate, err error) {
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		var certificate *x509.Certificate
+		if certificate, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		err = fmt.Errorf("%w: no PEM certificate", ErrInvalidCertificate)
+	}
+	return
+}
+
+// Metadata returns the metadata of the service provider, which the identity provider is configured with
+func (sp *ServiceProvider) Metadata() []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="%s" entityID="%s">
+  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">
+    <md:NameIDFormat>%s</md:NameIDFormat>
+    <md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>
+`, MetadataNamespace, escapeAttr(sp.EntityID), ProtocolNamespace, EmailNameIDFormat, PostBinding, escapeAttr(sp.ACSURL)))
+}
+
+// AuthnRequestURL returns the URL of the identity provider the user is sent to with the
+// HTTP-Redirect binding, along with the ID of the request which the response has to answer
+func (sp *ServiceProvider) AuthnRequestURL(relayState string) (redirectURL, requestID string, err error) {
+	id := make([]byte, 20)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	// IDs have to start with a letter
+	requestID = "id-" + hex.EncodeToString(id)
+	request := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s"><saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy Format="%s" AllowCreate="true"/></samlp:AuthnRequest>`,
+		ProtocolNamespace, AssertionNamespace, requestID, time.Now().UTC().Format(time.RFC3339),
+		escapeAttr(sp.IdPSSOURL), escapeAttr(sp.ACSURL), PostBinding, escapeText(sp.EntityID), EmailNameIDFormat)
+
+	compressed := &bytes.Buffer{}
+	writer, err := flate.NewWriter(compressed, flate.DefaultCompression)
+	if err != nil {
+		return
+	}
+	writer.Write([]byte(request))
+	if err = writer.Close(); err != nil {
+		return
+	}
+
+	parsedURL, err := url.Parse(sp.IdPSSOURL)
+	if err != nil {
+		return
+	}
+	query := parsedURL.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(compressed.Bytes()))
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	parsedURL.RawQuery = query.Encode()
+	redirectURL = parsedURL.String()
+	return
+}
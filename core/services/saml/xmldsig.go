@@ -0,0 +1,279 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+	// Algorithms of the XML signatures, only the ones without known weaknesses are accepted
+	ExcC14NAlgorithm      = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	EnvelopedAlgorithm    = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	RSASHA256Algorithm    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	RSASHA512Algorithm    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	SHA256DigestAlgorithm = "http://www.w3.org/2001/04/xmlenc#sha256"
+	SHA512DigestAlgorithm = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+var (
+	signatureAlgorithms = map[string]bool{
+		RSASHA256Algorithm: true,
+		RSASHA512Algorithm: true,
+	}
+	digestAlgorithms = map[string]bool{
+		SHA256DigestAlgorithm: true,
+		SHA512DigestAlgorithm: true,
+	}
+)
+
+type (
+	// element is a node of the parsed XML, which resolves the namespaces of its prefixes
+	element struct {
+		Prefix   string
+		Local    string
+		Attrs    []attribute
+		NS       map[string]string
+		Children []interface{}
+
+		parent *element
+	}
+
+	attribute struct {
+		Prefix string
+		Local  string
+		Value  string
+	}
+)
+
+// parseXML parses the document into elements. Document types are rejected as
+// SAML messages never have one and they're the vector of entity expansion attacks.
+func parseXML(data []byte) (root *element, err error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var current *element
+	for {
+		var token xml.Token
+		if token, err = decoder.RawToken(); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+				break
+			}
+			return
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			el := &element{Prefix: token.Name.Space, Local: token.Name.Local, NS: map[string]string{}, parent: current}
+			for _, attr := range token.Attr {
+				switch {
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					el.NS[""] = attr.Value
+				case attr.Name.Space == "xmlns":
+					el.NS[attr.Name.Local] = attr.Value
+				default:
+					el.Attrs = append(el.Attrs, attribute{Prefix: attr.Name.Space, Local: attr.Name.Local, Value: attr.Value})
+				}
+			}
+			if current == nil {
+				if root != nil {
+					err = errors.New("document has several root elements")
+					return
+				}
+				root = el
+			} else {
+				current.Children = append(current.Children, el)
+			}
+			current = el
+		case xml.EndElement:
+			if current == nil {
+				err = errors.New("unexpected end element")
+				return
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.Children = append(current.Children, string(token))
+			}
+		case xml.Directive:
+			err = errors.New("document types aren't allowed")
+			return
+		}
+	}
+	if root == nil || current != nil {
+		err = errors.New("document isn't complete")
+	}
+	return
+}
+
+// lookupNamespace returns the namespace the prefix is bound to in the scope of the element
+func (el *element) lookupNamespace(prefix string) (namespace string, ok bool) {
+	if prefix == "xml" {
+		return xmlNamespace, true
+	}
+	for current := el; current != nil; current = current.parent {
+		if namespace, ok = current.NS[prefix]; ok {
+			return
+		}
+	}
+	// Elements without a prefix and a default namespace have no namespace
+	return "", prefix == ""
+}
+
+// Namespace returns the namespace of the element
+func (el *element) Namespace() string {
+	namespace, _ := el.lookupNamespace(el.Prefix)
+	return namespace
+}
+
+// is checks the namespace and the local name of the element
+func (el *element) is(namespace, local string) bool {
+	return el.Local == local && el.Namespace() == namespace
+}
+
+// Attr returns the value of the attribute without a namespace
+func (el *element) Attr(local string) string {
+	for _, attr := range el.Attrs {
+		if attr.Prefix == "" && attr.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// children returns the child elements with the namespace and the local name
+func (el *element) children(namespace, local string) (children []*element) {
+	for _, child := range el.Children {
+		if child, ok := child.(*element); ok && child.is(namespace, local) {
+			children = append(children, child)
+		}
+	}
+	return
+}
+
+// child returns the first child element with the namespace and the local name
+func (el *element) child(namespace, local string) *element {
+	if children := el.children(namespace, local); len(children) > 0 {
+		return children[0]
+	}
+	return nil
+}
+
+// Text returns the text content of the element
+func (el *element) Text() string {
+	var builder strings.Builder
+	for _, child := range el.Children {
+		switch child := child.(type) {
+		case string:
+			builder.WriteString(child)
+		case *element:
+			builder.WriteString(child.Text())
+		}
+	}
+	return strings.TrimSpace(builder.String())
+}
+
+// verifySignature verifies the enveloped signature of the element with one of the certificates
+// and returns the signed content, which the assertion has to be read from rather than the posted
+// document. The signature is verified with goxmldsig once checked to be a direct child of the
+// element, referencing it by its ID and only using the algorithms without known weaknesses.
+func verifySignature(el *etree.Element, certificates []*x509.Certificate) (verified *element, err error) {
+	if err = checkSignature(el); err != nil {
+		return
+	}
+	// The certificate embedded in the signature has to be one of the configured ones
+	for _, certificate := range certificates {
+		ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{certificate}})
+		signed, validateErr := ctx.Validate(el)
+		if validateErr != nil {
+			err = validateErr
+			continue
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(signed)
+		data, err := doc.WriteToBytes()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+		}
+		return parseXML(data)
+	}
+	return nil, fmt.Errorf("%w: not signed by the identity provider: %v", ErrInvalidSignature, err)
+}
+
+// checkSignature checks the shape and the algorithms of the enveloped signature of the element
+func checkSignature(el *etree.Element) (err error) {
+	signatures := etreeChildren(el, DSigNamespace, "Signature")
+	if len(signatures) != 1 {
+		return fmt.Errorf("%w: expected one signature, got %d", ErrInvalidSignature, len(signatures))
+	}
+	signedInfo := etreeChild(signatures[0], DSigNamespace, "SignedInfo")
+	if signedInfo == nil {
+		return fmt.Errorf("%w: no SignedInfo", ErrInvalidSignature)
+	}
+	if c14nMethod := etreeChild(signedInfo, DSigNamespace, "CanonicalizationMethod"); c14nMethod == nil || c14nMethod.SelectAttrValue("Algorithm", "") != ExcC14NAlgorithm {
+		return fmt.Errorf("%w: unsupported canonicalization method", ErrInvalidSignature)
+	}
+	signatureMethod := etreeChild(signedInfo, DSigNamespace, "SignatureMethod")
+	if signatureMethod == nil || !signatureAlgorithms[signatureMethod.SelectAttrValue("Algorithm", "")] {
+		return fmt.Errorf("%w: unsupported signature method", ErrInvalidSignature)
+	}
+
+	references := etreeChildren(signedInfo, DSigNamespace, "Reference")
+	if len(references) != 1 {
+		return fmt.Errorf("%w: expected one reference, got %d", ErrInvalidSignature, len(references))
+	}
+	reference := references[0]
+	if id := el.SelectAttrValue("ID", ""); id == "" || reference.SelectAttrValue("URI", "") != "#"+id {
+		return fmt.Errorf("%w: the signature doesn't reference the signed element", ErrInvalidSignature)
+	}
+	if transforms := etreeChild(reference, DSigNamespace, "Transforms"); transforms != nil {
+		for _, transform := range etreeChildren(transforms, DSigNamespace, "Transform") {
+			if algorithm := transform.SelectAttrValue("Algorithm", ""); algorithm != EnvelopedAlgorithm && algorithm != ExcC14NAlgorithm {
+				return fmt.Errorf("%w: unsupported transform %s", ErrInvalidSignature, algorithm)
+			}
+		}
+	}
+	if digestMethod := etreeChild(reference, DSigNamespace, "DigestMethod"); digestMethod == nil || !digestAlgorithms[digestMethod.SelectAttrValue("Algorithm", "")] {
+		return fmt.Errorf("%w: unsupported digest method", ErrInvalidSignature)
+	}
+	return
+}
+
+// etreeChildren returns the child elements of the goxmldsig tree with the namespace and the local name
+func etreeChildren(el *etree.Element, namespace, local string) (children []*etree.Element) {
+	for _, child := range el.ChildElements() {
+		if child.Tag == local && child.NamespaceURI() == namespace {
+			children = append(children, child)
+		}
+	}
+	return
+}
+
+// etreeChild returns the first child element of the goxmldsig tree with the namespace and the local name
+func etreeChild(el *etree.Element, namespace, local string) *etree.Element {
+	if children := etreeChildren(el, namespace, local); len(children) > 0 {
+		return children[0]
+	}
+	return nil
+}
+
+func escapeText(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;").Replace(value)
+}
+
+func escapeAttr(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(value)
+}
+
+// decodeBase64 decodes the base64 content of an element, which may be split over several lines
+func decodeBase64(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+}
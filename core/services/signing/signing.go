@@ -0,0 +1,339 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// DefaultIssuer is the iss claim of the tokens unless JWT_ISSUER is set
+	DefaultIssuer = "goiter"
+)
+
+var (
+	// ErrNoSigningKey is returned when neither a signing key nor JWT_SECRET is configured
+	ErrNoSigningKey  = errors.New("JWT secret not configured")
+	ErrUnknownKey    = errors.New("token is signed with an unknown key")
+	ErrMissingClaims = errors.New("token is missing the sub, iat or jti claim")
+)
+
+type (
+	// Key signs or verifies the tokens with the algorithm of its type
+	Key struct {
+		// ID is the kid header of the tokens, the JWK thumbprint of the public key
+		ID     string
+		Method jwt.SigningMethod
+
+		signKey   interface{}
+		verifyKey interface{}
+		publicKey crypto.PublicKey
+	}
+
+	// KeySet signs the tokens with its signing key and verifies them with any of its keys,
+	// which lets the signing key be rotated while the tokens it signed are still valid
+	KeySet struct {
+		Issuer   string
+		Audience string
+
+		signingKey *Key
+		keys       map[string]*Key
+	}
+
+	// KeyManager loads the key set from the config the first time it's needed
+	KeyManager struct {
+		getKey func(string) string
+
+		mu     sync.Mutex
+		keySet *KeySet
+	}
+
+	// JWK is a public key of the JWKS
+	JWK struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		// RSA keys
+		N string `json:"n,omitempty"`
+		E string `json:"e,omitempty"`
+		// Ed25519 keys
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+	}
+
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+	}
+)
+
+func NewKeyManager(getKey func(string) string) *KeyManager {
+	return &KeyManager{getKey: getKey}
+}
+
+// KeySet returns the key set, loading it from the config if it wasn't yet
+func (km *KeyManager) KeySet() (keySet *KeySet, err error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if km.keySet != nil {
+		return km.keySet, nil
+	}
+	if keySet, err = LoadKeySet(km.getKey); err != nil {
+		return
+	}
+	km.keySet = keySet
+	return
+}
+
+// LoadKeySet builds the key set from the config:
+//
+//   - JWT_SIGNING_KEY_FILE or JWT_SIGNING_KEY, the PEM RSA or Ed25519 private key signing the tokens
+//   - JWT_VERIFICATION_KEY_FILES or JWT_VERIFICATION_KEYS, the PEM keys of the previous signing
+//     keys which are still accepted, the files being separated by commas
+//   - JWT_SECRET, the HS256 secret used when no signing key is configured
+//   - JWT_ISSUER and JWT_AUDIENCE, the iss and aud claims, the audience defaulting to the issuer
+func LoadKeySet(getKey func(string) string) (keySet *KeySet, err error) {
+	keySet = &KeySet{
+		Issuer:   getKey("JWT_ISSUER"),
+		Audience: getKey("JWT_AUDIENCE"),
+		keys:     map[string]*Key{},
+	}
+	if keySet.Issuer == "" {
+		keySet.Issuer = DefaultIssuer
+	}
+	if keySet.Audience == "" {
+		keySet.Audience = keySet.Issuer
+	}
+
+	signingPEM, err := readConfig(getKey, "JWT_SIGNING_KEY")
+	if err != nil {
+		return
+	}
+	if len(signingPEM) == 0 {
+		secret := getKey("JWT_SECRET")
+		if secret == "" {
+			err = ErrNoSigningKey
+			return
+		}
+		// The tokens signed with the secret don't have a kid
+		keySet.signingKey = &Key{Method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}
+		keySet.keys[""] = keySet.signingKey
+		return
+	}
+
+	keys, err := ParseKeys(signingPEM)
+	if err != nil {
+		return
+	}
+	if len(keys) != 1 || keys[0].signKey == nil {
+		err = errors.New("JWT_SIGNING_KEY must be a single private key")
+		return
+	}
+	keySet.signingKey = keys[0]
+	keySet.keys[keys[0].ID] = keys[0]
+
+	verificationPEM, err := readConfig(getKey, "JWT_VERIFICATION_KEY")
+	if err != nil {
+		return
+	}
+	if keys, err = ParseKeys(verificationPEM); err != nil {
+		return
+	}
+	for _, key := range keys {
+		if _, exists := keySet.keys[key.ID]; !exists {
+			keySet.keys[key.ID] = key
+		}
+	}
+	return
+}
+
+// readConfig reads the PEM of the config from its files, <NAME>_FILE or <NAME>_FILES, or its value, <NAME> or <NAME>S
+func readConfig(getKey func(string) string, name string) (data []byte, err error) {
+	files := getKey(name + "_FILE")
+	if files == "" {
+		files = getKey(name + "_FILES")
+	}
+	for _, file := range strings.Split(files, ",") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		var content []byte
+		if content, err = os.ReadFile(file); err != nil {
+			return
+		}
+		data = append(data, content...)
+		data = append(data, '\n')
+	}
+	if value := getKey(name); value != "" {
+		data = append(data, value...)
+	} else if value = getKey(name + "S"); value != "" {
+		data = append(data, value...)
+	}
+	return
+}
+
+// ParseKeys parses the PEM encoded RSA and Ed25519 keys, either private or public
+func ParseKeys(data []byte) (keys []*Key, err error) {
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return
+		}
+		var (
+			private interface{}
+			public  interface{}
+		)
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "PUBLIC KEY":
+			public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		default:
+			err = fmt.Errorf("unsupported PEM block %s", block.Type)
+		}
+		if err != nil {
+			return
+		}
+		if signer, ok := private.(crypto.Signer); ok {
+			public = signer.Public()
+		}
+		var key *Key
+		if key, err = newKey(private, public); err != nil {
+			return
+		}
+		keys = append(keys, key)
+	}
+}
+
+func newKey(private, public interface{}) (key *Key, err error) {
+	key = &Key{signKey: private, verifyKey: public, publicKey: public}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+		key.ID = thumbprint(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+			encode(big.NewInt(int64(public.E)).Bytes()), encode(public.N.Bytes())))
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.ID = thumbprint(fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, encode(public)))
+	default:
+		err = fmt.Errorf("unsupported key type %T, only RSA and Ed25519 keys are supported", public)
+	}
+	return
+}
+
+// thumbprint returns the JWK thumbprint of RFC 7638 of the required members of the key
+func thumbprint(members string) string {
+	hash := sha256.Sum256([]byte(members))
+	return encode(hash[:])
+}
+
+func encode(bytes []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// Sign signs the claims with the signing key after adding the iss, aud, iat and jti claims.
+// The caller sets the sub and exp claims.
+func (ks *KeySet) Sign(claims jwt.MapClaims) (tokenString string, err error) {
+	jti := make([]byte, 16)
+	if _, err = rand.Read(jti); err != nil {
+		return
+	}
+	claims["iss"] = ks.Issuer
+	claims["aud"] = ks.Audience
+	claims["iat"] = time.Now().Unix()
+	claims["jti"] = hex.EncodeToString(jti)
+
+	token := jwt.NewWithClaims(ks.signingKey.Method, claims)
+	if ks.signingKey.ID != "" {
+		token.Header["kid"] = ks.signingKey.ID
+	}
+	return token.SignedString(ks.signingKey.signKey)
+}
+
+// Parse verifies the token with the key of its kid and validates its standard claims
+func (ks *KeySet) Parse(tokenString string) (token *jwt.Token, err error) {
+	methods := []string{}
+	for _, key := range ks.keys {
+		methods = append(methods, key.Method.Alg())
+	}
+	token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := ks.keys[kid]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		// The algorithm of the token has to be the one of the key, e.g. an HMAC can't
+		// be signed with a public key
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.verifyKey, nil
+	},
+		jwt.WithValidMethods(methods),
+		jwt.WithIssuer(ks.Issuer),
+		jwt.WithAudience(ks.Audience),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	sub, _ := claims["sub"].(string)
+	jti, _ := claims["jti"].(string)
+	if _, hasIAT := claims["iat"]; sub == "" || jti == "" || !hasIAT {
+		err = ErrMissingClaims
+	}
+	return
+}
+
+// JWKS returns the public keys verifying the tokens. The HS256 secret isn't published.
+func (ks *KeySet) JWKS() (jwks *JWKS) {
+	jwks = &JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		switch public := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   encode(public.N.Bytes()),
+				E:   encode(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   encode(public),
+			})
+		}
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+	return
+}
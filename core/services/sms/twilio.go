@@ -13,8 +13,24 @@ type (
 		ToPhoneNumber   string
 		Message         string
 	}
+
+	// Sender delivers the SMS sent by the handlers
+	Sender interface {
+		Send(req *SmsRequest) error
+	}
+
+	// TwilioSender delivers the SMS with Twilio
+	TwilioSender struct{}
 )
 
+func NewTwilioSender() *TwilioSender {
+	return &TwilioSender{}
+}
+
+func (s *TwilioSender) Send(req *SmsRequest) (err error) {
+	return SendSms(req)
+}
+
 func NewSMS(fromPhoneNumber string) *SmsRequest {
 	return &SmsRequest{
 		FromPhoneNumber: fromPhoneNumber,
@@ -1,97 +1,92 @@
 package services
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 
 	"github.com/gsarmaonline/goiter/core/models"
-	"github.com/stripe/stripe-go/v74"
-	"github.com/stripe/stripe-go/v74/webhook"
+	"github.com/gsarmaonline/goiter/core/services/payments"
 	"gorm.io/gorm"
 )
 
+// StripeService applies the webhook events of the payment gateway to the accounts,
+// Stripe unless models.SetPaymentGateway replaced it
 type StripeService struct {
 	db *gorm.DB
 }
 
 func NewStripeService(db *gorm.DB) *StripeService {
-	// Set Stripe API key
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
 	return &StripeService{db: db}
 }
 
 // ProcessWebhook processes Stripe webhooks
 func (s *StripeService) ProcessWebhook(payload []byte, signature string) error {
-	event, err := webhook.ConstructEvent(payload, signature, os.Getenv("STRIPE_WEBHOOK_SECRET"))
+	event, err := models.GetPaymentGateway().ConstructEvent(payload, signature)
 	if err != nil {
 		return fmt.Errorf("failed to verify webhook signature: %v", err)
 	}
 
 	switch event.Type {
-	case "customer.subscription.created":
-		return s.handleSubscriptionCreated(event)
-	case "customer.subscription.updated":
-		return s.handleSubscriptionUpdated(event)
-	case "customer.subscription.deleted":
-		return s.handleSubscriptionDeleted(event)
-	case "invoice.payment_succeeded":
-		return s.handlePaymentSucceeded(event)
-	case "invoice.payment_failed":
-		return s.handlePaymentFailed(event)
+	case payments.SubscriptionCreatedEvent, payments.SubscriptionUpdatedEvent:
+		return s.handleSubscriptionUpdated(event.Subscription)
+	case payments.SubscriptionDeletedEvent:
+		return s.handleSubscriptionDeleted(event.Subscription)
+	case payments.InvoicePaymentSucceededEvent:
+		return s.handleInvoice(event.Invoice, payments.ActiveSubscription)
+	case payments.InvoicePaymentFailedEvent:
+		return s.handleInvoice(event.Invoice, payments.PastDueSubscription)
 	}
 
 	return nil
 }
 
-func (s *StripeService) handleSubscriptionCreated(event stripe.Event) error {
-	var sub stripe.Subscription
-	err := json.Unmarshal(event.Data.Raw, &sub)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal subscription: %v", err)
+// handleSubscriptionUpdated stores the status, the billing period and the plan of the subscription
+// in its account, so that the plan changes are reconciled once the subscription changed. Events
+// can be retried and arrive out of order, so that the subscription is fetched from the gateway
+// with its account locked instead of read from the event, and the account ends up in its latest state.
+func (s *StripeService) handleSubscriptionUpdated(sub *payments.Subscription) error {
+	if sub == nil {
+		return fmt.Errorf("subscription event without a subscription")
 	}
-
-	// Update account subscription status
-	if err := s.db.Model(&models.Account{}).
-		Where("stripe_subscription_id = ?", sub.ID).
-		Update("subscription_status", sub.Status).Error; err != nil {
-		return fmt.Errorf("failed to update account subscription status: %v", err)
-	}
-
-	return nil
+	return s.db.Transaction(func(tx *gorm.DB) (err error) {
+		account := &models.Account{}
+		if err = tx.Where("stripe_subscription_id = ?", sub.ID).First(account).Error; err != nil {
+			// The subscription isn't stored in an account yet, or anymore
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return
+		}
+		if err = models.LockAccount(tx, account.ID); err != nil {
+			return
+		}
+		current, err := models.GetPaymentGateway().GetSubscription(sub.ID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch the subscription: %v", err)
+		}
+		if err = models.SyncStripeSubscription(tx, current); err != nil {
+			return fmt.Errorf("failed to update account subscription status: %v", err)
+		}
+		return
+	})
 }
 
-func (s *StripeService) handleSubscriptionUpdated(event stripe.Event) error {
-	var sub stripe.Subscription
-	err := json.Unmarshal(event.Data.Raw, &sub)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal subscription: %v", err)
-	}
-
-	// Update account subscription status
-	if err := s.db.Model(&models.Account{}).
-		Where("stripe_subscription_id = ?", sub.ID).
-		Update("subscription_status", sub.Status).Error; err != nil {
-		return fmt.Errorf("failed to update account subscription status: %v", err)
+func (s *StripeService) handleSubscriptionDeleted(sub *payments.Subscription) error {
+	if sub == nil {
+		return fmt.Errorf("subscription event without a subscription")
 	}
 
-	return nil
-}
-
-func (s *StripeService) handleSubscriptionDeleted(event stripe.Event) error {
-	var sub stripe.Subscription
-	err := json.Unmarshal(event.Data.Raw, &sub)
+	// Reset account to free plan
+	plan, err := models.GetDefaultPlan(s.db)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal subscription: %v", err)
+		return fmt.Errorf("failed to get the free plan: %v", err)
 	}
-
-	// Reset account to free plan
 	if err := s.db.Model(&models.Account{}).
 		Where("stripe_subscription_id = ?", sub.ID).
 		Updates(map[string]interface{}{
-			"plan_id":                "free",
+			"plan_id":                plan.ID,
 			"stripe_subscription_id": "",
-			"subscription_status":    "canceled",
+			"subscription_status":    payments.CanceledSubscription,
 		}).Error; err != nil {
 		return fmt.Errorf("failed to reset account to free plan: %v", err)
 	}
@@ -99,34 +94,16 @@ func (s *StripeService) handleSubscriptionDeleted(event stripe.Event) error {
 	return nil
 }
 
-func (s *StripeService) handlePaymentSucceeded(event stripe.Event) error {
-	var invoice stripe.Invoice
-	err := json.Unmarshal(event.Data.Raw, &invoice)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal invoice: %v", err)
-	}
-
-	// Update account subscription status
-	if err := s.db.Model(&models.Account{}).
-		Where("stripe_subscription_id = ?", invoice.Subscription).
-		Update("subscription_status", "active").Error; err != nil {
-		return fmt.Errorf("failed to update account subscription status: %v", err)
-	}
-
-	return nil
-}
-
-func (s *StripeService) handlePaymentFailed(event stripe.Event) error {
-	var invoice stripe.Invoice
-	err := json.Unmarshal(event.Data.Raw, &invoice)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal invoice: %v", err)
+// handleInvoice sets the status of the subscription of the invoice after a payment
+func (s *StripeService) handleInvoice(invoice *payments.Invoice, status string) error {
+	if invoice == nil {
+		return fmt.Errorf("invoice event without an invoice")
 	}
 
 	// Update account subscription status
 	if err := s.db.Model(&models.Account{}).
-		Where("stripe_subscription_id = ?", invoice.Subscription).
-		Update("subscription_status", "past_due").Error; err != nil {
+		Where("stripe_subscription_id = ?", invoice.SubscriptionID).
+		Update("subscription_status", status).Error; err != nil {
 		return fmt.Errorf("failed to update account subscription status: %v", err)
 	}
 
@@ -0,0 +1,98 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits, Period and the SHA1 algorithm are the defaults of the authenticator apps
+	Digits = 6
+	Period = 30 * time.Second
+	// Skew is the number of periods before and after the current one whose codes are accepted,
+	// which tolerates clocks slightly off and codes typed as they expire
+	Skew = 1
+
+	secretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random base32 secret
+func GenerateSecret() (secret string, err error) {
+	bytes := make([]byte, secretSize)
+	if _, err = rand.Read(bytes); err != nil {
+		return
+	}
+	secret = encoding.EncodeToString(bytes)
+	return
+}
+
+// URI returns the otpauth URI of the secret, which the authenticator apps scan as a QR code
+func URI(issuer, accountName, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period.Seconds()))},
+	}
+	label := url.PathEscape(issuer + ":" + accountName)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Counter returns the time step of the time
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code returns the code of the secret at the time step
+func Code(secret string, counter int64) (code string, err error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return
+	}
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < Digits; i++ {
+		modulo *= 10
+	}
+	code = fmt.Sprintf("%0*d", Digits, value%modulo)
+	return
+}
+
+// Validate checks the code against the secret at the time, allowing for the Skew.
+// It returns the time step the code belongs to, which callers store to reject replays.
+func Validate(secret, code string, t time.Time) (counter int64, ok bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return
+	}
+	current := Counter(t)
+	for step := current - Skew; step <= current+Skew; step++ {
+		expected, err := Code(secret, step)
+		if err != nil {
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return
+}
@@ -0,0 +1,327 @@
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/payments"
+	"gorm.io/gorm"
+)
+
+const (
+	// Unlimited is the limit of the features without a limit, and their remaining quota
+	Unlimited = -1
+
+	// DefaultReportInterval is how often Run reports the usage to the payment provider
+	DefaultReportInterval = 10 * time.Minute
+	// ReportBatchSize is the number of records Report processes at most
+	ReportBatchSize = 1000
+)
+
+var (
+	ErrHardLimitReached = errors.New("usage limit of the plan reached")
+)
+
+type (
+	// Reporter reports the usage of a metered price of a subscription to the payment
+	// provider. It's implemented by the payment gateways.
+	Reporter interface {
+		ReportUsage(subscriptionID, priceID string, action payments.UsageActionT, quantity int64, idempotencyKey string) error
+	}
+
+	// Total is the usage of a feature by an account during the current billing period
+	Total struct {
+		Feature   string `json:"feature"`
+		Limit     int    `json:"limit"`
+		Metered   bool   `json:"metered"`
+		HardLimit bool   `json:"hard_limit"`
+		Used      int64  `json:"used"`
+		// Remaining is Unlimited without a limit, Overage the usage over the limit billed on top of the plan
+		Remaining int64 `json:"remaining"`
+		Overage   int64 `json:"overage"`
+		OverLimit bool  `json:"over_limit"`
+	}
+
+	// Summary is the usage of the features by an account during the current billing period
+	Summary struct {
+		Period   models.UsagePeriod `json:"period"`
+		Features []*Total           `json:"features"`
+	}
+
+	// LimitError is returned when recording the usage would exceed the hard limit of the feature
+	LimitError struct {
+		Total *Total
+	}
+
+	// Meter records the usage of the metered features by the accounts, caps it by the
+	// limits of their plan and reports it to the payment provider in batches
+	Meter struct {
+		db       *gorm.DB
+		reporter Reporter
+	}
+)
+
+func NewMeter(db *gorm.DB, reporter Reporter) *Meter {
+	return &Meter{db: db, reporter: reporter}
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("%s: %v", err.Total.Feature, ErrHardLimitReached)
+}
+
+func (err *LimitError) Unwrap() error {
+	return ErrHardLimitReached
+}
+
+// SetReporter replaces the reporter which reports the usage to the payment provider
+func (m *Meter) SetReporter(reporter Reporter) {
+	m.reporter = reporter
+}
+
+// Record adds the quantity to the usage of the feature by the account. Usage over a hard
+// limit is rejected with a LimitError, usage over a soft limit is recorded as overage.
+func (m *Meter) Record(account *models.Account, userID uint, feature string, quantity int64) (total *Total, err error) {
+	err = m.db.Transaction(func(tx *gorm.DB) (err error) {
+		if total, err = m.total(tx, account, feature, time.Now()); err != nil {
+			return
+		}
+		if total.HardLimit && total.Limit >= 0 {
+			// Concurrent records could each fit under the limit, so that the usage is counted
+			// again once the account is locked
+			if err = models.LockAccount(tx, account.ID); err != nil {
+				return
+			}
+			if total, err = m.total(tx, account, feature, time.Now()); err != nil {
+				return
+			}
+			if total.Used+quantity > int64(total.Limit) {
+				return &LimitError{Total: total}
+			}
+		}
+		if _, err = models.NewUsageRecord(tx, account.ID, userID, feature, models.IncrementUsage, quantity); err != nil {
+			return
+		}
+		total.add(quantity)
+		return
+	})
+	return
+}
+
+// Summary returns the usage of the metered features of the plan of the account and of the
+// other features it recorded usage of during the current billing period, sorted by feature
+func (m *Meter) Summary(account *models.Account) (summary *Summary, err error) {
+	plan := &models.Plan{}
+	if err = m.db.Preload("Features").First(plan, account.PlanID).Error; err != nil {
+		return
+	}
+	now := time.Now()
+	summary = &Summary{Period: account.CurrentPeriod(plan, now), Features: []*Total{}}
+
+	features := map[string]bool{}
+	for _, feature := range plan.Features {
+		if feature.Metered {
+			features[feature.Name] = true
+		}
+	}
+	var recorded []string
+	if err = m.db.Model(&models.UsageRecord{}).
+		Where("account_id = ? AND recorded_at < ?", account.ID, summary.Period.End).
+		Distinct().Pluck("feature", &recorded).Error; err != nil {
+		return
+	}
+	for _, feature := range recorded {
+		features[feature] = true
+	}
+
+	for feature := range features {
+		var total *Total
+		if total, err = m.total(m.db, account, feature, now); err != nil {
+			return
+		}
+		summary.Features = append(summary.Features, total)
+	}
+	sort.Slice(summary.Features, func(i, j int) bool {
+		return summary.Features[i].Feature < summary.Features[j].Feature
+	})
+	return
+}
+
+// total returns the usage of the feature during the billing period of the account at the time
+func (m *Meter) total(tx *gorm.DB, account *models.Account, featureName string, now time.Time) (total *Total, err error) {
+	plan := &models.Plan{}
+	if err = tx.First(plan, account.PlanID).Error; err != nil {
+		return
+	}
+	total = &Total{Feature: featureName, Limit: Unlimited}
+	feature, err := plan.GetFeature(tx, featureName)
+	if err != nil {
+		return
+	}
+	if feature != nil {
+		total.Limit = feature.Limit
+		total.Metered = feature.Metered
+		total.HardLimit = feature.HardLimit
+	}
+	used, err := models.SumUsage(tx, account.ID, featureName, account.CurrentPeriod(plan, now))
+	if err != nil {
+		return
+	}
+	total.add(used)
+	return
+}
+
+// add adds the quantity to the usage and updates the remaining quota
+func (total *Total) add(quantity int64) {
+	total.Used += quantity
+	total.Remaining = Unlimited
+	if total.Limit < 0 {
+		return
+	}
+	total.Remaining = int64(total.Limit) - total.Used
+	if total.Remaining < 0 {
+		total.Overage = -total.Remaining
+		total.Remaining = 0
+	}
+	total.OverLimit = total.Overage > 0
+}
+
+// Report reports the usage recorded since the last report to the payment provider, one
+// report per batch of records of an account and feature, and action. Usage of accounts without
+// a subscription and of features without a metered price isn't billed and only marked as
+// reported. Batches failing to report are retried by the next report with the same records
+// and idempotency key.
+func (m *Meter) Report() (reported int, err error) {
+	if err = m.assignBatches(); err != nil {
+		return
+	}
+	var batches []string
+	if err = m.db.Model(&models.UsageRecord{}).
+		Where("reported_at IS NULL AND report_batch IS NOT NULL").
+		Distinct().Order("report_batch").Limit(ReportBatchSize).
+		Pluck("report_batch", &batches).Error; err != nil {
+		return
+	}
+
+	for _, batch := range batches {
+		var records []*models.UsageRecord
+		if err = m.db.Where("report_batch = ? AND reported_at IS NULL", batch).Order("id").Find(&records).Error; err != nil {
+			return
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if batchErr := m.reportBatch(batch, records); batchErr != nil {
+			log.Printf("Failed to report the %s usage of the account %d: %v", records[0].Feature, records[0].AccountID, batchErr)
+			if err == nil {
+				err = batchErr
+			}
+			continue
+		}
+		reported += len(records)
+	}
+	return
+}
+
+// assignBatches groups the records which aren't in a batch yet per account and feature. The
+// batches are named after their first and last records, so that the records assigned by a
+// concurrent report end up in another batch.
+func (m *Meter) assignBatches() (err error) {
+	var records []*models.UsageRecord
+	if err = m.db.Where("reported_at IS NULL AND report_batch IS NULL").Order("id").Limit(ReportBatchSize).Find(&records).Error; err != nil {
+		return
+	}
+
+	type batchKey struct {
+		accountID uint
+		feature   string
+	}
+	batches := map[batchKey][]uint{}
+	var keys []batchKey
+	for _, record := range records {
+		key := batchKey{accountID: record.AccountID, feature: record.Feature}
+		if _, ok := batches[key]; !ok {
+			keys = append(keys, key)
+		}
+		batches[key] = append(batches[key], record.ID)
+	}
+
+	for _, key := range keys {
+		ids := batches[key]
+		batch := fmt.Sprintf("usage-%d-%d-%d", key.accountID, ids[0], ids[len(ids)-1])
+		if err = m.db.Model(&models.UsageRecord{}).
+			Where("id IN ? AND report_batch IS NULL", ids).
+			Update("report_batch", batch).Error; err != nil {
+			return
+		}
+	}
+	return
+}
+
+// reportBatch reports the records of the batch, of a feature of an account and ordered by id
+func (m *Meter) reportBatch(batch string, records []*models.UsageRecord) (err error) {
+	accountID, featureName := records[0].AccountID, records[0].Feature
+	account := &models.Account{}
+	if err = m.db.First(account, accountID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return m.markReported(records)
+		}
+		return
+	}
+	plan := &models.Plan{}
+	plan.ID = account.PlanID
+	feature, err := plan.GetFeature(m.db, featureName)
+	if err != nil {
+		return
+	}
+	if m.reporter == nil || account.StripeSubscriptionID == "" || feature == nil || !feature.Metered || feature.StripePriceID == "" {
+		return m.markReported(records)
+	}
+
+	// Set records replace the usage, so only the last one is reported along with the increments after it
+	var lastSet *models.UsageRecord
+	var increments int64
+	for _, record := range records {
+		if record.Action == models.SetUsage {
+			lastSet = record
+			increments = 0
+			continue
+		}
+		increments += record.Quantity
+	}
+	if lastSet != nil {
+		if err = m.reporter.ReportUsage(account.StripeSubscriptionID, feature.StripePriceID, payments.SetUsage, lastSet.Quantity, batch+"-set"); err != nil {
+			return
+		}
+	}
+	if increments > 0 {
+		if err = m.reporter.ReportUsage(account.StripeSubscriptionID, feature.StripePriceID, payments.IncrementUsage, increments, batch+"-increment"); err != nil {
+			return
+		}
+	}
+	return m.markReported(records)
+}
+
+// markReported marks the records as processed by the reporter
+func (m *Meter) markReported(records []*models.UsageRecord) (err error) {
+	ids := make([]uint, 0, len(records))
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+	err = m.db.Model(&models.UsageRecord{}).Where("id IN ?", ids).Update("reported_at", time.Now()).Error
+	return
+}
+
+// Run reports the usage every interval, until the process exits
+func (m *Meter) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if reported, err := m.Report(); err == nil && reported > 0 {
+			log.Printf("Reported %d usage records", reported)
+		}
+	}
+}
@@ -71,7 +71,6 @@ func (w *Worker) Start() (err error) {
 			return
 		}
 	}
-	return
 }
 
 func (w *Worker) handleEvent(event *Event) (err error) {
@@ -128,9 +127,7 @@ func NewWorkerPool(namespace string, db *gorm.DB) (wp *WorkerPool, err error) {
 
 func (wp *WorkerPool) Start() {
 
-	for _, worker := range wp.workers {
-		go worker.Start()
-	}
+	wp.StartWorkers()
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, os.Kill)
@@ -138,16 +135,15 @@ func (wp *WorkerPool) Start() {
 
 }
 
-func (wp *WorkerPool) RegisterJob(eventName EventTypeT, handler WorkerJobHandler) (err error) {
-	var (
-		existing  []WorkerJobHandler
-		isPresent bool
-	)
-	if existing, isPresent = wp.jobs[eventName]; !isPresent {
-		existing = []WorkerJobHandler{handler}
+// StartWorkers starts the workers in the background, unlike Start which waits for the process to be interrupted
+func (wp *WorkerPool) StartWorkers() {
+	for _, worker := range wp.workers {
+		go worker.Start()
 	}
-	existing = append(existing, handler)
-	wp.jobs[eventName] = existing
+}
+
+func (wp *WorkerPool) RegisterJob(eventName EventTypeT, handler WorkerJobHandler) (err error) {
+	wp.jobs[eventName] = append(wp.jobs[eventName], handler)
 
 	return
 }
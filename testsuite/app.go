@@ -82,6 +82,23 @@ func (c *GoiterClient) ListModelOnes() (models []interface{}, err error) {
 	return
 }
 
+func (c *GoiterClient) GetModelOne(id uint) (modelOne map[string]interface{}, err error) {
+	cliResp := &ClientResponse{}
+	if cliResp, err = c.makeRequest(&ClientRequest{
+		Method: "GET",
+		URL:    fmt.Sprintf("/model_ones/%d", id),
+		Body:   nil,
+	}); err != nil {
+		return
+	}
+	if cliResp.Resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("expected status 200, got %d", cliResp.Resp.StatusCode)
+		return
+	}
+	modelOne = cliResp.RespBody["data"].(map[string]interface{})
+	return
+}
+
 func (c *GoiterClient) RunAppTestSuite() (err error) {
 	log.Println("Running app test suite...")
 	if err = c.PingOpenRoute(); err != nil {
@@ -90,7 +107,11 @@ func (c *GoiterClient) RunAppTestSuite() (err error) {
 	if err = c.PingProtectedRoute(); err != nil {
 		return
 	}
-	if _, err = c.CreateModelOne("Test Model One"); err != nil {
+	var modelOne map[string]interface{}
+	if modelOne, err = c.CreateModelOne("Test Model One"); err != nil {
+		return
+	}
+	if _, err = c.GetModelOne(uint(modelOne["data"].(map[string]interface{})["id"].(float64))); err != nil {
 		return
 	}
 	if _, err = c.ListModelOnes(); err != nil {
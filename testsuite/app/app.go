@@ -53,6 +53,7 @@ func NewApp(srv *core.Server) (app *App, err error) {
 	app.Handler.ProtectedRouteGroup.GET("/app_protected_ping", app.Ping)
 	app.Handler.ProtectedRouteGroup.GET("/model_ones", app.ListModelOnesHandler)
 	app.Handler.ProtectedRouteGroup.POST("/model_ones", app.CreateModelOneHandler)
+	app.Handler.ProtectedRouteGroup.GET("/model_ones/:id", app.Handler.Require(models.ReadAction, "ModelOne"), app.GetModelOneHandler)
 	return
 }
 
@@ -22,9 +22,13 @@ func (app *App) ListModelOnesHandler(c *gin.Context) {
 		modelOnes []ModelOne
 		err       error
 	)
-	if err = app.Handler.Db.Find(&modelOnes).Error; err != nil {
+	if err = app.Handler.FindWithUser(c, &modelOnes); err != nil {
 		app.Handler.WriteError(c, err, "Failed to list ModelOnes")
 		return
 	}
 	app.Handler.WriteSuccess(c, modelOnes)
 }
+
+func (app *App) GetModelOneHandler(c *gin.Context) {
+	app.Handler.WriteSuccess(c, app.Handler.GetResourceFromContext(c))
+}
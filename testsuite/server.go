@@ -5,6 +5,7 @@ import (
 
 	"github.com/gsarmaonline/goiter/config"
 	"github.com/gsarmaonline/goiter/core"
+	"github.com/gsarmaonline/goiter/core/services/payments"
 	"github.com/joho/godotenv"
 )
 
@@ -22,5 +23,7 @@ func (c *GoiterClient) NewServer() (server *core.Server) {
 	}
 
 	server = core.NewServer(c.getServerConfig())
+	// The suite runs offline, with the plans and subscriptions kept in memory
+	server.Handler.SetPaymentGateway(payments.NewFakeGateway())
 	return
 }
@@ -49,11 +49,11 @@ func (c *GoiterClient) shortCircuitLogin(baseURL, email string) (token string, e
 		return
 	}
 	respBody, _ := io.ReadAll(resp.Body)
-	var respData map[string]string
+	var respData map[string]interface{}
 	if err = json.Unmarshal(respBody, &respData); err != nil {
 		return
 	}
-	token = respData["token"]
+	token, _ = respData["token"].(string)
 	return
 }
 
@@ -2,12 +2,14 @@ package testutils
 
 import (
 	"fmt"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/signing"
 )
 
 // AuthTestHelper provides authentication-related test utilities
@@ -22,25 +24,24 @@ func NewAuthTestHelper(env *TestEnvironment) *AuthTestHelper {
 
 // CreateJWTForUser creates a valid JWT token for the given user
 func (h *AuthTestHelper) CreateJWTForUser(t *testing.T, user *models.User) string {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"email": user.Email,
-			"exp":   time.Now().Add(time.Hour * 24).Unix(),
-		})
-
-	secret := "test-secret-key-for-testing-only"
-	tokenString, err := token.SignedString([]byte(secret))
-	require.NoError(t, err)
-
-	return tokenString
+	return h.signJWT(t, user, time.Now().Add(time.Hour*24))
 }
 
 // CreateExpiredJWT creates an expired JWT token for testing
-func (h *AuthTestHelper) CreateExpiredJWT(t *testing.T, email string) string {
+func (h *AuthTestHelper) CreateExpiredJWT(t *testing.T, user *models.User) string {
+	return h.signJWT(t, user, time.Now().Add(-time.Hour)) // Expired 1 hour ago
+}
+
+// signJWT signs a token of the user with the standard claims the authentication middleware requires
+func (h *AuthTestHelper) signJWT(t *testing.T, user *models.User, expiresAt time.Time) string {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
 		jwt.MapClaims{
-			"email": email,
-			"exp":   time.Now().Add(-time.Hour).Unix(), // Expired 1 hour ago
+			"sub": strconv.FormatUint(uint64(user.ID), 10),
+			"iss": signing.DefaultIssuer,
+			"aud": signing.DefaultIssuer,
+			"iat": time.Now().Unix(),
+			"jti": fmt.Sprintf("test-%d-%d", user.ID, time.Now().UnixNano()),
+			"exp": expiresAt.Unix(),
 		})
 
 	secret := "test-secret-key-for-testing-only"
@@ -105,7 +106,7 @@ func (h *AuthTestHelper) SetupAuthenticationScenarios(t *testing.T) *TestAuthent
 	return &TestAuthenticationScenarios{
 		ValidUser:       validUser,
 		ValidToken:      validUser.Token,
-		ExpiredToken:    h.CreateExpiredJWT(t, validUser.User.Email),
+		ExpiredToken:    h.CreateExpiredJWT(t, validUser.User),
 		InvalidToken:    h.CreateInvalidJWT(t),
 		MalformedToken:  "Bearer invalid-format",
 		NonexistentUser: nonexistentUser,
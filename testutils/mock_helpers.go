@@ -1,12 +1,22 @@
 package testutils
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 )
 
@@ -103,37 +113,134 @@ func (m *MockStripeServer) GetRequestsForPath(path string) []MockStripeRequest {
 	return requests
 }
 
-// MockGoogleServer provides a mock Google OAuth server for testing
+// MockGoogleServer provides a mock Google OAuth server for testing.
+// It is an OpenID Connect issuer which signs in User once Authorize is called.
 type MockGoogleServer struct {
 	Server *httptest.Server
+	// ClientID is the audience of the ID tokens
+	ClientID string
+	// User is the user signed in by the server
+	User MockGoogleUser
+
+	key            *rsa.PrivateKey
+	mu             sync.Mutex
+	authorizations map[string]mockGoogleAuthorization
+	issuedCodes    int
+}
+
+// MockGoogleUser is the user signed in by the mock Google server
+type MockGoogleUser struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+type mockGoogleAuthorization struct {
+	nonce         string
+	codeChallenge string
+	user          MockGoogleUser
 }
 
 // NewMockGoogleServer creates a new mock Google OAuth server
 func NewMockGoogleServer(t *testing.T) *MockGoogleServer {
-	mock := &MockGoogleServer{}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	mock := &MockGoogleServer{
+		ClientID: "mock-client-id",
+		User: MockGoogleUser{
+			Subject:       "mock_google_id",
+			Email:         "mockuser@gmail.com",
+			EmailVerified: true,
+			Name:          "Mock User",
+			Picture:       "https://example.com/picture.jpg",
+		},
+		key:            key,
+		authorizations: make(map[string]mockGoogleAuthorization),
+	}
 
 	mock.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                 mock.URL(),
+				"authorization_endpoint": mock.URL() + "/authorize",
+				"token_endpoint":         mock.URL() + "/token",
+				"userinfo_endpoint":      mock.URL() + "/userinfo",
+				"jwks_uri":               mock.URL() + "/jwks",
+			})
+
+		case "/authorize":
+			// Mock consent of the user, redirecting back with a code
+			query := r.URL.Query()
+			code := mock.authorize(query.Get("nonce"), query.Get("code_challenge"))
+			redirectURL, _ := url.Parse(query.Get("redirect_uri"))
+			redirectQuery := redirectURL.Query()
+			redirectQuery.Set("code", code)
+			redirectQuery.Set("state", query.Get("state"))
+			redirectURL.RawQuery = redirectQuery.Encode()
+			http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+
 		case "/token":
-			// Mock OAuth token exchange
+			// Mock OAuth token exchange, which checks the PKCE verifier of the code
+			r.ParseForm()
+			mock.mu.Lock()
+			authorization, ok := mock.authorizations[r.Form.Get("code")]
+			delete(mock.authorizations, r.Form.Get("code"))
+			mock.mu.Unlock()
+			challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
 			w.Header().Set("Content-Type", "application/json")
+			if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.codeChallenge {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid_grant"})
+				return
+			}
 			response := map[string]interface{}{
 				"access_token":  "mock_access_token",
 				"token_type":    "Bearer",
 				"expires_in":    3600,
 				"refresh_token": "mock_refresh_token",
+				"id_token": mock.SignIDToken(t, jwt.MapClaims{
+					"iss":            mock.URL(),
+					"aud":            mock.ClientID,
+					"sub":            authorization.user.Subject,
+					"email":          authorization.user.Email,
+					"email_verified": authorization.user.EmailVerified,
+					"name":           authorization.user.Name,
+					"picture":        authorization.user.Picture,
+					"nonce":          authorization.nonce,
+					"iat":            time.Now().Unix(),
+					"exp":            time.Now().Add(time.Hour).Unix(),
+				}),
 			}
 			json.NewEncoder(w).Encode(response)
 
-		case "/oauth2/v2/userinfo":
+		case "/jwks":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]interface{}{{
+					"kty": "RSA",
+					"kid": "mock-key",
+					"alg": "RS256",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+				}},
+			})
+
+		case "/userinfo", "/oauth2/v2/userinfo":
 			// Mock user info endpoint
 			w.Header().Set("Content-Type", "application/json")
 			response := map[string]interface{}{
-				"id":             "mock_google_id",
-				"email":          "mockuser@gmail.com",
-				"verified_email": true,
-				"name":           "Mock User",
-				"picture":        "https://example.com/picture.jpg",
+				"id":             mock.User.Subject,
+				"sub":            mock.User.Subject,
+				"email":          mock.User.Email,
+				"verified_email": mock.User.EmailVerified,
+				"email_verified": mock.User.EmailVerified,
+				"name":           mock.User.Name,
+				"picture":        mock.User.Picture,
 			}
 			json.NewEncoder(w).Encode(response)
 
@@ -145,6 +252,42 @@ func NewMockGoogleServer(t *testing.T) *MockGoogleServer {
 	return mock
 }
 
+// URL returns the issuer URL of the server
+func (m *MockGoogleServer) URL() string {
+	return m.Server.URL
+}
+
+// Authorize follows the auth code URL as the user would and returns the callback URL
+// the server redirects to, carrying the code and the state
+func (m *MockGoogleServer) Authorize(t *testing.T, authCodeURL string) string {
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authCodeURL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	return resp.Header.Get("Location")
+}
+
+// SignIDToken signs the claims with the key of the server
+func (m *MockGoogleServer) SignIDToken(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "mock-key"
+	signed, err := token.SignedString(m.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func (m *MockGoogleServer) authorize(nonce, codeChallenge string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.issuedCodes++
+	code := fmt.Sprintf("mock_code_%d", m.issuedCodes)
+	m.authorizations[code] = mockGoogleAuthorization{nonce: nonce, codeChallenge: codeChallenge, user: m.User}
+	return code
+}
+
 // Close closes the mock server
 func (m *MockGoogleServer) Close() {
 	if m.Server != nil {
@@ -0,0 +1,185 @@
+package testutils
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlDSigNamespace      = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+var samlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// MockSAMLIdP is a local SAML identity provider for testing. It reads the requests
+// of the service provider and answers them with responses signed by its own key.
+type MockSAMLIdP struct {
+	EntityID string
+	SSOURL   string
+	// Certificate is the PEM certificate of the signing key
+	Certificate string
+	// User is the user signed in by the identity provider
+	User MockSAMLUser
+
+	key *rsa.PrivateKey
+}
+
+// MockSAMLUser is the user signed in by the mock identity provider
+type MockSAMLUser struct {
+	NameID string
+	Email  string
+	Name   string
+}
+
+// MockSAMLRequest is the sign in request the service provider redirected the user with
+type MockSAMLRequest struct {
+	ID     string `xml:"ID,attr"`
+	ACSURL string `xml:"AssertionConsumerServiceURL,attr"`
+	Issuer string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+// MockSAMLResponse customises the response of the identity provider
+type MockSAMLResponse struct {
+	// Audience is the service provider the assertion is meant for, the issuer of the request by default
+	Audience string
+	// Unsigned leaves the assertion unsigned
+	Unsigned bool
+	// Key signs the assertion instead of the key of the identity provider
+	Key *rsa.PrivateKey
+}
+
+// NewMockSAMLIdP creates a mock identity provider with a new self signed certificate
+func NewMockSAMLIdP(t *testing.T) *MockSAMLIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Mock IdP"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &MockSAMLIdP{
+		EntityID:    "https://idp.example.com/metadata",
+		SSOURL:      "https://idp.example.com/sso",
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		User: MockSAMLUser{
+			NameID: "jane@acme.com",
+			Email:  "jane@acme.com",
+			Name:   "Jane Doe",
+		},
+		key: key,
+	}
+}
+
+// Metadata returns the metadata the service provider is configured with
+func (m *MockSAMLIdP) Metadata() string {
+	block, _ := pem.Decode([]byte(m.Certificate))
+	return fmt.Sprintf(`<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="%s" entityID="%s">
+  <md:IDPSSODescriptor protocolSupportEnumeration="%s">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="%s/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="%s"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`, samlDSigNamespace, m.EntityID, samlProtocolNamespace,
+		base64.StdEncoding.EncodeToString(block.Bytes), m.SSOURL, m.SSOURL)
+}
+
+// ParseRequest reads the sign in request from the URL the service provider redirected the user to
+func (m *MockSAMLIdP) ParseRequest(t *testing.T, redirectURL string) MockSAMLRequest {
+	parsedURL, err := url.Parse(redirectURL)
+	require.NoError(t, err)
+	require.Equal(t, m.SSOURL, parsedURL.Scheme+"://"+parsedURL.Host+parsedURL.Path)
+	compressed, err := base64.StdEncoding.DecodeString(parsedURL.Query().Get("SAMLRequest"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	require.NoError(t, err)
+	request := MockSAMLRequest{}
+	require.NoError(t, xml.Unmarshal(data, &request))
+	require.NotEmpty(t, request.ID)
+	return request
+}
+
+// Respond returns the base64 response signing in User, which the browser posts to the ACS of the request
+func (m *MockSAMLIdP) Respond(t *testing.T, request MockSAMLRequest, options MockSAMLResponse) string {
+	if options.Audience == "" {
+		options.Audience = request.Issuer
+	}
+	if options.Key == nil {
+		options.Key = m.key
+	}
+	now := time.Now().UTC()
+	format := func(t time.Time) string { return t.Format(time.RFC3339) }
+	assertionID := "_" + randomHex(t)
+
+	// The assertion is written in its canonical form, so that it's digested as is
+	assertionStart := fmt.Sprintf(`<saml:Assertion xmlns:saml="%s" ID="%s" IssueInstant="%s" Version="2.0"><saml:Issuer>%s</saml:Issuer>`,
+		samlAssertionNamespace, assertionID, format(now), samlEscaper.Replace(m.EntityID))
+	assertionEnd := fmt.Sprintf(`<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">%s</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer"><saml:SubjectConfirmationData InResponseTo="%s" NotOnOrAfter="%s" Recipient="%s"></saml:SubjectConfirmationData></saml:SubjectConfirmation></saml:Subject>`+
+		`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+		`<saml:AuthnStatement AuthnInstant="%s" SessionIndex="%s"><saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext></saml:AuthnStatement>`+
+		`<saml:AttributeStatement><saml:Attribute Name="email"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute><saml:Attribute Name="name"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>`+
+		`</saml:Assertion>`,
+		samlEscaper.Replace(m.User.NameID),
+		samlEscaper.Replace(request.ID), format(now.Add(5*time.Minute)), samlEscaper.Replace(request.ACSURL),
+		format(now.Add(-time.Minute)), format(now.Add(5*time.Minute)), samlEscaper.Replace(options.Audience),
+		format(now), "_"+randomHex(t),
+		samlEscaper.Replace(m.User.Email), samlEscaper.Replace(m.User.Name))
+
+	signature := ""
+	if !options.Unsigned {
+		digest := sha256.Sum256([]byte(assertionStart + assertionEnd))
+		// SignedInfo is canonical as well, declaring the namespace it uses
+		signedInfo := fmt.Sprintf(`<ds:SignedInfo xmlns:ds="%s"><ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:CanonicalizationMethod>`+
+			`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod>`+
+			`<ds:Reference URI="#%s"><ds:Transforms><ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></ds:Transform><ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:Transform></ds:Transforms>`+
+			`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod><ds:DigestValue>%s</ds:DigestValue></ds:Reference></ds:SignedInfo>`,
+			samlDSigNamespace, assertionID, base64.StdEncoding.EncodeToString(digest[:]))
+		hashed := sha256.Sum256([]byte(signedInfo))
+		signatureValue, err := rsa.SignPKCS1v15(rand.Reader, options.Key, crypto.SHA256, hashed[:])
+		require.NoError(t, err)
+		block, _ := pem.Decode([]byte(m.Certificate))
+		signature = fmt.Sprintf(`<ds:Signature xmlns:ds="%s">%s<ds:SignatureValue>%s</ds:SignatureValue><ds:KeyInfo><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo></ds:Signature>`,
+			samlDSigNamespace, signedInfo, base64.StdEncoding.EncodeToString(signatureValue), base64.StdEncoding.EncodeToString(block.Bytes))
+	}
+
+	response := fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" xmlns:saml="%s" ID="_%s" InResponseTo="%s" IssueInstant="%s" Destination="%s" Version="2.0">`+
+		`<saml:Issuer>%s</saml:Issuer><samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>%s</samlp:Response>`,
+		samlProtocolNamespace, samlAssertionNamespace, randomHex(t), samlEscaper.Replace(request.ID), format(now),
+		samlEscaper.Replace(request.ACSURL), samlEscaper.Replace(m.EntityID), assertionStart+signature+assertionEnd)
+	return base64.StdEncoding.EncodeToString([]byte(response))
+}
+
+func randomHex(t *testing.T) string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	require.NoError(t, err)
+	return hex.EncodeToString(id)
+}
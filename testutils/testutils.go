@@ -17,6 +17,7 @@ import (
 	"github.com/gsarmaonline/goiter/config"
 	"github.com/gsarmaonline/goiter/core/handlers"
 	"github.com/gsarmaonline/goiter/core/models"
+	"github.com/gsarmaonline/goiter/core/services/payments"
 )
 
 // TestEnvironment holds all the infrastructure needed for handler testing
@@ -26,6 +27,8 @@ type TestEnvironment struct {
 	Handler *handlers.Handler
 	Config  *config.Config
 	Server  *httptest.Server
+	// Payments keeps the billing objects of the handlers in memory
+	Payments *payments.FakeGateway
 }
 
 // TestUser represents a test user with authentication token
@@ -57,9 +60,35 @@ func SetupTestEnvironment(t *testing.T) *TestEnvironment {
 		&models.Feature{},
 		&models.PlanFeature{},
 		&models.Group{},
+		&models.GroupMember{},
+		&models.RoleAccess{},
+		&models.Project{},
+		&models.ProjectMember{},
+		&models.AccountMembership{},
+		&models.AccountInvitation{},
+		&models.Session{},
+		&models.RotatedRefreshToken{},
+		&models.UserToken{},
+		&models.UserIdentity{},
+		&models.APIKey{},
+		&models.RecoveryCode{},
+		&models.OneTimeCode{},
+		&models.ImpersonationLog{},
+		&models.SAMLConfig{},
+		&models.UsageRecord{},
+		&models.OutboxEvent{},
 	)
 	require.NoError(t, err)
 
+	// Create a default plan to satisfy the Account BeforeCreate hook
+	err = db.Create(&models.Plan{
+		Name:          "Free",
+		Price:         0,
+		BillingPeriod: "monthly",
+		Description:   "Default free plan for testing",
+	}).Error
+	require.NoError(t, err)
+
 	// Setup test config
 	cfg := &config.Config{
 		Mode: config.ModeDev,
@@ -75,16 +104,19 @@ func SetupTestEnvironment(t *testing.T) *TestEnvironment {
 	// Create router and handler
 	router := gin.New()
 	handler := handlers.NewHandler(router, db, cfg)
+	gateway := payments.NewFakeGateway()
+	handler.SetPaymentGateway(gateway)
 
 	// Create test server
 	server := httptest.NewServer(router)
 
 	env := &TestEnvironment{
-		DB:      db,
-		Router:  router,
-		Handler: handler,
-		Config:  cfg,
-		Server:  server,
+		DB:       db,
+		Router:   router,
+		Handler:  handler,
+		Config:   cfg,
+		Server:   server,
+		Payments: gateway,
 	}
 
 	return env
@@ -110,7 +142,6 @@ func (env *TestEnvironment) CreateTestUser(t *testing.T, email string) *TestUser
 	user := &models.User{
 		Email:       email,
 		Name:        fmt.Sprintf("Test User %s", email),
-		GoogleID:    fmt.Sprintf("google-id-%s", email),
 		UserStatus:  models.ActiveUser,
 		CreatedFrom: "test",
 	}
@@ -150,6 +181,11 @@ func (env *TestEnvironment) CreateTestPlan(t *testing.T, name string, price floa
 	err := env.DB.Create(plan).Error
 	require.NoError(t, err)
 
+	// The Stripe price of the plan is otherwise only created by the billing outbox in the background
+	_, err = env.Handler.BillingOutbox().Process()
+	require.NoError(t, err)
+	require.NoError(t, env.DB.First(plan, plan.ID).Error)
+
 	return plan
 }
 
@@ -223,31 +259,3 @@ func (c *TestClient) AssertErrorResponse(t *testing.T, w *httptest.ResponseRecor
 	require.True(t, exists, "Response should contain an error field")
 	assert.Contains(t, error.(string), expectedErrorMessage)
 }
-
-// MockStripeService provides a mock implementation for Stripe operations
-type MockStripeService struct {
-	CreateSubscriptionFunc func(accountID uint, planID uint, paymentMethodID string) error
-	CancelSubscriptionFunc func(subscriptionID string) error
-	ProcessWebhookFunc     func(payload []byte, signature string) error
-}
-
-func (m *MockStripeService) CreateSubscription(accountID uint, planID uint, paymentMethodID string) error {
-	if m.CreateSubscriptionFunc != nil {
-		return m.CreateSubscriptionFunc(accountID, planID, paymentMethodID)
-	}
-	return nil
-}
-
-func (m *MockStripeService) CancelSubscription(subscriptionID string) error {
-	if m.CancelSubscriptionFunc != nil {
-		return m.CancelSubscriptionFunc(subscriptionID)
-	}
-	return nil
-}
-
-func (m *MockStripeService) ProcessWebhook(payload []byte, signature string) error {
-	if m.ProcessWebhookFunc != nil {
-		return m.ProcessWebhookFunc(payload, signature)
-	}
-	return nil
-}
\ No newline at end of file